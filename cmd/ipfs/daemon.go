@@ -530,6 +530,8 @@ func serveHTTPApi(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, error
 	}
 
 	var opts = []corehttp.ServeOption{
+		corehttp.AccessLogOption(corehttp.APIAccessLogConfigKey),
+		corehttp.APIAuthorizationsOption(),
 		corehttp.MetricsCollectionOption("api"),
 		corehttp.MetricsOpenCensusCollectionOption(),
 		corehttp.CheckVersionOption(),
@@ -661,7 +663,9 @@ func serveHTTPGateway(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, e
 	cmdctx.Gateway = true
 
 	var opts = []corehttp.ServeOption{
+		corehttp.AccessLogOption(corehttp.GatewayAccessLogConfigKey),
 		corehttp.MetricsCollectionOption("gateway"),
+		corehttp.RateLimitOption(),
 		corehttp.HostnameOption(),
 		corehttp.GatewayOption(writable, "/ipfs", "/ipns"),
 		corehttp.VersionOption(),
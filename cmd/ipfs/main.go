@@ -41,6 +41,7 @@ var dnsResolver = madns.DefaultResolver
 
 const (
 	EnvEnableProfiling = "IPFS_PROF"
+	EnvAPIAuth         = "IPFS_API_AUTH"
 	cpuProfile         = "ipfs.cpuprof"
 	heapProfile        = "ipfs.memprof"
 )
@@ -274,25 +275,45 @@ func makeExecutor(req *cmds.Request, env interface{}) (cmds.Executor, error) {
 		opts = append(opts, cmdhttp.ClientWithFallback(exe))
 	}
 
+	var transport http.RoundTripper = http.DefaultTransport
 	switch network {
 	case "tcp", "tcp4", "tcp6":
 	case "unix":
 		path := host
 		host = "unix"
-		opts = append(opts, cmdhttp.ClientWithHTTPClient(&http.Client{
-			Transport: &http.Transport{
-				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-					return net.Dial("unix", path)
-				},
+		transport = &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", path)
 			},
-		}))
+		}
 	default:
 		return nil, fmt.Errorf("unsupported API address: %s", apiAddr)
 	}
 
+	if secret := os.Getenv(EnvAPIAuth); secret != "" {
+		header, err := corehttp.AuthorizationHeader(secret)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", EnvAPIAuth, err)
+		}
+		transport = &authTransport{header: header, base: transport}
+	}
+	opts = append(opts, cmdhttp.ClientWithHTTPClient(&http.Client{Transport: transport}))
+
 	return cmdhttp.NewClient(host, opts...), nil
 }
 
+// authTransport sends the API credentials along with every request.
+type authTransport struct {
+	header string
+	base   http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", t.header)
+	return t.base.RoundTrip(req)
+}
+
 func getRepoPath(req *cmds.Request) (string, error) {
 	repoOpt, found := req.Options["config"].(string)
 	if found && repoOpt != "" {
@@ -0,0 +1,241 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditLogConfigKey is the config key holding the path of the audit log,
+// relative to the repo unless absolute.
+const AuditLogConfigKey = "API.AuditLog"
+
+// Outcomes of a logged request.
+const (
+	OutcomeOK        = "ok"
+	OutcomeError     = "error"
+	OutcomeDenied    = "denied"
+	OutcomeCancelled = "cancelled"
+)
+
+// auditedCommands are the commands changing the state of the node.
+var auditedCommands = map[string]bool{
+	"add":                      true,
+	"block/put":                true,
+	"block/rm":                 true,
+	"bootstrap/add":            true,
+	"bootstrap/add/all":        true,
+	"bootstrap/add/default":    true,
+	"bootstrap/rm":             true,
+	"bootstrap/rm/all":         true,
+	"config/profile/apply":     true,
+	"config/replace":           true,
+	"dag/import":               true,
+	"dag/put":                  true,
+	"diag/cmds/cancel":         true,
+	"files/chcid":              true,
+	"files/cp":                 true,
+	"files/flush":              true,
+	"files/mkdir":              true,
+	"files/mv":                 true,
+	"files/rollback":           true,
+	"files/rm":                 true,
+	"files/snapshot":           true,
+	"files/snapshot/rm":        true,
+	"files/sync":               true,
+	"files/tx/abort":           true,
+	"files/tx/begin":           true,
+	"files/tx/commit":          true,
+	"files/write":              true,
+	"key/gen":                  true,
+	"key/import":               true,
+	"key/rename":               true,
+	"key/rm":                   true,
+	"name/publish":             true,
+	"object/new":               true,
+	"object/patch/add-link":    true,
+	"object/patch/append-data": true,
+	"object/patch/rm-link":     true,
+	"object/patch/set-data":    true,
+	"object/put":               true,
+	"pin/add":                  true,
+	"pin/remote/add":           true,
+	"pin/remote/rm":            true,
+	"pin/remote/service/add":   true,
+	"pin/remote/service/rm":    true,
+	"pin/rm":                   true,
+	"pin/update":               true,
+	"repo/gc":                  true,
+	"shutdown":                 true,
+	"swarm/filters/add":        true,
+	"swarm/filters/rm":         true,
+	"swarm/peering/add":        true,
+	"swarm/peering/rm":         true,
+}
+
+// IsAudited returns whether the given command, as in ReqLogEntry.Command,
+// changes the state of the node.
+func IsAudited(command string, args []string) bool {
+	if command == "config" {
+		// "config <key>" reads, "config <key> <value>" writes
+		return len(args) > 1
+	}
+	return auditedCommands[command]
+}
+
+// redactedValue replaces the arguments of audited requests which may hold
+// secrets.
+const redactedValue = "<redacted>"
+
+// secretArgs are the audited commands taking secrets as arguments, and the
+// index of the first of them: the values written to the config and the API
+// keys of remote pinning services.
+var secretArgs = map[string]int{
+	"config":                 1,
+	"pin/remote/service/add": 2,
+}
+
+// auditArgs returns the arguments of an audited request as logged, without
+// the secrets, see secretArgs.
+func auditArgs(command string, args []string) []string {
+	first, ok := secretArgs[command]
+	if !ok || len(args) <= first {
+		return args
+	}
+	out := make([]string, len(args))
+	copy(out, args[:first])
+	for i := first; i < len(args); i++ {
+		out[i] = redactedValue
+	}
+	return out
+}
+
+// secretOptionWords are the words in the names of options which may hold
+// secrets.
+var secretOptionWords = []string{"secret", "token", "password", "passphrase", "auth", "api-key"}
+
+// auditOptions returns the options of an audited request as logged, without
+// the values of those which may hold secrets, going by their names.
+func auditOptions(opts map[string]interface{}) map[string]interface{} {
+	if opts == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(opts))
+	for name, v := range opts {
+		if secretOption(name) {
+			v = redactedValue
+		}
+		out[name] = v
+	}
+	return out
+}
+
+func secretOption(name string) bool {
+	name = strings.ToLower(name)
+	for _, w := range secretOptionWords {
+		if strings.Contains(name, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestOrigin tells who sent a request over the API.
+type RequestOrigin struct {
+	Remote   string
+	Identity string
+
+	entry *ReqLogEntry
+}
+
+// Entry returns the request log entry created for the request, if any.
+func (o *RequestOrigin) Entry() *ReqLogEntry {
+	return o.entry
+}
+
+type requestOriginKey struct{}
+
+// WithRequestOrigin returns a context making LogRequest record the origin
+// of the request.
+func WithRequestOrigin(ctx context.Context, o *RequestOrigin) context.Context {
+	return context.WithValue(ctx, requestOriginKey{}, o)
+}
+
+// GetRequestOrigin returns the origin of the request stored in ctx, or nil.
+func GetRequestOrigin(ctx context.Context) *RequestOrigin {
+	o, _ := ctx.Value(requestOriginKey{}).(*RequestOrigin)
+	return o
+}
+
+// AuditLog is an append-only log of the requests changing the state of the
+// node, one JSON encoded ReqLogEntry per line.
+type AuditLog struct {
+	path string
+
+	lock sync.Mutex
+	f    *os.File
+}
+
+// OpenAuditLog opens the audit log at path, creating it if needed.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, f: f}, nil
+}
+
+// Record appends an entry to the log.
+func (al *AuditLog) Record(rle *ReqLogEntry) error {
+	e := *rle
+	e.Args = auditArgs(rle.Command, rle.Args)
+	e.Options = auditOptions(rle.Options)
+	buf, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	// a single write per entry, so that entries are never interleaved
+	_, err = al.f.Write(buf)
+	return err
+}
+
+// History returns the entries logged since the given time.
+func (al *AuditLog) History(since time.Time) ([]*ReqLogEntry, error) {
+	f, err := os.Open(al.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := []*ReqLogEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rle ReqLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &rle); err != nil {
+			// a partial line left by a crash
+			log.Warnf("skipping malformed audit log entry: %s", err)
+			continue
+		}
+		if rle.StartTime.Before(since) {
+			continue
+		}
+		out = append(out, &rle)
+	}
+	return out, scanner.Err()
+}
+
+// Close closes the log.
+func (al *AuditLog) Close() error {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	return al.f.Close()
+}
@@ -23,6 +23,7 @@ var log = logging.Logger("command")
 type Context struct {
 	ConfigRoot string
 	ReqLog     *ReqLog
+	AuditLog   *AuditLog
 
 	Plugins *loader.PluginLoader
 
@@ -109,8 +110,12 @@ func (c *Context) Context() context.Context {
 
 // LogRequest adds the passed request to the request log and
 // returns a function that should be called when the request
-// lifetime is over.
+// lifetime is over. The request can then be cancelled through
+// the log.
 func (c *Context) LogRequest(req *cmds.Request) func() {
+	ctx, cancel := context.WithCancel(req.Context)
+	req.Context = ctx
+
 	rle := &ReqLogEntry{
 		StartTime: time.Now(),
 		Active:    true,
@@ -118,11 +123,18 @@ func (c *Context) LogRequest(req *cmds.Request) func() {
 		Options:   req.Options,
 		Args:      req.Arguments,
 		log:       c.ReqLog,
+		cancel:    cancel,
+	}
+	if o := GetRequestOrigin(req.Context); o != nil {
+		rle.Remote = o.Remote
+		rle.Identity = o.Identity
+		o.entry = rle
 	}
 	c.ReqLog.AddEntry(rle)
 
 	return func() {
 		c.ReqLog.Finish(rle)
+		cancel()
 	}
 }
 
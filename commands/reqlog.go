@@ -1,6 +1,8 @@
 package commands
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"time"
 )
@@ -15,13 +17,22 @@ type ReqLogEntry struct {
 	Args      []string
 	ID        int
 
-	log *ReqLog
+	// Remote and Identity tell who sent the request over the API, Outcome
+	// and Error how it ended.
+	Remote   string `json:",omitempty"`
+	Identity string `json:",omitempty"`
+	Outcome  string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+
+	log    *ReqLog
+	cancel context.CancelFunc
 }
 
 // Copy returns a copy of the ReqLogEntry
 func (r *ReqLogEntry) Copy() *ReqLogEntry {
 	out := *r
 	out.log = nil
+	out.cancel = nil
 	return &out
 }
 
@@ -99,6 +110,41 @@ func (rl *ReqLog) Report() []*ReqLogEntry {
 	return out
 }
 
+// SetOutcome records how the request of an entry ended, and returns a copy
+// of the entry.
+func (rl *ReqLog) SetOutcome(rle *ReqLogEntry, outcome, errMsg string) *ReqLogEntry {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if rle.Outcome != OutcomeCancelled {
+		rle.Outcome = outcome
+	}
+	rle.Error = errMsg
+	return rle.Copy()
+}
+
+// Cancel cancels the context of the active request with the given ID.
+func (rl *ReqLog) Cancel(id int) error {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	for _, rle := range rl.Requests {
+		if rle.ID != id {
+			continue
+		}
+		if !rle.Active {
+			return fmt.Errorf("request %d is not active anymore", id)
+		}
+		if rle.cancel == nil {
+			return fmt.Errorf("request %d can't be cancelled", id)
+		}
+		rle.cancel()
+		rle.Outcome = OutcomeCancelled
+		return nil
+	}
+	return fmt.Errorf("no request with ID %d", id)
+}
+
 // Finish marks an entry in the log as finished
 func (rl *ReqLog) Finish(rle *ReqLogEntry) {
 	rl.lock.Lock()
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"sort"
+	"strconv"
 	"text/tabwriter"
 	"time"
 
@@ -14,6 +15,8 @@ import (
 
 const (
 	verboseOptionName = "verbose"
+	historyOptionName = "history"
+	sinceOptionName   = "since"
 )
 
 var ActiveReqsCmd = &cmds.Command{
@@ -21,23 +24,57 @@ var ActiveReqsCmd = &cmds.Command{
 		Tagline: "List commands run on this IPFS node.",
 		ShortDescription: `
 Lists running and recently run commands.
+`,
+		LongDescription: `
+Lists running and recently run commands.
+
+With --history, lists the commands that changed the state of the node from
+the audit log instead, including those of previous runs of the daemon. The
+audit log is enabled by setting API.AuditLog to the path of the log file,
+relative to the repo:
+
+  $ ipfs config API.AuditLog audit.log
 `,
 	},
 	NoLocal: true,
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		ctx := env.(*oldcmds.Context)
-		return cmds.EmitOnce(res, ctx.ReqLog.Report())
+		history, _ := req.Options[historyOptionName].(bool)
+		if !history {
+			return cmds.EmitOnce(res, ctx.ReqLog.Report())
+		}
+
+		if ctx.AuditLog == nil {
+			return fmt.Errorf("the audit log is not enabled, see %s", oldcmds.AuditLogConfigKey)
+		}
+		var since time.Time
+		if s, ok := req.Options[sinceOptionName].(string); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			since = time.Now().Add(-d)
+		}
+		entries, err := ctx.AuditLog.History(since)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, entries)
 	},
 	Options: []cmds.Option{
 		cmds.BoolOption(verboseOptionName, "v", "Print extra information."),
+		cmds.BoolOption(historyOptionName, "List the commands that changed the state of the node from the audit log."),
+		cmds.StringOption(sinceOptionName, "With --history, only list the commands run in the given duration, e.g. 24h."),
 	},
 	Subcommands: map[string]*cmds.Command{
+		"cancel":   cancelRequestCmd,
 		"clear":    clearInactiveCmd,
 		"set-time": setRequestClearCmd,
 	},
 	Encoders: cmds.EncoderMap{
-		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *[]*cmds.ReqLogEntry) error {
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *[]*oldcmds.ReqLogEntry) error {
 			verbose, _ := req.Options[verboseOptionName].(bool)
+			history, _ := req.Options[historyOptionName].(bool)
 
 			tw := tabwriter.NewWriter(w, 4, 4, 2, ' ', 0)
 			if verbose {
@@ -47,7 +84,11 @@ Lists running and recently run commands.
 			if verbose {
 				fmt.Fprint(tw, "Arguments\tOptions\t")
 			}
-			fmt.Fprintln(tw, "Active\tStartTime\tRunTime")
+			if history {
+				fmt.Fprintln(tw, "Caller\tOutcome\tStartTime\tRunTime")
+			} else {
+				fmt.Fprintln(tw, "Active\tStartTime\tRunTime")
+			}
 
 			for _, req := range *out {
 				if verbose {
@@ -75,14 +116,47 @@ Lists running and recently run commands.
 					live = req.EndTime.Sub(req.StartTime)
 				}
 				t := req.StartTime.Format(time.Stamp)
-				fmt.Fprintf(tw, "%t\t%s\t%s\n", req.Active, t, live)
+				if history {
+					caller := req.Remote
+					if req.Identity != "" {
+						caller = req.Identity + "@" + caller
+					}
+					outcome := req.Outcome
+					if verbose && req.Error != "" {
+						outcome += ": " + req.Error
+					}
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", caller, outcome, t, live)
+				} else {
+					fmt.Fprintf(tw, "%t\t%s\t%s\n", req.Active, t, live)
+				}
 			}
 			tw.Flush()
 
 			return nil
 		}),
 	},
-	Type: []*cmds.ReqLogEntry{},
+	Type: []*oldcmds.ReqLogEntry{},
+}
+
+var cancelRequestCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Cancel an active request.",
+		ShortDescription: `
+Cancels the request with the given ID, as listed by 'ipfs diag cmds -v'.
+`,
+	},
+	NoLocal: true,
+	Arguments: []cmds.Argument{
+		cmds.StringArg("id", true, false, "ID of the request to cancel."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		id, err := strconv.Atoi(req.Arguments[0])
+		if err != nil {
+			return fmt.Errorf("invalid request ID %q", req.Arguments[0])
+		}
+		ctx := env.(*oldcmds.Context)
+		return ctx.ReqLog.Cancel(id)
+	},
 }
 
 var clearInactiveCmd = &cmds.Command{
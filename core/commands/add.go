@@ -9,6 +9,8 @@ import (
 	"strings"
 
 	"github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/core/coreunix"
 
 	"github.com/cheggaaa/pb"
 	cmds "github.com/ipfs/go-ipfs-cmds"
@@ -29,22 +31,27 @@ type AddEvent struct {
 }
 
 const (
-	quietOptionName       = "quiet"
-	quieterOptionName     = "quieter"
-	silentOptionName      = "silent"
-	progressOptionName    = "progress"
-	trickleOptionName     = "trickle"
-	wrapOptionName        = "wrap-with-directory"
-	onlyHashOptionName    = "only-hash"
-	chunkerOptionName     = "chunker"
-	pinOptionName         = "pin"
-	rawLeavesOptionName   = "raw-leaves"
-	noCopyOptionName      = "nocopy"
-	fstoreCacheOptionName = "fscache"
-	cidVersionOptionName  = "cid-version"
-	hashOptionName        = "hash"
-	inlineOptionName      = "inline"
-	inlineLimitOptionName = "inline-limit"
+	quietOptionName         = "quiet"
+	quieterOptionName       = "quieter"
+	silentOptionName        = "silent"
+	progressOptionName      = "progress"
+	trickleOptionName       = "trickle"
+	wrapOptionName          = "wrap-with-directory"
+	onlyHashOptionName      = "only-hash"
+	chunkerOptionName       = "chunker"
+	pinOptionName           = "pin"
+	rawLeavesOptionName     = "raw-leaves"
+	noCopyOptionName        = "nocopy"
+	fstoreCacheOptionName   = "fscache"
+	cidVersionOptionName    = "cid-version"
+	hashOptionName          = "hash"
+	inlineOptionName        = "inline"
+	inlineLimitOptionName   = "inline-limit"
+	preserveModeOptionName  = "preserve-mode"
+	preserveMtimeOptionName = "preserve-mtime"
+	gitignoreOptionName     = "gitignore"
+	resumeOptionName        = "resume"
+	workersOptionName       = "workers"
 )
 
 const adderOutChanSize = 8
@@ -107,6 +114,40 @@ You can now check what blocks have been created by:
   QmerURi9k4XzKCaaPbsK6BL5pMEjF7PGphjDvkkjDtsVf3 868
   QmQB28iwSriSUSMqG2nXDTLtdPHgWb4rebBrU7Q1j4vxPv 338
 
+The '--preserve-mode' and '--preserve-mtime' options store the permissions
+and modification time of the added files and directories (UnixFS 1.5
+metadata), which 'ipfs get' and the FUSE mounts restore. They are read by
+the client and sent along with the files, the files streamed from stdin have
+none.
+
+Recursive adds skip the files matching the .gitignore-style rules of the
+'.ipfsignore' files found in the added directories, and of the '.gitignore'
+files with '--gitignore', as they skip those matching '--ignore' or
+'--ignore-rules-path'. As in git, the rules of an ignore file apply to the
+directory it is in and below: those with a leading or middle slash match the
+paths relative to it, the others the names of the files at any depth, and a
+trailing slash restricts them to directories. The files are filtered before
+being sent to the daemon.
+
+  > echo node_modules/ > project/.ipfsignore
+  > ipfs add -r --ignore=build project
+
+With '--resume', the files and directories are checkpointed in the repo as
+they are added. If the import is interrupted, running it again with the same
+options skips those added by the previous run that didn't change since,
+instead of chunking them again, and the garbage collector keeps their blocks
+in the meantime. The checkpoints are removed once the import completes, or
+after a week if it never does. The files are only checked against their size,
+mode and modification time. Through the daemon, the client sends those along
+with the files, which are still uploaded but not chunked again, and they are
+only checked against those sent by the previous runs.
+
+The '--workers' option sets how many files are chunked and hashed at the
+same time, which speeds up adding many files on machines with several cores.
+The resulting hashes are the same whatever the number of workers. Files sent
+to a running daemon are only imported in parallel up to 1MiB, the larger ones
+are imported one at a time as they arrive.
+
 Finally, a note on hash determinism. While not guaranteed, adding the same
 file/directory with the same flags will almost always result in the same output
 hash. However, almost all of the flags provided by this command (other than pin,
@@ -124,6 +165,7 @@ only-hash, and progress/status related flags) will change the final hash.
 		cmds.OptionHidden,
 		cmds.OptionIgnore,
 		cmds.OptionIgnoreRules,
+		cmds.BoolOption(gitignoreOptionName, "Also skip the files matching the rules of .gitignore files. Only takes effect on recursive add. (experimental)"),
 		cmds.BoolOption(quietOptionName, "q", "Write minimal output."),
 		cmds.BoolOption(quieterOptionName, "Q", "Write only final hash."),
 		cmds.BoolOption(silentOptionName, "Write no output."),
@@ -140,8 +182,19 @@ only-hash, and progress/status related flags) will change the final hash.
 		cmds.StringOption(hashOptionName, "Hash function to use. Implies CIDv1 if not sha2-256. (experimental)").WithDefault("sha2-256"),
 		cmds.BoolOption(inlineOptionName, "Inline small blocks into CIDs. (experimental)"),
 		cmds.IntOption(inlineLimitOptionName, "Maximum block size to inline. (experimental)").WithDefault(32),
+		cmds.BoolOption(preserveModeOptionName, "Store the file and directory permissions. (experimental)"),
+		cmds.BoolOption(preserveMtimeOptionName, "Store the file and directory modification times. (experimental)"),
+		cmds.BoolOption(resumeOptionName, "Checkpoint the added files to resume an interrupted import. (experimental)"),
+		cmds.IntOption(workersOptionName, "Number of files to chunk and hash in parallel. (experimental)").WithDefault(1),
 	},
 	PreRun: func(req *cmds.Request, env cmds.Environment) error {
+		if err := filterIgnored(req); err != nil {
+			return err
+		}
+		if err := sendMetadata(req); err != nil {
+			return err
+		}
+
 		quiet, _ := req.Options[quietOptionName].(bool)
 		quieter, _ := req.Options[quieterOptionName].(bool)
 		quiet = quiet || quieter
@@ -180,6 +233,10 @@ only-hash, and progress/status related flags) will change the final hash.
 		hashFunStr, _ := req.Options[hashOptionName].(string)
 		inline, _ := req.Options[inlineOptionName].(bool)
 		inlineLimit, _ := req.Options[inlineLimitOptionName].(int)
+		preserveMode, _ := req.Options[preserveModeOptionName].(bool)
+		preserveMtime, _ := req.Options[preserveMtimeOptionName].(bool)
+		resume, _ := req.Options[resumeOptionName].(bool)
+		workers, _ := req.Options[workersOptionName].(int)
 
 		hashFunCode, ok := mh.Names[strings.ToLower(hashFunStr)]
 		if !ok {
@@ -191,10 +248,22 @@ only-hash, and progress/status related flags) will change the final hash.
 			return err
 		}
 
+		unixfs, ok := api.Unixfs().(*coreapi.UnixfsAPI)
+		if !ok {
+			return fmt.Errorf("unexpected unixfs api %T", api.Unixfs())
+		}
+
+		var metadata map[string]sentMetadata
 		toadd := req.Files
+		if preserveMode || preserveMtime || resume {
+			metadata, toadd, err = readMetadata(toadd)
+			if err != nil {
+				return err
+			}
+		}
 		if wrap {
 			toadd = files.NewSliceDirectory([]files.DirEntry{
-				files.FileEntry("", req.Files),
+				files.FileEntry("", toadd),
 			})
 		}
 
@@ -229,6 +298,13 @@ only-hash, and progress/status related flags) will change the final hash.
 
 		opts = append(opts, nil) // events option placeholder
 
+		extra := coreunix.AdderOptions{
+			PreserveMode:  preserveMode,
+			PreserveMtime: preserveMtime,
+			Resume:        resume,
+			Workers:       workers,
+		}
+
 		var added int
 		addit := toadd.Entries()
 		for addit.Next() {
@@ -236,11 +312,22 @@ only-hash, and progress/status related flags) will change the final hash.
 			errCh := make(chan error, 1)
 			events := make(chan interface{}, adderOutChanSize)
 			opts[len(opts)-1] = options.Unixfs.Events(events)
+			md := metadata
+			if !wrap {
+				md = entryMetadata(metadata, addit.Name())
+			}
+			if preserveMode || preserveMtime {
+				extra.Metadata = unixfsMetadata(md)
+			}
+			node := addit.Node()
+			if resume {
+				node = withSentFiles(node, md)
+			}
 
 			go func() {
 				var err error
 				defer close(events)
-				_, err = api.Unixfs().Add(req.Context, addit.Node(), opts...)
+				_, err = unixfs.AddWithAdderOptions(req.Context, node, extra, opts...)
 				errCh <- err
 			}()
 
@@ -295,7 +382,7 @@ only-hash, and progress/status related flags) will change the final hash.
 
 			// Could be slow.
 			go func() {
-				size, err := req.Files.Size()
+				size, err := addedSize(req.Files)
 				if err != nil {
 					log.Warnf("error getting files size: %s", err)
 					// see comment above
@@ -324,9 +411,10 @@ only-hash, and progress/status related flags) will change the final hash.
 					bar.Start()
 				}
 
-				lastFile := ""
 				lastHash := ""
-				var totalProgress, prevFiles, lastBytes int64
+				// files may be imported in parallel, their progress
+				// interleaved
+				fileBytes := make(map[string]int64)
 
 			LOOP:
 				for {
@@ -342,6 +430,7 @@ only-hash, and progress/status related flags) will change the final hash.
 						output := out.(*AddEvent)
 						if len(output.Hash) > 0 {
 							lastHash = output.Hash
+							delete(fileBytes, output.Name)
 							if quieter {
 								continue
 							}
@@ -361,16 +450,13 @@ only-hash, and progress/status related flags) will change the final hash.
 								continue
 							}
 
-							if len(lastFile) == 0 {
-								lastFile = output.Name
-							}
-							if output.Name != lastFile || output.Bytes < lastBytes {
-								prevFiles += lastBytes
-								lastFile = output.Name
+							delta := output.Bytes - fileBytes[output.Name]
+							if delta < 0 {
+								// another file with the same name
+								delta = output.Bytes
 							}
-							lastBytes = output.Bytes
-							delta := prevFiles + lastBytes - totalProgress
-							totalProgress = bar.Add64(delta)
+							fileBytes[output.Name] = output.Bytes
+							bar.Add64(delta)
 						}
 
 						if progress {
@@ -0,0 +1,321 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-ipfs/core/coreunix"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// addMetadataName is the name of the entry holding the metadata of the added
+// files, sent ahead of them when preserving it.
+const addMetadataName = ".ipfs-add-metadata"
+
+// metadataModeBits are the mode bits UnixFS stores.
+const metadataModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// metadataFile is the entry sent by sendMetadata.
+type metadataFile struct {
+	files.File
+}
+
+// sentMetadata is what the client sends of an added file or directory.
+type sentMetadata struct {
+	coreunix.UnixFSMetadata
+	// Size and Path, the absolute path of a file on the client, are sent
+	// with --resume
+	Size int64  `json:",omitempty"`
+	Path string `json:",omitempty"`
+}
+
+// sendMetadata makes the client send the mode and modification time of the
+// added files and directories, which the daemon can't look up itself, and
+// with --resume the size and path of the files. They are sent as a JSON map
+// of their paths to their sentMetadata, in a first entry read back by
+// readMetadata.
+func sendMetadata(req *cmds.Request) error {
+	preserveMode, _ := req.Options[preserveModeOptionName].(bool)
+	preserveMtime, _ := req.Options[preserveMtimeOptionName].(bool)
+	resume, _ := req.Options[resumeOptionName].(bool)
+	if req.Files == nil || !(preserveMode || preserveMtime || resume) {
+		return nil
+	}
+
+	md := make(map[string]sentMetadata)
+	var entries []files.DirEntry
+	it := req.Files.Entries()
+	for it.Next() {
+		if it.Name() == addMetadataName {
+			if _, ok := it.Node().(*metadataFile); ok {
+				// PreRun runs twice when falling back to the local node,
+				// the entries may have been filtered since
+				continue
+			}
+			return fmt.Errorf("can't preserve the metadata when adding a file named %s", addMetadataName)
+		}
+		if err := collectMetadata(md, it.Name(), it.Node(), resume); err != nil {
+			return err
+		}
+		entries = append(entries, files.FileEntry(it.Name(), it.Node()))
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	manifest := &metadataFile{files.NewBytesFile(data)}
+	entries = append([]files.DirEntry{files.FileEntry(addMetadataName, manifest)}, entries...)
+	req.Files = files.NewSliceDirectory(entries)
+	return nil
+}
+
+// collectMetadata adds the metadata of the node nd at path, and of its
+// entries if a directory, to md, with their size and path if resume.
+func collectMetadata(md map[string]sentMetadata, path string, nd files.Node, resume bool) error {
+	if st := statOf(nd); st != nil {
+		m := sentMetadata{UnixFSMetadata: coreunix.UnixFSMetadata{
+			Mode:  st.Mode() & metadataModeBits,
+			Mtime: st.ModTime(),
+		}}
+		if fi, ok := nd.(files.FileInfo); ok && resume && st.Mode().IsRegular() {
+			m.Size = st.Size()
+			m.Path = filepath.ToSlash(fi.AbsPath())
+		}
+		md[path] = m
+	}
+	dir, ok := nd.(files.Directory)
+	if !ok {
+		return nil
+	}
+	it := dir.Entries()
+	for it.Next() {
+		err := collectMetadata(md, gopath.Join(path, it.Name()), it.Node(), resume)
+		// the entries are opened again when sent
+		it.Node().Close()
+		if err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// readMetadata reads the metadata sent by sendMetadata ahead of the files of
+// dir, and returns them and the directory of the added files. The metadata
+// is nil if none was sent.
+func readMetadata(dir files.Directory) (map[string]sentMetadata, files.Directory, error) {
+	it := &peekedIterator{DirIterator: dir.Entries()}
+	rest := &peekedDirectory{Directory: dir, it: it}
+	if !it.DirIterator.Next() {
+		return nil, rest, nil
+	}
+	f, ok := it.Node().(files.File)
+	if it.Name() != addMetadataName || !ok {
+		it.peeked = true
+		return nil, rest, nil
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	var md map[string]sentMetadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return nil, nil, fmt.Errorf("malformed %s: %s", addMetadataName, err)
+	}
+	if md == nil {
+		md = make(map[string]sentMetadata)
+	}
+	return md, rest, nil
+}
+
+// entryMetadata returns the metadata of the top level entry name, by path
+// relative to it, nil if md is.
+func entryMetadata(md map[string]sentMetadata, name string) map[string]sentMetadata {
+	if md == nil {
+		return nil
+	}
+	sub := make(map[string]sentMetadata)
+	for p, m := range md {
+		switch {
+		case p == name:
+			sub[""] = m
+		case strings.HasPrefix(p, name+"/"):
+			sub[p[len(name)+1:]] = m
+		}
+	}
+	return sub
+}
+
+// unixfsMetadata returns the metadata to preserve of md, nil if md is.
+func unixfsMetadata(md map[string]sentMetadata) map[string]coreunix.UnixFSMetadata {
+	if md == nil {
+		return nil
+	}
+	umd := make(map[string]coreunix.UnixFSMetadata, len(md))
+	for p, m := range md {
+		umd[p] = m.UnixFSMetadata
+	}
+	return umd
+}
+
+// withSentFiles returns the added node nd, sent by the client, as
+// coreunix.SentFile nodes where the client sent the file information of
+// their files, by path relative to it in md, which makes their import
+// resumable.
+func withSentFiles(nd files.Node, md map[string]sentMetadata) files.Node {
+	return wrapSent(nd, md, "")
+}
+
+func wrapSent(nd files.Node, md map[string]sentMetadata, path string) files.Node {
+	if statOf(nd) != nil {
+		// read from the local filesystem, without the daemon
+		return nd
+	}
+	m, ok := md[path]
+	switch nd := nd.(type) {
+	case files.Directory:
+		d := &sentDirectory{Directory: nd, md: md, path: path}
+		if ok {
+			d.stat = m.fileInfo(path, os.ModeDir)
+		}
+		return d
+	case *files.Symlink:
+		return nd
+	case files.File:
+		if !ok || m.Path == "" {
+			return nd
+		}
+		return &sentFile{File: nd, stat: m.fileInfo(path, 0), path: m.Path}
+	}
+	return nd
+}
+
+// sentFile is an added file with the file information sent by the client.
+type sentFile struct {
+	files.File
+	stat os.FileInfo
+	path string
+}
+
+func (f *sentFile) Stat() os.FileInfo {
+	return f.stat
+}
+
+func (f *sentFile) SentPath() string {
+	return f.path
+}
+
+// sentDirectory is an added directory whose entries come with the file
+// information sent by the client.
+type sentDirectory struct {
+	files.Directory
+	// stat is nil if none was sent
+	stat os.FileInfo
+	md   map[string]sentMetadata
+	path string
+}
+
+func (d *sentDirectory) Stat() os.FileInfo {
+	return d.stat
+}
+
+func (d *sentDirectory) SentPath() string {
+	return ""
+}
+
+func (d *sentDirectory) Entries() files.DirIterator {
+	return &sentIterator{DirIterator: d.Directory.Entries(), dir: d}
+}
+
+type sentIterator struct {
+	files.DirIterator
+	dir *sentDirectory
+}
+
+func (it *sentIterator) Node() files.Node {
+	return wrapSent(it.DirIterator.Node(), it.dir.md, gopath.Join(it.dir.path, it.Name()))
+}
+
+// fileInfo returns the file information of m, of the entry at path, of
+// type typ.
+func (m sentMetadata) fileInfo(path string, typ os.FileMode) os.FileInfo {
+	return &sentFileInfo{
+		name:  gopath.Base(path),
+		size:  m.Size,
+		mode:  m.Mode | typ,
+		mtime: m.Mtime,
+	}
+}
+
+// sentFileInfo is the file information of an added file sent by the client.
+type sentFileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (fi *sentFileInfo) Name() string       { return fi.name }
+func (fi *sentFileInfo) Size() int64        { return fi.size }
+func (fi *sentFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *sentFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *sentFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *sentFileInfo) Sys() interface{}   { return nil }
+
+// addedSize returns the size of the added files, without the metadata sent
+// along.
+func addedSize(dir files.Directory) (int64, error) {
+	var size int64
+	it := dir.Entries()
+	for it.Next() {
+		if it.Name() == addMetadataName {
+			if _, ok := it.Node().(*metadataFile); ok {
+				continue
+			}
+		}
+		s, err := it.Node().Size()
+		if err != nil {
+			return 0, err
+		}
+		size += s
+	}
+	return size, it.Err()
+}
+
+// peekedDirectory is a directory whose entries are listed by it once.
+type peekedDirectory struct {
+	files.Directory
+	it *peekedIterator
+}
+
+func (d *peekedDirectory) Entries() files.DirIterator {
+	return d.it
+}
+
+// peekedIterator is an iterator whose current entry, if peeked, was looked
+// at but not returned yet.
+type peekedIterator struct {
+	files.DirIterator
+	peeked bool
+}
+
+func (it *peekedIterator) Next() bool {
+	if it.peeked {
+		it.peeked = false
+		return true
+	}
+	return it.DirIterator.Next()
+}
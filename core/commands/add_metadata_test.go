@@ -0,0 +1,163 @@
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-ipfs/core/coreunix"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+func TestSendMetadata(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "project")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fpath := filepath.Join(root, "sub", "file")
+	if err := ioutil.WriteFile(fpath, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Chtimes(fpath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, err := files.NewSerialFile(root, false, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &cmds.Request{
+		Options: cmds.OptMap{preserveModeOptionName: true},
+		Files: files.NewMapDirectory(map[string]files.Node{
+			"project": sf,
+			"stdin":   files.NewBytesFile([]byte("streamed")),
+		}),
+	}
+	for i := 0; i < 2; i++ {
+		if err := sendMetadata(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	md, rest, err := readMetadata(req.Files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	it := rest.Entries()
+	for it.Next() {
+		names = append(names, it.Name())
+	}
+	if len(names) != 2 || names[0] != "project" || names[1] != "stdin" {
+		t.Fatalf("expected the added entries only, got %v", names)
+	}
+
+	project := entryMetadata(md, "project")
+	if len(project) != 3 {
+		t.Fatalf("unexpected metadata %v", project)
+	}
+	if m := project["sub/file"]; m.Mode != 0600 || !m.Mtime.Equal(mtime) {
+		t.Errorf("unexpected metadata of sub/file %+v", m)
+	}
+	if m := project["sub"]; m.Mode != 0755 {
+		t.Errorf("expected the mode of sub without the directory bit, got %v", m.Mode)
+	}
+	if stdin := entryMetadata(md, "stdin"); len(stdin) != 0 {
+		t.Errorf("expected no metadata for streamed files, got %v", stdin)
+	}
+
+	// without any metadata sent, the entries are left alone
+	md, rest, err = readMetadata(files.NewMapDirectory(map[string]files.Node{
+		"file": files.NewBytesFile(nil),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	it = rest.Entries()
+	if md != nil || !it.Next() || it.Name() != "file" || it.Next() {
+		t.Fatal("expected the first entry to be kept")
+	}
+
+	req.Files = files.NewMapDirectory(map[string]files.Node{
+		addMetadataName: files.NewBytesFile(nil),
+	})
+	if err := sendMetadata(req); err == nil {
+		t.Fatal("expected a file named like the metadata to be refused")
+	}
+}
+
+func TestSendResumeMetadata(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "project")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fpath := filepath.Join(root, "sub", "file")
+	if err := ioutil.WriteFile(fpath, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, err := files.NewSerialFile(root, false, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &cmds.Request{
+		Options: cmds.OptMap{resumeOptionName: true},
+		Files:   files.NewMapDirectory(map[string]files.Node{"project": sf}),
+	}
+	if err := sendMetadata(req); err != nil {
+		t.Fatal(err)
+	}
+	md, _, err := readMetadata(req.Files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	project := entryMetadata(md, "project")
+	if m := project["sub/file"]; m.Size != 4 || m.Path != filepath.ToSlash(fpath) {
+		t.Fatalf("unexpected file information of sub/file %+v", m)
+	}
+
+	// as received by the daemon
+	sent := withSentFiles(files.NewMapDirectory(map[string]files.Node{
+		"sub": files.NewMapDirectory(map[string]files.Node{
+			"file": files.NewBytesFile([]byte("data")),
+		}),
+	}), project)
+	sub := sent.(files.Directory).Entries()
+	if !sub.Next() {
+		t.Fatal("missing sub")
+	}
+	if st := sub.Node().(coreunix.SentFile).Stat(); st == nil || !st.IsDir() || st.Mode().Perm() != 0755 {
+		t.Fatalf("unexpected file information of sub %v", st)
+	}
+	it := sub.Node().(files.Directory).Entries()
+	if !it.Next() {
+		t.Fatal("missing sub/file")
+	}
+	f, ok := it.Node().(coreunix.SentFile)
+	if !ok {
+		t.Fatalf("expected sub/file to be sent with its file information, got %T", it.Node())
+	}
+	if f.SentPath() != filepath.ToSlash(fpath) || f.Stat().Size() != 4 || !f.Stat().Mode().IsRegular() {
+		t.Fatalf("unexpected file information of sub/file %s %v", f.SentPath(), f.Stat())
+	}
+	if _, ok := f.(files.FileInfo); ok {
+		t.Fatal("the daemon mustn't take the sent path as a local one")
+	}
+
+	// the local files are left alone
+	if local := withSentFiles(sf, project); local != sf {
+		t.Fatalf("expected the local directory as is, got %T", local)
+	}
+}
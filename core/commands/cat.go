@@ -58,7 +58,15 @@ var CatCmd = &cmds.Command{
 			return err
 		}
 
-		readers, length, err := cat(req.Context, api, req.Arguments, int64(offset), int64(max))
+		paths := make([]path.Path, len(req.Arguments))
+		for i, p := range req.Arguments {
+			paths[i], err = cmdenv.CheckDenylist(req.Context, env, api, path.New(p))
+			if err != nil {
+				return err
+			}
+		}
+
+		readers, length, err := cat(req.Context, api, paths, int64(offset), int64(max))
 		if err != nil {
 			return err
 		}
@@ -111,14 +119,14 @@ var CatCmd = &cmds.Command{
 	},
 }
 
-func cat(ctx context.Context, api iface.CoreAPI, paths []string, offset int64, max int64) ([]io.Reader, uint64, error) {
+func cat(ctx context.Context, api iface.CoreAPI, paths []path.Path, offset int64, max int64) ([]io.Reader, uint64, error) {
 	readers := make([]io.Reader, 0, len(paths))
 	length := uint64(0)
 	if max == 0 {
 		return nil, 0, nil
 	}
 	for _, p := range paths {
-		f, err := api.Unixfs().Get(ctx, path.New(p))
+		f, err := api.Unixfs().Get(ctx, p)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -0,0 +1,31 @@
+package cmdenv
+
+import (
+	"context"
+
+	"github.com/ipfs/go-ipfs/commands"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// CheckDenylist returns denylist.ErrBlocked if the command is served by the
+// gateway's read-only API and the path is on the node's denylist. Otherwise it
+// returns the path to use in place of p, resolved if it was checked, see
+// denylist.Denylist.Check.
+func CheckDenylist(ctx context.Context, env cmds.Environment, api coreiface.CoreAPI, p path.Path) (path.Path, error) {
+	cctx, ok := env.(*commands.Context)
+	if !ok || !cctx.Gateway {
+		return p, nil
+	}
+	n, err := cctx.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	if n.Denylist == nil {
+		return p, nil
+	}
+
+	return n.Denylist.Check(ctx, api, p)
+}
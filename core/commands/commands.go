@@ -6,6 +6,7 @@
 package commands
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -25,6 +26,12 @@ func (e *commandEncoder) Encode(v interface{}) error {
 		ok  bool
 	)
 
+	if doc, ok := v.(*openAPIDocument); ok {
+		enc := json.NewEncoder(e.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(doc)
+	}
+
 	if cmd, ok = v.(*Command); !ok {
 		return fmt.Errorf(`core/commands: unexpected type %T, expected *"core/commands".Command`, v)
 	}
@@ -52,7 +59,8 @@ type Option struct {
 }
 
 const (
-	flagsOptionName = "flags"
+	flagsOptionName   = "flags"
+	openAPIOptionName = "openapi"
 )
 
 // CommandsCmd takes in a root command,
@@ -62,12 +70,24 @@ func CommandsCmd(root *cmds.Command) *cmds.Command {
 		Helptext: cmds.HelpText{
 			Tagline:          "List all available commands.",
 			ShortDescription: `Lists all available commands (and subcommands) and exits.`,
+			LongDescription: `
+Lists all available commands (and subcommands) and exits.
+
+With --openapi, prints an OpenAPI 3 document describing the HTTP RPC API
+instead: the arguments, options and output of every command callable over
+the API.
+`,
 		},
 		Options: []cmds.Option{
 			cmds.BoolOption(flagsOptionName, "f", "Show command flags"),
+			cmds.BoolOption(openAPIOptionName, "Print an OpenAPI description of the HTTP API."),
 		},
 		Extra: CreateCmdExtras(SetDoesNotUseRepo(true)),
 		Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+			if openAPI, _ := req.Options[openAPIOptionName].(bool); openAPI {
+				return cmds.EmitOnce(res, newOpenAPIDocument(root))
+			}
+
 			rootCmd := cmd2outputCmd("ipfs", root)
 			rootCmd.showOpts, _ = req.Options[flagsOptionName].(bool)
 			return cmds.EmitOnce(res, &rootCmd)
@@ -110,11 +110,13 @@ func TestCommands(t *testing.T) {
 		"/dht/query",
 		"/diag",
 		"/diag/cmds",
+		"/diag/cmds/cancel",
 		"/diag/cmds/clear",
 		"/diag/cmds/set-time",
 		"/diag/sys",
 		"/dns",
 		"/file",
+		"/file/diff",
 		"/file/ls",
 		"/files",
 		"/files/chcid",
@@ -126,6 +128,18 @@ func TestCommands(t *testing.T) {
 		"/files/read",
 		"/files/rm",
 		"/files/stat",
+		"/files/sync",
+		"/files/snapshot",
+		"/files/snapshot/rm",
+		"/files/log",
+		"/files/rollback",
+		"/files/tx",
+		"/files/tx/begin",
+		"/files/tx/commit",
+		"/files/tx/abort",
+		"/files/tx/ls",
+		"/files/du",
+		"/files/find",
 		"/filestore",
 		"/filestore/dups",
 		"/filestore/ls",
@@ -119,6 +119,9 @@ Set the value of the 'Datastore.Path' key:
 			}
 		} else {
 			output, err = getConfig(r, key)
+			if err == nil {
+				output.Value, err = scrubSecrets(key, output.Value)
+			}
 		}
 
 		if err != nil {
@@ -173,11 +176,41 @@ func matchesGlobPrefix(key string, glob []string) bool {
 	return true
 }
 
+// secretSelectors are the config keys holding the credentials of clients of
+// the node, not shown by the config commands.
+var secretSelectors = [][]string{
+	{"API", "Authorizations", "*", "AuthSecret"},
+	{"Gateway", "WriteTokens", "*", "Secret"},
+}
+
+// scrubSecrets returns the config value at key without the secrets it holds,
+// or an error if the value is a secret.
+func scrubSecrets(key string, value interface{}) (interface{}, error) {
+	k := strings.Split(key, ".")
+	for _, sel := range secretSelectors {
+		if !matchesGlobPrefix(key, sel) {
+			continue
+		}
+		if len(k) >= len(sel) {
+			return nil, fmt.Errorf("cannot show %s: it is a secret", key)
+		}
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var err error
+		if value, err = scrubOptionalValue(m, sel[len(k):]); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
 var configShowCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "Output config file contents.",
 		ShortDescription: `
-NOTE: For security reasons, this command will omit your private key and remote services. If you would like to make a full backup of your config (private key included), you must copy the config file from your repo.
+NOTE: For security reasons, this command will omit your private key, remote services and client secrets. If you would like to make a full backup of your config (private key included), you must copy the config file from your repo.
 `,
 	},
 	Type: make(map[string]interface{}),
@@ -213,6 +246,13 @@ NOTE: For security reasons, this command will omit your private key and remote s
 			return err
 		}
 
+		for _, sel := range secretSelectors {
+			cfg, err = scrubOptionalValue(cfg, sel)
+			if err != nil {
+				return err
+			}
+		}
+
 		return cmds.EmitOnce(res, &cfg)
 	},
 	Encoders: cmds.EncoderMap{
@@ -416,7 +456,8 @@ func buildProfileHelp() string {
 	return out
 }
 
-// scrubPrivKey scrubs private key for security reasons.
+// scrubPrivKey scrubs private key and the secrets of clients for security
+// reasons.
 func scrubPrivKey(cfg *config.Config) (map[string]interface{}, error) {
 	cfgMap, err := config.ToMap(cfg)
 	if err != nil {
@@ -428,6 +469,13 @@ func scrubPrivKey(cfg *config.Config) (map[string]interface{}, error) {
 		return nil, err
 	}
 
+	for _, sel := range secretSelectors {
+		cfgMap, err = scrubOptionalValue(cfgMap, sel)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return cfgMap, nil
 }
 
@@ -505,8 +553,17 @@ func editConfig(filename string) error {
 }
 
 func replaceConfig(r repo.Repo, file io.Reader) error {
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
 	var newCfg config.Config
-	if err := json.NewDecoder(file).Decode(&newCfg); err != nil {
+	if err := json.Unmarshal(data, &newCfg); err != nil {
+		return errors.New("failed to decode file as config")
+	}
+	// the settings config.Config has no field for are replaced too
+	var newMap map[string]interface{}
+	if err := json.Unmarshal(data, &newMap); err != nil {
 		return errors.New("failed to decode file as config")
 	}
 
@@ -528,6 +585,19 @@ func replaceConfig(r repo.Repo, file io.Reader) error {
 
 	newCfg.Identity.PrivKey = pkstr
 
+	// Handle the secrets of clients (left out by config show too)
+
+	for _, sel := range secretSelectors {
+		old, err := r.GetConfigKey(sel[0])
+		if err != nil {
+			// not set
+			continue
+		}
+		if err := restoreSecrets(map[string]interface{}{sel[0]: old}, newMap, sel, ""); err != nil {
+			return err
+		}
+	}
+
 	// Handle Pinning.RemoteServices (API.Key of each service is a secret)
 
 	newServices := newCfg.Pinning.RemoteServices
@@ -558,7 +628,45 @@ func replaceConfig(r repo.Repo, file io.Reader) error {
 		}
 	}
 
-	return r.SetConfig(&newCfg)
+	return r.ReplaceConfig(&newCfg, newMap)
+}
+
+// restoreSecrets puts the secrets at the glob sel of the old config back into
+// the updated one, which config show left them out of. Changing one fails,
+// new ones are kept.
+func restoreSecrets(old, updated map[string]interface{}, sel []string, prefix string) error {
+	if len(sel) == 1 {
+		key := prefix + sel[0]
+		secret, hadSecret := old[sel[0]]
+		v, ok := updated[sel[0]]
+		if !hadSecret {
+			return nil
+		}
+		if ok && v != "" && v != secret {
+			return fmt.Errorf("cannot change %s with 'config replace'", key)
+		}
+		updated[sel[0]] = secret
+		return nil
+	}
+
+	keys := []string{sel[0]}
+	if sel[0] == "*" {
+		keys = keys[:0]
+		for k := range updated {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		u, ok := updated[k].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		o, _ := old[k].(map[string]interface{})
+		if err := restoreSecrets(o, u, sel[1:], prefix+k+"."); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func getRemotePinningServices(r repo.Repo) (map[string]config.RemotePinningService, error) {
@@ -1,6 +1,9 @@
 package commands
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+)
 
 func TestScrubMapInternalDelete(t *testing.T) {
 	m, err := scrubMapInternal(nil, nil, true)
@@ -15,3 +18,82 @@ func TestScrubMapInternalDelete(t *testing.T) {
 
 	}
 }
+
+func TestScrubSecrets(t *testing.T) {
+	tokens := func() map[string]interface{} {
+		return map[string]interface{}{
+			"uploader": map[string]interface{}{
+				"Secret": "s3cr3t",
+				"Paths":  []interface{}{"/ipfs/"},
+			},
+		}
+	}
+
+	v, err := scrubSecrets("Gateway.WriteTokens", tokens())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := v.(map[string]interface{})["uploader"].(map[string]interface{})
+	if _, ok := token["Secret"]; ok {
+		t.Error("expected the secret to be scrubbed")
+	}
+	if _, ok := token["Paths"]; !ok {
+		t.Error("expected the rest of the token to be kept")
+	}
+
+	for _, key := range []string{"gateway.writetokens.uploader.secret", "API.Authorizations.admin.AuthSecret"} {
+		if _, err := scrubSecrets(key, "s3cr3t"); err == nil {
+			t.Errorf("expected an error showing %s", key)
+		}
+	}
+	if v, err := scrubSecrets("Gateway.Writable", true); err != nil || v != true {
+		t.Errorf("expected other keys to be left alone, got %v, %v", v, err)
+	}
+}
+
+func TestRestoreSecrets(t *testing.T) {
+	decode := func(s string) map[string]interface{} {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	old := decode(`{
+		"API": {"Authorizations": {"admin": {"AuthSecret": "bearer:s3cr3t", "AllowedPaths": ["/api/v0"]}}},
+		"Gateway": {"WriteTokens": {"uploader": {"Secret": "t0k3n", "Paths": ["/ipfs/"]}}}
+	}`)
+	restore := func(updated map[string]interface{}) error {
+		for _, sel := range secretSelectors {
+			if err := restoreSecrets(old, updated, sel, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// as shown by config show
+	shown := decode(`{
+		"API": {"Authorizations": {"admin": {"AllowedPaths": ["/api/v0", "/api/v1"]}}},
+		"Gateway": {"WriteTokens": {"uploader": {"Paths": ["/ipfs/"]}, "new": {"Secret": "n3w"}}}
+	}`)
+	if err := restore(shown); err != nil {
+		t.Fatal(err)
+	}
+	api := shown["API"].(map[string]interface{})["Authorizations"].(map[string]interface{})["admin"].(map[string]interface{})
+	if api["AuthSecret"] != "bearer:s3cr3t" || len(api["AllowedPaths"].([]interface{})) != 2 {
+		t.Errorf("unexpected authorization %v", api)
+	}
+	tokens := shown["Gateway"].(map[string]interface{})["WriteTokens"].(map[string]interface{})
+	if tokens["uploader"].(map[string]interface{})["Secret"] != "t0k3n" {
+		t.Errorf("expected the write token secret to be restored, got %v", tokens["uploader"])
+	}
+	if tokens["new"].(map[string]interface{})["Secret"] != "n3w" {
+		t.Errorf("expected a new secret to be kept, got %v", tokens["new"])
+	}
+
+	changed := decode(`{"API": {"Authorizations": {"admin": {"AuthSecret": "bearer:other"}}}}`)
+	if err := restore(changed); err == nil {
+		t.Error("expected changing a secret to fail")
+	}
+}
@@ -5,13 +5,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	gopath "path"
+	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	"github.com/ipfs/go-ipfs/core/coreunix"
 
 	"github.com/dustin/go-humanize"
 	bservice "github.com/ipfs/go-blockservice"
@@ -63,22 +68,33 @@ of consistency guarantees. If the daemon is unexpectedly killed before running
 'ipfs files flush' on the files in question, then data may be lost. This also
 applies to run 'ipfs repo gc' concurrently with '--flush=false'
 operations.
+
+Changes made with '--tx' go to a private copy of MFS and only show up in MFS
+once the transaction is committed, see 'ipfs files tx'.
 `,
 	},
 	Options: []cmds.Option{
 		cmds.BoolOption(filesFlushOptionName, "f", "Flush target and ancestors after write.").WithDefault(true),
+		cmds.StringOption(filesTxOptionName, "Work in the given transaction, see 'ipfs files tx'."),
 	},
 	Subcommands: map[string]*cmds.Command{
-		"read":  filesReadCmd,
-		"write": filesWriteCmd,
-		"mv":    filesMvCmd,
-		"cp":    filesCpCmd,
-		"ls":    filesLsCmd,
-		"mkdir": filesMkdirCmd,
-		"stat":  filesStatCmd,
-		"rm":    filesRmCmd,
-		"flush": filesFlushCmd,
-		"chcid": filesChcidCmd,
+		"read":     filesReadCmd,
+		"write":    filesWriteCmd,
+		"mv":       filesMvCmd,
+		"cp":       filesCpCmd,
+		"ls":       filesLsCmd,
+		"mkdir":    filesMkdirCmd,
+		"stat":     filesStatCmd,
+		"rm":       filesRmCmd,
+		"flush":    filesFlushCmd,
+		"chcid":    filesChcidCmd,
+		"sync":     filesSyncCmd,
+		"snapshot": filesSnapshotCmd,
+		"log":      filesLogCmd,
+		"rollback": filesRollbackCmd,
+		"tx":       filesTxCmd,
+		"du":       filesDuCmd,
+		"find":     filesFindCmd,
 	},
 }
 
@@ -169,7 +185,13 @@ var filesStatCmd = &cmds.Command{
 			dagserv = node.DAG
 		}
 
-		nd, err := getNodeFromPath(req.Context, node, api, path)
+		root, done, err := getFilesRoot(req, node)
+		if err != nil {
+			return err
+		}
+		defer done(nil)
+
+		nd, err := getNodeFromPath(req.Context, root, api, path)
 		if err != nil {
 			return err
 		}
@@ -343,11 +365,16 @@ $ ipfs cp /ipfs/<CID> /your/desired/mfs/path
 		cmds.StringArg("source", true, false, "Source IPFS or MFS path to copy."),
 		cmds.StringArg("dest", true, false, "Destination within MFS."),
 	},
-	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) (retErr error) {
 		nd, err := cmdenv.GetNode(env)
 		if err != nil {
 			return err
 		}
+		root, done, err := changeFilesRoot(req, nd)
+		if err != nil {
+			return err
+		}
+		defer done(&retErr)
 
 		api, err := cmdenv.GetApi(env, req)
 		if err != nil {
@@ -371,18 +398,21 @@ $ ipfs cp /ipfs/<CID> /your/desired/mfs/path
 			dst += gopath.Base(src)
 		}
 
-		node, err := getNodeFromPath(req.Context, nd, api, src)
+		node, err := getNodeFromPath(req.Context, root, api, src)
 		if err != nil {
 			return fmt.Errorf("cp: cannot get node from path %s: %s", src, err)
 		}
 
-		err = mfs.PutNode(nd.FilesRoot, dst, node)
+		err = mfs.PutNode(root, dst, node)
 		if err != nil {
 			return fmt.Errorf("cp: cannot put node in path %s: %s", dst, err)
 		}
+		if err := reshardParent(req.Context, nd, root, dst); err != nil {
+			return err
+		}
 
 		if flush {
-			_, err := mfs.FlushPath(req.Context, nd.FilesRoot, dst)
+			_, err := mfs.FlushPath(req.Context, root, dst)
 			if err != nil {
 				return fmt.Errorf("cp: cannot flush the created file %s: %s", dst, err)
 			}
@@ -392,12 +422,12 @@ $ ipfs cp /ipfs/<CID> /your/desired/mfs/path
 	},
 }
 
-func getNodeFromPath(ctx context.Context, node *core.IpfsNode, api iface.CoreAPI, p string) (ipld.Node, error) {
+func getNodeFromPath(ctx context.Context, root *mfs.Root, api iface.CoreAPI, p string) (ipld.Node, error) {
 	switch {
 	case strings.HasPrefix(p, "/ipfs/"):
 		return api.ResolveNode(ctx, path.New(p))
 	default:
-		fsn, err := mfs.Lookup(node.FilesRoot, p)
+		fsn, err := mfs.Lookup(root, p)
 		if err != nil {
 			return nil, err
 		}
@@ -462,7 +492,13 @@ Examples:
 			return err
 		}
 
-		fsn, err := mfs.Lookup(nd.FilesRoot, path)
+		root, done, err := getFilesRoot(req, nd)
+		if err != nil {
+			return err
+		}
+		defer done(nil)
+
+		fsn, err := mfs.Lookup(root, path)
 		if err != nil {
 			return err
 		}
@@ -582,7 +618,13 @@ Examples:
 			return err
 		}
 
-		fsn, err := mfs.Lookup(nd.FilesRoot, path)
+		root, done, err := getFilesRoot(req, nd)
+		if err != nil {
+			return err
+		}
+		defer done(nil)
+
+		fsn, err := mfs.Lookup(root, path)
 		if err != nil {
 			return err
 		}
@@ -660,11 +702,16 @@ Example:
 		cmds.StringArg("source", true, false, "Source file to move."),
 		cmds.StringArg("dest", true, false, "Destination path for file to be moved to."),
 	},
-	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) (retErr error) {
 		nd, err := cmdenv.GetNode(env)
 		if err != nil {
 			return err
 		}
+		root, done, err := changeFilesRoot(req, nd)
+		if err != nil {
+			return err
+		}
+		defer done(&retErr)
 
 		flush, _ := req.Options[filesFlushOptionName].(bool)
 
@@ -677,9 +724,23 @@ Example:
 			return err
 		}
 
-		err = mfs.Mv(nd.FilesRoot, src, dst)
-		if err == nil && flush {
-			_, err = mfs.FlushPath(req.Context, nd.FilesRoot, "/")
+		// moving to a directory moves into it
+		moved := dst
+		if fsn, err := mfs.Lookup(root, dst); err == nil && fsn.Type() == mfs.TDir {
+			moved = gopath.Join(dst, gopath.Base(src))
+		}
+
+		err = mfs.Mv(root, src, dst)
+		if err != nil {
+			return err
+		}
+		for _, p := range []string{src, moved} {
+			if err := reshardParent(req.Context, nd, root, p); err != nil {
+				return err
+			}
+		}
+		if flush {
+			_, err = mfs.FlushPath(req.Context, root, "/")
 		}
 		return err
 	},
@@ -769,14 +830,45 @@ stat' on the file or any of its ancestors.
 			return fmt.Errorf("cannot have negative write offset")
 		}
 
+		count, countfound := req.Options[filesCountOptionName].(int64)
+		if countfound && count < 0 {
+			return fmt.Errorf("cannot have negative byte count")
+		}
+
+		var r io.Reader
+		r, err = cmdenv.GetFileArg(req.Files.Entries())
+		if err != nil {
+			return err
+		}
+		if countfound {
+			r = io.LimitReader(r, int64(count))
+		}
+
+		// the data is read in full before changing MFS, so that slow
+		// uploads don't hold the other changes back
+		data, err := spoolUpload(r)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			data.Close()
+			os.Remove(data.Name())
+		}()
+
+		root, done, err := changeFilesRoot(req, nd)
+		if err != nil {
+			return err
+		}
+		defer done(&retErr)
+
 		if mkParents {
-			err := ensureContainingDirectoryExists(nd.FilesRoot, path, prefix)
+			err := ensureContainingDirectoryExists(root, path, prefix)
 			if err != nil {
 				return err
 			}
 		}
 
-		fi, err := getFileHandle(nd.FilesRoot, path, create, prefix)
+		fi, err := getFileHandle(root, path, create, prefix)
 		if err != nil {
 			return err
 		}
@@ -797,6 +889,11 @@ stat' on the file or any of its ancestors.
 				} else {
 					flog.Error("files: error closing file mfs file descriptor", err)
 				}
+				return
+			}
+			if create && retErr == nil {
+				// once closed, not to reshard the directory under the file
+				retErr = reshardParent(req.Context, nd, root, path)
 			}
 		}()
 
@@ -806,31 +903,35 @@ stat' on the file or any of its ancestors.
 			}
 		}
 
-		count, countfound := req.Options[filesCountOptionName].(int64)
-		if countfound && count < 0 {
-			return fmt.Errorf("cannot have negative byte count")
-		}
-
 		_, err = wfd.Seek(int64(offset), io.SeekStart)
 		if err != nil {
 			flog.Error("seekfail: ", err)
 			return err
 		}
 
-		var r io.Reader
-		r, err = cmdenv.GetFileArg(req.Files.Entries())
-		if err != nil {
-			return err
-		}
-		if countfound {
-			r = io.LimitReader(r, int64(count))
-		}
-
-		_, err = io.Copy(wfd, r)
+		_, err = io.Copy(wfd, data)
 		return err
 	},
 }
 
+// spoolUpload copies r to a temporary file, returned rewound. The caller
+// closes and removes it.
+func spoolUpload(r io.Reader) (*os.File, error) {
+	f, err := ioutil.TempFile("", "ipfs-files-write-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
 var filesMkdirCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "Make directories.",
@@ -857,11 +958,16 @@ Examples:
 		cidVersionOption,
 		hashOption,
 	},
-	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) (retErr error) {
 		n, err := cmdenv.GetNode(env)
 		if err != nil {
 			return err
 		}
+		root, done, err := changeFilesRoot(req, n)
+		if err != nil {
+			return err
+		}
+		defer done(&retErr)
 
 		dashp, _ := req.Options[filesParentsOptionName].(bool)
 		dirtomake, err := checkPath(req.Arguments[0])
@@ -875,172 +981,1037 @@ Examples:
 		if err != nil {
 			return err
 		}
-		root := n.FilesRoot
 
 		err = mfs.Mkdir(root, dirtomake, mfs.MkdirOpts{
 			Mkparents:  dashp,
 			Flush:      flush,
 			CidBuilder: prefix,
 		})
+		if err != nil {
+			return err
+		}
 
-		return err
+		return reshardParent(req.Context, n, root, dirtomake)
 	},
 }
 
-type flushRes struct {
-	Cid string
+const (
+	filesCacheOptionName = "cache"
+)
+
+// SyncOutput is a change made by 'ipfs files sync'.
+type SyncOutput struct {
+	Type string
+	Path string
 }
 
-var filesFlushCmd = &cmds.Command{
+var filesSyncCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
-		Tagline: "Flush a given path's data to disk.",
+		Tagline: "Sync a local directory into MFS.",
 		ShortDescription: `
-Flush a given path to the disk. This is only useful when other commands
-are run with the '--flush=false'.
+Brings the MFS directory at <path>, created if needed, in line with the local
+directory <local-dir>, like rsync: only the files which changed are added,
+and the entries missing locally are removed.
+`,
+		LongDescription: `
+Brings the MFS directory at <path>, created if needed, in line with the local
+directory <local-dir>, like rsync: only the files which changed are added,
+and the entries missing locally are removed.
+
+Files are known to be unchanged when their size and modification time are
+those stored with --preserve-mtime, or those recorded in the state cache kept
+in the repo with --cache. Other files are added again, which hashes them, and
+only replaced in MFS if their content changed.
+
+The local directory is read by the client, which sends its files, with
+their sizes, modes and modification times, to the daemon. The unchanged files
+are still sent, but not read by the daemon.
+
+Each change is listed as it is made:
+
+    +  added
+    -  removed
+    ~  modified
+
+Example:
+
+    $ ipfs files sync --cache /srv/dataset /dataset
+    ~ 2021/week-12.csv
+    + 2021/week-13.csv
 `,
 	},
 	Arguments: []cmds.Argument{
-		cmds.StringArg("path", false, false, "Path to flush. Default: '/'."),
+		cmds.StringArg("local-dir", true, false, "Local directory to sync from."),
+		cmds.StringArg("path", true, false, "MFS directory to sync to."),
 	},
-	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+	Options: []cmds.Option{
+		cmds.BoolOption(filesCacheOptionName, "Keep a state cache of the synced files in the repo, to skip the unchanged ones without hashing them."),
+		cmds.BoolOption(preserveModeOptionName, "Store the file permissions. (experimental)"),
+		cmds.BoolOption(preserveMtimeOptionName, "Store the file modification times, to skip the unchanged files without hashing them. (experimental)"),
+		cmds.StringOption(chunkerOptionName, "s", "Chunking algorithm, size-[bytes], rabin-[min]-[avg]-[max] or buzhash").WithDefault("size-262144"),
+		cmds.BoolOption(filesRawLeavesOptionName, "Use raw blocks for newly created leaf nodes. (experimental)"),
+		cidVersionOption,
+		hashOption,
+	},
+	PreRun: func(req *cmds.Request, env cmds.Environment) error {
+		if req.Files != nil {
+			// PreRun runs twice when falling back to the local node
+			return nil
+		}
+		// relative to the working directory of the client
+		abs, err := filepath.Abs(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+		req.Arguments[0] = abs
+		return sendSyncDir(req, abs)
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) (retErr error) {
 		nd, err := cmdenv.GetNode(env)
 		if err != nil {
 			return err
 		}
-
-		enc, err := cmdenv.GetCidEncoder(req)
+		root, done, err := changeFilesRoot(req, nd)
 		if err != nil {
 			return err
 		}
+		defer done(&retErr)
 
-		path := "/"
-		if len(req.Arguments) > 0 {
-			path = req.Arguments[0]
+		dst, err := checkPath(req.Arguments[1])
+		if err != nil {
+			return err
 		}
-
-		n, err := mfs.FlushPath(req.Context, nd.FilesRoot, path)
+		prefix, err := getPrefixNew(req)
+		if err != nil {
+			return err
+		}
+		stats, local, err := readSyncDir(req)
 		if err != nil {
 			return err
 		}
 
-		return cmds.EmitOnce(res, &flushRes{enc.Encode(n.Cid())})
+		syncer := coreunix.NewSyncer(req.Context, nd.Pinning, nd.Blockstore, nd.DAG, root)
+		syncer.Chunker, _ = req.Options[chunkerOptionName].(string)
+		syncer.RawLeaves, _ = req.Options[filesRawLeavesOptionName].(bool)
+		syncer.CidBuilder = prefix
+		syncer.PreserveMode, _ = req.Options[preserveModeOptionName].(bool)
+		syncer.PreserveMtime, _ = req.Options[preserveMtimeOptionName].(bool)
+		syncer.ShardingThreshold = int(nd.ShardingThreshold)
+		syncer.Stats = stats
+		if cache, _ := req.Options[filesCacheOptionName].(bool); cache {
+			syncer.Cache = nd.Repo.Datastore()
+		}
+		syncer.Out = func(e coreunix.SyncEvent) error {
+			return res.Emit(&SyncOutput{Type: string(e.Type), Path: e.Path})
+		}
+
+		// the local path only names the state cache, it isn't read
+		if err := syncer.Sync(req.Arguments[0], local, dst); err != nil {
+			return err
+		}
+		return reshardParent(req.Context, nd, root, dst)
 	},
-	Type: flushRes{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *SyncOutput) error {
+			var sign string
+			switch coreunix.DiffType(out.Type) {
+			case coreunix.DiffAdded:
+				sign = "+"
+			case coreunix.DiffRemoved:
+				sign = "-"
+			case coreunix.DiffModified:
+				sign = "~"
+			default:
+				return fmt.Errorf("unknown change type %q", out.Type)
+			}
+			_, err := fmt.Fprintf(w, "%s %s\n", sign, cmdenv.EscNonPrint(out.Path))
+			return err
+		}),
+	},
+	Type: SyncOutput{},
 }
 
-var filesChcidCmd = &cmds.Command{
+const (
+	filesSnapshotNameOptionName = "name"
+)
+
+// SnapshotOutput is an MFS snapshot.
+type SnapshotOutput struct {
+	Name string
+	Path string
+	Cid  string
+	Time time.Time
+}
+
+func snapshotOutput(enc cidenc.Encoder, s coreunix.Snapshot) *SnapshotOutput {
+	return &SnapshotOutput{
+		Name: s.Name,
+		Path: s.Path,
+		Cid:  enc.Encode(s.Cid),
+		Time: s.Time,
+	}
+}
+
+var filesSnapshotCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
-		Tagline: "Change the cid version or hash function of the root node of a given path.",
+		Tagline: "Record a snapshot of MFS.",
 		ShortDescription: `
-Change the cid version or hash function of the root node of a given path.
+Records the current state of <path>, the MFS root by default, in the repo
+under the given name, or the current time. The data of the snapshots is kept
+by the garbage collector until they are removed with 'ipfs files snapshot rm'.
+`,
+		LongDescription: `
+Records the current state of <path>, the MFS root by default, in the repo
+under the given name, or the current time. The data of the snapshots is kept
+by the garbage collector until they are removed with 'ipfs files snapshot rm'.
+
+The snapshots are listed by 'ipfs files log' and restored by
+'ipfs files rollback'.
+
+Example:
+
+    $ ipfs files snapshot --name before-cleanup
+    before-cleanup
+    $ ipfs files rm -r /archive
+    $ ipfs files rollback before-cleanup
 `,
 	},
 	Arguments: []cmds.Argument{
-		cmds.StringArg("path", false, false, "Path to change. Default: '/'."),
+		cmds.StringArg("path", false, false, "Path to record. Default: '/'."),
 	},
 	Options: []cmds.Option{
-		cidVersionOption,
-		hashOption,
+		cmds.StringOption(filesSnapshotNameOptionName, "n", "Name of the snapshot, made of letters, digits, '.', '-' and '_'. Default: the current time."),
+	},
+	Subcommands: map[string]*cmds.Command{
+		"rm": filesSnapshotRmCmd,
 	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		if _, ok := req.Options[filesTxOptionName].(string); ok {
+			return errNotInTx
+		}
 		nd, err := cmdenv.GetNode(env)
 		if err != nil {
 			return err
 		}
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
 
 		path := "/"
 		if len(req.Arguments) > 0 {
-			path = req.Arguments[0]
+			path, err = checkPath(req.Arguments[0])
+			if err != nil {
+				return err
+			}
 		}
+		name, _ := req.Options[filesSnapshotNameOptionName].(string)
 
-		flush, _ := req.Options[filesFlushOptionName].(bool)
+		filesLock.Lock()
+		defer filesLock.Unlock()
 
-		prefix, err := getPrefix(req)
+		s, err := coreunix.SnapshotMfs(req.Context, nd.FilesRoot, nd.Repo.Datastore(), path, name)
 		if err != nil {
 			return err
 		}
-
-		err = updatePath(nd.FilesRoot, path, prefix)
-		if err == nil && flush {
-			_, err = mfs.FlushPath(req.Context, nd.FilesRoot, path)
-		}
-		return err
+		return cmds.EmitOnce(res, snapshotOutput(enc, s))
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *SnapshotOutput) error {
+			_, err := fmt.Fprintln(w, out.Name)
+			return err
+		}),
 	},
+	Type: SnapshotOutput{},
 }
 
-func updatePath(rt *mfs.Root, pth string, builder cid.Builder) error {
-	if builder == nil {
-		return nil
-	}
-
-	nd, err := mfs.Lookup(rt, pth)
-	if err != nil {
-		return err
-	}
-
-	switch n := nd.(type) {
-	case *mfs.Directory:
-		n.SetCidBuilder(builder)
-	default:
-		return fmt.Errorf("can only update directories")
-	}
+var filesSnapshotRmCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Remove MFS snapshots.",
+		ShortDescription: `
+Removes the given snapshots. Their data is removed by the next garbage
+collection unless still referenced elsewhere.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("name", true, true, "Name of the snapshots to remove."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		for _, name := range req.Arguments {
+			if err := coreunix.RemoveSnapshot(nd.Repo.Datastore(), name); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		return nil
+	},
 }
 
-var filesRmCmd = &cmds.Command{
+var filesLogCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
-		Tagline: "Remove a file.",
+		Tagline: "List the MFS snapshots.",
 		ShortDescription: `
-Remove files or directories.
+Lists the snapshots recorded by 'ipfs files snapshot', the latest first, or
+only those of <path> if given.
 
-    $ ipfs files rm /foo
-    $ ipfs files ls /bar
-    cat
-    dog
-    fish
-    $ ipfs files rm -r /bar
+Example:
+
+    $ ipfs files log
+    before-cleanup  2021-03-02 10:12:45  /  QmRoot...
 `,
 	},
-
 	Arguments: []cmds.Argument{
-		cmds.StringArg("path", true, true, "File to remove."),
-	},
-	Options: []cmds.Option{
-		cmds.BoolOption(recursiveOptionName, "r", "Recursively remove directories."),
-		cmds.BoolOption(forceOptionName, "Forcibly remove target at path; implies -r for directories"),
+		cmds.StringArg("path", false, false, "Only list the snapshots of this path."),
 	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		nd, err := cmdenv.GetNode(env)
 		if err != nil {
 			return err
 		}
-
-		path, err := checkPath(req.Arguments[0])
+		enc, err := cmdenv.GetCidEncoder(req)
 		if err != nil {
 			return err
 		}
 
-		if path == "/" {
-			return fmt.Errorf("cannot delete root")
-		}
-
-		// 'rm a/b/c/' will fail unless we trim the slash at the end
-		if path[len(path)-1] == '/' {
-			path = path[:len(path)-1]
+		var path string
+		if len(req.Arguments) > 0 {
+			path, err = checkPath(req.Arguments[0])
+			if err != nil {
+				return err
+			}
+			path = gopath.Clean(path)
 		}
 
-		// if '--force' specified, it will remove anything else,
-		// including file, directory, corrupted node, etc
-		force, _ := req.Options[forceOptionName].(bool)
-
-		dir, name := gopath.Split(path)
-
-		pdir, err := getParentDir(nd.FilesRoot, dir)
+		snapshots, err := coreunix.Snapshots(req.Context, nd.Repo.Datastore())
 		if err != nil {
-			if force && err == os.ErrNotExist {
-				return nil
-			}
+			return err
+		}
+		for _, s := range snapshots {
+			if path != "" && s.Path != path {
+				continue
+			}
+			if err := res.Emit(snapshotOutput(enc, s)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *SnapshotOutput) error {
+			_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", cmdenv.EscNonPrint(out.Name),
+				out.Time.Local().Format("2006-01-02 15:04:05"), cmdenv.EscNonPrint(out.Path), out.Cid)
+			return err
+		}),
+	},
+	Type: SnapshotOutput{},
+}
+
+// RollbackOutput is the result of 'ipfs files rollback'.
+type RollbackOutput struct {
+	// Snapshot is the snapshot restored.
+	Snapshot SnapshotOutput
+	// Saved is the snapshot of the state replaced.
+	Saved SnapshotOutput
+}
+
+var filesRollbackCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Restore an MFS snapshot.",
+		ShortDescription: `
+Restores the path recorded in the given snapshot to its recorded state. The
+current state of the path is recorded first as a new snapshot, named after
+the current time, so the rollback itself can be undone.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("snapshot", true, false, "Name of the snapshot to restore."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		if _, ok := req.Options[filesTxOptionName].(string); ok {
+			return errNotInTx
+		}
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		ds := nd.Repo.Datastore()
+		s, err := coreunix.GetSnapshot(ds, req.Arguments[0])
+		if err != nil {
+			return err
+		}
+
+		filesLock.Lock()
+		defer filesLock.Unlock()
+
+		out := &RollbackOutput{Snapshot: *snapshotOutput(enc, s)}
+		if _, err := mfs.Lookup(nd.FilesRoot, s.Path); err == nil {
+			saved, err := coreunix.SnapshotMfs(req.Context, nd.FilesRoot, ds, s.Path, "")
+			if err != nil {
+				return err
+			}
+			out.Saved = *snapshotOutput(enc, saved)
+		} else if err != os.ErrNotExist {
+			return err
+		}
+
+		if err := coreunix.RollbackMfs(req.Context, nd.FilesRoot, nd.DAG, s); err != nil {
+			return err
+		}
+		if s.Path != "/" {
+			if err := reshardParent(req.Context, nd, nd.FilesRoot, s.Path); err != nil {
+				return err
+			}
+		}
+		return cmds.EmitOnce(res, out)
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *RollbackOutput) error {
+			if out.Saved.Name == "" {
+				_, err := fmt.Fprintf(w, "restored %s to %s\n", cmdenv.EscNonPrint(out.Snapshot.Path), out.Snapshot.Name)
+				return err
+			}
+			_, err := fmt.Fprintf(w, "restored %s to %s, previous state saved as %s\n",
+				cmdenv.EscNonPrint(out.Snapshot.Path), out.Snapshot.Name, out.Saved.Name)
+			return err
+		}),
+	},
+	Type: RollbackOutput{},
+}
+
+const (
+	filesTxOptionName = "tx"
+)
+
+var errNotInTx = errors.New("not supported in a transaction")
+
+// filesLock serializes the changes to MFS, so that those made in several
+// steps, like committing a transaction, don't interleave with others. It's
+// taken after filesTxLock.
+var filesLock sync.Mutex
+
+// filesTxLock serializes the commands working in transactions, the root of
+// a transaction being loaded and saved by each of them.
+var filesTxLock sync.Mutex
+
+// TxOutput is an MFS transaction.
+type TxOutput struct {
+	ID   string
+	Path string
+	// Cid is the CID of the path when the transaction began, or once
+	// committed.
+	Cid  string
+	Time time.Time
+}
+
+var filesTxCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Group MFS changes in transactions.",
+		ShortDescription: `
+Transactions make the changes of several 'ipfs files' commands show up in MFS
+at once. 'ipfs files tx begin' returns the ID of a new transaction, to pass
+to the commands with '--tx'. They then work on a private copy of MFS, which
+'ipfs files tx commit' applies to the path of the transaction in one step, or
+'ipfs files tx abort' drops.
+`,
+		LongDescription: `
+Transactions make the changes of several 'ipfs files' commands show up in MFS
+at once. 'ipfs files tx begin' returns the ID of a new transaction, to pass
+to the commands with '--tx'. They then work on a private copy of MFS, which
+'ipfs files tx commit' applies to the path of the transaction in one step, or
+'ipfs files tx abort' drops.
+
+A transaction may only change the directory it began on, the MFS root by
+default. Committing fails if that directory was changed in MFS in the
+meantime; the transaction is kept, to be aborted or retried.
+
+Transactions are kept in the repo until committed or aborted, and so is the
+data they hold.
+
+Example:
+
+    $ tx=$(ipfs files tx begin /site)
+    $ ipfs files --tx=$tx rm -r /site/assets
+    $ ipfs files --tx=$tx cp /ipfs/QmAssets /site/assets
+    $ echo "v2" | ipfs files --tx=$tx write --create --truncate /site/VERSION
+    $ ipfs files tx commit $tx
+`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"begin":  filesTxBeginCmd,
+		"commit": filesTxCommitCmd,
+		"abort":  filesTxAbortCmd,
+		"ls":     filesTxLsCmd,
+	},
+}
+
+func txOutput(enc cidenc.Encoder, tx coreunix.Tx, c cid.Cid) *TxOutput {
+	return &TxOutput{
+		ID:   tx.ID,
+		Path: tx.Path,
+		Cid:  enc.Encode(c),
+		Time: tx.Time,
+	}
+}
+
+var filesTxBeginCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Begin an MFS transaction.",
+		ShortDescription: `
+Begins a transaction changing the directory <path>, the MFS root by default,
+and prints its ID.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("path", false, false, "Directory the transaction may change. Default: '/'."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		path := "/"
+		if len(req.Arguments) > 0 {
+			path, err = checkPath(req.Arguments[0])
+			if err != nil {
+				return err
+			}
+		}
+
+		filesLock.Lock()
+		defer filesLock.Unlock()
+
+		tx, err := coreunix.BeginTx(req.Context, nd.FilesRoot, nd.Repo.Datastore(), path)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, txOutput(enc, tx, tx.Base))
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *TxOutput) error {
+			_, err := fmt.Fprintln(w, out.ID)
+			return err
+		}),
+	},
+	Type: TxOutput{},
+}
+
+var filesTxCommitCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Commit an MFS transaction.",
+		ShortDescription: `
+Applies the changes of the transaction to MFS and prints the new CID of its
+path. Fails, keeping the transaction, if the path changed in MFS since the
+transaction began.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("id", true, false, "ID of the transaction."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		filesTxLock.Lock()
+		defer filesTxLock.Unlock()
+		filesLock.Lock()
+		defer filesLock.Unlock()
+
+		tx, err := coreunix.CommitTx(req.Context, nd.FilesRoot, nd.DAG, nd.Repo.Datastore(), req.Arguments[0])
+		if err != nil {
+			return err
+		}
+		if tx.Path != "/" {
+			if err := reshardParent(req.Context, nd, nd.FilesRoot, tx.Path); err != nil {
+				return err
+			}
+		}
+		committed, err := mfs.FlushPath(req.Context, nd.FilesRoot, tx.Path)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, txOutput(enc, tx, committed.Cid()))
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *TxOutput) error {
+			_, err := fmt.Fprintln(w, out.Cid)
+			return err
+		}),
+	},
+	Type: TxOutput{},
+}
+
+var filesTxAbortCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Abort MFS transactions.",
+		ShortDescription: `
+Drops the given transactions and their changes.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("id", true, true, "ID of the transactions."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		filesTxLock.Lock()
+		defer filesTxLock.Unlock()
+
+		for _, id := range req.Arguments {
+			if err := coreunix.AbortTx(nd.Repo.Datastore(), id); err != nil {
+				return fmt.Errorf("%s: %s", id, err)
+			}
+		}
+		return nil
+	},
+}
+
+var filesTxLsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "List the MFS transactions in progress.",
+		ShortDescription: `
+Lists the transactions begun and neither committed nor aborted, the oldest
+first, with the path they change and its CID when they began.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		txs, err := coreunix.Txs(req.Context, nd.Repo.Datastore())
+		if err != nil {
+			return err
+		}
+		for _, tx := range txs {
+			if err := res.Emit(txOutput(enc, tx, tx.Base)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *TxOutput) error {
+			_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", out.ID,
+				out.Time.Local().Format("2006-01-02 15:04:05"), cmdenv.EscNonPrint(out.Path), out.Cid)
+			return err
+		}),
+	},
+	Type: TxOutput{},
+}
+
+const (
+	filesDepthOptionName   = "depth"
+	filesNameOptionName    = "name"
+	filesTypeOptionName    = "type"
+	filesMinSizeOptionName = "min-size"
+)
+
+// DuOutput is the disk usage of an MFS directory.
+type DuOutput struct {
+	Path      string
+	Size      uint64
+	LocalSize uint64
+}
+
+var filesDuCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Show the disk usage of MFS directories.",
+		ShortDescription: `
+Lists the cumulative size of the directory <path>, the MFS root by default,
+and of each directory below it, and how much of it is present locally, the
+subdirectories before their parent.
+`,
+		LongDescription: `
+Lists the cumulative size of the directory <path>, the MFS root by default,
+and of each directory below it, and how much of it is present locally, the
+subdirectories before their parent. With --depth, only the directories at
+most that many levels below <path> are listed.
+
+The contents of files are never fetched to be measured. Directories missing
+locally are fetched to be walked, unless --offline is given: they are then
+counted in the cumulative size of their parent, but not listed.
+
+Each line holds the cumulative size, the local size, in bytes, and the path:
+
+    $ ipfs files du -d 1 /
+    1053266	1053266	/photos
+    2301	0	/papers
+    1055691	1053390	/
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("path", false, false, "Path to the directory. Default: '/'."),
+	},
+	Options: []cmds.Option{
+		cmds.IntOption(filesDepthOptionName, "d", "List the directories at most this many levels below the path.").WithDefault(-1),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		api, err := cmdenv.GetApi(env, req)
+		if err != nil {
+			return err
+		}
+
+		path := "/"
+		if len(req.Arguments) > 0 {
+			path, err = checkPath(req.Arguments[0])
+			if err != nil {
+				return err
+			}
+			path = gopath.Clean(path)
+		}
+		depth, _ := req.Options[filesDepthOptionName].(int)
+
+		root, done, err := getFilesRoot(req, nd)
+		if err != nil {
+			return err
+		}
+		defer done(nil)
+
+		fsn, err := mfs.Lookup(root, path)
+		if err != nil {
+			return err
+		}
+		if fsn.Type() != mfs.TDir {
+			return fmt.Errorf("%s is not a directory", path)
+		}
+		dir, err := fsn.GetNode()
+		if err != nil {
+			return err
+		}
+
+		return coreunix.DiskUsageTree(req.Context, api.Dag(), nd.Blockstore, path, dir, depth, func(du coreunix.DiskUsage) error {
+			return res.Emit(&DuOutput{Path: du.Path, Size: du.Size, LocalSize: du.LocalSize})
+		})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *DuOutput) error {
+			_, err := fmt.Fprintf(w, "%d\t%d\t%s\n", out.Size, out.LocalSize, cmdenv.EscNonPrint(out.Path))
+			return err
+		}),
+	},
+	Type: DuOutput{},
+}
+
+// FindOutput is an MFS entry found by 'ipfs files find'.
+type FindOutput struct {
+	Path string
+	Type string
+	Cid  string
+	Size uint64
+}
+
+var filesFindCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Search MFS.",
+		ShortDescription: `
+Lists the paths of the entries of <path>, the MFS root by default, matching
+the given criteria, <path> included.
+`,
+		LongDescription: `
+Lists the paths of the entries of <path>, the MFS root by default, matching
+the given criteria, <path> included.
+
+--name matches the names of the entries against a shell pattern, see
+https://golang.org/pkg/path/#Match, --type restricts the entries to files (f)
+or directories (d), and --min-size to the files or directories at least that
+large, like "10MB". The size of directories is their cumulative size.
+
+Entries missing locally are fetched, unless --offline is given: the missing
+directories are then skipped. Use --enc=json for the type, CID and size of
+the entries found.
+
+Example:
+
+    $ ipfs files find / --name '*.csv' --type f --min-size 1MB
+    /data/2021.csv
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("path", false, false, "Path to search. Default: '/'."),
+	},
+	Options: []cmds.Option{
+		cmds.StringOption(filesNameOptionName, "Pattern the names must match."),
+		cmds.StringOption(filesTypeOptionName, "Type of the entries, f for files or d for directories."),
+		cmds.StringOption(filesMinSizeOptionName, "Minimum size of the entries."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		api, err := cmdenv.GetApi(env, req)
+		if err != nil {
+			return err
+		}
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		path := "/"
+		if len(req.Arguments) > 0 {
+			path, err = checkPath(req.Arguments[0])
+			if err != nil {
+				return err
+			}
+			path = gopath.Clean(path)
+		}
+
+		var opts coreunix.FindOptions
+		opts.Name, _ = req.Options[filesNameOptionName].(string)
+		typ, _ := req.Options[filesTypeOptionName].(string)
+		switch coreunix.FindType(typ) {
+		case coreunix.FindAny, coreunix.FindFiles, coreunix.FindDirectories:
+			opts.Type = coreunix.FindType(typ)
+		default:
+			return fmt.Errorf("unknown type %q, expected f or d", typ)
+		}
+		if minSize, ok := req.Options[filesMinSizeOptionName].(string); ok {
+			opts.MinSize, err = humanize.ParseBytes(minSize)
+			if err != nil {
+				return fmt.Errorf("invalid minimum size %q: %s", minSize, err)
+			}
+		}
+
+		root, done, err := getFilesRoot(req, nd)
+		if err != nil {
+			return err
+		}
+		defer done(nil)
+
+		fsn, err := mfs.Lookup(root, path)
+		if err != nil {
+			return err
+		}
+		start, err := fsn.GetNode()
+		if err != nil {
+			return err
+		}
+
+		return coreunix.Find(req.Context, api.Dag(), path, start, opts, func(r coreunix.FindResult) error {
+			out := &FindOutput{
+				Path: r.Path,
+				Type: "file",
+				Cid:  enc.Encode(r.Cid),
+				Size: r.Size,
+			}
+			if r.Dir {
+				out.Type = "directory"
+			}
+			return res.Emit(out)
+		})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *FindOutput) error {
+			_, err := fmt.Fprintln(w, cmdenv.EscNonPrint(out.Path))
+			return err
+		}),
+	},
+	Type: FindOutput{},
+}
+
+type flushRes struct {
+	Cid string
+}
+
+var filesFlushCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Flush a given path's data to disk.",
+		ShortDescription: `
+Flush a given path to the disk. This is only useful when other commands
+are run with the '--flush=false'.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("path", false, false, "Path to flush. Default: '/'."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		path := "/"
+		if len(req.Arguments) > 0 {
+			path = req.Arguments[0]
+		}
+
+		root, done, err := getFilesRoot(req, nd)
+		if err != nil {
+			return err
+		}
+		defer done(nil)
+
+		n, err := mfs.FlushPath(req.Context, root, path)
+		if err != nil {
+			return err
+		}
+
+		return cmds.EmitOnce(res, &flushRes{enc.Encode(n.Cid())})
+	},
+	Type: flushRes{},
+}
+
+var filesChcidCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Change the cid version or hash function of the root node of a given path.",
+		ShortDescription: `
+Change the cid version or hash function of the root node of a given path.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("path", false, false, "Path to change. Default: '/'."),
+	},
+	Options: []cmds.Option{
+		cidVersionOption,
+		hashOption,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) (retErr error) {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		root, done, err := changeFilesRoot(req, nd)
+		if err != nil {
+			return err
+		}
+		defer done(&retErr)
+
+		path := "/"
+		if len(req.Arguments) > 0 {
+			path = req.Arguments[0]
+		}
+
+		flush, _ := req.Options[filesFlushOptionName].(bool)
+
+		prefix, err := getPrefix(req)
+		if err != nil {
+			return err
+		}
+
+		err = updatePath(root, path, prefix)
+		if err == nil && flush {
+			_, err = mfs.FlushPath(req.Context, root, path)
+		}
+		return err
+	},
+}
+
+func updatePath(rt *mfs.Root, pth string, builder cid.Builder) error {
+	if builder == nil {
+		return nil
+	}
+
+	nd, err := mfs.Lookup(rt, pth)
+	if err != nil {
+		return err
+	}
+
+	switch n := nd.(type) {
+	case *mfs.Directory:
+		n.SetCidBuilder(builder)
+	default:
+		return fmt.Errorf("can only update directories")
+	}
+
+	return nil
+}
+
+var filesRmCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Remove a file.",
+		ShortDescription: `
+Remove files or directories.
+
+    $ ipfs files rm /foo
+    $ ipfs files ls /bar
+    cat
+    dog
+    fish
+    $ ipfs files rm -r /bar
+`,
+	},
+
+	Arguments: []cmds.Argument{
+		cmds.StringArg("path", true, true, "File to remove."),
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(recursiveOptionName, "r", "Recursively remove directories."),
+		cmds.BoolOption(forceOptionName, "Forcibly remove target at path; implies -r for directories"),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) (retErr error) {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		root, done, err := changeFilesRoot(req, nd)
+		if err != nil {
+			return err
+		}
+		defer done(&retErr)
+
+		path, err := checkPath(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+
+		if path == "/" {
+			return fmt.Errorf("cannot delete root")
+		}
+
+		// 'rm a/b/c/' will fail unless we trim the slash at the end
+		if path[len(path)-1] == '/' {
+			path = path[:len(path)-1]
+		}
+
+		// if '--force' specified, it will remove anything else,
+		// including file, directory, corrupted node, etc
+		force, _ := req.Options[forceOptionName].(bool)
+
+		dir, name := gopath.Split(path)
+
+		pdir, err := getParentDir(root, dir)
+		if err != nil {
+			if force && err == os.ErrNotExist {
+				return nil
+			}
 			return fmt.Errorf("parent lookup: %s", err)
 		}
 
@@ -1052,7 +2023,10 @@ Remove files or directories.
 				}
 				return err
 			}
-			return pdir.Flush()
+			if err := pdir.Flush(); err != nil {
+				return err
+			}
+			return reshardParent(req.Context, nd, root, path)
 		}
 
 		// get child node by name, when the node is corrupted and nonexistent,
@@ -1076,7 +2050,10 @@ Remove files or directories.
 			return err
 		}
 
-		return pdir.Flush()
+		if err := pdir.Flush(); err != nil {
+			return err
+		}
+		return reshardParent(req.Context, nd, root, path)
 	},
 }
 
@@ -1228,3 +2205,52 @@ func getParentDir(root *mfs.Root, dir string) (*mfs.Directory, error) {
 	}
 	return pdir, nil
 }
+
+// getFilesRoot returns the MFS root the request works on: that of the
+// transaction given with --tx, or the one of the node. done must be called
+// once the request is over: given the error of the request, it saves the
+// changes made to the transaction unless the request failed.
+func getFilesRoot(req *cmds.Request, n *core.IpfsNode) (root *mfs.Root, done func(*error), err error) {
+	id, _ := req.Options[filesTxOptionName].(string)
+	if id == "" {
+		return n.FilesRoot, func(*error) {}, nil
+	}
+
+	filesTxLock.Lock()
+	ds := n.Repo.Datastore()
+	tx, err := coreunix.GetTx(ds, id)
+	if err == nil {
+		root, err = coreunix.TxRoot(req.Context, n.DAG, tx)
+	}
+	if err != nil {
+		filesTxLock.Unlock()
+		return nil, nil, err
+	}
+	return root, func(errp *error) {
+		defer filesTxLock.Unlock()
+		if errp != nil && *errp == nil {
+			*errp = coreunix.SaveTx(req.Context, ds, &tx, root)
+		}
+		if err := root.Close(); err != nil {
+			flog.Errorf("files: error closing the root of transaction %s: %s", id, err)
+		}
+	}, nil
+}
+
+// changeFilesRoot is getFilesRoot for the requests changing MFS. Unless
+// working in a transaction, they hold filesLock until done.
+func changeFilesRoot(req *cmds.Request, n *core.IpfsNode) (root *mfs.Root, done func(*error), err error) {
+	if id, _ := req.Options[filesTxOptionName].(string); id != "" {
+		return getFilesRoot(req, n)
+	}
+	filesLock.Lock()
+	return n.FilesRoot, func(*error) { filesLock.Unlock() }, nil
+}
+
+// reshardParent shards the directory holding the entry at path once it gets
+// too large, or turns it back into a basic directory once small enough, see
+// node.ShardingThreshold.
+func reshardParent(ctx context.Context, n *core.IpfsNode, root *mfs.Root, path string) error {
+	dirpath := gopath.Dir(strings.TrimRight(path, "/"))
+	return coreunix.ReshardMfsDirectory(ctx, root, n.DAG, dirpath, int(n.ShardingThreshold))
+}
@@ -0,0 +1,117 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	gopath "path"
+	"path/filepath"
+
+	"github.com/ipfs/go-ipfs/core/coreunix"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// syncStatsName is the name of the entry holding the file information of
+// the synced files, sent ahead of them.
+const syncStatsName = ".ipfs-sync-stats"
+
+// sendSyncDir makes the client send the local directory at path, which the
+// daemon can't read itself, and the file information of its files, as a
+// JSON map of their paths to their coreunix.SyncStat in a first entry read
+// back by readSyncDir.
+func sendSyncDir(req *cmds.Request, path string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	nd, err := files.NewSerialFile(path, true, st)
+	if err != nil {
+		return err
+	}
+	dir := nd.(files.Directory)
+
+	stats := make(map[string]coreunix.SyncStat)
+	if err := collectSyncStats(stats, "", dir); err != nil {
+		return err
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	req.Files = files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry(syncStatsName, files.NewBytesFile(data)),
+		files.FileEntry(filepath.Base(path), dir),
+	})
+	return nil
+}
+
+// collectSyncStats adds the file information of the files below dir, at
+// path in the synced directory, to stats.
+func collectSyncStats(stats map[string]coreunix.SyncStat, path string, dir files.Directory) error {
+	it := dir.Entries()
+	for it.Next() {
+		p := gopath.Join(path, it.Name())
+		var err error
+		switch nd := it.Node().(type) {
+		case files.Directory:
+			err = collectSyncStats(stats, p, nd)
+		case files.FileInfo:
+			if st := nd.Stat(); st != nil {
+				stats[p] = coreunix.SyncStat{Size: st.Size(), Mode: st.Mode(), ModTime: st.ModTime()}
+			}
+		}
+		// the entries are opened again when sent
+		it.Node().Close()
+		if err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// readSyncDir reads the directory sent by sendSyncDir, and the file
+// information of its files.
+func readSyncDir(req *cmds.Request) (map[string]coreunix.SyncStat, files.Directory, error) {
+	if req.Files == nil {
+		return nil, nil, errors.New("the local directory must be sent along")
+	}
+	it := req.Files.Entries()
+	if !it.Next() {
+		if it.Err() != nil {
+			return nil, nil, it.Err()
+		}
+		return nil, nil, errors.New("the local directory must be sent along")
+	}
+	f, ok := it.Node().(files.File)
+	if it.Name() != syncStatsName || !ok {
+		return nil, nil, fmt.Errorf("%s must be sent ahead of the local directory", syncStatsName)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	stats := make(map[string]coreunix.SyncStat)
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, nil, fmt.Errorf("malformed %s: %s", syncStatsName, err)
+	}
+
+	if !it.Next() {
+		if it.Err() != nil {
+			return nil, nil, it.Err()
+		}
+		return nil, nil, errors.New("the local directory must be sent along")
+	}
+	dir, ok := it.Node().(files.Directory)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not a directory", it.Name())
+	}
+	return stats, dir, nil
+}
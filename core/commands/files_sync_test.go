@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"io/ioutil"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+func TestSendSyncDir(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "project")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fpath := filepath.Join(root, "sub", "file")
+	if err := ioutil.WriteFile(fpath, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Chtimes(fpath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, ".hidden"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &cmds.Request{Arguments: []string{root, "/dst"}}
+	if err := sendSyncDir(req, root); err != nil {
+		t.Fatal(err)
+	}
+
+	// as read by the daemon
+	mfr := files.NewMultiFileReader(req.Files, true)
+	received, err := files.NewFileFromPartReader(multipart.NewReader(mfr, mfr.Boundary()), "multipart/form-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, dir, err := readSyncDir(&cmds.Request{Files: received})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("unexpected file information %v", stats)
+	}
+	if st := stats["sub/file"]; st.Size != 4 || st.Mode != 0600 || !st.ModTime.Equal(mtime) {
+		t.Errorf("unexpected file information of sub/file %+v", st)
+	}
+	var names []string
+	it := dir.Entries()
+	for it.Next() {
+		names = append(names, it.Name())
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if len(names) != 2 || names[0] != ".hidden" || names[1] != "sub" {
+		t.Fatalf("expected the hidden files to be sent, got %v", names)
+	}
+
+	if _, _, err := readSyncDir(&cmds.Request{Files: files.NewMapDirectory(map[string]files.Node{
+		"project": files.NewMapDirectory(nil),
+	})}); err == nil {
+		t.Fatal("expected the file information to be required")
+	}
+}
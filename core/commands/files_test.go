@@ -0,0 +1,77 @@
+package commands
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	oldcmds "github.com/ipfs/go-ipfs/commands"
+	"github.com/ipfs/go-ipfs/core"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-mfs"
+)
+
+func TestFilesWriteUnlockedUpload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nd, err := core.NewNode(ctx, &core.BuildCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nd.Close()
+	env := &oldcmds.Context{ConstructNode: func() (*core.IpfsNode, error) { return nd, nil }}
+
+	pr, pw := io.Pipe()
+	req, err := cmds.NewRequest(ctx, []string{"files", "write"}, cmds.OptMap{filesCreateOptionName: true}, []string{"/file"},
+		files.NewMapDirectory(map[string]files.Node{"data": files.NewReaderFile(pr)}), Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- filesWriteCmd.Run(req, nil, env) }()
+
+	if _, err := pw.Write([]byte("uploading")); err != nil {
+		t.Fatal(err)
+	}
+	// other changes can be made while the data is uploaded
+	locked := make(chan struct{})
+	go func() {
+		filesLock.Lock()
+		filesLock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("MFS locked during the upload")
+	}
+
+	if _, err := pw.Write([]byte(" done")); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err := mfs.Lookup(nd.FilesRoot, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfd, err := fsn.(*mfs.File).Open(mfs.Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rfd.Close()
+	data, err := ioutil.ReadAll(rfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "uploading done" {
+		t.Fatalf("unexpected content %q", data)
+	}
+}
@@ -1,11 +1,13 @@
 package commands
 
 import (
+	archivetar "archive/tar"
 	"bufio"
 	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	gopath "path"
 	"path/filepath"
@@ -13,10 +15,12 @@ import (
 
 	"github.com/ipfs/go-ipfs/core/commands/cmdenv"
 	"github.com/ipfs/go-ipfs/core/commands/e"
+	"github.com/ipfs/go-ipfs/core/coreunix"
 
 	"github.com/cheggaaa/pb"
 	cmds "github.com/ipfs/go-ipfs-cmds"
 	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/interface-go-ipfs-core/path"
 	"github.com/whyrusleeping/tar-utils"
 )
@@ -43,6 +47,10 @@ To output a TAR archive instead of unpacked files, use '--archive' or '-a'.
 
 To compress the output with GZIP compression, use '--compress' or '-C'. You
 may also specify the level of compression by specifying '-l=<1-9>'.
+
+The permissions and modification times stored with 'ipfs add --preserve-mode'
+and '--preserve-mtime' are only restored on the extracted files with the same
+options. The setuid, setgid and sticky bits are never restored.
 `,
 	},
 
@@ -54,6 +62,8 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 		cmds.BoolOption(archiveOptionName, "a", "Output a TAR archive."),
 		cmds.BoolOption(compressOptionName, "C", "Compress the output with GZIP compression."),
 		cmds.IntOption(compressionLevelOptionName, "l", "The level of compression (1-9)."),
+		cmds.BoolOption(preserveModeOptionName, "Restore the stored file and directory permissions. (experimental)"),
+		cmds.BoolOption(preserveMtimeOptionName, "Restore the stored file and directory modification times. (experimental)"),
 	},
 	PreRun: func(req *cmds.Request, env cmds.Environment) error {
 		_, err := getCompressOptions(req)
@@ -72,7 +82,17 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 
 		p := path.New(req.Arguments[0])
 
-		file, err := api.Unixfs().Get(req.Context, p)
+		checked, err := cmdenv.CheckDenylist(req.Context, env, api, p)
+		if err != nil {
+			return err
+		}
+
+		file, err := api.Unixfs().Get(req.Context, checked)
+		if err != nil {
+			return err
+		}
+
+		nd, err := api.ResolveNode(req.Context, checked)
 		if err != nil {
 			return err
 		}
@@ -85,7 +105,10 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 		res.SetLength(uint64(size))
 
 		archive, _ := req.Options[archiveOptionName].(bool)
-		reader, err := fileArchive(file, p.String(), archive, cmplvl)
+		tarw := func(w io.Writer) *coreunix.TarWriter {
+			return coreunix.NewTarWriter(req.Context, api.Dag(), w)
+		}
+		reader, err := fileArchive(file, nd, tarw, p.String(), archive, cmplvl)
 		if err != nil {
 			return err
 		}
@@ -114,13 +137,17 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 			}
 
 			archive, _ := req.Options[archiveOptionName].(bool)
+			preserveMode, _ := req.Options[preserveModeOptionName].(bool)
+			preserveMtime, _ := req.Options[preserveMtimeOptionName].(bool)
 
 			gw := getWriter{
-				Out:         os.Stdout,
-				Err:         os.Stderr,
-				Archive:     archive,
-				Compression: cmplvl,
-				Size:        int64(res.Length()),
+				Out:           os.Stdout,
+				Err:           os.Stderr,
+				Archive:       archive,
+				Compression:   cmplvl,
+				Size:          int64(res.Length()),
+				PreserveMode:  preserveMode,
+				PreserveMtime: preserveMtime,
 			}
 
 			return gw.Write(outReader, outPath)
@@ -181,6 +208,11 @@ type getWriter struct {
 	Archive     bool
 	Compression int
 	Size        int64
+
+	// PreserveMode and PreserveMtime restore the stored metadata of the
+	// extracted entries.
+	PreserveMode  bool
+	PreserveMtime bool
 }
 
 func (gw *getWriter) Write(r io.Reader, fpath string) error {
@@ -228,8 +260,90 @@ func (gw *getWriter) writeExtracted(r io.Reader, fpath string) error {
 	defer bar.Finish()
 	defer bar.Set64(gw.Size)
 
-	extractor := &tar.Extractor{Path: fpath, Progress: bar.Add64}
-	return extractor.Extract(r)
+	if !gw.PreserveMode && !gw.PreserveMtime {
+		extractor := &tar.Extractor{Path: fpath, Progress: bar.Add64}
+		return extractor.Extract(r)
+	}
+
+	// The extractor ignores the mode and modification time of the entries,
+	// read the archive a second time alongside to restore them after.
+	pr, pw := io.Pipe()
+	headers := make(chan []*archivetar.Header, 1)
+	go func() {
+		var hs []*archivetar.Header
+		tr := archivetar.NewReader(pr)
+		for {
+			h, err := tr.Next()
+			if err != nil {
+				// drain whatever is left for the extractor to go on
+				io.Copy(ioutil.Discard, pr)
+				break
+			}
+			hs = append(hs, h)
+		}
+		headers <- hs
+	}()
+
+	var paths []string
+	extractor := &tar.Extractor{
+		Path:     fpath,
+		Progress: bar.Add64,
+		SanitizePathFunc: func(p string) (string, error) {
+			// the default behavior, recording the path of every entry
+			p = filepath.FromSlash(p)
+			paths = append(paths, p)
+			return p, nil
+		},
+	}
+	rootExists := false
+	if _, err := os.Stat(fpath); err == nil {
+		rootExists = true
+	}
+	err := extractor.Extract(io.TeeReader(r, pw))
+	pw.Close()
+	hs := <-headers
+	if err != nil || len(paths) == 0 {
+		// nothing extracted when writing to the null device
+		return err
+	}
+	return gw.restoreMetadata(hs, paths, rootExists)
+}
+
+// restoreMetadata applies the UnixFS metadata of the extracted entries. It
+// comes from the node, which may not be trusted, so only the permission bits
+// of the modes are applied.
+func (gw *getWriter) restoreMetadata(headers []*archivetar.Header, paths []string, rootExists bool) error {
+	if len(headers) != len(paths) {
+		return fmt.Errorf("extracted %d entries out of %d", len(paths), len(headers))
+	}
+	// children first, creating them updates the mtime of their directory
+	for i := len(headers) - 1; i >= 0; i-- {
+		h, p := headers[i], paths[i]
+		if h.Typeflag == archivetar.TypeSymlink {
+			continue
+		}
+		md := coreunix.TarHeaderMetadata(h)
+		if md.IsZero() {
+			continue
+		}
+		if i == 0 && rootExists && h.Typeflag == archivetar.TypeReg {
+			// a single file saved into an existing directory
+			if st, err := os.Stat(p); err == nil && st.IsDir() {
+				p = filepath.Join(p, gopath.Base(h.Name))
+			}
+		}
+		if gw.PreserveMode && md.Mode != 0 {
+			if err := os.Chmod(p, md.Mode&os.ModePerm); err != nil {
+				return err
+			}
+		}
+		if gw.PreserveMtime && !md.Mtime.IsZero() {
+			if err := os.Chtimes(p, md.Mtime, md.Mtime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func getCompressOptions(req *cmds.Request) (int, error) {
@@ -262,7 +376,7 @@ func (i *identityWriteCloser) Close() error {
 	return nil
 }
 
-func fileArchive(f files.Node, name string, archive bool, compression int) (io.Reader, error) {
+func fileArchive(f files.Node, nd ipld.Node, newTarWriter func(io.Writer) *coreunix.TarWriter, name string, archive bool, compression int) (io.Reader, error) {
 	cleaned := gopath.Clean(name)
 	_, filename := gopath.Split(cleaned)
 
@@ -312,14 +426,11 @@ func fileArchive(f files.Node, name string, archive bool, compression int) (io.R
 		// the case for 1. archive, and 2. not archived and not compressed, in which tar is used anyway as a transport format
 
 		// construct the tar writer
-		w, err := files.NewTarWriter(maybeGzw)
-		if checkErrAndClosePipe(err) {
-			return nil, err
-		}
+		w := newTarWriter(maybeGzw)
 
 		go func() {
 			// write all the nodes recursively
-			if err := w.WriteFile(f, filename); checkErrAndClosePipe(err) {
+			if err := w.WriteNode(nd, filename); checkErrAndClosePipe(err) {
 				return
 			}
 			w.Close()         // close tar writer
@@ -1,9 +1,16 @@
 package commands
 
 import (
+	archivetar "archive/tar"
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/ipfs/go-ipfs/core/coreunix"
 
 	cmds "github.com/ipfs/go-ipfs-cmds"
 )
@@ -66,3 +73,50 @@ func TestGetOutputPath(t *testing.T) {
 		})
 	}
 }
+
+func TestGetRestoreMetadata(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(p, []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1600000000, 0)
+	h := &archivetar.Header{
+		Typeflag: archivetar.TypeReg,
+		Name:     "file",
+		Mode:     04755,
+		ModTime:  mtime,
+		PAXRecords: map[string]string{
+			coreunix.TarModeRecord:  "4755",
+			coreunix.TarMtimeRecord: "1600000000",
+		},
+	}
+
+	// nothing is restored unless asked for
+	gw := &getWriter{}
+	if err := gw.restoreMetadata([]*archivetar.Header{h}, []string{p}, false); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode() != 0600 || st.ModTime().Equal(mtime) {
+		t.Fatalf("expected the metadata to be left alone, got %s %s", st.Mode(), st.ModTime())
+	}
+
+	gw = &getWriter{PreserveMode: true, PreserveMtime: true}
+	if err := gw.restoreMetadata([]*archivetar.Header{h}, []string{p}, false); err != nil {
+		t.Fatal(err)
+	}
+	st, err = os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode() != 0755 {
+		t.Errorf("expected the permission bits only, got %s", st.Mode())
+	}
+	if !st.ModTime().Equal(mtime) {
+		t.Errorf("expected the mtime to be restored, got %s", st.ModTime())
+	}
+}
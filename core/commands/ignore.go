@@ -0,0 +1,252 @@
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"strings"
+
+	ignore "github.com/crackcomm/go-gitignore"
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// Names of the files holding .gitignore-style rules for the directory they
+// are in.
+const (
+	ipfsIgnoreFileName = ".ipfsignore"
+	gitIgnoreFileName  = ".gitignore"
+)
+
+// filterIgnored makes recursive adds also skip the files matching the rules
+// of the ignore files found in the added directories. As in .gitignore
+// files, the rules are matched against the paths relative to the directory
+// of the file declaring them, those of the files below coming last. It runs
+// client side, so that ignored files are never sent to the daemon.
+func filterIgnored(req *cmds.Request) error {
+	recursive, _ := req.Options[cmds.RecLong].(bool)
+	if req.Files == nil || !recursive {
+		return nil
+	}
+
+	names := []string{ipfsIgnoreFileName}
+	if gitignore, _ := req.Options[gitignoreOptionName].(bool); gitignore {
+		names = append(names, gitIgnoreFileName)
+	}
+
+	entries := make(map[string]files.Node)
+	it := req.Files.Entries()
+	for it.Next() {
+		nd := it.Node()
+		if dir, ok := nd.(files.Directory); ok {
+			if _, ok := dir.(*ignoreDirectory); ok {
+				// PreRun runs twice when falling back to the local node
+				return nil
+			}
+			if p := localDirPath(dir); p != "" {
+				var err error
+				nd, err = wrapIgnored(dir, p, "", names, nil)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		entries[it.Name()] = nd
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+	req.Files = files.NewMapDirectory(entries)
+	return nil
+}
+
+// wrapIgnored returns dir, read from the local path, at rel below the added
+// directory, without the entries matching the rules of its ignore files,
+// named names, or the given rules of the ignore files of its parents.
+func wrapIgnored(dir files.Directory, path string, rel string, names []string, rules []ignoreRule) (*ignoreDirectory, error) {
+	// copy, the slice is shared with the siblings
+	rules = rules[:len(rules):len(rules)]
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(path, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if r, ok := parseIgnoreRule(rel, line); ok {
+				rules = append(rules, r)
+			}
+		}
+	}
+	return &ignoreDirectory{Directory: dir, path: path, rel: rel, names: names, rules: rules}, nil
+}
+
+// ignoreRule is a rule of an ignore file, matched against the paths relative
+// to dir, the directory of the file.
+type ignoreRule struct {
+	dir     string
+	pattern *ignore.GitIgnore
+	negate  bool
+}
+
+// parseIgnoreRule parses a line of the ignore file of the directory dir.
+func parseIgnoreRule(dir string, line string) (ignoreRule, bool) {
+	line = strings.TrimSpace(strings.TrimRight(line, "\r"))
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	negate := strings.HasPrefix(line, "!")
+	if negate {
+		line = line[1:]
+	}
+	// patterns with a slash before the end are relative to dir, the
+	// matcher only anchors those starting with one
+	if strings.Contains(strings.TrimSuffix(line, "/"), "/") && !strings.HasPrefix(line, "/") && !strings.HasPrefix(line, "**/") {
+		line = "/" + line
+	}
+	pattern, err := ignore.CompileIgnoreLines(line)
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	return ignoreRule{dir: dir, pattern: pattern, negate: negate}, true
+}
+
+// matches returns whether the rule matches the entry at path, relative to
+// the added directory.
+func (r ignoreRule) matches(path string, isDir bool) bool {
+	if r.dir != "" {
+		if !strings.HasPrefix(path, r.dir+"/") {
+			return false
+		}
+		path = path[len(r.dir)+1:]
+	}
+	// patterns ending with a slash only match directories
+	return r.pattern.MatchesPath(path) || isDir && r.pattern.MatchesPath(path+"/")
+}
+
+type ignoreDirectory struct {
+	files.Directory
+
+	path  string
+	rel   string
+	names []string
+	rules []ignoreRule
+}
+
+func (d *ignoreDirectory) Entries() files.DirIterator {
+	return &ignoreIterator{DirIterator: d.Directory.Entries(), dir: d}
+}
+
+// Stat returns the file information of the wrapped directory.
+func (d *ignoreDirectory) Stat() os.FileInfo {
+	return statOf(d.Directory)
+}
+
+// ignored returns whether the entry name is ignored, the last rule matching
+// it deciding.
+func (d *ignoreDirectory) ignored(name string, isDir bool) bool {
+	path := gopath.Join(d.rel, name)
+	ignored := false
+	for _, r := range d.rules {
+		if r.matches(path, isDir) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+type ignoreIterator struct {
+	files.DirIterator
+
+	dir  *ignoreDirectory
+	node files.Node
+	err  error
+}
+
+func (it *ignoreIterator) Next() bool {
+	for it.DirIterator.Next() {
+		name := it.DirIterator.Name()
+		nd := it.DirIterator.Node()
+		dir, isDir := nd.(files.Directory)
+		if it.dir.ignored(name, isDir) {
+			nd.Close()
+			continue
+		}
+		if isDir {
+			sub, err := wrapIgnored(dir, filepath.Join(it.dir.path, name), gopath.Join(it.dir.rel, name), it.dir.names, it.dir.rules)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			nd = sub
+		}
+		it.node = nd
+		return true
+	}
+	return false
+}
+
+func (it *ignoreIterator) Node() files.Node {
+	return it.node
+}
+
+func (it *ignoreIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.DirIterator.Err()
+}
+
+// statOf returns the file information of nd, if it has any.
+func statOf(nd files.Node) os.FileInfo {
+	if s, ok := nd.(interface{ Stat() os.FileInfo }); ok {
+		return s.Stat()
+	}
+	return nil
+}
+
+// localDirPath returns the local path of a directory read from the
+// filesystem, or "" if it isn't. Only the files know theirs, so it's found
+// from the first file below it, and checked to be the directory.
+func localDirPath(dir files.Directory) string {
+	st := statOf(dir)
+	if st == nil {
+		return ""
+	}
+	abs, rel := firstFilePath(dir, "")
+	if abs == "" {
+		return ""
+	}
+	p := abs
+	for i := strings.Count(rel, "/") + 1; i > 0; i-- {
+		p = filepath.Dir(p)
+	}
+	if pst, err := os.Stat(p); err != nil || !os.SameFile(pst, st) {
+		return ""
+	}
+	return p
+}
+
+// firstFilePath returns the absolute path of the first file found below
+// dir, and its path relative to dir, if any.
+func firstFilePath(dir files.Directory, rel string) (string, string) {
+	it := dir.Entries()
+	for it.Next() {
+		p := gopath.Join(rel, it.Name())
+		var abs string
+		switch nd := it.Node().(type) {
+		case files.FileInfo:
+			abs = nd.AbsPath()
+		case files.Directory:
+			abs, p = firstFilePath(nd, p)
+		}
+		it.Node().Close()
+		if abs != "" {
+			return abs, p
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,133 @@
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+func TestFilterIgnored(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "project")
+	for name, data := range map[string]string{
+		".ipfsignore":             "node_modules/\n*.log\n/build\nsrc/gen/*.js\n",
+		".gitignore":              "secret\n",
+		"main.go":                 "",
+		"debug.log":               "",
+		"secret":                  "",
+		"node_modules/dep/dep.js": "",
+		"build/out":               "",
+		"docs/.ipfsignore":        "drafts/\n!keep.log\n/old.md\n",
+		"docs/old.md":             "",
+		"docs/sub/old.md":         "",
+		"docs/index.md":           "",
+		"docs/keep.log":           "",
+		"docs/drafts/wip.md":      "",
+		"docs/sub/drafts/ok.md":   "",
+		"docs/other/drafts":       "",
+		"lib/.ipfsignore":         "*.tmp\n",
+		"lib/sub/x.tmp":           "",
+		"lib/sub/y.go":            "",
+		"src/build/gen.go":        "",
+		"src/gen/a.js":            "",
+		"src/gen/sub/b.js":        "",
+		"lib/src/gen/c.js":        "",
+	} {
+		fpath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fpath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(options cmds.OptMap) []string {
+		st, err := os.Stat(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// as the command line parser does
+		rules, _ := options[cmds.Ignore].([]string)
+		filter, err := files.NewFilter("", rules, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sf, err := files.NewSerialFileWithFilter(root, filter, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options[cmds.RecLong] = true
+		req := &cmds.Request{
+			Options: options,
+			Files:   files.NewMapDirectory(map[string]files.Node{"project": sf}),
+		}
+		for i := 0; i < 2; i++ {
+			if err := filterIgnored(req); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var out []string
+		var walk func(dir files.Directory, p string)
+		walk = func(dir files.Directory, p string) {
+			it := dir.Entries()
+			for it.Next() {
+				name := gopath.Join(p, it.Name())
+				if sub, ok := it.Node().(files.Directory); ok {
+					walk(sub, name)
+					continue
+				}
+				out = append(out, name)
+				it.Node().Close()
+			}
+			if it.Err() != nil {
+				t.Fatal(it.Err())
+			}
+		}
+		walk(req.Files, "")
+		sort.Strings(out)
+		return out
+	}
+
+	for _, test := range []struct {
+		options cmds.OptMap
+		files   []string
+	}{
+		// anchored patterns and those with a slash only match relative
+		// to the directory of their ignore file
+		{cmds.OptMap{}, []string{
+			"project/docs/index.md",
+			"project/docs/keep.log",
+			"project/docs/other/drafts",
+			"project/docs/sub/old.md",
+			"project/lib/src/gen/c.js",
+			"project/lib/sub/y.go",
+			"project/main.go",
+			"project/secret",
+			"project/src/build/gen.go",
+			"project/src/gen/sub/b.js",
+		}},
+		{cmds.OptMap{gitignoreOptionName: true, cmds.Ignore: []string{"build"}}, []string{
+			"project/docs/index.md",
+			"project/docs/keep.log",
+			"project/docs/other/drafts",
+			"project/docs/sub/old.md",
+			"project/lib/src/gen/c.js",
+			"project/lib/sub/y.go",
+			"project/main.go",
+			"project/src/gen/sub/b.js",
+		}},
+	} {
+		if got := list(test.options); strings.Join(got, "\n") != strings.Join(test.files, "\n") {
+			t.Errorf("with %v got:\n%s\nexpected:\n%s", test.options,
+				strings.Join(got, "\n"), strings.Join(test.files, "\n"))
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package commands
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	version "github.com/ipfs/go-ipfs"
+
+	cid "github.com/ipfs/go-cid"
+	cmds "github.com/ipfs/go-ipfs-cmds"
+)
+
+// openAPIVersion is the version of the OpenAPI specification followed by
+// openAPIDocument.
+const openAPIVersion = "3.0.3"
+
+// clientOptions are the options of the root command only used by the
+// command line client, which the HTTP API ignores.
+var clientOptions = map[string]bool{
+	ConfigOption:      true,
+	DebugOption:       true,
+	ApiOption:         true,
+	cmds.OptLongHelp:  true,
+	cmds.OptShortHelp: true,
+}
+
+type openAPIDocument struct {
+	OpenAPI    string                     `json:"openapi"`
+	Info       openAPIInfo                `json:"info"`
+	Paths      map[string]openAPIPathItem `json:"paths"`
+	Components openAPIComponents          `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIPathItem struct {
+	Post *openAPIOperation `json:"post"`
+}
+
+type openAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	Summary     string                     `json:"summary,omitempty"`
+	Description string                     `json:"description,omitempty"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Parameters  []*openAPIParameter        `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Ref         string         `json:"$ref,omitempty"`
+	Name        string         `json:"name,omitempty"`
+	In          string         `json:"in,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema,omitempty"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required,omitempty"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPIComponents struct {
+	Parameters map[string]*openAPIParameter `json:"parameters"`
+	Schemas    map[string]*openAPISchema    `json:"schemas"`
+}
+
+// openAPISchema is the subset of JSON Schema used to describe the
+// arguments, options and outputs of commands.
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	Default              interface{}               `json:"default,omitempty"`
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	timeType          = reflect.TypeOf(time.Time{})
+	cidType           = reflect.TypeOf(cid.Cid{})
+)
+
+// openAPIGenerator builds the OpenAPI document of a command tree.
+type openAPIGenerator struct {
+	doc *openAPIDocument
+
+	// names of the schemas of named types in doc.Components.Schemas
+	schemaNames map[reflect.Type]string
+}
+
+// newOpenAPIDocument describes the HTTP API of the commands under root.
+func newOpenAPIDocument(root *cmds.Command) *openAPIDocument {
+	g := &openAPIGenerator{
+		doc: &openAPIDocument{
+			OpenAPI: openAPIVersion,
+			Info: openAPIInfo{
+				Title:   "IPFS HTTP RPC API",
+				Version: version.CurrentVersionNumber,
+			},
+			Paths: map[string]openAPIPathItem{},
+			Components: openAPIComponents{
+				Parameters: map[string]*openAPIParameter{},
+				Schemas: map[string]*openAPISchema{
+					"Error": {
+						Type: "object",
+						Properties: map[string]*openAPISchema{
+							"Message": {Type: "string"},
+							"Code":    {Type: "integer"},
+							"Type":    {Type: "string"},
+						},
+					},
+				},
+			},
+		},
+		schemaNames: map[reflect.Type]string{},
+	}
+
+	var global []*openAPIParameter
+	for _, opt := range root.Options {
+		if clientOptions[opt.Name()] {
+			continue
+		}
+		g.doc.Components.Parameters[opt.Name()] = optionParameter(opt)
+		global = append(global, &openAPIParameter{Ref: "#/components/parameters/" + opt.Name()})
+	}
+
+	g.addCommands(nil, root, global)
+	return g.doc
+}
+
+func (g *openAPIGenerator) addCommands(cmdPath []string, cmd *cmds.Command, inherited []*openAPIParameter) {
+	if len(cmdPath) > 0 {
+		params := make([]*openAPIParameter, 0, len(inherited)+len(cmd.Options))
+		own := map[string]bool{}
+		for _, opt := range cmd.Options {
+			own[opt.Name()] = true
+		}
+		for _, p := range inherited {
+			// options of a command shadow those of its parents
+			if !own[p.Name] && !own[strings.TrimPrefix(p.Ref, "#/components/parameters/")] {
+				params = append(params, p)
+			}
+		}
+		for _, opt := range cmd.Options {
+			params = append(params, optionParameter(opt))
+		}
+		if cmd.Run != nil && !cmd.NoRemote {
+			g.addOperation(cmdPath, cmd, params)
+		}
+		// options of a command apply to its subcommands too
+		inherited = params
+	}
+
+	names := make([]string, 0, len(cmd.Subcommands))
+	for name := range cmd.Subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub := append(append([]string{}, cmdPath...), name)
+		g.addCommands(sub, cmd.Subcommands[name], inherited)
+	}
+}
+
+func (g *openAPIGenerator) addOperation(cmdPath []string, cmd *cmds.Command, params []*openAPIParameter) {
+	op := &openAPIOperation{
+		OperationID: operationID(cmdPath),
+		Summary:     cmd.Helptext.Tagline,
+		Description: strings.TrimSpace(cmd.Helptext.ShortDescription),
+		Tags:        []string{cmdPath[0]},
+		Responses: map[string]openAPIResponse{
+			"200": {Description: "Success"},
+			"500": {
+				Description: "Failure",
+				Content: map[string]openAPIMediaType{
+					"application/json": {Schema: &openAPISchema{Ref: "#/components/schemas/Error"}},
+				},
+			},
+		},
+	}
+
+	var (
+		stringArgs []string
+		required   bool
+		variadic   bool
+		files      []cmds.Argument
+	)
+	for _, arg := range cmd.Arguments {
+		if arg.Type == cmds.ArgFile {
+			files = append(files, arg)
+			continue
+		}
+		desc := arg.Name
+		if arg.Description != "" {
+			desc += ": " + arg.Description
+		}
+		stringArgs = append(stringArgs, desc)
+		required = required || arg.Required
+		variadic = variadic || arg.Variadic
+	}
+	if len(stringArgs) > 0 {
+		schema := &openAPISchema{Type: "string"}
+		if variadic || len(stringArgs) > 1 {
+			schema = &openAPISchema{Type: "array", Items: schema}
+		}
+		op.Parameters = append(op.Parameters, &openAPIParameter{
+			Name:        "arg",
+			In:          "query",
+			Description: "Arguments, in order: " + strings.Join(stringArgs, "; "),
+			Required:    required,
+			Schema:      schema,
+		})
+	}
+	op.Parameters = append(op.Parameters, params...)
+
+	if len(files) > 0 {
+		// files are sent as a multipart body, whatever their name
+		file := &openAPISchema{Type: "string", Format: "binary"}
+		required := false
+		var desc []string
+		for _, arg := range files {
+			required = required || arg.Required
+			if arg.Variadic {
+				file = &openAPISchema{Type: "array", Items: &openAPISchema{Type: "string", Format: "binary"}}
+			}
+			desc = append(desc, arg.Name+": "+arg.Description)
+		}
+		file.Description = strings.Join(desc, "; ")
+		op.RequestBody = &openAPIRequestBody{
+			Required: required,
+			Content: map[string]openAPIMediaType{
+				"multipart/form-data": {Schema: &openAPISchema{
+					Type:       "object",
+					Properties: map[string]*openAPISchema{"file": file},
+				}},
+			},
+		}
+	}
+
+	if cmd.Type != nil {
+		op.Responses["200"] = openAPIResponse{
+			Description: "Success, values may be streamed one after another",
+			Content: map[string]openAPIMediaType{
+				"application/json": {Schema: g.schema(reflect.TypeOf(cmd.Type))},
+			},
+		}
+	}
+
+	g.doc.Paths["/api/v0/"+strings.Join(cmdPath, "/")] = openAPIPathItem{Post: op}
+}
+
+// operationID turns a command path into a camel cased identifier, e.g.
+// "objectPatchSetData" for object/patch/set-data.
+func operationID(cmdPath []string) string {
+	var b strings.Builder
+	for i, name := range cmdPath {
+		for j, part := range strings.Split(name, "-") {
+			if part == "" {
+				continue
+			}
+			if i > 0 || j > 0 {
+				part = strings.ToUpper(part[:1]) + part[1:]
+			}
+			b.WriteString(part)
+		}
+	}
+	return b.String()
+}
+
+func optionParameter(opt cmds.Option) *openAPIParameter {
+	schema := kindSchema(opt.Type())
+	if schema == nil {
+		schema = &openAPISchema{Type: "string"}
+	}
+	schema.Default = opt.Default()
+
+	desc := opt.Description()
+	if names := opt.Names(); len(names) > 1 {
+		desc += fmt.Sprintf(" (aliases: %s)", strings.Join(names[1:], ", "))
+	}
+	return &openAPIParameter{
+		Name:        opt.Name(),
+		In:          "query",
+		Description: desc,
+		Schema:      schema,
+	}
+}
+
+// kindSchema returns the schema of basic kinds, or nil.
+func kindSchema(k reflect.Kind) *openAPISchema {
+	switch k {
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &openAPISchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice:
+		// StringsOption
+		return &openAPISchema{Type: "array", Items: &openAPISchema{Type: "string"}}
+	}
+	return nil
+}
+
+// schema reflects the JSON encoding of values of type t. Named structs are
+// described once in the components of the document and referenced.
+func (g *openAPIGenerator) schema(t reflect.Type) *openAPISchema {
+	if t.Kind() == reflect.Ptr {
+		s := g.schema(t.Elem())
+		if s.Ref == "" {
+			s.Nullable = true
+		}
+		return s
+	}
+
+	switch {
+	case t == timeType:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	case t == cidType:
+		return &openAPISchema{
+			Type:       "object",
+			Properties: map[string]*openAPISchema{"/": {Type: "string"}},
+		}
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType):
+		// custom encoding, anything goes
+		return &openAPISchema{}
+	case t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType):
+		return &openAPISchema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		return &openAPISchema{}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &openAPISchema{Type: "string", Format: "byte"}
+		}
+		return &openAPISchema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.structSchema(t)
+	}
+	if s := kindSchema(t.Kind()); s != nil {
+		return s
+	}
+	return &openAPISchema{}
+}
+
+func (g *openAPIGenerator) structSchema(t reflect.Type) *openAPISchema {
+	if t.Name() == "" {
+		return g.structProperties(t)
+	}
+
+	name, ok := g.schemaNames[t]
+	if !ok {
+		name = path.Base(t.PkgPath()) + "." + t.Name()
+		for i := 2; g.doc.Components.Schemas[name] != nil; i++ {
+			name = fmt.Sprintf("%s.%s%d", path.Base(t.PkgPath()), t.Name(), i)
+		}
+		g.schemaNames[t] = name
+		// reserve the name first, the type may be recursive
+		g.doc.Components.Schemas[name] = &openAPISchema{}
+		*g.doc.Components.Schemas[name] = *g.structProperties(t)
+	}
+	return &openAPISchema{Ref: "#/components/schemas/" + name}
+}
+
+func (g *openAPIGenerator) structProperties(t reflect.Type) *openAPISchema {
+	s := &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				// fields of embedded structs are inlined
+				for k, v := range g.structProperties(ft).Properties {
+					s.Properties[k] = v
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = g.schema(f.Type)
+	}
+	return s
+}
@@ -0,0 +1,64 @@
+package commands
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	doc := newOpenAPIDocument(Root)
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatal(err)
+	}
+
+	for p, item := range doc.Paths {
+		seen := map[string]bool{}
+		for _, param := range item.Post.Parameters {
+			name := param.Name + strings.TrimPrefix(param.Ref, "#/components/parameters/")
+			if seen[name] {
+				t.Errorf("%s: duplicate parameter %s", p, name)
+			}
+			seen[name] = true
+			if param.Ref != "" && doc.Components.Parameters[name] == nil {
+				t.Errorf("%s: dangling parameter reference %s", p, param.Ref)
+			}
+		}
+	}
+
+	pinAdd, ok := doc.Paths["/api/v0/pin/add"]
+	if !ok {
+		t.Fatal("missing pin/add")
+	}
+	if pinAdd.Post.OperationID != "pinAdd" {
+		t.Errorf("unexpected operation ID %q", pinAdd.Post.OperationID)
+	}
+	params := map[string]*openAPIParameter{}
+	for _, param := range pinAdd.Post.Parameters {
+		params[param.Name] = param
+	}
+	if arg := params["arg"]; arg == nil || !arg.Required || arg.Schema.Type != "array" {
+		t.Errorf("unexpected arg parameter %+v", arg)
+	}
+	if rec := params["recursive"]; rec == nil || rec.Schema.Type != "boolean" || rec.Schema.Default != true {
+		t.Errorf("unexpected recursive parameter %+v", rec)
+	}
+
+	ref := pinAdd.Post.Responses["200"].Content["application/json"].Schema.Ref
+	out := doc.Components.Schemas[strings.TrimPrefix(ref, "#/components/schemas/")]
+	if out == nil || out.Properties["Pins"] == nil || out.Properties["Pins"].Type != "array" {
+		t.Errorf("unexpected pin/add output schema %q: %+v", ref, out)
+	}
+
+	add := doc.Paths["/api/v0/add"].Post
+	if add.RequestBody == nil || add.RequestBody.Content["multipart/form-data"].Schema == nil {
+		t.Error("add should take files in a multipart body")
+	}
+
+	if _, ok := doc.Paths["/api/v0/object/patch/set-data"]; !ok {
+		t.Error("missing object/patch/set-data")
+	}
+	if id := operationID([]string{"object", "patch", "set-data"}); id != "objectPatchSetData" {
+		t.Errorf("unexpected operation ID %q", id)
+	}
+}
@@ -82,6 +82,11 @@ environment variable:
 
   export IPFS_PATH=/path/to/ipfsrepo
 
+If the daemon's API requires credentials (see API.Authorizations in the
+config), set them in the $IPFS_API_AUTH environment variable:
+
+  export IPFS_API_AUTH=bearer:<token>
+
 EXIT STATUS
 
 The CLI will exit with one of the following values:
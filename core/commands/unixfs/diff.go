@@ -0,0 +1,151 @@
+package unixfs
+
+import (
+	"fmt"
+	"io"
+
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	"github.com/ipfs/go-ipfs/core/coreunix"
+
+	"github.com/dustin/go-humanize"
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	path "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+const (
+	diffSizesOptionName = "sizes"
+)
+
+// DiffOutput is a change between two directory trees.
+type DiffOutput struct {
+	Type string
+	Path string
+	From string `json:",omitempty"`
+
+	Before string `json:",omitempty"`
+	After  string `json:",omitempty"`
+
+	BeforeSize uint64 `json:",omitempty"`
+	AfterSize  uint64 `json:",omitempty"`
+}
+
+var DiffCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Show the changes between two Unix filesystem trees.",
+		ShortDescription: `
+Compares two directory trees, descending into the directories which differ,
+and lists the paths added, removed, modified and moved from the first to the
+second.
+`,
+		LongDescription: `
+Compares two directory trees, descending into the directories which differ,
+and lists the paths added, removed, modified and moved from the first to the
+second. Identical subtrees are skipped without being fetched.
+
+Each line starts with the kind of change:
+
+    +  added
+    -  removed
+    ~  modified
+    >  moved, with the old path before the new one
+
+Directories only present in one tree are listed as a whole. Paths removed
+and added elsewhere with the same CID are reported as moved. The modified
+paths are listed as they are found, the added, removed and moved ones once
+both trees are walked, to be paired.
+
+With --sizes, the cumulative sizes of the DAGs of the changed entries are
+shown as well, as recorded in the links to them. They count the blocks and
+their encoding, not only the contents of the files. Use --enc=json for the
+CIDs and sizes of every change.
+
+Example:
+
+    > ipfs file diff QmOld QmNew
+    ~ data/2020.csv
+    > README README.md
+    + data/2021.csv
+`,
+	},
+
+	Arguments: []cmds.Argument{
+		cmds.StringArg("old", true, false, "Path to the tree to compare against."),
+		cmds.StringArg("new", true, false, "Path to the tree to compare."),
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(diffSizesOptionName, "s", "Show the cumulative DAG sizes of the changed entries."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		api, err := cmdenv.GetApi(env, req)
+		if err != nil {
+			return err
+		}
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		a, err := api.ResolveNode(req.Context, path.New(req.Arguments[0]))
+		if err != nil {
+			return err
+		}
+		b, err := api.ResolveNode(req.Context, path.New(req.Arguments[1]))
+		if err != nil {
+			return err
+		}
+
+		sizes, _ := req.Options[diffSizesOptionName].(bool)
+		return coreunix.Diff(req.Context, api.Dag(), a, b, func(c coreunix.DiffEntry) error {
+			out := &DiffOutput{
+				Type: string(c.Type),
+				Path: c.Path,
+				From: c.From,
+			}
+			if c.Before.Defined() {
+				out.Before = enc.Encode(c.Before)
+			}
+			if c.After.Defined() {
+				out.After = enc.Encode(c.After)
+			}
+			if sizes {
+				out.BeforeSize = c.BeforeSize
+				out.AfterSize = c.AfterSize
+			}
+			return res.Emit(out)
+		})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *DiffOutput) error {
+			sizes, _ := req.Options[diffSizesOptionName].(bool)
+
+			var line string
+			switch coreunix.DiffType(out.Type) {
+			case coreunix.DiffAdded:
+				line = "+ " + cmdenv.EscNonPrint(out.Path)
+				if sizes {
+					line += fmt.Sprintf(" (%s)", humanize.IBytes(out.AfterSize))
+				}
+			case coreunix.DiffRemoved:
+				line = "- " + cmdenv.EscNonPrint(out.Path)
+				if sizes {
+					line += fmt.Sprintf(" (%s)", humanize.IBytes(out.BeforeSize))
+				}
+			case coreunix.DiffModified:
+				line = "~ " + cmdenv.EscNonPrint(out.Path)
+				if sizes {
+					line += fmt.Sprintf(" (%s -> %s)", humanize.IBytes(out.BeforeSize), humanize.IBytes(out.AfterSize))
+				}
+			case coreunix.DiffMoved:
+				line = "> " + cmdenv.EscNonPrint(out.From) + " " + cmdenv.EscNonPrint(out.Path)
+				if sizes {
+					line += fmt.Sprintf(" (%s)", humanize.IBytes(out.AfterSize))
+				}
+			default:
+				return fmt.Errorf("unknown change type %q", out.Type)
+			}
+			_, err := fmt.Fprintln(w, line)
+			return err
+		}),
+	},
+	Type: DiffOutput{},
+}
@@ -20,6 +20,7 @@ objects (e.g. fanout and chunking).
 	},
 
 	Subcommands: map[string]*cmds.Command{
-		"ls": LsCmd,
+		"ls":   LsCmd,
+		"diff": DiffCmd,
 	},
 }
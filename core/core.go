@@ -42,6 +42,7 @@ import (
 	ma "github.com/multiformats/go-multiaddr"
 
 	"github.com/ipfs/go-ipfs/core/bootstrap"
+	"github.com/ipfs/go-ipfs/core/denylist"
 	"github.com/ipfs/go-ipfs/core/node"
 	"github.com/ipfs/go-ipfs/core/node/libp2p"
 	"github.com/ipfs/go-ipfs/fuse/mount"
@@ -81,6 +82,9 @@ type IpfsNode struct {
 	Discovery       discovery.Service         `optional:"true"`
 	FilesRoot       *mfs.Root
 	RecordValidator record.Validator
+	Denylist        *denylist.Denylist `optional:"true"` // content refused by the gateway, if any
+	// size past which the UnixFS directories are sharded
+	ShardingThreshold node.ShardingThreshold
 
 	// Online
 	PeerHost      p2phost.Host            `optional:"true"` // the network host (server+client)
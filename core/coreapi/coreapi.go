@@ -69,6 +69,8 @@ type CoreAPI struct {
 
 	pubSub *pubsub.PubSub
 
+	shardingThreshold node.ShardingThreshold
+
 	checkPublishAllowed func() error
 	checkOnline         func(allowOffline bool) error
 
@@ -179,6 +181,8 @@ func (api *CoreAPI) WithOptions(opts ...options.ApiOption) (coreiface.CoreAPI, e
 
 		pubSub: n.PubSub,
 
+		shardingThreshold: n.ShardingThreshold,
+
 		nd:         n,
 		parentOpts: settings,
 	}
@@ -55,6 +55,11 @@ func getOrCreateNilNode() (*core.IpfsNode, error) {
 // Add builds a merkledag node from a reader, adds it to the blockstore,
 // and returns the key representing that node.
 func (api *UnixfsAPI) Add(ctx context.Context, files files.Node, opts ...options.UnixfsAddOption) (path.Resolved, error) {
+	return api.AddWithAdderOptions(ctx, files, coreunix.AdderOptions{}, opts...)
+}
+
+// AddWithAdderOptions is Add, applying the adder settings of extra too.
+func (api *UnixfsAPI) AddWithAdderOptions(ctx context.Context, files files.Node, extra coreunix.AdderOptions, opts ...options.UnixfsAddOption) (path.Resolved, error) {
 	settings, prefix, err := options.UnixfsAddOptions(opts...)
 	if err != nil {
 		return nil, err
@@ -134,6 +139,15 @@ func (api *UnixfsAPI) Add(ctx context.Context, files files.Node, opts ...options
 	fileAdder.RawLeaves = settings.RawLeaves
 	fileAdder.NoCopy = settings.NoCopy
 	fileAdder.CidBuilder = prefix
+	fileAdder.ShardingThreshold = int(api.shardingThreshold)
+
+	fileAdder.PreserveMode = extra.PreserveMode
+	fileAdder.PreserveMtime = extra.PreserveMtime
+	fileAdder.Metadata = extra.Metadata
+	fileAdder.Workers = extra.Workers
+	if extra.Resume && !settings.OnlyHash {
+		fileAdder.Checkpoints = coreunix.NewCheckpoints(api.repo.Datastore(), addblockstore)
+	}
 
 	switch settings.Layout {
 	case options.BalancedLayout:
@@ -0,0 +1,62 @@
+package coredag
+
+import (
+	"bytes"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ipldcbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// DagJSON is the multicodec of dag-json blocks, which go-cid has no name for.
+const DagJSON = 0x0129
+
+func init() {
+	ipld.Register(DagJSON, DecodeDagJSONBlock)
+}
+
+// DagJSONNode is a dag-json block, resolved through the dag-cbor node
+// holding the same data. It keeps the CID and bytes of the block.
+type DagJSONNode struct {
+	*ipldcbor.Node
+	block blocks.Block
+}
+
+// DecodeDagJSONBlock decodes a dag-json block, whose links are encoded as
+// {"/": "<cid>"}, into a node paths can be resolved through.
+func DecodeDagJSONBlock(b blocks.Block) (ipld.Node, error) {
+	nd, err := ipldcbor.FromJSON(bytes.NewReader(b.RawData()), mh.SHA2_256, -1)
+	if err != nil {
+		return nil, err
+	}
+	return &DagJSONNode{Node: nd, block: b}, nil
+}
+
+func (n *DagJSONNode) Cid() cid.Cid {
+	return n.block.Cid()
+}
+
+func (n *DagJSONNode) RawData() []byte {
+	return n.block.RawData()
+}
+
+func (n *DagJSONNode) String() string {
+	return n.block.Cid().String()
+}
+
+func (n *DagJSONNode) Loggable() map[string]interface{} {
+	return map[string]interface{}{
+		"node_type": "dag-json",
+		"cid":       n.Cid(),
+	}
+}
+
+func (n *DagJSONNode) Copy() ipld.Node {
+	return &DagJSONNode{Node: n.Node.Copy().(*ipldcbor.Node), block: n.block}
+}
+
+func (n *DagJSONNode) Size() (uint64, error) {
+	return uint64(len(n.block.RawData())), nil
+}
@@ -0,0 +1,335 @@
+package corehttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	core "github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/jbenet/goprocess"
+)
+
+// Config keys of the access logs of the gateway and API listeners.
+const (
+	GatewayAccessLogConfigKey = "Gateway.AccessLog"
+	APIAccessLogConfigKey     = "API.AccessLog"
+)
+
+// Access log formats.
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+const defaultAccessLogMaxSize = 100 << 20
+
+// AccessLogConfig configures an access log.
+type AccessLogConfig struct {
+	// Path of the log file, relative to the repo root if not absolute.
+	Path string
+
+	// Format is either "combined" (default) or "json".
+	Format string
+
+	// MaxSize is the size in bytes after which the file is rotated, 100MiB
+	// by default. MaxBackups rotated files are kept, none by default.
+	MaxSize    int64
+	MaxBackups int
+}
+
+type accessLogRecordKey struct{}
+
+// accessLogRecord collects what handlers know about a request that the
+// access log can't tell from the response.
+type accessLogRecord struct {
+	mu  sync.Mutex
+	cid cid.Cid
+}
+
+// setAccessLogCid records the CID the request resolved to, if the request is
+// logged.
+func setAccessLogCid(ctx context.Context, c cid.Cid) {
+	if rec, ok := ctx.Value(accessLogRecordKey{}).(*accessLogRecord); ok {
+		rec.mu.Lock()
+		rec.cid = c
+		rec.mu.Unlock()
+	}
+}
+
+// accessLogResponseWriter records the status and size of a response, and
+// when its first byte was written.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status    int
+	bytes     int64
+	firstByte time.Time
+}
+
+func (w *accessLogResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.firstByte = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+		w.firstByte = time.Now()
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streamed responses (e.g. of the commands API) working.
+func (w *accessLogResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// accessLogEntry is a line of the access log.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Host      string    `json:"host"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Cid       string    `json:"cid,omitempty"`
+	IpfsPath  string    `json:"ipfs_path,omitempty"`
+	TTFB      float64   `json:"ttfb_ms"`
+	Duration  float64   `json:"duration_ms"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// writeCombined writes the entry in the Combined Log Format, followed by the
+// CID, X-IPFS-Path, TTFB and duration (in milliseconds).
+func (e *accessLogEntry) writeCombined(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%s - - [%s] %s %d %d %s %s %s %s %.3f %.3f\n",
+		e.Remote,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto),
+		e.Status,
+		e.Bytes,
+		quoteOrDash(e.Referer),
+		quoteOrDash(e.UserAgent),
+		quoteOrDash(e.Cid),
+		quoteOrDash(e.IpfsPath),
+		e.TTFB,
+		e.Duration,
+	)
+	return err
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strconv.Quote(s)
+}
+
+// accessLogger writes access log entries.
+type accessLogger struct {
+	format string
+
+	mu  sync.Mutex
+	out *rotatingFile
+	buf *bufio.Writer
+}
+
+func (l *accessLogger) log(e *accessLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	if l.format == AccessLogJSON {
+		err = json.NewEncoder(l.buf).Encode(e)
+	} else {
+		err = e.writeCombined(l.buf)
+	}
+	if err == nil {
+		err = l.buf.Flush()
+	}
+	if err != nil {
+		log.Errorf("failed to write access log: %s", err)
+	}
+}
+
+func (l *accessLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out.Close()
+}
+
+func (l *accessLogger) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	start := time.Now()
+	rec := &accessLogRecord{}
+	lw := &accessLogResponseWriter{ResponseWriter: w}
+
+	defer func() {
+		end := time.Now()
+		if lw.status == 0 {
+			// nothing written, net/http answers with a 200
+			lw.status = http.StatusOK
+			lw.firstByte = end
+		}
+
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remote = r.RemoteAddr
+		}
+		e := &accessLogEntry{
+			Time:      start,
+			Remote:    remote,
+			Host:      r.Host,
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    lw.status,
+			Bytes:     lw.bytes,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			IpfsPath:  lw.Header().Get("X-IPFS-Path"),
+			TTFB:      milliseconds(lw.firstByte.Sub(start)),
+			Duration:  milliseconds(end.Sub(start)),
+		}
+		rec.mu.Lock()
+		if rec.cid.Defined() {
+			e.Cid = rec.cid.String()
+		}
+		rec.mu.Unlock()
+		l.log(e)
+	}()
+
+	next.ServeHTTP(lw, r.WithContext(context.WithValue(r.Context(), accessLogRecordKey{}, rec)))
+}
+
+// AccessLogOption logs the requests to the following options as configured
+// under the given config key, see GatewayAccessLogConfigKey and
+// APIAccessLogConfigKey.
+func AccessLogOption(configKey string) ServeOption {
+	return func(n *core.IpfsNode, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		var cfg AccessLogConfig
+		if _, err := repo.DecodeConfigKey(n.Repo, configKey, &cfg); err != nil {
+			return nil, err
+		}
+		if cfg.Path == "" {
+			return mux, nil
+		}
+
+		switch cfg.Format {
+		case "":
+			cfg.Format = AccessLogCombined
+		case AccessLogCombined, AccessLogJSON:
+		default:
+			return nil, fmt.Errorf("%s: unknown access log format %q", configKey, cfg.Format)
+		}
+		if cfg.MaxSize <= 0 {
+			cfg.MaxSize = defaultAccessLogMaxSize
+		}
+		if pr, ok := n.Repo.(interface{ Path() string }); ok && !filepath.IsAbs(cfg.Path) {
+			cfg.Path = filepath.Join(pr.Path(), cfg.Path)
+		}
+
+		out, err := openRotatingFile(cfg.Path, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l := &accessLogger{format: cfg.Format, out: out, buf: bufio.NewWriter(out)}
+		if n.Process != nil {
+			n.Process.AddChild(goprocess.WithTeardown(l.Close))
+		}
+
+		childMux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			l.serve(w, r, childMux)
+		})
+		return childMux, nil
+	}
+}
+
+// rotatingFile is an append-only file renamed to <path>.1 (shifting older
+// backups) once it grows over maxSize.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, st.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	if rf.size > 0 && rf.size+int64(len(b)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
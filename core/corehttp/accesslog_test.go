@@ -0,0 +1,119 @@
+package corehttp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+func newTestAccessLogger(t *testing.T, format string) (*accessLogger, string) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	out, err := openRotatingFile(path, defaultAccessLogMaxSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &accessLogger{format: format, out: out, buf: bufio.NewWriter(out)}
+	t.Cleanup(func() { l.Close() })
+	return l, path
+}
+
+func TestAccessLogGateway(t *testing.T) {
+	_, api, ctx := newTestServerAndNode(t, nil)
+	k, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := newGatewayHandler(GatewayConfig{}, api)
+
+	l, path := newTestAccessLogger(t, AccessLogJSON)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.serve(w, r, gw)
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + k.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var e accessLogEntry
+	if err := json.NewDecoder(f).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Method != http.MethodGet || e.URI != k.String() || e.Status != http.StatusOK || e.Bytes != 5 {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if e.Cid != k.Cid().String() || e.IpfsPath != k.String() || e.Remote != "127.0.0.1" {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if e.TTFB < 0 || e.Duration < e.TTFB {
+		t.Fatalf("unexpected timings %+v", e)
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	l, path := newTestAccessLogger(t, AccessLogCombined)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusNotFound)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/ipfs/nope", nil)
+	req.Header.Set("User-Agent", "test")
+	l.serve(httptest.NewRecorder(), req, h)
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile(`^192\.0\.2\.1 - - \[[^\]]+\] "GET /ipfs/nope HTTP/1\.1" 404 5 - "test" - - [0-9.]+ [0-9.]+\n$`)
+	if !re.Match(out) {
+		t.Fatalf("unexpected log line %q", out)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, expected := range map[string]string{
+		path:        "dddddd\n",
+		path + ".1": "cccccc\n",
+		path + ".2": "bbbbbb\n",
+	} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Fatalf("%s: got %q, expected %q", name, b, expected)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("expected only two backups")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -13,11 +14,13 @@ import (
 	oldcmds "github.com/ipfs/go-ipfs/commands"
 	"github.com/ipfs/go-ipfs/core"
 	corecommands "github.com/ipfs/go-ipfs/core/commands"
+	"github.com/ipfs/go-ipfs/repo"
 
 	cmds "github.com/ipfs/go-ipfs-cmds"
 	cmdsHttp "github.com/ipfs/go-ipfs-cmds/http"
 	config "github.com/ipfs/go-ipfs-config"
 	path "github.com/ipfs/go-path"
+	"github.com/jbenet/goprocess"
 )
 
 var (
@@ -141,7 +144,40 @@ func commandsOption(cctx oldcmds.Context, command *cmds.Command, allowGet bool)
 		addCORSDefaults(cfg)
 		patchCORSVars(cfg, l.Addr())
 
-		cmdHandler := cmdsHttp.NewHandler(&cctx, command, cfg)
+		if command == corecommands.Root {
+			var auditPath string
+			if _, err := repo.DecodeConfigKey(n.Repo, oldcmds.AuditLogConfigKey, &auditPath); err != nil {
+				return nil, err
+			}
+			if auditPath != "" {
+				if pr, ok := n.Repo.(interface{ Path() string }); ok && !filepath.IsAbs(auditPath) {
+					auditPath = filepath.Join(pr.Path(), auditPath)
+				}
+				al, err := oldcmds.OpenAuditLog(auditPath)
+				if err != nil {
+					return nil, err
+				}
+				if n.Process != nil {
+					n.Process.AddChild(goprocess.WithTeardown(al.Close))
+				}
+				cctx.AuditLog = al
+			}
+		}
+
+		var cmdHandler http.Handler = cmdsHttp.NewHandler(&cctx, command, cfg)
+
+		// the read-only API served by the gateway stays public
+		if command == corecommands.Root {
+			auths, err := loadAPIAuthorizations(n)
+			if err != nil {
+				return nil, err
+			}
+			if len(auths) > 0 {
+				cmdHandler = withAPIAuthorizations(auths, cmdHandler)
+			}
+		}
+		cmdHandler = withAuditLog(&cctx, cmdHandler)
+
 		mux.Handle(APIPath+"/", cmdHandler)
 		return mux, nil
 	}
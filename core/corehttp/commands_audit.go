@@ -0,0 +1,114 @@
+package corehttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	oldcmds "github.com/ipfs/go-ipfs/commands"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	cmdsHttp "github.com/ipfs/go-ipfs-cmds/http"
+)
+
+// maxAuditErrorBody is how much of an error response is kept to find the
+// error message in.
+const maxAuditErrorBody = 4096
+
+// auditResponseWriter remembers the status of a response, and the start of
+// its body when it's an error.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 && w.body.Len() < maxAuditErrorBody {
+		rest := maxAuditErrorBody - w.body.Len()
+		if len(b) < rest {
+			rest = len(b)
+		}
+		w.body.Write(b[:rest])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// outcome tells how the request ended from the response.
+func (w *auditResponseWriter) outcome() (string, string) {
+	switch {
+	case w.status == http.StatusUnauthorized || w.status == http.StatusForbidden:
+		return oldcmds.OutcomeDenied, strings.TrimSpace(w.body.String())
+	case w.status >= 400:
+		var e cmds.Error
+		if err := json.Unmarshal(w.body.Bytes(), &e); err == nil && e.Message != "" {
+			return oldcmds.OutcomeError, e.Message
+		}
+		return oldcmds.OutcomeError, strings.TrimSpace(w.body.String())
+	}
+	// errors happening once the output started are sent as a trailer
+	if msg := w.Header().Get(cmdsHttp.StreamErrHeader); msg != "" {
+		return oldcmds.OutcomeError, msg
+	}
+	return oldcmds.OutcomeOK, ""
+}
+
+// withAuditLog records the origin of the API requests in the request log,
+// how they ended, and appends the ones changing the state of the node to
+// the audit log.
+func withAuditLog(cctx *oldcmds.Context, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remote = r.RemoteAddr
+		}
+		origin := &oldcmds.RequestOrigin{Remote: remote}
+		aw := &auditResponseWriter{ResponseWriter: w}
+
+		next.ServeHTTP(aw, r.WithContext(oldcmds.WithRequestOrigin(r.Context(), origin)))
+
+		outcome, msg := aw.outcome()
+		var rle *oldcmds.ReqLogEntry
+		if e := origin.Entry(); e != nil {
+			rle = cctx.ReqLog.SetOutcome(e, outcome, msg)
+		} else if outcome == oldcmds.OutcomeDenied {
+			// turned away before reaching the commands
+			rle = &oldcmds.ReqLogEntry{
+				StartTime: start,
+				EndTime:   time.Now(),
+				Command:   strings.Trim(strings.TrimPrefix(r.URL.Path, APIPath), "/"),
+				Args:      r.URL.Query()["arg"],
+				Remote:    origin.Remote,
+				Identity:  origin.Identity,
+				Outcome:   outcome,
+				Error:     msg,
+			}
+		}
+		if rle == nil || cctx.AuditLog == nil || !oldcmds.IsAudited(rle.Command, rle.Args) {
+			return
+		}
+		if err := cctx.AuditLog.Record(rle); err != nil {
+			log.Errorf("failed to write audit log: %s", err)
+		}
+	})
+}
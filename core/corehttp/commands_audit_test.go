@@ -0,0 +1,192 @@
+package corehttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	oldcmds "github.com/ipfs/go-ipfs/commands"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	cmdsHttp "github.com/ipfs/go-ipfs-cmds/http"
+)
+
+func TestAuditLog(t *testing.T) {
+	al, err := oldcmds.OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+	cctx := &oldcmds.Context{ReqLog: &oldcmds.ReqLog{}, AuditLog: al}
+
+	auths, err := newAPIAuthorizations(map[string]APIAuthorization{
+		"pinner": {AuthSecret: "bearer:pin-token", AllowedPaths: []string{"/api/v0/pin"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stands in for the commands handler
+	cmdHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(strings.TrimPrefix(r.URL.Path, APIPath+"/"), "/")
+		opts := cmds.OptMap{}
+		for k, v := range r.URL.Query() {
+			if k != "arg" && k != "fail" {
+				opts[k] = v[0]
+			}
+		}
+		done := cctx.LogRequest(&cmds.Request{
+			Context:   r.Context(),
+			Path:      path,
+			Options:   opts,
+			Arguments: r.URL.Query()["arg"],
+		})
+		defer done()
+
+		switch r.URL.Query().Get("fail") {
+		case "early":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"Message":"pin: invalid path","Code":0,"Type":"error"}`))
+		case "late":
+			w.Write([]byte(`{}`))
+			w.Header().Set(cmdsHttp.StreamErrHeader, "context canceled")
+		default:
+			w.Write([]byte(`{}`))
+		}
+	})
+	h := withAuditLog(cctx, withAPIAuthorizations(auths, cmdHandler))
+
+	for _, test := range []struct {
+		uri  string
+		auth string
+	}{
+		{"/api/v0/pin/add?arg=/ipfs/bafy", "Bearer pin-token"},
+		{"/api/v0/pin/ls", "Bearer pin-token"},
+		{"/api/v0/pin/rm?arg=foo&fail=early", "Bearer pin-token"},
+		{"/api/v0/pin/add?arg=/ipfs/bafy&fail=late", "Bearer pin-token"},
+		{"/api/v0/config?arg=Foo&arg=bar", "Bearer pin-token"},
+		{"/api/v0/pin/remote/service/add?arg=svc&arg=https://pin.example&arg=s3cr3t&auth-token=t0k3n&enc=json", "Bearer pin-token"},
+		{"/api/v0/repo/gc", ""},
+	} {
+		req := httptest.NewRequest(http.MethodPost, test.uri, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// the request log knows the origin of all requests
+	report := cctx.ReqLog.Report()
+	if len(report) != 5 {
+		t.Fatalf("expected 5 requests in the request log, got %d", len(report))
+	}
+	if report[1].Command != "pin/ls" || report[1].Identity != "pinner" || report[1].Outcome != oldcmds.OutcomeOK {
+		t.Errorf("unexpected request log entry %+v", report[1])
+	}
+
+	history, err := al.History(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		command  string
+		identity string
+		outcome  string
+		err      string
+	}{
+		{"pin/add", "pinner", oldcmds.OutcomeOK, ""},
+		{"pin/rm", "pinner", oldcmds.OutcomeError, "pin: invalid path"},
+		{"pin/add", "pinner", oldcmds.OutcomeError, "context canceled"},
+		{"config", "pinner", oldcmds.OutcomeDenied, "403 - pinner is not allowed to call /api/v0/config"},
+		{"pin/remote/service/add", "pinner", oldcmds.OutcomeOK, ""},
+		{"repo/gc", "", oldcmds.OutcomeDenied, "401 - missing or invalid API authorization"},
+	}
+	if len(history) != len(expected) {
+		t.Fatalf("expected %d audit log entries, got %d", len(expected), len(history))
+	}
+	for i, e := range expected {
+		rle := history[i]
+		if rle.Command != e.command || rle.Identity != e.identity || rle.Outcome != e.outcome || rle.Error != e.err {
+			t.Errorf("entry %d: got %s %q %s %q, expected %s %q %s %q", i,
+				rle.Command, rle.Identity, rle.Outcome, rle.Error,
+				e.command, e.identity, e.outcome, e.err)
+		}
+		if rle.Remote != "10.0.0.1" {
+			t.Errorf("entry %d: unexpected remote %q", i, rle.Remote)
+		}
+	}
+	// the values written to the config may be secrets
+	if args := history[3].Args; len(args) != 2 || args[0] != "Foo" || args[1] != "<redacted>" {
+		t.Errorf("unexpected arguments %v", args)
+	}
+	// so are the API keys of pinning services, and the options named like
+	// secrets
+	if args := history[4].Args; len(args) != 3 || args[1] != "https://pin.example" || args[2] != "<redacted>" {
+		t.Errorf("unexpected arguments %v", args)
+	}
+	if opts := history[4].Options; opts["auth-token"] != "<redacted>" || opts["enc"] != "json" {
+		t.Errorf("unexpected options %v", opts)
+	}
+
+	since, err := al.History(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(since) != 0 {
+		t.Errorf("expected no entries in the future, got %d", len(since))
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	al, err := oldcmds.OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+	cctx := &oldcmds.Context{ReqLog: &oldcmds.ReqLog{}, AuditLog: al}
+
+	started := make(chan struct{})
+	h := withAuditLog(cctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &cmds.Request{Context: r.Context(), Path: []string{"pin", "add"}}
+		done := cctx.LogRequest(req)
+		defer done()
+
+		close(started)
+		<-req.Context.Done()
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"Message":"context canceled","Code":0,"Type":"error"}`))
+	}))
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v0/pin/add", nil))
+	}()
+	<-started
+
+	if err := cctx.ReqLog.Cancel(1); err == nil {
+		t.Error("expected an error cancelling an unknown request")
+	}
+	if err := cctx.ReqLog.Cancel(0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request wasn't cancelled")
+	}
+	if err := cctx.ReqLog.Cancel(0); err == nil {
+		t.Error("expected an error cancelling a finished request")
+	}
+
+	history, err := al.History(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Outcome != oldcmds.OutcomeCancelled || history[0].Error != "context canceled" {
+		t.Fatalf("unexpected audit log %+v", history)
+	}
+}
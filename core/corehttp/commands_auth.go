@@ -0,0 +1,169 @@
+package corehttp
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	gopath "path"
+	"strings"
+
+	oldcmds "github.com/ipfs/go-ipfs/commands"
+	core "github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/repo"
+)
+
+// APIAuthorizationsConfigKey is the config key holding the credentials
+// allowed to use the API, by name.
+const APIAuthorizationsConfigKey = "API.Authorizations"
+
+// APIAuthorization grants access to a part of the API.
+type APIAuthorization struct {
+	// AuthSecret is either "bearer:<token>" or "basic:<user>:<password>".
+	AuthSecret string
+
+	// AllowedPaths lists the API paths the credentials may call, e.g.
+	// "/api/v0/pin" for all pin commands. "/api/v0" allows all the commands,
+	// "/" everything served by the API listener.
+	AllowedPaths []string
+}
+
+// AuthorizationHeader returns the value of the Authorization header matching
+// an AuthSecret.
+func AuthorizationHeader(secret string) (string, error) {
+	kind, credentials := secret, ""
+	if i := strings.IndexByte(secret, ':'); i >= 0 {
+		kind, credentials = secret[:i], secret[i+1:]
+	}
+	switch strings.ToLower(kind) {
+	case "bearer":
+		if credentials == "" {
+			return "", fmt.Errorf("empty bearer token")
+		}
+		return "Bearer " + credentials, nil
+	case "basic":
+		if !strings.Contains(credentials, ":") {
+			return "", fmt.Errorf("basic credentials must be <user>:<password>")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)), nil
+	default:
+		return "", fmt.Errorf("auth secret must start with bearer: or basic:")
+	}
+}
+
+type apiAuthorization struct {
+	name         string
+	scheme       string
+	credentials  []byte
+	allowedPaths []string
+}
+
+func (a *apiAuthorization) allows(p string) bool {
+	p = gopath.Clean(p)
+	for _, prefix := range a.allowedPaths {
+		prefix = gopath.Clean(prefix)
+		if p == prefix || strings.HasPrefix(p, prefix+"/") || prefix == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAPIAuthorizations returns the credentials allowed to use the API of
+// the node, none if anyone may.
+func loadAPIAuthorizations(n *core.IpfsNode) ([]*apiAuthorization, error) {
+	var cfg map[string]APIAuthorization
+	if _, err := repo.DecodeConfigKey(n.Repo, APIAuthorizationsConfigKey, &cfg); err != nil {
+		return nil, err
+	}
+	return newAPIAuthorizations(cfg)
+}
+
+func newAPIAuthorizations(cfg map[string]APIAuthorization) ([]*apiAuthorization, error) {
+	auths := make([]*apiAuthorization, 0, len(cfg))
+	for name, a := range cfg {
+		header, err := AuthorizationHeader(a.AuthSecret)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %s", APIAuthorizationsConfigKey, name, err)
+		}
+		scheme := strings.SplitN(header, " ", 2)
+		auths = append(auths, &apiAuthorization{
+			name:         name,
+			scheme:       scheme[0],
+			credentials:  []byte(scheme[1]),
+			allowedPaths: a.AllowedPaths,
+		})
+	}
+	return auths, nil
+}
+
+// withAPIAuthorizations only lets requests with valid credentials through to
+// the commands allowed for them. CORS preflight requests carry no
+// credentials, and are left to the commands handler.
+func withAPIAuthorizations(auths []*apiAuthorization, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var auth *apiAuthorization
+		header := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+		if len(header) == 2 {
+			for _, a := range auths {
+				if strings.EqualFold(header[0], a.scheme) &&
+					subtle.ConstantTimeCompare([]byte(strings.TrimSpace(header[1])), a.credentials) == 1 {
+					auth = a
+					break
+				}
+			}
+		}
+		if auth == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ipfs-api", charset="UTF-8"`)
+			http.Error(w, "401 - missing or invalid API authorization", http.StatusUnauthorized)
+			return
+		}
+		if o := oldcmds.GetRequestOrigin(r.Context()); o != nil {
+			o.Identity = auth.name
+		}
+		if !auth.allows(r.URL.Path) {
+			log.Debugf("API authorization %q is not allowed to call %s", auth.name, r.URL.Path)
+			http.Error(w, "403 - "+auth.name+" is not allowed to call "+r.URL.Path, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// APIAuthorizationsOption returns a ServeOption requiring the credentials of
+// API.Authorizations, once set, for the requests to the handlers registered
+// after it: the debug and log endpoints, the web UI and the gateway.
+func APIAuthorizationsOption() ServeOption {
+	return func(n *core.IpfsNode, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		auths, err := loadAPIAuthorizations(n)
+		if err != nil {
+			return nil, err
+		}
+		if len(auths) == 0 {
+			return mux, nil
+		}
+		childMux := http.NewServeMux()
+		mux.Handle("/", withListenerAuthorizations(auths, childMux))
+		return childMux, nil
+	}
+}
+
+// withListenerAuthorizations authorizes the requests to next but the ones to
+// the commands, which are authorized by the commands handler so that the
+// audit log records the denied ones.
+func withListenerAuthorizations(auths []*apiAuthorization, next http.Handler) http.Handler {
+	authorized := withAPIAuthorizations(auths, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := gopath.Clean(r.URL.Path); p == APIPath || strings.HasPrefix(p, APIPath+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authorized.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,111 @@
+package corehttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizationHeader(t *testing.T) {
+	for secret, expected := range map[string]string{
+		"bearer:token":       "Bearer token",
+		"BEARER:token":       "Bearer token",
+		"basic:user:pass":    "Basic dXNlcjpwYXNz",
+		"basic:user:p:a:s:s": "Basic dXNlcjpwOmE6czpz",
+		"bearer:":            "",
+		"basic:user":         "",
+		"user:pass":          "",
+		"token":              "",
+	} {
+		header, err := AuthorizationHeader(secret)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", secret, header)
+			}
+			continue
+		}
+		if err != nil || header != expected {
+			t.Errorf("%q: got %q (%v), expected %q", secret, header, err, expected)
+		}
+	}
+}
+
+func TestAPIAuthorizations(t *testing.T) {
+	auths, err := newAPIAuthorizations(map[string]APIAuthorization{
+		"pinner": {AuthSecret: "bearer:pin-token", AllowedPaths: []string{"/api/v0/pin"}},
+		"admin":  {AuthSecret: "basic:admin:secret", AllowedPaths: []string{"/api/v0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := withAPIAuthorizations(auths, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, test := range []struct {
+		method string
+		path   string
+		auth   string
+		status int
+	}{
+		{http.MethodPost, "/api/v0/pin/add", "", http.StatusUnauthorized},
+		{http.MethodPost, "/api/v0/pin/add", "Bearer wrong", http.StatusUnauthorized},
+		{http.MethodPost, "/api/v0/pin/add", "Bearer pin-token", http.StatusOK},
+		{http.MethodPost, "/api/v0/pin", "bearer pin-token", http.StatusOK},
+		{http.MethodPost, "/api/v0/pinfoo", "Bearer pin-token", http.StatusForbidden},
+		{http.MethodPost, "/api/v0/config/replace", "Bearer pin-token", http.StatusForbidden},
+		{http.MethodPost, "/api/v0/config/replace", "Basic YWRtaW46c2VjcmV0", http.StatusOK},
+		{http.MethodOptions, "/api/v0/shutdown", "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s %s with %q: got %d, expected %d", test.method, test.path, test.auth, w.Code, test.status)
+		}
+	}
+
+	if _, err := newAPIAuthorizations(map[string]APIAuthorization{"bad": {AuthSecret: "nope"}}); err == nil {
+		t.Fatal("expected an error for an invalid secret")
+	}
+}
+
+func TestAPIListenerAuthorizations(t *testing.T) {
+	auths, err := newAPIAuthorizations(map[string]APIAuthorization{
+		"pinner": {AuthSecret: "bearer:pin-token", AllowedPaths: []string{"/api/v0/pin"}},
+		"admin":  {AuthSecret: "bearer:admin-token", AllowedPaths: []string{"/"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := withListenerAuthorizations(auths, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, test := range []struct {
+		path   string
+		auth   string
+		status int
+	}{
+		{"/debug/pprof/", "", http.StatusUnauthorized},
+		{"/logs", "", http.StatusUnauthorized},
+		{"/webui", "Bearer pin-token", http.StatusForbidden},
+		{"/ipfs/bafkqaaa", "Bearer admin-token", http.StatusOK},
+		{"/debug/metrics/prometheus", "Bearer admin-token", http.StatusOK},
+		// left to the commands handler
+		{"/api/v0/id", "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s with %q: got %d, expected %d", test.path, test.auth, w.Code, test.status)
+		}
+	}
+}
@@ -9,8 +9,11 @@ import (
 	version "github.com/ipfs/go-ipfs"
 	core "github.com/ipfs/go-ipfs/core"
 	coreapi "github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/core/denylist"
+	"github.com/ipfs/go-ipfs/repo"
 
 	options "github.com/ipfs/interface-go-ipfs-core/options"
+	routing "github.com/libp2p/go-libp2p-core/routing"
 	id "github.com/libp2p/go-libp2p/p2p/protocol/identify"
 )
 
@@ -18,6 +21,14 @@ type GatewayConfig struct {
 	Headers      map[string][]string
 	Writable     bool
 	PathPrefixes []string
+	Denylist     *denylist.Denylist
+	WriteTokens  map[string]WriteToken
+
+	// Routing provides the IPNS records served with ?format=ipns-record
+	Routing routing.ValueStore
+
+	// MaxConcurrentFetches caps the requests in flight, but OPTIONS ones
+	MaxConcurrentFetches int
 }
 
 // A helper function to clean up a set of headers:
@@ -87,10 +98,27 @@ func GatewayOption(writable bool, paths ...string) ServeOption {
 				"X-Stream-Output",
 			}, headers[ACEHeadersName]...))
 
+		var writeTokens map[string]WriteToken
+		if writable {
+			if _, err := repo.DecodeConfigKey(n.Repo, WriteTokensConfigKey, &writeTokens); err != nil {
+				return nil, err
+			}
+		}
+
+		limits, err := readRateLimits(n.Repo)
+		if err != nil {
+			return nil, err
+		}
+
 		gateway := newGatewayHandler(GatewayConfig{
 			Headers:      headers,
 			Writable:     writable,
 			PathPrefixes: cfg.Gateway.PathPrefixes,
+			Denylist:     n.Denylist,
+			WriteTokens:  writeTokens,
+			Routing:      n.Routing,
+
+			MaxConcurrentFetches: limits.MaxConcurrentFetches,
 		}, api)
 
 		for _, p := range paths {
@@ -0,0 +1,126 @@
+package corehttp
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	gopath "path"
+	"strings"
+
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// WriteTokensConfigKey is the config key holding the tokens allowed to write
+// through the writable gateway, by name.
+const WriteTokensConfigKey = "Gateway.WriteTokens"
+
+// WriteToken grants write access to the writable gateway. Requests carry the
+// secret in an "Authorization: Bearer <secret>" header.
+type WriteToken struct {
+	Secret string
+
+	// Keys lists the IPNS keys, as named by `ipfs key list`, that writes to
+	// /ipns/<key> paths may publish to.
+	Keys []string
+
+	// Paths lists the path prefixes writes to /ipfs/ paths may target.
+	// "/ipfs/" allows adding new content and patching any immutable tree.
+	Paths []string
+}
+
+// allowsPath reports whether p is under one of the token's path prefixes.
+func (t *WriteToken) allowsPath(p string) bool {
+	p = gopath.Clean(p)
+	for _, prefix := range t.Paths {
+		prefix = strings.TrimSuffix(gopath.Clean(prefix), "/")
+		if p == prefix || strings.HasPrefix(p, prefix+"/") || prefix == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *WriteToken) allowsKey(name string) bool {
+	for _, k := range t.Keys {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// writeToken returns the token matching the request's bearer credentials.
+func (i *gatewayHandler) writeToken(r *http.Request) (string, *WriteToken) {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", nil
+	}
+	secret := []byte(strings.TrimSpace(auth[len(prefix):]))
+
+	for name, token := range i.config.WriteTokens {
+		if token.Secret == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(token.Secret), secret) == 1 {
+			token := token
+			return name, &token
+		}
+	}
+	return "", nil
+}
+
+// authorizeWrite checks the request against the configured write tokens and
+// answers it with 401 or 403 if it's denied. Without any configured token
+// the writable gateway is open to everyone.
+func (i *gatewayHandler) authorizeWrite(w http.ResponseWriter, r *http.Request) bool {
+	if len(i.config.WriteTokens) == 0 {
+		return true
+	}
+
+	name, token := i.writeToken(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ipfs-gateway"`)
+		http.Error(w, "WritableGateway: missing or invalid token", http.StatusUnauthorized)
+		return false
+	}
+
+	if strings.HasPrefix(r.URL.Path, ipnsPathPrefix) {
+		// publishing is only allowed with the key, whatever the paths
+		segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, ipnsPathPrefix), "/", 2)
+		key, err := i.localKey(r.Context(), segments[0])
+		if err != nil {
+			internalWebError(w, err)
+			return false
+		}
+		if key != nil && token.allowsKey(key.Name()) {
+			return true
+		}
+	} else if token.allowsPath(r.URL.Path) {
+		return true
+	}
+
+	log.Debugf("write token %q is not allowed to write to %s", name, r.URL.Path)
+	http.Error(w, "WritableGateway: token is not allowed to write to "+r.URL.Path, http.StatusForbidden)
+	return false
+}
+
+// localKey returns the key of the node the IPNS name belongs to, nil if
+// there is none.
+func (i *gatewayHandler) localKey(ctx context.Context, name string) (coreiface.Key, error) {
+	pid, err := peer.Decode(name)
+	if err != nil {
+		return nil, nil
+	}
+	keys, err := i.api.Key().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.ID() == pid {
+			return k, nil
+		}
+	}
+	return nil, nil
+}
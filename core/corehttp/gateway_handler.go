@@ -20,11 +20,15 @@ import (
 	"github.com/ipfs/go-cid"
 	files "github.com/ipfs/go-ipfs-files"
 	assets "github.com/ipfs/go-ipfs/assets"
+	"github.com/ipfs/go-ipfs/core/coredag"
+	"github.com/ipfs/go-ipfs/core/coreunix"
 	dag "github.com/ipfs/go-merkledag"
 	mfs "github.com/ipfs/go-mfs"
 	path "github.com/ipfs/go-path"
 	"github.com/ipfs/go-path/resolver"
+	unixfile "github.com/ipfs/go-unixfs/file"
 	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
 	routing "github.com/libp2p/go-libp2p-core/routing"
 )
@@ -41,6 +45,10 @@ var onlyAscii = regexp.MustCompile("[[:^ascii:]]")
 type gatewayHandler struct {
 	config GatewayConfig
 	api    coreiface.CoreAPI
+
+	// fetches holds a slot per request in flight but OPTIONS ones when
+	// MaxConcurrentFetches is set
+	fetches chan struct{}
 }
 
 // StatusResponseWriter enables us to override HTTP Status Code passed to
@@ -67,6 +75,9 @@ func newGatewayHandler(c GatewayConfig, api coreiface.CoreAPI) *gatewayHandler {
 		config: c,
 		api:    api,
 	}
+	if c.MaxConcurrentFetches > 0 {
+		i.fetches = make(chan struct{}, c.MaxConcurrentFetches)
+	}
 	return i
 }
 
@@ -90,6 +101,36 @@ func parseIpfsPath(p string) (cid.Cid, string, error) {
 	return rootCid, path.Join(rsegs[2:]), nil
 }
 
+// parseWritePath parses the target of a write request: an /ipfs path, or an
+// /ipns path under one of the node's keys, in which case the key is returned
+// so the new root can be published to it.
+func (i *gatewayHandler) parseWritePath(ctx context.Context, p string) (cid.Cid, string, coreiface.Key, error) {
+	if !strings.HasPrefix(p, ipnsPathPrefix) {
+		rootCid, newPath, err := parseIpfsPath(p)
+		return rootCid, newPath, nil, err
+	}
+
+	rootPath, err := path.ParsePath(p)
+	if err != nil {
+		return cid.Cid{}, "", nil, err
+	}
+	rsegs := rootPath.Segments()
+
+	key, err := i.localKey(ctx, rsegs[1])
+	if err != nil {
+		return cid.Cid{}, "", nil, err
+	}
+	if key == nil {
+		return cid.Cid{}, "", nil, fmt.Errorf("WritableGateway: %s is not a key of this node", rsegs[1])
+	}
+
+	resolved, err := i.api.ResolvePath(ctx, key.Path())
+	if err != nil {
+		return cid.Cid{}, "", nil, err
+	}
+	return resolved.Cid(), path.Join(rsegs[2:]), key, nil
+}
+
 func (i *gatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// the hour is a hard fallback, we don't expect it to happen, but just in case
 	ctx, cancel := context.WithTimeout(r.Context(), time.Hour)
@@ -98,13 +139,35 @@ func (i *gatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	defer func() {
 		if r := recover(); r != nil {
+			if r == http.ErrAbortHandler {
+				// deliberate abort of a streamed response, let
+				// net/http close the connection
+				panic(r)
+			}
 			log.Error("A panic occurred in the gateway handler!")
 			log.Error(r)
 			debug.PrintStack()
 		}
 	}()
 
+	if i.fetches != nil && r.Method != http.MethodOptions {
+		select {
+		case i.fetches <- struct{}{}:
+			defer func() { <-i.fetches }()
+		default:
+			tooManyRequests(w, time.Second, "too many requests in flight, try again later")
+			return
+		}
+	}
+
 	if i.config.Writable {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodDelete:
+			if !i.authorizeWrite(w, r) {
+				return
+			}
+		}
+
 		switch r.Method {
 		case http.MethodPost:
 			i.postHandler(w, r)
@@ -221,14 +284,43 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// the path checked against the denylist, resolved
+	checkedPath := parsedPath
+	if i.config.Denylist != nil {
+		var err error
+		checkedPath, err = i.config.Denylist.Check(r.Context(), i.api, parsedPath)
+		if err != nil {
+			webError(w, escapedURLPath, err, http.StatusGone)
+			return
+		}
+	}
+
+	// Trustless responses: hand out the verifiable bytes instead of the
+	// deserialized UnixFS representation when the client asked for them.
+	responseFormat, err := customResponseFormat(r)
+	if err != nil {
+		webError(w, "error while processing the Accept header", err, http.StatusBadRequest)
+		return
+	}
+
+	// IPNS records are served without resolving the name
+	if responseFormat == ipnsRecordResponseFormat {
+		i.serveIpnsRecord(w, r, parsedPath)
+		return
+	}
+
 	// Resolve path to the final DAG node for the ETag
-	resolvedPath, err := i.api.ResolvePath(r.Context(), parsedPath)
+	resolvedPath, err := i.api.ResolvePath(r.Context(), checkedPath)
 	switch err {
 	case nil:
 	case coreiface.ErrOffline:
 		webError(w, "ipfs resolve -r "+escapedURLPath, err, http.StatusServiceUnavailable)
 		return
 	default:
+		if i.serveRedirectsIfPresent(w, r, parsedPath) {
+			return
+		}
+
 		if i.servePretty404IfPresent(w, r, parsedPath) {
 			return
 		}
@@ -236,8 +328,36 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 		webError(w, "ipfs resolve -r "+escapedURLPath, err, http.StatusNotFound)
 		return
 	}
+	setAccessLogCid(r.Context(), resolvedPath.Cid())
+
+	switch responseFormat {
+	case rawResponseFormat:
+		i.serveRawBlock(w, r, resolvedPath, urlPath)
+		return
+	case carResponseFormat:
+		i.serveCar(w, r, resolvedPath, urlPath)
+		return
+	}
 
-	dr, err := i.api.Unixfs().Get(r.Context(), resolvedPath)
+	// Non-UnixFS DAGs are served as IPLD data
+	if c := resolvedPath.Cid().Type(); c == cid.DagCBOR || c == coredag.DagJSON {
+		i.serveCodec(w, r, resolvedPath, urlPath, responseFormat)
+		return
+	}
+	if responseFormat != "" && responseFormat != jsonResponseFormat {
+		err := fmt.Errorf("unsupported format %q", responseFormat)
+		webError(w, "failed to respond with requested content type", err, http.StatusBadRequest)
+		return
+	}
+
+	// resolve the node ourselves, rather than through Unixfs().Get, so its
+	// metadata can be read without fetching it again
+	nd, err := i.api.ResolveNode(r.Context(), resolvedPath)
+	if err != nil {
+		webError(w, "ipfs cat "+escapedURLPath, err, http.StatusNotFound)
+		return
+	}
+	dr, err := unixfile.NewUnixfsFile(r.Context(), i.api.Dag(), nd)
 	if err != nil {
 		webError(w, "ipfs cat "+escapedURLPath, err, http.StatusNotFound)
 		return
@@ -251,6 +371,12 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 
 	// we need to figure out whether this is a directory before doing most of the heavy lifting below
 	_, ok := dr.(files.Directory)
+	if !ok && responseFormat != "" {
+		// only directories have a JSON representation
+		err := fmt.Errorf("unsupported format %q", responseFormat)
+		webError(w, "failed to respond with requested content type", err, http.StatusBadRequest)
+		return
+	}
 
 	if ok && assets.BindataVersionHash != "" {
 		responseEtag = `"DirIndex-` + assets.BindataVersionHash + `_CID-` + resolvedPath.Cid().String() + `"`
@@ -281,6 +407,10 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 			// set modtime to a really long time ago, since files are immutable and should stay cached
 			modtime = time.Unix(1, 0)
 		}
+		// unless the file carries its own
+		if md, err := coreunix.ReadUnixFSMetadata(nd); err == nil && !md.Mtime.IsZero() {
+			modtime = md.Mtime
+		}
 
 		urlFilename := r.URL.Query().Get("filename")
 		var name string
@@ -305,6 +435,22 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// ?download=tar|zip streams the whole tree as an archive
+	if archive := r.URL.Query().Get("download"); archive == "tar" || archive == "zip" {
+		i.serveArchive(w, r, dir, nd, resolvedPath, urlPath, archive)
+		return
+	}
+
+	listingOpts, err := parseListingOptions(r)
+	if err != nil {
+		webError(w, "failed to list directory", err, http.StatusBadRequest)
+		return
+	}
+	if responseFormat == jsonResponseFormat || acceptsJSON(r) {
+		i.serveDirectoryJSON(w, r, resolvedPath, urlPath, originalUrlPath, listingOpts)
+		return
+	}
+
 	idx, err := i.api.Unixfs().Get(r.Context(), ipath.Join(resolvedPath, "index.html"))
 	switch err.(type) {
 	case nil:
@@ -354,35 +500,32 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// storage for directory listing
-	var dirListing []directoryItem
-	dirit := dir.Entries()
-	for dirit.Next() {
-		size := "?"
-		if s, err := dirit.Node().Size(); err == nil {
-			// Size may not be defined/supported. Continue anyways.
-			size = humanize.Bytes(uint64(s))
-		}
+	entries, next, err := i.listDirectory(r.Context(), resolvedPath, listingOpts)
+	if err != nil {
+		webListingError(w, err)
+		return
+	}
+	if next != "" {
+		setNextPageLink(w, r, originalUrlPath, next)
+	}
 
-		hash := ""
-		if r, err := i.api.ResolvePath(r.Context(), ipath.Join(resolvedPath, dirit.Name())); err == nil {
-			// Path may not be resolved. Continue anyways.
-			hash = r.Cid().String()
+	dirListing := make([]directoryItem, 0, len(entries))
+	for _, e := range entries {
+		size := "?"
+		if e.Size != nil {
+			size = humanize.Bytes(*e.Size)
 		}
 
 		// See comment above where originalUrlPath is declared.
 		di := directoryItem{
 			Size:      size,
-			Name:      dirit.Name(),
-			Path:      gopath.Join(originalUrlPath, dirit.Name()),
-			Hash:      hash,
-			ShortHash: shortHash(hash),
+			Name:      e.Name,
+			Path:      gopath.Join(originalUrlPath, e.Name),
+			Hash:      e.Hash,
+			ShortHash: shortHash(e.Hash),
 		}
 		dirListing = append(dirListing, di)
 	}
-	if dirit.Err() != nil {
-		internalWebError(w, dirit.Err())
-		return
-	}
 
 	// construct the correct back link
 	// https://github.com/ipfs/go-ipfs/issues/1365
@@ -493,6 +636,10 @@ func (i *gatewayHandler) serveFile(w http.ResponseWriter, req *http.Request, nam
 	w.Header().Set("Content-Type", ctype)
 
 	w = &statusResponseWriter{w}
+	if isMultiRangeRequest(req) {
+		serveMultiRange(w, req, ctype, modtime, size, content)
+		return
+	}
 	http.ServeContent(w, req, name, modtime, content)
 }
 
@@ -543,7 +690,7 @@ func (i *gatewayHandler) putHandler(w http.ResponseWriter, r *http.Request) {
 	ds := i.api.Dag()
 
 	// Parse the path
-	rootCid, newPath, err := parseIpfsPath(r.URL.Path)
+	rootCid, newPath, key, err := i.parseWritePath(ctx, r.URL.Path)
 	if err != nil {
 		webError(w, "WritableGateway: failed to parse the path", err, http.StatusBadRequest)
 		return
@@ -625,9 +772,7 @@ func (i *gatewayHandler) putHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	newcid := nnode.Cid()
 
-	i.addUserHeaders(w) // ok, _now_ write user's headers.
-	w.Header().Set("IPFS-Hash", newcid.String())
-	http.Redirect(w, r, gopath.Join(ipfsPathPrefix, newcid.String(), newPath), http.StatusCreated)
+	i.finishWrite(w, r, key, newcid, newPath)
 }
 
 func (i *gatewayHandler) deleteHandler(w http.ResponseWriter, r *http.Request) {
@@ -635,7 +780,7 @@ func (i *gatewayHandler) deleteHandler(w http.ResponseWriter, r *http.Request) {
 
 	// parse the path
 
-	rootCid, newPath, err := parseIpfsPath(r.URL.Path)
+	rootCid, newPath, key, err := i.parseWritePath(ctx, r.URL.Path)
 	if err != nil {
 		webError(w, "WritableGateway: failed to parse the path", err, http.StatusBadRequest)
 		return
@@ -696,10 +841,26 @@ func (i *gatewayHandler) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	ncid := nnode.Cid()
 
-	i.addUserHeaders(w) // ok, _now_ write user's headers.
-	w.Header().Set("IPFS-Hash", ncid.String())
 	// note: StatusCreated is technically correct here as we created a new resource.
-	http.Redirect(w, r, gopath.Join(ipfsPathPrefix+ncid.String(), directory), http.StatusCreated)
+	i.finishWrite(w, r, key, ncid, directory)
+}
+
+// finishWrite publishes the new root to the IPNS key the write targeted, if
+// any, and redirects to the written path.
+func (i *gatewayHandler) finishWrite(w http.ResponseWriter, r *http.Request, key coreiface.Key, root cid.Cid, p string) {
+	location := gopath.Join(ipfsPathPrefix, root.String(), p)
+	if key != nil {
+		_, err := i.api.Name().Publish(r.Context(), ipath.IpfsPath(root), options.Name.Key(key.Name()))
+		if err != nil {
+			webError(w, "WritableGateway: failed to publish", err, http.StatusInternalServerError)
+			return
+		}
+		location = gopath.Join(key.Path().String(), p)
+	}
+
+	i.addUserHeaders(w) // ok, _now_ write user's headers.
+	w.Header().Set("IPFS-Hash", root.String())
+	http.Redirect(w, r, location, http.StatusCreated)
 }
 
 func (i *gatewayHandler) addUserHeaders(w http.ResponseWriter) {
@@ -0,0 +1,147 @@
+package corehttp
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	gopath "path"
+	"strings"
+	"time"
+
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-ipfs/core/coreunix"
+	ipld "github.com/ipfs/go-ipld-format"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+var archiveContentTypes = map[string]string{
+	"tar": "application/x-tar",
+	"zip": "application/zip",
+}
+
+// serveArchive streams the directory as a tar or zip archive, just like
+// `ipfs get -a` does. Entries are fetched and written one at a time, so the
+// tree is never held in memory.
+func (i *gatewayHandler) serveArchive(w http.ResponseWriter, r *http.Request, dir files.Directory, nd ipld.Node, resolvedPath ipath.Resolved, urlPath string, format string) {
+	responseEtag := `"` + resolvedPath.Cid().String() + `.` + format + `"`
+	if etagMatches(r, responseEtag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// name of the top-level directory inside the archive, which must not
+	// make the archive write outside of where it is extracted
+	name := r.URL.Query().Get("filename")
+	if name != "" {
+		name = gopath.Base(strings.ReplaceAll(name, `\`, "/"))
+		if name == "." || name == ".." || name == "/" {
+			webError(w, "invalid archive filename", fmt.Errorf("%q is not a file name", r.URL.Query().Get("filename")), http.StatusBadRequest)
+			return
+		}
+	} else {
+		name = getFilename(urlPath)
+	}
+	if name == "" || name == "/" {
+		name = resolvedPath.Cid().String()
+	}
+	archiveName := name + "." + format
+
+	i.addUserHeaders(w)
+	w.Header().Set("X-IPFS-Path", urlPath)
+	w.Header().Set("Etag", responseEtag)
+	if strings.HasPrefix(urlPath, ipfsPathPrefix) {
+		w.Header().Set("Cache-Control", "public, max-age=29030400, immutable")
+	}
+	asciiName := url.PathEscape(onlyAscii.ReplaceAllLiteralString(archiveName, "_"))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"; filename*=UTF-8''%s", asciiName, url.PathEscape(archiveName)))
+	w.Header().Set("Content-Type", archiveContentTypes[format])
+	// size is not known upfront, and the stream can't be seeked
+	w.Header().Set("Accept-Ranges", "none")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	var err error
+	switch format {
+	case "tar":
+		err = writeTarArchive(r.Context(), w, i.api.Dag(), nd, name)
+	case "zip":
+		err = writeZipArchive(w, dir, name)
+	}
+	if err != nil {
+		// Headers are already sent, abort the connection so the client
+		// doesn't mistake a truncated archive for a complete one.
+		log.Errorf("error writing %s archive for %s: %s", format, urlPath, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func writeTarArchive(ctx context.Context, w io.Writer, dag ipld.DAGService, nd ipld.Node, name string) error {
+	tw := coreunix.NewTarWriter(ctx, dag, w)
+	if err := tw.WriteNode(nd, name); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeZipArchive(w io.Writer, dir files.Directory, name string) error {
+	zw := zip.NewWriter(w)
+	if err := writeZipNode(zw, dir, name); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeZipNode(zw *zip.Writer, nd files.Node, fpath string) error {
+	// zip entries don't carry the UnixFS metadata, use a fixed time.
+	header := &zip.FileHeader{
+		Name:     fpath,
+		Method:   zip.Deflate,
+		Modified: time.Unix(0, 0),
+	}
+
+	switch nd := nd.(type) {
+	case *files.Symlink:
+		header.SetMode(os.ModeSymlink | 0777)
+		zf, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(zf, nd.Target)
+		return err
+	case files.File:
+		header.SetMode(0644)
+		zf, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(zf, nd)
+		return err
+	case files.Directory:
+		header.Name += "/"
+		header.Method = zip.Store
+		header.SetMode(os.ModeDir | 0755)
+		if _, err := zw.CreateHeader(header); err != nil {
+			return err
+		}
+		it := nd.Entries()
+		for it.Next() {
+			if err := coreunix.CheckLinkName(it.Name()); err != nil {
+				return fmt.Errorf("%s in %q", err, fpath)
+			}
+			if err := writeZipNode(zw, it.Node(), gopath.Join(fpath, it.Name())); err != nil {
+				return err
+			}
+		}
+		return it.Err()
+	default:
+		return fmt.Errorf("file type %T at %q is not supported", nd, fpath)
+	}
+}
@@ -0,0 +1,106 @@
+package corehttp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+const (
+	rawResponseFormat = "application/vnd.ipld.raw"
+	carResponseFormat = "application/vnd.ipld.car"
+)
+
+// customResponseFormat returns the explicitly requested response format, if
+// any. The ?format= query parameter takes precedence over the Accept header,
+// and only vendor-specific IPLD types are picked from the latter: browsers
+// send generic types like */* we don't want to act upon.
+func customResponseFormat(r *http.Request) (string, error) {
+	switch r.URL.Query().Get("format") {
+	case "":
+	case "raw":
+		return rawResponseFormat, nil
+	case "car":
+		return carResponseFormat, nil
+	case "json":
+		return jsonResponseFormat, nil
+	case "cbor":
+		return cborResponseFormat, nil
+	case "html":
+		return htmlResponseFormat, nil
+	case "ipns-record":
+		return ipnsRecordResponseFormat, nil
+	default:
+		return r.URL.Query().Get("format"), nil
+	}
+
+	for _, header := range r.Header.Values("Accept") {
+		for _, spec := range strings.Split(header, ",") {
+			spec = strings.TrimSpace(spec)
+			if !strings.HasPrefix(spec, "application/vnd.ipld.") && !strings.HasPrefix(spec, ipnsRecordResponseFormat) {
+				continue
+			}
+			mediatype, _, err := mime.ParseMediaType(spec)
+			if err != nil {
+				return "", err
+			}
+			return mediatype, nil
+		}
+	}
+	return "", nil
+}
+
+// serveRawBlock responds with the bytes of the single block the path resolved
+// to, allowing the client to verify them against the CID.
+func (i *gatewayHandler) serveRawBlock(w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, urlPath string) {
+	blockCid := resolvedPath.Cid()
+	blockReader, err := i.api.Block().Get(r.Context(), resolvedPath)
+	if err != nil {
+		webError(w, "ipfs block get "+blockCid.String(), err, http.StatusInternalServerError)
+		return
+	}
+	block, err := ioutil.ReadAll(blockReader)
+	if err != nil {
+		webError(w, "ipfs block get "+blockCid.String(), err, http.StatusInternalServerError)
+		return
+	}
+
+	responseEtag := `"` + blockCid.String() + `.raw"`
+	if etagMatches(r, responseEtag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	i.addUserHeaders(w)
+	setTrustlessHeaders(w, urlPath, responseEtag)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+blockCid.String()+`.bin"`)
+	w.Header().Set("Content-Type", rawResponseFormat)
+
+	// A block is immutable, so its modification time is irrelevant; use the
+	// same value as for immutable files.
+	http.ServeContent(w, r, "", time.Unix(1, 0), bytes.NewReader(block))
+}
+
+// etagMatches returns true if the request carries an If-None-Match header
+// matching the given etag, either strong or weak.
+func etagMatches(r *http.Request, etag string) bool {
+	inm := r.Header.Get("If-None-Match")
+	return inm == etag || inm == `W/`+etag
+}
+
+// setTrustlessHeaders sets the headers shared by the raw block and CAR
+// responses.
+func setTrustlessHeaders(w http.ResponseWriter, urlPath string, etag string) {
+	w.Header().Set("X-IPFS-Path", urlPath)
+	w.Header().Set("Etag", etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Add("Vary", "Accept")
+	if strings.HasPrefix(urlPath, ipfsPathPrefix) {
+		w.Header().Set("Cache-Control", "public, max-age=29030400, immutable")
+	}
+}
@@ -0,0 +1,46 @@
+package corehttp
+
+import (
+	"net/http"
+
+	cid "github.com/ipfs/go-cid"
+	mdag "github.com/ipfs/go-merkledag"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	gocar "github.com/ipld/go-car"
+)
+
+// serveCar streams the complete DAG under the resolved path as a CAR file,
+// the same way `ipfs dag export` does.
+func (i *gatewayHandler) serveCar(w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, urlPath string) {
+	rootCid := resolvedPath.Cid()
+
+	// The DAG is immutable, so is the CAR built from it.
+	responseEtag := `"` + rootCid.String() + `.car"`
+	if etagMatches(r, responseEtag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	i.addUserHeaders(w)
+	setTrustlessHeaders(w, urlPath, responseEtag)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+rootCid.String()+`.car"`)
+	w.Header().Set("Content-Type", carResponseFormat+"; version=1")
+
+	// The size of the CAR is not known upfront and it can't be seeked in,
+	// so range requests are not supported.
+	w.Header().Set("Accept-Ranges", "none")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	ctx := r.Context()
+	err := gocar.WriteCar(ctx, mdag.NewSession(ctx, i.api.Dag()), []cid.Cid{rootCid}, w)
+	if err != nil {
+		// The status code has already been sent, the best we can do is
+		// to abort the stream so the client notices the truncated CAR.
+		log.Errorf("error writing CAR for %s: %s", urlPath, err)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,236 @@
+package corehttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	gopath "path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-ipfs/core/coredag"
+
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	jsonResponseFormat = "application/json"
+	cborResponseFormat = "application/cbor"
+	htmlResponseFormat = "text/html"
+)
+
+// codecResponseFormat picks the representation of an IPLD node: the explicit
+// format if there is one, else the first of JSON, CBOR or HTML in the Accept
+// header. Clients not asking for anything in particular get JSON.
+func codecResponseFormat(r *http.Request, format string) string {
+	if format != "" {
+		return format
+	}
+	for _, header := range r.Header.Values("Accept") {
+		for _, spec := range strings.Split(header, ",") {
+			mediatype, _, err := mime.ParseMediaType(strings.TrimSpace(spec))
+			if err != nil {
+				continue
+			}
+			switch mediatype {
+			case jsonResponseFormat, cborResponseFormat, htmlResponseFormat:
+				return mediatype
+			}
+		}
+	}
+	return jsonResponseFormat
+}
+
+// serveCodec serves the IPLD data (dag-cbor or dag-json) resolvedPath points
+// into, as JSON, CBOR or a browsable HTML page.
+func (i *gatewayHandler) serveCodec(w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, urlPath string, format string) {
+	format = codecResponseFormat(r, format)
+
+	nd, err := i.api.Dag().Get(r.Context(), resolvedPath.Cid())
+	if err != nil {
+		webError(w, "ipfs dag get "+resolvedPath.Cid().String(), err, http.StatusInternalServerError)
+		return
+	}
+
+	// Re-encode the value the remainder of the path points to, if any. The
+	// node itself is served as is, dag-json data being handled through the
+	// dag-cbor node holding the same.
+	var node *cbor.Node
+	switch nd := nd.(type) {
+	case *cbor.Node:
+		node = nd
+	case *coredag.DagJSONNode:
+		node = nd.Node
+	default:
+		err := fmt.Errorf("unsupported codec %d", resolvedPath.Cid().Type())
+		webError(w, "failed to decode "+resolvedPath.Cid().String(), err, http.StatusNotImplemented)
+		return
+	}
+	if rem := resolvedPath.Remainder(); rem != "" {
+		val, _, err := node.Resolve(strings.Split(rem, "/"))
+		if err != nil {
+			webError(w, "ipfs dag get "+urlPath, err, http.StatusNotFound)
+			return
+		}
+		if lnk, ok := val.(*ipld.Link); ok {
+			val = lnk.Cid
+		}
+		if node, err = cbor.WrapObject(val, mh.SHA2_256, -1); err != nil {
+			internalWebError(w, err)
+			return
+		}
+	}
+
+	var body []byte
+	var ext string
+	switch format {
+	case jsonResponseFormat:
+		if _, ok := nd.(*coredag.DagJSONNode); ok && resolvedPath.Remainder() == "" {
+			body = nd.RawData()
+		} else {
+			body, err = node.MarshalJSON()
+		}
+		ext = "json"
+	case cborResponseFormat:
+		body = node.RawData()
+		ext = "cbor"
+	case htmlResponseFormat:
+		body, err = renderCodecHTML(node, resolvedPath.Cid(), urlPath, r)
+		ext = "html"
+	default:
+		err := fmt.Errorf("unsupported format %q", format)
+		webError(w, "failed to respond with requested content type", err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		internalWebError(w, err)
+		return
+	}
+
+	etag := resolvedPath.Cid().String()
+	if rem := resolvedPath.Remainder(); rem != "" {
+		etag += "/" + url.PathEscape(rem)
+	}
+	responseEtag := `"` + etag + "." + ext + `"`
+	if etagMatches(r, responseEtag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	i.addUserHeaders(w)
+	setTrustlessHeaders(w, urlPath, responseEtag)
+	if format == htmlResponseFormat {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", format)
+	}
+	http.ServeContent(w, r, "", time.Unix(1, 0), bytes.NewReader(body))
+}
+
+var codecTemplate = template.Must(template.New("codec").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Path }}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; }
+a { color: #0b3a53; }
+</style>
+</head>
+<body>
+<p><strong>{{ .Path }}</strong> ({{ .Cid }})
+&mdash; <a href="?format=json">json</a>, <a href="?format=cbor">cbor</a>, <a href="?format=car">car</a></p>
+<pre>{{ .Body }}</pre>
+</body>
+</html>
+`))
+
+// renderCodecHTML renders node, the value at urlPath in the block c, as
+// indented JSON, with links to the linked CIDs and to the paths of the map
+// keys and list indexes.
+func renderCodecHTML(node *cbor.Node, c cid.Cid, urlPath string, r *http.Request) ([]byte, error) {
+	raw, err := node.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	// links are relative to the URL the client used, which differs from
+	// urlPath on subdomain and DNSLink gateways
+	base := r.URL.Path
+	if requestURI, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		base = requestURI.Path
+	}
+
+	var body strings.Builder
+	writeCodecHTML(&body, v, base, "")
+
+	var out bytes.Buffer
+	err = codecTemplate.Execute(&out, struct {
+		Path string
+		Cid  string
+		Body template.HTML
+	}{urlPath, c.String(), template.HTML(body.String())})
+	return out.Bytes(), err
+}
+
+func writeCodecHTML(b *strings.Builder, v interface{}, p string, indent string) {
+	esc := template.HTMLEscapeString
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if link, ok := v["/"].(string); ok && len(v) == 1 {
+			fmt.Fprintf(b, `{"/": "<a href="%s">%s</a>"}`, esc(ipfsPathPrefix+link), esc(link))
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString("{\n")
+		for n, k := range keys {
+			sub := gopath.Join(p, url.PathEscape(k))
+			fmt.Fprintf(b, `%s  <a href="%s">%s</a>: `, indent, esc(sub), esc(quoteJSON(k)))
+			writeCodecHTML(b, v[k], sub, indent+"  ")
+			if n < len(keys)-1 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(indent + "}")
+	case []interface{}:
+		b.WriteString("[\n")
+		for n, e := range v {
+			b.WriteString(indent + "  ")
+			writeCodecHTML(b, e, gopath.Join(p, fmt.Sprint(n)), indent+"  ")
+			if n < len(v)-1 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(indent + "]")
+	default:
+		out, _ := json.Marshal(v)
+		b.WriteString(esc(string(out)))
+	}
+}
+
+func quoteJSON(s string) string {
+	out, _ := json.Marshal(s)
+	return string(out)
+}
@@ -0,0 +1,67 @@
+package corehttp
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	proto "github.com/gogo/protobuf/proto"
+	datastore "github.com/ipfs/go-datastore"
+	ipns "github.com/ipfs/go-ipns"
+	ipns_pb "github.com/ipfs/go-ipns/pb"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	routing "github.com/libp2p/go-libp2p-core/routing"
+)
+
+const ipnsRecordResponseFormat = "application/vnd.ipfs.ipns-record"
+
+// serveIpnsRecord serves the signed IPNS record of /ipns/<key>, as found by
+// the node's routing, so clients can verify the name themselves.
+func (i *gatewayHandler) serveIpnsRecord(w http.ResponseWriter, r *http.Request, parsedPath ipath.Path) {
+	segments := strings.Split(strings.Trim(parsedPath.String(), "/"), "/")
+	if parsedPath.Namespace() != "ipns" || len(segments) != 2 {
+		err := fmt.Errorf("IPNS records are only available for /ipns/<key>")
+		webError(w, "failed to respond with requested content type", err, http.StatusBadRequest)
+		return
+	}
+	pid, err := peer.Decode(segments[1])
+	if err != nil {
+		// DNSLink names have no record
+		webError(w, segments[1]+" is not an IPNS key", err, http.StatusBadRequest)
+		return
+	}
+	if i.config.Routing == nil {
+		http.Error(w, "IPNS records are not available on this gateway", http.StatusNotImplemented)
+		return
+	}
+
+	record, err := i.config.Routing.GetValue(r.Context(), ipns.RecordKey(pid))
+	switch err {
+	case nil:
+	case routing.ErrNotFound, datastore.ErrNotFound: // the latter from the offline router
+		webError(w, "ipfs name resolve "+segments[1], err, http.StatusNotFound)
+		return
+	default:
+		webError(w, "ipfs name resolve "+segments[1], err, http.StatusInternalServerError)
+		return
+	}
+
+	// let caches keep the record as long as resolvers would
+	var entry ipns_pb.IpnsEntry
+	if err := proto.Unmarshal(record, &entry); err == nil && entry.Ttl != nil {
+		ttl := time.Duration(entry.GetTtl()) / time.Second
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(int64(ttl), 10))
+	}
+
+	i.addUserHeaders(w)
+	w.Header().Set("X-IPFS-Path", parsedPath.String())
+	w.Header().Set("Content-Type", ipnsRecordResponseFormat)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+segments[1]+`.ipns-record"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Add("Vary", "Accept")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(record))
+}
@@ -0,0 +1,263 @@
+package corehttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+var (
+	errListingPageFull = errors.New("directory listing page is full")
+	errUnknownCursor   = errors.New("directory listing cursor not found")
+)
+
+// listingOptions select the page of a directory listing, from the ?limit=,
+// ?after= and ?sizes= query parameters. Pages are in link order, which is
+// stable for a given directory CID, and after is the cursor returned with the
+// previous page, see listDirectory.
+type listingOptions struct {
+	after string
+	limit int // 0 lists everything
+	sizes bool
+}
+
+func parseListingOptions(r *http.Request) (listingOptions, error) {
+	q := r.URL.Query()
+	opts := listingOptions{after: q.Get("after"), sizes: true}
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return opts, fmt.Errorf("invalid limit %q", s)
+		}
+		opts.limit = limit
+	}
+	if s := q.Get("sizes"); s != "" {
+		sizes, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, fmt.Errorf("invalid sizes %q", s)
+		}
+		opts.sizes = sizes
+	}
+	return opts, nil
+}
+
+// listingEntry is a directory entry. Size is nil when it wasn't resolved.
+type listingEntry struct {
+	Name string
+	Hash string
+	Size *uint64 `json:",omitempty"`
+}
+
+// directoryListing is the JSON representation of a directory. Next is the
+// cursor of the following page, if any.
+type directoryListing struct {
+	Path    string
+	Hash    string
+	Entries []listingEntry
+	Next    string `json:",omitempty"`
+}
+
+// listDirectory returns a page of the directory's entries, and the cursor of
+// the next page. The cursor is the position of the first entry of the next
+// page: the index of its link in a basic directory, or the indexes of the
+// links leading to it from the root shard of a sharded one, joined with dots.
+// Only the shards leading to the page and those it covers are fetched, and
+// the entries themselves only when their sizes are asked for.
+func (i *gatewayHandler) listDirectory(ctx context.Context, resolvedPath ipath.Resolved, opts listingOptions) ([]listingEntry, string, error) {
+	nd, err := i.api.Dag().Get(ctx, resolvedPath.Cid())
+	if err != nil {
+		return nil, "", err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil, "", uio.ErrNotADir
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return nil, "", err
+	}
+
+	l := &directoryLister{i: i, opts: opts}
+	switch fsn.Type() {
+	case unixfs.TDirectory:
+	case unixfs.THAMTShard:
+		l.padLen = len(fmt.Sprintf("%X", fsn.Fanout()-1))
+	default:
+		return nil, "", uio.ErrNotADir
+	}
+
+	var from []int
+	if opts.after != "" {
+		for _, s := range strings.Split(opts.after, ".") {
+			k, err := strconv.Atoi(s)
+			if err != nil || k < 0 {
+				return nil, "", errUnknownCursor
+			}
+			from = append(from, k)
+		}
+	}
+	next, err := l.list(ctx, pbnd, from, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	var cursor []string
+	for _, k := range next {
+		cursor = append(cursor, strconv.Itoa(k))
+	}
+	return l.entries, strings.Join(cursor, "."), nil
+}
+
+// directoryLister lists a page of the entries of a directory.
+type directoryLister struct {
+	i    *gatewayHandler
+	opts listingOptions
+	// padLen is the length of the index prefixed to the names of the links
+	// of shards, 0 for a basic directory.
+	padLen  int
+	entries []listingEntry
+}
+
+// list lists the entries below nd, the node at position, starting at the
+// position from below it. It returns the position of the next entry once
+// the page is full.
+func (l *directoryLister) list(ctx context.Context, nd *dag.ProtoNode, from []int, position []int) ([]int, error) {
+	links := nd.Links()
+	start := 0
+	if len(from) > 0 {
+		start = from[0]
+		if start >= len(links) {
+			return nil, errUnknownCursor
+		}
+	}
+	for k := start; k < len(links); k++ {
+		link := links[k]
+		pos := append(position[:len(position):len(position)], k)
+		var below []int
+		if k == start && len(from) > 1 {
+			below = from[1:]
+		}
+
+		if l.padLen > 0 && len(link.Name) == l.padLen {
+			child, err := link.GetNode(ctx, l.i.api.Dag())
+			if err != nil {
+				return nil, err
+			}
+			shard, ok := child.(*dag.ProtoNode)
+			if !ok {
+				return nil, dag.ErrNotProtobuf
+			}
+			next, err := l.list(ctx, shard, below, pos)
+			if err != nil || next != nil {
+				return next, err
+			}
+			continue
+		}
+		if below != nil || len(link.Name) < l.padLen {
+			return nil, errUnknownCursor
+		}
+
+		if l.opts.limit > 0 && len(l.entries) == l.opts.limit {
+			return pos, nil
+		}
+		entry := listingEntry{Name: link.Name[l.padLen:], Hash: link.Cid.String()}
+		if l.opts.sizes {
+			entry.Size = l.i.entrySize(ctx, link.Cid)
+		}
+		l.entries = append(l.entries, entry)
+	}
+	return nil, nil
+}
+
+func (i *gatewayHandler) entrySize(ctx context.Context, c cid.Cid) *uint64 {
+	f, err := i.api.Unixfs().Get(ctx, ipath.IpfsPath(c))
+	if err != nil {
+		// Path may not be resolved. Continue anyways.
+		return nil
+	}
+	defer f.Close()
+	s, err := f.Size()
+	if err != nil {
+		// Size may not be defined/supported. Continue anyways.
+		return nil
+	}
+	size := uint64(s)
+	return &size
+}
+
+// setNextPageLink points clients to the next page of a listing.
+func setNextPageLink(w http.ResponseWriter, r *http.Request, originalUrlPath string, next string) {
+	q := r.URL.Query()
+	q.Set("after", next)
+	u := url.URL{Path: originalUrlPath, RawQuery: q.Encode()}
+	w.Header().Set("Link", `<`+u.String()+`>; rel="next"`)
+}
+
+// acceptsJSON returns true if the client prefers JSON over HTML.
+func acceptsJSON(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept") {
+		for _, spec := range strings.Split(header, ",") {
+			switch strings.TrimSpace(strings.SplitN(spec, ";", 2)[0]) {
+			case jsonResponseFormat:
+				return true
+			case htmlResponseFormat:
+				return false
+			}
+		}
+	}
+	return false
+}
+
+func (i *gatewayHandler) serveDirectoryJSON(w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, urlPath, originalUrlPath string, opts listingOptions) {
+	responseEtag := `"DirIndex-json_CID-` + resolvedPath.Cid().String() + `"`
+	if etagMatches(r, responseEtag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Etag", responseEtag)
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	entries, next, err := i.listDirectory(r.Context(), resolvedPath, opts)
+	if err != nil {
+		webListingError(w, err)
+		return
+	}
+	if entries == nil {
+		entries = []listingEntry{}
+	}
+	if next != "" {
+		setNextPageLink(w, r, originalUrlPath, next)
+	}
+
+	err = json.NewEncoder(w).Encode(directoryListing{
+		Path:    urlPath,
+		Hash:    resolvedPath.Cid().String(),
+		Entries: entries,
+		Next:    next,
+	})
+	if err != nil {
+		log.Debugf("error writing the listing of %s: %s", urlPath, err)
+	}
+}
+
+func webListingError(w http.ResponseWriter, err error) {
+	if err == errUnknownCursor {
+		webError(w, "failed to list directory", err, http.StatusBadRequest)
+		return
+	}
+	internalWebError(w, err)
+}
@@ -0,0 +1,310 @@
+package corehttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// byteRange is a single, satisfiable range of a Range request.
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r byteRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// parseByteRanges parses a Range header as defined by RFC 7233. Ranges that
+// start past the end of the content are dropped; errNoOverlap is returned if
+// none are left.
+func parseByteRanges(s string, size int64) ([]byteRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errors.New("invalid range")
+	}
+	var ranges []byteRange
+	noOverlap := false
+	for _, spec := range strings.Split(s[len(b):], ",") {
+		spec = textproto.TrimString(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, errors.New("invalid range")
+		}
+		start, end := textproto.TrimString(spec[:i]), textproto.TrimString(spec[i+1:])
+		var r byteRange
+		if start == "" {
+			// suffix range: the last N bytes
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errors.New("invalid range")
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		if r.length == 0 {
+			noOverlap = true
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// coalesceByteRanges sorts the ranges and merges the ones that overlap or are
+// adjacent, so every part of the content is fetched and sent at most once and
+// the file is read front to back.
+func coalesceByteRanges(ranges []byteRange) []byteRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+	sorted := make([]byteRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start < sorted[j].start })
+
+	out := sorted[:1]
+	for _, r := range sorted[1:] {
+		last := &out[len(out)-1]
+		if r.start <= last.start+last.length {
+			if end := r.start + r.length; end > last.start+last.length {
+				last.length = end - last.start
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// isMultiRangeRequest returns true for requests asking for more than one
+// range, which http.ServeContent can't serve efficiently: it neither merges
+// overlapping ranges nor honours ranges adding up to more than the file.
+func isMultiRangeRequest(r *http.Request) bool {
+	rangeHeader := r.Header.Get("Range")
+	// If-Range needs the validator logic of http.ServeContent
+	return strings.Contains(rangeHeader, ",") && r.Header.Get("If-Range") == ""
+}
+
+// etagListMatches returns whether the list of entity tags of an If-Match or
+// If-None-Match header matches etag, as defined by RFC 7232. Weak tags only
+// match in a weak comparison.
+func etagListMatches(list string, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	for _, t := range strings.Split(list, ",") {
+		t = textproto.TrimString(t)
+		switch {
+		case t == "*":
+			return true
+		case weak:
+			if strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		case !strings.HasPrefix(t, "W/") && t == etag && !strings.HasPrefix(etag, "W/"):
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions evaluates the conditional headers of a request for the
+// content with the Etag header already set on w and modified at modtime, in
+// the order of RFC 7232, section 6. It responds with 304 or 412 and returns
+// false if the content must not be served, just like http.ServeContent.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
+	etag := w.Header().Get("Etag")
+	ifUnmodifiedSince, ifModifiedSince := time.Time{}, time.Time{}
+	if modtime.IsZero() || modtime.Equal(time.Unix(0, 0)) {
+		modtime = time.Time{}
+	} else {
+		modtime = modtime.Truncate(time.Second)
+		if t, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil {
+			ifUnmodifiedSince = t
+		}
+		if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+			ifModifiedSince = t
+		}
+	}
+
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagListMatches(im, etag, false) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return false
+		}
+	} else if !ifUnmodifiedSince.IsZero() && modtime.After(ifUnmodifiedSince) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagListMatches(inm, etag, true) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return false
+			}
+			notModified = true
+		}
+	} else if !ifModifiedSince.IsZero() && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		notModified = !modtime.After(ifModifiedSince)
+	}
+	if notModified {
+		h := w.Header()
+		delete(h, "Content-Type")
+		delete(h, "Content-Length")
+		if etag != "" {
+			delete(h, "Last-Modified")
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return false
+	}
+	return true
+}
+
+// serveMultiRange responds to a multi-range request for the content modified
+// at modtime, once its preconditions are met. Each range is read by seeking
+// the content to its start, which only fetches the blocks covering the range
+// instead of reading the file from the start.
+func serveMultiRange(w http.ResponseWriter, r *http.Request, ctype string, modtime time.Time, size int64, content io.ReadSeeker) {
+	if !checkPreconditions(w, r, modtime) {
+		return
+	}
+	if !modtime.IsZero() && !modtime.Equal(time.Unix(0, 0)) {
+		w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+
+	ranges, err := parseByteRanges(r.Header.Get("Range"), size)
+	if err != nil {
+		if err == errNoOverlap {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		}
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	ranges = coalesceByteRanges(ranges)
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	status := http.StatusPartialContent
+	if len(ranges) == 0 {
+		// only empty specs, serve everything
+		ranges = []byteRange{{0, size}}
+		status = http.StatusOK
+	}
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		w.Header().Set("Content-Type", ctype)
+		w.Header().Set("Content-Length", strconv.FormatInt(ra.length, 10))
+		if status == http.StatusPartialContent {
+			w.Header().Set("Content-Range", ra.contentRange(size))
+		}
+		w.WriteHeader(status)
+		if r.Method == http.MethodHead {
+			return
+		}
+		if err := copyRange(w, content, ra); err != nil {
+			log.Debugf("error serving range: %s", err)
+		}
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.Header().Set("Content-Length", strconv.FormatInt(multipartSize(ranges, mw.Boundary(), ctype, size), 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if r.Method == http.MethodHead {
+		return
+	}
+	for _, ra := range ranges {
+		part, err := mw.CreatePart(ra.mimeHeader(ctype, size))
+		if err != nil {
+			log.Debugf("error serving range: %s", err)
+			return
+		}
+		if err := copyRange(part, content, ra); err != nil {
+			log.Debugf("error serving range: %s", err)
+			return
+		}
+	}
+	if err := mw.Close(); err != nil {
+		log.Debugf("error serving range: %s", err)
+	}
+}
+
+func copyRange(w io.Writer, content io.ReadSeeker, ra byteRange) error {
+	if _, err := content.Seek(ra.start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, content, ra.length)
+	return err
+}
+
+// multipartSize returns the exact length of the multipart/byteranges body
+// for the given ranges.
+func multipartSize(ranges []byteRange, boundary string, ctype string, size int64) int64 {
+	var cw countingWriter
+	mw := multipart.NewWriter(&cw)
+	_ = mw.SetBoundary(boundary)
+	var total int64
+	for _, ra := range ranges {
+		_, _ = mw.CreatePart(ra.mimeHeader(ctype, size))
+		total += ra.length
+	}
+	_ = mw.Close()
+	return total + int64(cw)
+}
+
+// countingWriter counts how many bytes have been written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
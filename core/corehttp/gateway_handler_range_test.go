@@ -0,0 +1,52 @@
+package corehttp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseByteRanges(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		size   int64
+		ranges []byteRange
+		err    bool
+	}{
+		{"bytes=0-9", 100, []byteRange{{0, 10}}, false},
+		{"bytes=0-9, 20-", 100, []byteRange{{0, 10}, {20, 80}}, false},
+		{"bytes=-10", 100, []byteRange{{90, 10}}, false},
+		{"bytes=-200", 100, []byteRange{{0, 100}}, false},
+		{"bytes=90-200", 100, []byteRange{{90, 10}}, false},
+		{"bytes=0-9,200-300", 100, []byteRange{{0, 10}}, false},
+		{"bytes=200-300", 100, nil, true},
+		{"bytes=9-0", 100, nil, true},
+		{"bytes=a-b", 100, nil, true},
+		{"items=0-9", 100, nil, true},
+	} {
+		ranges, err := parseByteRanges(test.header, test.size)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error %v", test.header, err)
+			continue
+		}
+		if !reflect.DeepEqual(ranges, test.ranges) {
+			t.Errorf("%q: got %v, expected %v", test.header, ranges, test.ranges)
+		}
+	}
+}
+
+func TestCoalesceByteRanges(t *testing.T) {
+	for _, test := range []struct {
+		in, out []byteRange
+	}{
+		{[]byteRange{{0, 10}}, []byteRange{{0, 10}}},
+		{[]byteRange{{20, 10}, {0, 10}}, []byteRange{{0, 10}, {20, 10}}},
+		{[]byteRange{{0, 10}, {5, 10}}, []byteRange{{0, 15}}},
+		{[]byteRange{{0, 10}, {10, 10}}, []byteRange{{0, 20}}},
+		{[]byteRange{{0, 100}, {10, 10}, {200, 1}}, []byteRange{{0, 100}, {200, 1}}},
+	} {
+		out := coalesceByteRanges(test.in)
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%v: got %v, expected %v", test.in, out, test.out)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package corehttp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	gopath "path"
+	"strconv"
+	"strings"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+const (
+	// redirectsFileName is looked up at the root of origin-isolated
+	// websites, see https://docs.netlify.com/routing/redirects/
+	redirectsFileName = "_redirects"
+
+	// redirectsMaxSize keeps the parsing of every missing path cheap.
+	redirectsMaxSize = 64 * 1024
+)
+
+// redirectsAppliedKey marks requests rewritten by a 200 rule, so the rules
+// are not evaluated again for the rewritten path.
+type redirectsAppliedKey struct{}
+
+// redirectRule is a single `from to [status]` line of a _redirects file.
+type redirectRule struct {
+	from   string
+	to     string
+	status int
+}
+
+var redirectStatuses = map[int]bool{
+	http.StatusOK:                         true, // rewrite
+	http.StatusMovedPermanently:           true,
+	http.StatusFound:                      true,
+	http.StatusSeeOther:                   true,
+	http.StatusTemporaryRedirect:          true,
+	http.StatusPermanentRedirect:          true,
+	http.StatusNotFound:                   true,
+	http.StatusGone:                       true,
+	http.StatusUnavailableForLegalReasons: true,
+}
+
+func isRedirectStatus(status int) bool {
+	return status >= 300 && status < 400
+}
+
+// parseRedirects parses the rules of a _redirects file. Every line holds a
+// source path, a destination and an optional status code, 301 by default.
+// Source paths may use :placeholders for a single path segment and a
+// trailing * splat matching the rest of the path; both can be used in the
+// destination, the splat as :splat.
+func parseRedirects(r io.Reader) ([]redirectRule, error) {
+	var rules []redirectRule
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected 'from to [status]'", line)
+		}
+		rule := redirectRule{from: fields[0], to: fields[1], status: http.StatusMovedPermanently}
+		if !strings.HasPrefix(rule.from, "/") {
+			return nil, fmt.Errorf("line %d: source %q must be an absolute path", line, rule.from)
+		}
+		if i := strings.Index(rule.from, "*"); i >= 0 && i != len(rule.from)-1 {
+			return nil, fmt.Errorf("line %d: splat is only allowed at the end of the source", line)
+		}
+		if len(fields) == 3 {
+			status, err := strconv.Atoi(fields[2])
+			if err != nil || !redirectStatuses[status] {
+				return nil, fmt.Errorf("line %d: unsupported status %q", line, fields[2])
+			}
+			rule.status = status
+		}
+		if !isRedirectStatus(rule.status) && !strings.HasPrefix(rule.to, "/") {
+			return nil, fmt.Errorf("line %d: status %d requires a destination path on the website", line, rule.status)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// match returns the destination for the website path p, if the rule applies.
+func (rule redirectRule) match(p string) (string, bool) {
+	from := strings.Split(strings.Trim(rule.from, "/"), "/")
+	req := strings.Split(strings.Trim(p, "/"), "/")
+
+	params := make(map[string]string)
+	for i, seg := range from {
+		if seg == "*" && i == len(from)-1 {
+			params["splat"] = strings.Join(req[i:], "/")
+			return expandPlaceholders(rule.to, params), true
+		}
+		if i >= len(req) {
+			return "", false
+		}
+		if strings.HasPrefix(seg, ":") {
+			params[seg[1:]] = req[i]
+			continue
+		}
+		if seg != req[i] {
+			return "", false
+		}
+	}
+	if len(req) != len(from) {
+		return "", false
+	}
+	return expandPlaceholders(rule.to, params), true
+}
+
+// expandPlaceholders replaces the :name placeholders in s. Unknown ones are
+// left as they are.
+func expandPlaceholders(s string, params map[string]string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, ':')
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:i])
+		s = s[i+1:]
+		j := 0
+		for j < len(s) && isPlaceholderChar(s[j]) {
+			j++
+		}
+		if v, ok := params[s[:j]]; ok && j > 0 {
+			b.WriteString(v)
+		} else {
+			b.WriteString(":" + s[:j])
+		}
+		s = s[j:]
+	}
+}
+
+func isPlaceholderChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// serveRedirectsIfPresent applies the rules of the website's _redirects file
+// to a path that doesn't exist. It is only done for origin-isolated requests
+// (subdomain or DNSLink gateways), where the content root is the website
+// root. It returns true if the request has been answered.
+func (i *gatewayHandler) serveRedirectsIfPresent(w http.ResponseWriter, r *http.Request, parsedPath ipath.Path) bool {
+	if _, ok := r.Context().Value("gw-hostname").(string); !ok {
+		return false
+	}
+	if applied, _ := r.Context().Value(redirectsAppliedKey{}).(bool); applied {
+		return false
+	}
+
+	// /ipfs/<root>/... or /ipns/<root>/...
+	segments := strings.SplitN(strings.TrimPrefix(parsedPath.String(), "/"), "/", 3)
+	if len(segments) < 2 {
+		return false
+	}
+	root := "/" + segments[0] + "/" + segments[1]
+	sitePath := "/"
+	if len(segments) == 3 {
+		sitePath += segments[2]
+	}
+
+	rules, err := i.getRedirectRules(r.Context(), root)
+	if err != nil {
+		internalWebError(w, err)
+		return true
+	}
+
+	for _, rule := range rules {
+		to, ok := rule.match(sitePath)
+		if !ok {
+			continue
+		}
+		if !strings.Contains(to, "?") && r.URL.RawQuery != "" {
+			to += "?" + r.URL.RawQuery
+		}
+
+		switch {
+		case isRedirectStatus(rule.status):
+			http.Redirect(w, r, to, rule.status)
+		case rule.status == http.StatusOK:
+			// rewrite: serve the destination as if it was requested
+			u := *r.URL
+			u.Path, u.RawQuery = root+gopath.Clean(strings.SplitN(to, "?", 2)[0]), ""
+			if q := strings.SplitN(to, "?", 2); len(q) == 2 {
+				u.RawQuery = q[1]
+			}
+			u.RawPath = ""
+			rewritten := r.WithContext(context.WithValue(r.Context(), redirectsAppliedKey{}, true))
+			rewritten.URL = &u
+			i.getOrHeadHandler(w, rewritten)
+		default:
+			// custom error page
+			dest := strings.SplitN(to, "?", 2)[0]
+			if !i.serveFileWithStatus(w, r, ipath.New(root+gopath.Clean(dest)), rule.status) {
+				http.Error(w, http.StatusText(rule.status), rule.status)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (i *gatewayHandler) getRedirectRules(ctx context.Context, root string) ([]redirectRule, error) {
+	resolved, err := i.api.ResolvePath(ctx, ipath.New(root+"/"+redirectsFileName))
+	if err != nil {
+		// no _redirects file
+		return nil, nil
+	}
+	node, err := i.api.Unixfs().Get(ctx, resolved)
+	if err != nil {
+		return nil, err
+	}
+	defer node.Close()
+
+	f, ok := node.(files.File)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a file", redirectsFileName)
+	}
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size > redirectsMaxSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", redirectsFileName, redirectsMaxSize)
+	}
+	rules, err := parseRedirects(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", redirectsFileName, err)
+	}
+	return rules, nil
+}
+
+// serveFileWithStatus writes the file at p with the given status code, for
+// custom error pages.
+func (i *gatewayHandler) serveFileWithStatus(w http.ResponseWriter, r *http.Request, p ipath.Path, status int) bool {
+	node, err := i.api.Unixfs().Get(r.Context(), p)
+	if err != nil {
+		return false
+	}
+	defer node.Close()
+
+	f, ok := node.(files.File)
+	if !ok {
+		return false
+	}
+	size, err := f.Size()
+	if err != nil {
+		return false
+	}
+
+	ctype := mime.TypeByExtension(gopath.Ext(p.String()))
+	if ctype == "" {
+		ctype = "text/html"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return true
+	}
+	_, err = io.CopyN(w, f, size)
+	if err != nil {
+		log.Debugf("error serving %s: %s", p, err)
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package corehttp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRedirects(t *testing.T) {
+	rules, err := parseRedirects(strings.NewReader("# comment\n\n/a /b\n/c/:id /d/:id.html 302\n/e/* /f/:splat 200\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || rules[0].status != 301 || rules[1].status != 302 || rules[2].status != 200 {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+
+	for _, bad := range []string{
+		"/a",
+		"a /b",
+		"/a /b 200 extra",
+		"/a /b 500",
+		"/a/*/b /c",
+		"/a https://example.org 200",
+	} {
+		if _, err := parseRedirects(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestRedirectRuleMatch(t *testing.T) {
+	for _, test := range []struct {
+		from, to, path string
+		ok             bool
+		dest           string
+	}{
+		{"/a", "/b", "/a", true, "/b"},
+		{"/a", "/b", "/a/", true, "/b"},
+		{"/a", "/b", "/a/c", false, ""},
+		{"/p/:year/:id", "/q/:year-:id", "/p/2020/x", true, "/q/2020-x"},
+		{"/p/:year/:id", "/q/:year", "/p/2020", false, ""},
+		{"/s/*", "/t/:splat", "/s/x/y", true, "/t/x/y"},
+		{"/s/*", "/t/:splat", "/s", true, "/t/"},
+		{"/*", "https://example.org/:splat", "/x", true, "https://example.org/x"},
+		{"/:id", "/:identifier", "/x", true, "/:identifier"},
+	} {
+		dest, ok := redirectRule{from: test.from, to: test.to}.match(test.path)
+		if ok != test.ok || dest != test.dest {
+			t.Errorf("%s -> %s on %s: got %q %t, expected %q %t", test.from, test.to, test.path, dest, ok, test.dest, test.ok)
+		}
+	}
+}
@@ -1,11 +1,23 @@
 package corehttp
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
@@ -14,19 +26,39 @@ import (
 	version "github.com/ipfs/go-ipfs"
 	core "github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/core/coredag"
+	"github.com/ipfs/go-ipfs/core/coreunix"
+	"github.com/ipfs/go-ipfs/core/denylist"
+	"github.com/ipfs/go-ipfs/core/node/libp2p"
 	repo "github.com/ipfs/go-ipfs/repo"
 	namesys "github.com/ipfs/go-namesys"
 
+	proto "github.com/gogo/protobuf/proto"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
 	datastore "github.com/ipfs/go-datastore"
 	syncds "github.com/ipfs/go-datastore/sync"
 	config "github.com/ipfs/go-ipfs-config"
 	files "github.com/ipfs/go-ipfs-files"
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipns "github.com/ipfs/go-ipns"
+	dag "github.com/ipfs/go-merkledag"
 	path "github.com/ipfs/go-path"
+	ft "github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfs/hamt"
 	iface "github.com/ipfs/interface-go-ipfs-core"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
 	nsopts "github.com/ipfs/interface-go-ipfs-core/options/namesys"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	gocar "github.com/ipld/go-car"
 	ci "github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	routing "github.com/libp2p/go-libp2p-core/routing"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	record "github.com/libp2p/go-libp2p-record"
 	id "github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	mh "github.com/multiformats/go-multihash"
 )
 
 // `ipfs object new unixfs-dir`
@@ -89,6 +121,7 @@ func newNodeWithMockNamesys(ns mockNamesys) (*core.IpfsNode, error) {
 	r := &repo.Mock{
 		C: c,
 		D: syncds.MutexWrap(datastore.NewMapDatastore()),
+		K: keystore.NewMemKeystore(),
 	}
 	n, err := core.NewNode(context.Background(), &core.BuildCfg{Repo: r})
 	if err != nil {
@@ -125,7 +158,10 @@ func newTestServerAndNode(t *testing.T, ns mockNamesys) (*httptest.Server, iface
 	if err != nil {
 		t.Fatal(err)
 	}
+	return newTestServerWithNode(t, n)
+}
 
+func newTestServerWithNode(t *testing.T, n *core.IpfsNode) (*httptest.Server, iface.CoreAPI, context.Context) {
 	cfg, err := n.Repo.Config()
 	if err != nil {
 		t.Fatal(err)
@@ -352,6 +388,144 @@ func TestPretty404(t *testing.T) {
 	}
 }
 
+func TestRedirectsFile(t *testing.T) {
+	ns := mockNamesys{}
+	ts, api, ctx := newTestServerAndNode(t, ns)
+
+	f1 := files.NewMapDirectory(map[string]files.Node{
+		"_redirects": files.NewBytesFile([]byte(`# comment
+/old-page        /new-page
+/temp            /new-page                302
+/posts/:year/:id /blog/:year/:id.html     301
+/app/*           /index.html              200
+/gone            /410.html                410
+/docs/*          https://docs.example.org/:splat
+/*               /404.html                404
+`)),
+		"index.html": files.NewBytesFile([]byte("SPA")),
+		"new-page":   files.NewBytesFile([]byte("New page")),
+		"404.html":   files.NewBytesFile([]byte("Not here")),
+		"410.html":   files.NewBytesFile([]byte("Gone forever")),
+	})
+
+	k, err := api.Unixfs().Add(ctx, f1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := "example.net"
+	ns["/ipns/"+host] = path.FromString(k.String())
+
+	for _, test := range []struct {
+		path     string
+		host     string
+		status   int
+		location string
+		text     string
+	}{
+		{"/new-page", host, http.StatusOK, "", "New page"},
+		{"/old-page", host, http.StatusMovedPermanently, "/new-page", ""},
+		{"/temp?x=1", host, http.StatusFound, "/new-page?x=1", ""},
+		{"/posts/2021/hello", host, http.StatusMovedPermanently, "/blog/2021/hello.html", ""},
+		{"/app/some/route", host, http.StatusOK, "", "SPA"},
+		{"/gone", host, http.StatusGone, "", "Gone forever"},
+		{"/docs/a/b", host, http.StatusMovedPermanently, "https://docs.example.org/a/b", ""},
+		{"/nope", host, http.StatusNotFound, "", "Not here"},
+		// rules only apply to origin-isolated websites
+		{"/ipns/example.net/old-page", "", http.StatusNotFound, "", ""},
+	} {
+		c := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.host != "" {
+			req.Host = test.host
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("error requesting %s: %s", test.path, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("error reading response from %s: %s", test.path, err)
+		}
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("got %d, expected %d, from %s", resp.StatusCode, test.status, test.path)
+		}
+		if loc := resp.Header.Get("Location"); loc != test.location {
+			t.Fatalf("got location %q, expected %q, from %s", loc, test.location, test.path)
+		}
+		if test.text != "" && string(body) != test.text {
+			t.Fatalf("unexpected response body from %s: got %q, expected %q", test.path, body, test.text)
+		}
+	}
+}
+
+func TestWritableGatewayTokens(t *testing.T) {
+	ns := mockNamesys{}
+	_, api, ctx := newTestServerAndNode(t, ns)
+
+	root, err := api.Unixfs().Add(ctx, files.NewMapDirectory(map[string]files.Node{
+		"a.txt": files.NewBytesFile([]byte("a")),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(newGatewayHandler(GatewayConfig{
+		Writable: true,
+		WriteTokens: map[string]WriteToken{
+			"uploader": {Secret: "upload-secret", Paths: []string{"/ipfs/"}},
+			"website":  {Secret: "website-secret", Keys: []string{"website"}},
+			"any-path": {Secret: "any-path-secret", Paths: []string{"/"}},
+		},
+	}, api))
+	t.Cleanup(ts.Close)
+
+	self := "/ipns/QmTFauExutTsy4XP6JbMFcw2Wa9645HJt2bTqL6qYDCKfe/b.txt"
+	for _, test := range []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{http.MethodPost, "/ipfs/", "", http.StatusUnauthorized},
+		{http.MethodPost, "/ipfs/", "wrong", http.StatusUnauthorized},
+		{http.MethodPost, "/ipfs/", "upload-secret", http.StatusCreated},
+		{http.MethodPut, root.String() + "/b.txt", "upload-secret", http.StatusCreated},
+		{http.MethodDelete, root.String() + "/a.txt", "upload-secret", http.StatusCreated},
+		{http.MethodPut, root.String() + "/b.txt", "website-secret", http.StatusForbidden},
+		{http.MethodPut, self, "upload-secret", http.StatusForbidden},
+		{http.MethodPut, self, "website-secret", http.StatusForbidden},
+		// publishing needs the key
+		{http.MethodPut, self, "any-path-secret", http.StatusForbidden},
+		{http.MethodPut, root.String() + "/b.txt", "any-path-secret", http.StatusCreated},
+		// reads stay public
+		{http.MethodGet, root.String() + "/a.txt", "", http.StatusOK},
+	} {
+		req, err := http.NewRequest(test.method, ts.URL+test.path, strings.NewReader("b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		resp, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s with %q: got %d, expected %d", test.method, test.path, test.token, resp.StatusCode, test.status)
+		}
+	}
+}
+
 func TestIPNSHostnameRedirect(t *testing.T) {
 	ns := mockNamesys{}
 	ts, api, ctx := newTestServerAndNode(t, ns)
@@ -740,3 +914,893 @@ func TestVersion(t *testing.T) {
 		t.Fatalf("response doesn't contain protocol version:\n%s", s)
 	}
 }
+
+func TestGatewayRawBlock(t *testing.T) {
+	ts, api, ctx := newTestServerAndNode(t, nil)
+
+	k, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte("fnord")), options.Unixfs.RawLeaves(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path   string
+		accept string
+	}{
+		{k.String() + "?format=raw", ""},
+		{k.String(), "application/vnd.ipld.raw"},
+		{k.String(), "text/html, application/vnd.ipld.raw;q=0.9"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status is %d, expected 200", test.path, res.StatusCode)
+		}
+		if ctype := res.Header.Get("Content-Type"); ctype != "application/vnd.ipld.raw" {
+			t.Fatalf("%s: unexpected content type %q", test.path, ctype)
+		}
+		if etag := res.Header.Get("Etag"); etag != `"`+k.Cid().String()+`.raw"` {
+			t.Fatalf("%s: unexpected etag %q", test.path, etag)
+		}
+		if string(body) != "fnord" {
+			t.Fatalf("%s: unexpected body %q", test.path, body)
+		}
+	}
+}
+
+func TestGatewayCar(t *testing.T) {
+	ts, api, ctx := newTestServerAndNode(t, nil)
+
+	k, err := api.Unixfs().Add(ctx, files.NewMapDirectory(map[string]files.Node{
+		"a.txt": files.NewBytesFile([]byte("a")),
+		"sub": files.NewMapDirectory(map[string]files.Node{
+			"b.txt": files.NewBytesFile([]byte("b")),
+		}),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := api.ResolvePath(ctx, ipath.Join(k, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path   string
+		accept string
+		root   cid.Cid
+		blocks int
+	}{
+		{k.String() + "?format=car", "", k.Cid(), 4},
+		{k.String() + "/sub", "application/vnd.ipld.car", sub.Cid(), 2},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status is %d, expected 200", test.path, res.StatusCode)
+		}
+		if ctype := res.Header.Get("Content-Type"); ctype != "application/vnd.ipld.car; version=1" {
+			t.Fatalf("%s: unexpected content type %q", test.path, ctype)
+		}
+
+		cr, err := gocar.NewCarReader(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cr.Header.Roots) != 1 || !cr.Header.Roots[0].Equals(test.root) {
+			t.Fatalf("%s: unexpected roots %v", test.path, cr.Header.Roots)
+		}
+		var blocks int
+		for {
+			_, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks++
+		}
+		res.Body.Close()
+		if blocks != test.blocks {
+			t.Fatalf("%s: got %d blocks, expected %d", test.path, blocks, test.blocks)
+		}
+	}
+}
+
+func TestGatewayDirectoryListingJSON(t *testing.T) {
+	ts, api, ctx := newTestServerAndNode(t, nil)
+
+	k, err := api.Unixfs().Add(ctx, files.NewMapDirectory(map[string]files.Node{
+		"a.txt": files.NewBytesFile([]byte("a")),
+		"b.txt": files.NewBytesFile([]byte("bb")),
+		"c.txt": files.NewBytesFile([]byte("ccc")),
+		"d":     files.NewMapDirectory(map[string]files.Node{}),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(query string, accept string) (int, directoryListing, *http.Response) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+k.String()+"/"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var listing directoryListing
+		if res.StatusCode == http.StatusOK && res.Header.Get("Content-Type") == "application/json" {
+			if err := json.NewDecoder(res.Body).Decode(&listing); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res.StatusCode, listing, res
+	}
+	names := func(l directoryListing) string {
+		var out []string
+		for _, e := range l.Entries {
+			out = append(out, e.Name)
+		}
+		return strings.Join(out, ",")
+	}
+
+	status, listing, _ := list("", "application/json")
+	if status != http.StatusOK || names(listing) != "a.txt,b.txt,c.txt,d" || listing.Next != "" {
+		t.Fatalf("unexpected listing (%d): %+v", status, listing)
+	}
+	if listing.Hash != k.Cid().String() || listing.Entries[2].Size == nil || *listing.Entries[2].Size != 3 {
+		t.Fatalf("unexpected listing: %+v", listing)
+	}
+
+	status, listing, res := list("?limit=2", "application/json")
+	if status != http.StatusOK || names(listing) != "a.txt,b.txt" || listing.Next != "2" {
+		t.Fatalf("unexpected first page (%d): %+v", status, listing)
+	}
+	if link := res.Header.Get("Link"); link != `<`+k.String()+`/?after=2&limit=2>; rel="next"` {
+		t.Fatalf("unexpected Link header %q", link)
+	}
+	status, listing, _ = list("?limit=2&after=2&format=json", "")
+	if status != http.StatusOK || names(listing) != "c.txt,d" || listing.Next != "" {
+		t.Fatalf("unexpected second page (%d): %+v", status, listing)
+	}
+
+	status, listing, _ = list("?sizes=false", "application/json")
+	if status != http.StatusOK || listing.Entries[0].Size != nil {
+		t.Fatalf("unexpected listing without sizes (%d): %+v", status, listing)
+	}
+
+	for _, after := range []string{"nope", "4", "0.1", "-1"} {
+		if status, _, _ := list("?after="+after, "application/json"); status != http.StatusBadRequest {
+			t.Fatalf("expected 400 for the unknown cursor %s, got %d", after, status)
+		}
+	}
+	if status, _, _ := list("?limit=-1", "application/json"); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid limit, got %d", status)
+	}
+
+	// HTML listings are paginated the same way
+	status, _, res = list("?limit=3", "text/html")
+	if status != http.StatusOK || res.Header.Get("Link") != `<`+k.String()+`/?after=3&limit=3>; rel="next"` {
+		t.Fatalf("unexpected HTML page (%d), Link: %q", status, res.Header.Get("Link"))
+	}
+}
+
+func TestGatewayShardedDirectoryListing(t *testing.T) {
+	ts, api, ctx := newTestServerAndNode(t, nil)
+
+	shard, err := hamt.NewShard(api.Dag(), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		data := []byte(fmt.Sprint(i))
+		nd := dag.NodeWithData(ft.FilePBData(data, uint64(len(data))))
+		if err := api.Dag().Add(ctx, nd); err != nil {
+			t.Fatal(err)
+		}
+		if err := shard.Set(ctx, fmt.Sprintf("file%d", i), nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := shard.Node()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Dag().Add(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(query string) directoryListing {
+		res, err := http.Get(ts.URL + "/ipfs/" + root.Cid().String() + "/?format=json&sizes=false" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", query, res.StatusCode)
+		}
+		var listing directoryListing
+		if err := json.NewDecoder(res.Body).Decode(&listing); err != nil {
+			t.Fatal(err)
+		}
+		return listing
+	}
+
+	all := list("")
+	if len(all.Entries) != 1000 || all.Next != "" {
+		t.Fatalf("expected 1000 entries at once, got %d, next %q", len(all.Entries), all.Next)
+	}
+	var paged []listingEntry
+	nested := false
+	for query := "&limit=64"; ; {
+		page := list(query)
+		paged = append(paged, page.Entries...)
+		if page.Next == "" {
+			break
+		}
+		nested = nested || strings.Contains(page.Next, ".")
+		query = "&limit=64&after=" + page.Next
+	}
+	if !nested {
+		t.Error("expected cursors within the shards below the root")
+	}
+	if len(paged) != len(all.Entries) {
+		t.Fatalf("expected %d entries over the pages, got %d", len(all.Entries), len(paged))
+	}
+	for i := range paged {
+		if paged[i].Name != all.Entries[i].Name {
+			t.Fatalf("entry %d: got %s, expected %s", i, paged[i].Name, all.Entries[i].Name)
+		}
+	}
+}
+
+func TestGatewayIpnsRecord(t *testing.T) {
+	n, err := newNodeWithMockNamesys(mockNamesys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, _, ctx := newTestServerWithNode(t, n)
+
+	sk, _, err := ci.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := ipns.Create(sk, []byte("/ipfs/bafkqaaa"), 1, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := proto.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Routing.PutValue(ctx, ipns.RecordKey(pid), rec); err != nil {
+		t.Fatal(err)
+	}
+
+	name := peer.ToCid(pid).String()
+	for _, test := range []struct {
+		path   string
+		accept string
+		status int
+	}{
+		{"/ipns/" + name + "?format=ipns-record", "", http.StatusOK},
+		{"/ipns/" + pid.Pretty(), "application/vnd.ipfs.ipns-record", http.StatusOK},
+		{"/ipns/" + name + "/sub?format=ipns-record", "", http.StatusBadRequest},
+		{"/ipns/example.com?format=ipns-record", "", http.StatusBadRequest},
+		{"/ipns/QmTFauExutTsy4XP6JbMFcw2Wa9645HJt2bTqL6qYDCKfe?format=ipns-record", "", http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != test.status {
+			t.Fatalf("%s: got %d, expected %d", test.path, res.StatusCode, test.status)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if ctype := res.Header.Get("Content-Type"); ctype != "application/vnd.ipfs.ipns-record" {
+			t.Fatalf("%s: unexpected content type %q", test.path, ctype)
+		}
+		if !bytes.Equal(body, rec) {
+			t.Fatalf("%s: unexpected record", test.path)
+		}
+	}
+
+	// nodes can resolve the name through the gateway, verifying the record
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not a record"))
+	}))
+	defer broken.Close()
+
+	validator := record.NamespacedValidator{"ipns": ipns.Validator{KeyBook: pstoremem.NewPeerstore()}}
+	vs := &libp2p.GatewayValueStore{Gateways: []string{broken.URL, ts.URL}, Validator: validator}
+	got, err := vs.GetValue(ctx, ipns.RecordKey(pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, rec) {
+		t.Fatal("unexpected record from the gateway")
+	}
+
+	vs.Gateways = []string{broken.URL}
+	if _, err := vs.GetValue(ctx, ipns.RecordKey(pid)); err != routing.ErrNotFound {
+		t.Fatalf("expected ErrNotFound without valid records, got %v", err)
+	}
+}
+
+func TestGatewayDagCbor(t *testing.T) {
+	ts, api, ctx := newTestServerAndNode(t, nil)
+
+	file, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := cbor.WrapObject(map[string]interface{}{
+		"name":   "<doc>",
+		"file":   file.Cid(),
+		"nested": map[string]interface{}{"n": 1},
+	}, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Dag().Add(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+	root := "/ipfs/" + nd.Cid().String()
+
+	for _, test := range []struct {
+		path   string
+		accept string
+		status int
+		ctype  string
+		body   string
+	}{
+		{root, "", http.StatusOK, "application/json", `{"file":{"/":"` + file.Cid().String() + `"},"name":"\u003cdoc\u003e","nested":{"n":1}}`},
+		{root + "?format=cbor", "", http.StatusOK, "application/cbor", string(nd.RawData())},
+		{root, "application/cbor", http.StatusOK, "application/cbor", string(nd.RawData())},
+		{root + "/nested/n", "", http.StatusOK, "application/json", "1"},
+		{root + "/nested", "application/json", http.StatusOK, "application/json", `{"n":1}`},
+		{root + "/file", "", http.StatusOK, "text/plain; charset=utf-8", "hello"},
+		{root + "/missing", "", http.StatusNotFound, "", ""},
+		{root + "?format=tar", "", http.StatusBadRequest, "", ""},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != test.status {
+			t.Fatalf("%s: status is %d, expected %d", test.path, res.StatusCode, test.status)
+		}
+		if test.ctype != "" && res.Header.Get("Content-Type") != test.ctype {
+			t.Fatalf("%s: unexpected content type %q", test.path, res.Header.Get("Content-Type"))
+		}
+		if test.body != "" && string(body) != test.body {
+			t.Fatalf("%s: unexpected body %q", test.path, body)
+		}
+	}
+
+	// browsers get a page linking to the paths and CIDs
+	req, err := http.NewRequest(http.MethodGet, ts.URL+root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	res, err := doWithoutRedirect(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`<a href="/ipfs/` + file.Cid().String() + `">`,
+		`<a href="` + root + `/nested/n">`,
+		`&#34;\u003cdoc\u003e&#34;`,
+	} {
+		if !strings.Contains(string(body), s) {
+			t.Fatalf("expected %q in the HTML view:\n%s", s, body)
+		}
+	}
+}
+
+func TestGatewayDagJSON(t *testing.T) {
+	ts, api, ctx := newTestServerAndNode(t, nil)
+
+	file, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`{"file":{"/":"` + file.Cid().String() + `"},"nested":{"n":1}}`)
+	hash, err := mh.Sum(data, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := blocks.NewBlockWithCid(data, cid.NewCidV1(coredag.DagJSON, hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := coredag.DecodeDagJSONBlock(blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Dag().Add(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+	root := "/ipfs/" + nd.Cid().String()
+
+	for _, test := range []struct {
+		path   string
+		accept string
+		ctype  string
+		body   string
+	}{
+		{root, "", "application/json", string(data)},
+		{root + "?format=cbor", "", "application/cbor", ""},
+		{root + "/nested/n", "", "application/json", "1"},
+		{root + "/file", "", "text/plain; charset=utf-8", "hello"},
+		{root, "text/html", "text/html; charset=utf-8", `<a href="/ipfs/` + file.Cid().String() + `">`},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status is %d: %s", test.path, res.StatusCode, body)
+		}
+		if res.Header.Get("Content-Type") != test.ctype {
+			t.Fatalf("%s: unexpected content type %q", test.path, res.Header.Get("Content-Type"))
+		}
+		if !strings.Contains(string(body), test.body) {
+			t.Fatalf("%s: unexpected body %q", test.path, body)
+		}
+	}
+}
+
+func TestGatewayUnsupportedFormat(t *testing.T) {
+	ts, _, _ := newTestServerAndNode(t, nil)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+emptyDir+"?format=nope", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := doWithoutRedirect(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status is %d, expected 400", res.StatusCode)
+	}
+}
+
+func TestGatewayDirectoryArchive(t *testing.T) {
+	ts, api, ctx := newTestServerAndNode(t, nil)
+
+	k, err := api.Unixfs().Add(ctx, files.NewMapDirectory(map[string]files.Node{
+		"index.html": files.NewBytesFile([]byte("index")),
+		"sub": files.NewMapDirectory(map[string]files.Node{
+			"b.txt": files.NewBytesFile([]byte("b")),
+		}),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(query string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+k.String()+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status is %d, expected 200", query, res.StatusCode)
+		}
+		return res, body
+	}
+
+	expected := map[string]string{
+		"site/":           "",
+		"site/index.html": "index",
+		"site/sub/":       "",
+		"site/sub/b.txt":  "b",
+	}
+
+	res, body := get("?download=tar&filename=site")
+	if ctype := res.Header.Get("Content-Type"); ctype != "application/x-tar" {
+		t.Fatalf("unexpected content type %q", ctype)
+	}
+	if disp := res.Header.Get("Content-Disposition"); !strings.Contains(disp, `filename="site.tar"`) {
+		t.Fatalf("unexpected content disposition %q", disp)
+	}
+	tr := tar.NewReader(bytes.NewReader(body))
+	seen := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := hdr.Name
+		if hdr.Typeflag == tar.TypeDir {
+			name += "/"
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, ok := expected[name]
+		if !ok || want != string(content) {
+			t.Fatalf("unexpected tar entry %q: %q", name, content)
+		}
+		seen++
+	}
+	if seen != len(expected) {
+		t.Fatalf("got %d tar entries, expected %d", seen, len(expected))
+	}
+
+	// only the base name of the given filename is kept
+	res, body = get("?download=zip&filename=../../tmp/site")
+	if ctype := res.Header.Get("Content-Type"); ctype != "application/zip" {
+		t.Fatalf("unexpected content type %q", ctype)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(expected) {
+		t.Fatalf("got %d zip entries, expected %d", len(zr.File), len(expected))
+	}
+	for _, zf := range zr.File {
+		f, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, ok := expected[zf.Name]
+		if !ok || want != string(content) {
+			t.Fatalf("unexpected zip entry %q: %q", zf.Name, content)
+		}
+	}
+
+	for _, filename := range []string{"..", "/", `..\`} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+k.String()+"?download=tar&filename="+url.QueryEscape(filename), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("filename %q: status is %d, expected 400", filename, res.StatusCode)
+		}
+	}
+}
+
+func TestZipArchiveLinkNames(t *testing.T) {
+	for _, name := range []string{"../x", "sub/../../x", `..\x`, ".."} {
+		dir := files.NewMapDirectory(map[string]files.Node{
+			name: files.NewBytesFile([]byte("outside")),
+		})
+		if err := writeZipArchive(ioutil.Discard, dir, "site"); err == nil {
+			t.Errorf("expected the link name %q to be rejected", name)
+		}
+	}
+}
+
+func TestGatewayLastModified(t *testing.T) {
+	ts, api, ctx := newTestServerAndNode(t, nil)
+
+	mtime := time.Unix(1500000000, 0)
+	nd := dag.NodeWithData(ft.FilePBData([]byte("hello"), 5))
+	if err := coreunix.SetUnixFSMetadata(nd, coreunix.UnixFSMetadata{Mtime: mtime}); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Dag().Add(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/"+nd.Cid().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := doWithoutRedirect(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if lm := res.Header.Get("Last-Modified"); lm != mtime.UTC().Format(http.TimeFormat) {
+		t.Fatalf("unexpected Last-Modified %q", lm)
+	}
+}
+
+func TestGatewayMultiRange(t *testing.T) {
+	ts, api, ctx := newTestServerAndNode(t, nil)
+
+	content := make([]byte, 64*1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	// small chunks so every range touches only a few blocks
+	k, err := api.Unixfs().Add(ctx, files.NewBytesFile(content), options.Unixfs.Chunker("size-1024"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+k.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// overlapping ranges are merged, suffix ranges resolved against the size
+	req.Header.Set("Range", "bytes=40000-40099, 10-19, 0-14, -5")
+	res, err := doWithoutRedirect(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status is %d, expected 206", res.StatusCode)
+	}
+	mediatype, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediatype != "multipart/byteranges" {
+		t.Fatalf("unexpected content type %q", mediatype)
+	}
+
+	expected := []struct {
+		contentRange string
+		start, end   int
+	}{
+		{"bytes 0-19/65536", 0, 20},
+		{"bytes 40000-40099/65536", 40000, 40100},
+		{"bytes 65531-65535/65536", 65531, 65536},
+	}
+	mr := multipart.NewReader(res.Body, params["boundary"])
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			if i != len(expected) {
+				t.Fatalf("got %d parts, expected %d", i, len(expected))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(expected) {
+			t.Fatalf("unexpected part %s", part.Header.Get("Content-Range"))
+		}
+		if cr := part.Header.Get("Content-Range"); cr != expected[i].contentRange {
+			t.Fatalf("part %d: got content range %q, expected %q", i, cr, expected[i].contentRange)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, content[expected[i].start:expected[i].end]) {
+			t.Fatalf("part %d: unexpected content", i)
+		}
+	}
+
+	// the preconditions are checked before serving the ranges
+	etag := res.Header.Get("Etag")
+	if etag == "" {
+		t.Fatal("expected an Etag")
+	}
+	for _, test := range []struct {
+		header, value string
+		status        int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `W/` + etag, http.StatusNotModified},
+		{"If-None-Match", `"other"`, http.StatusPartialContent},
+		{"If-Match", `"other"`, http.StatusPreconditionFailed},
+		{"If-Match", etag, http.StatusPartialContent},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+k.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", "bytes=0-9, 100-109")
+		req.Header.Set(test.header, test.value)
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%s: %s: status is %d, expected %d", test.header, test.value, res.StatusCode, test.status)
+		}
+	}
+}
+
+func TestGatewayDenylist(t *testing.T) {
+	ns := mockNamesys{}
+	n, err := newNodeWithMockNamesys(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := coreapi.NewCoreAPI(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := n.Context()
+
+	blocked, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte("blocked")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := api.Unixfs().Add(ctx, files.NewMapDirectory(map[string]files.Node{
+		"public.txt": files.NewBytesFile([]byte("public")),
+		"secret.txt": files.NewBytesFile([]byte("secret")),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// holds dir, reached through it
+	outer, err := api.Unixfs().Add(ctx, files.NewMapDirectory(map[string]files.Node{
+		"sub": files.NewMapDirectory(map[string]files.Node{
+			"public.txt": files.NewBytesFile([]byte("public")),
+			"secret.txt": files.NewBytesFile([]byte("secret")),
+		}),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns["/ipns/example.com"] = path.FromString(blocked.String())
+	ns["/ipns/outer.example.com"] = path.FromString(outer.String())
+	ns["/ipns/blocked.example.com"] = path.FromString(dir.String())
+	ns["/ipns/dir.example.com"] = path.FromString(dir.String())
+
+	tmp, err := ioutil.TempDir("", "denylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	listPath := filepath.Join(tmp, "denylist")
+	list := blocked.Cid().String() + "\n" +
+		dir.String() + "/secret.txt\n" +
+		"/ipns/blocked.example.com\n"
+	if err := ioutil.WriteFile(listPath, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n.Denylist, err = denylist.Open(listPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Denylist.Close()
+
+	ts, _, _ := newTestServerWithNode(t, n)
+
+	for _, test := range []struct {
+		host   string
+		path   string
+		status int
+	}{
+		{"127.0.0.1:8080", blocked.String(), http.StatusGone},
+		{"127.0.0.1:8080", dir.String() + "/public.txt", http.StatusOK},
+		{"127.0.0.1:8080", dir.String() + "/secret.txt", http.StatusGone},
+		{"127.0.0.1:8080", outer.String() + "/sub/public.txt", http.StatusOK},
+		{"127.0.0.1:8080", outer.String() + "/sub/secret.txt", http.StatusGone},
+		{"127.0.0.1:8080", "/ipns/outer.example.com/sub/secret.txt", http.StatusGone},
+		{"127.0.0.1:8080", "/ipns/example.com", http.StatusGone},
+		{"127.0.0.1:8080", "/ipns/blocked.example.com/public.txt", http.StatusGone},
+		{"127.0.0.1:8080", "/ipns/dir.example.com/public.txt", http.StatusOK},
+		{"127.0.0.1:8080", "/ipns/dir.example.com/secret.txt", http.StatusGone},
+		{"blocked.example.com", "/public.txt", http.StatusGone},
+		{"dir.example.com", "/public.txt", http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = test.host
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%s%s: got %d, expected %d", test.host, test.path, res.StatusCode, test.status)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package corehttp
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	core "github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/repo"
+)
+
+// RateLimitsConfigKey is the config key holding the gateway's admission
+// control settings.
+const RateLimitsConfigKey = "Gateway.RateLimits"
+
+// RateLimits configures the admission control of the gateway. Zero values
+// disable the respective limit.
+type RateLimits struct {
+	// RequestsPerSecond is the sustained request rate allowed per client IP,
+	// Burst the number of requests it may exceed it by.
+	RequestsPerSecond float64
+	Burst             int
+
+	// MaxConcurrentRequests caps the requests in flight per client IP.
+	MaxConcurrentRequests int
+
+	// MaxConcurrentFetches caps the /ipfs and /ipns requests in flight,
+	// which may all fetch DAGs from the network, over all clients.
+	MaxConcurrentFetches int
+
+	// TrustedProxies are the addresses, or CIDR ranges, of the proxies in
+	// front of the gateway. The client of a request coming from one of them
+	// is the last address of its X-Forwarded-For header not of a trusted
+	// proxy.
+	TrustedProxies []string
+}
+
+// clientSweepInterval is how often the state of idle clients is dropped.
+const clientSweepInterval = time.Minute
+
+type clientState struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+// rateLimiter enforces the per client limits with a token bucket and a
+// counter of in-flight requests per IP.
+type rateLimiter struct {
+	limits  RateLimits
+	proxies []*net.IPNet
+
+	mu        sync.Mutex
+	clients   map[string]*clientState
+	lastSweep time.Time
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	if limits.Burst < 1 {
+		limits.Burst = 1
+	}
+	return &rateLimiter{
+		limits:    limits,
+		clients:   make(map[string]*clientState),
+		lastSweep: time.Now(),
+	}
+}
+
+// admit registers a request of the client. It returns false and how long to
+// wait before retrying if the client is over its limits.
+func (rl *rateLimiter) admit(client string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) > clientSweepInterval {
+		rl.sweep(now)
+	}
+
+	c, ok := rl.clients[client]
+	if !ok {
+		c = &clientState{tokens: float64(rl.limits.Burst), last: now}
+		rl.clients[client] = c
+	}
+
+	if max := rl.limits.MaxConcurrentRequests; max > 0 && c.active >= max {
+		return false, time.Second
+	}
+
+	if rate := rl.limits.RequestsPerSecond; rate > 0 {
+		c.tokens = math.Min(float64(rl.limits.Burst), c.tokens+now.Sub(c.last).Seconds()*rate)
+		c.last = now
+		if c.tokens < 1 {
+			return false, time.Duration((1 - c.tokens) / rate * float64(time.Second))
+		}
+		c.tokens--
+	}
+
+	c.active++
+	return true, 0
+}
+
+// done marks the end of an admitted request.
+func (rl *rateLimiter) done(client string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if c, ok := rl.clients[client]; ok {
+		c.active--
+	}
+}
+
+// sweep drops the clients without requests in flight and with a full bucket,
+// they are indistinguishable from new ones.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for client, c := range rl.clients {
+		full := rl.limits.RequestsPerSecond <= 0 ||
+			c.tokens+now.Sub(c.last).Seconds()*rl.limits.RequestsPerSecond >= float64(rl.limits.Burst)
+		if c.active == 0 && full {
+			delete(rl.clients, client)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// parseProxies parses the TrustedProxies setting.
+func parseProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %s", p, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func (rl *rateLimiter) trusted(ip net.IP) bool {
+	for _, p := range rl.proxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// client returns the address of the client of r, taken from the
+// X-Forwarded-For header of the requests coming from a trusted proxy.
+func (rl *rateLimiter) client(r *http.Request) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if ip := net.ParseIP(client); ip == nil || !rl.trusted(ip) {
+		return client
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for k := len(hops) - 1; k >= 0; k-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[k]))
+		if ip == nil {
+			// not set by a proxy, the last one is the client
+			break
+		}
+		client = ip.String()
+		if !rl.trusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// serve passes the request on to next if the client is within its limits.
+func (rl *rateLimiter) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	client := rl.client(r)
+
+	ok, retryAfter := rl.admit(client, time.Now())
+	if !ok {
+		tooManyRequests(w, retryAfter, "too many requests from "+client)
+		return
+	}
+	defer rl.done(client)
+	next.ServeHTTP(w, r)
+}
+
+// tooManyRequests answers with a 429, telling the client when to retry.
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+func readRateLimits(r repo.Repo) (RateLimits, error) {
+	var limits RateLimits
+	_, err := repo.DecodeConfigKey(r, RateLimitsConfigKey, &limits)
+	return limits, err
+}
+
+// RateLimitOption enforces the per client limits configured in
+// Gateway.RateLimits on the requests to the following options.
+func RateLimitOption() ServeOption {
+	return func(n *core.IpfsNode, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		limits, err := readRateLimits(n.Repo)
+		if err != nil {
+			return nil, err
+		}
+		if limits.RequestsPerSecond <= 0 && limits.MaxConcurrentRequests <= 0 {
+			return mux, nil
+		}
+
+		rl := newRateLimiter(limits)
+		if rl.proxies, err = parseProxies(limits.TrustedProxies); err != nil {
+			return nil, err
+		}
+		childMux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			rl.serve(w, r, childMux)
+		})
+		return childMux, nil
+	}
+}
@@ -0,0 +1,126 @@
+package corehttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRate(t *testing.T) {
+	rl := newRateLimiter(RateLimits{RequestsPerSecond: 2, Burst: 2})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.admit("a", now); !ok {
+			t.Fatalf("request %d within the burst was denied", i)
+		}
+		rl.done("a")
+	}
+	ok, retryAfter := rl.admit("a", now)
+	if ok {
+		t.Fatal("request over the burst was admitted")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Fatalf("unexpected retry delay %s", retryAfter)
+	}
+
+	// other clients have their own bucket
+	if ok, _ := rl.admit("b", now); !ok {
+		t.Fatal("request from another client was denied")
+	}
+	rl.done("b")
+
+	if ok, _ := rl.admit("a", now.Add(500*time.Millisecond)); !ok {
+		t.Fatal("request after the refill was denied")
+	}
+	rl.done("a")
+
+	// idle clients with a full bucket are forgotten
+	rl.admit("a", now.Add(time.Hour))
+	rl.done("a")
+	if len(rl.clients) != 1 {
+		t.Fatalf("expected idle clients to be swept, have %d", len(rl.clients))
+	}
+}
+
+func TestRateLimiterConcurrency(t *testing.T) {
+	rl := newRateLimiter(RateLimits{MaxConcurrentRequests: 2})
+	now := time.Now()
+
+	rl.admit("a", now)
+	rl.admit("a", now)
+	if ok, retryAfter := rl.admit("a", now); ok || retryAfter != time.Second {
+		t.Fatalf("third concurrent request: admitted %t, retry after %s", ok, retryAfter)
+	}
+	rl.done("a")
+	if ok, _ := rl.admit("a", now); !ok {
+		t.Fatal("request after one finished was denied")
+	}
+}
+
+func TestGatewayMaxConcurrentFetches(t *testing.T) {
+	_, api, _ := newTestServerAndNode(t, nil)
+	gw := newGatewayHandler(GatewayConfig{MaxConcurrentFetches: 1}, api)
+
+	// occupy the only slot
+	gw.fetches <- struct{}{}
+
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ipfs/bafkqaaa", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("got %d with Retry-After %q, expected 429", w.Code, w.Header().Get("Retry-After"))
+	}
+	w = httptest.NewRecorder()
+	gw.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ipfs/bafkqaaa", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d for a POST, expected 429", w.Code)
+	}
+	w = httptest.NewRecorder()
+	gw.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/ipfs/bafkqaaa", nil))
+	if w.Code == http.StatusTooManyRequests {
+		t.Fatal("OPTIONS request denied")
+	}
+
+	<-gw.fetches
+	w = httptest.NewRecorder()
+	gw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ipfs/bafkqaaa", nil))
+	if w.Code == http.StatusTooManyRequests {
+		t.Fatal("request denied with a free slot")
+	}
+}
+
+func TestRateLimiterTrustedProxies(t *testing.T) {
+	rl := newRateLimiter(RateLimits{})
+	var err error
+	rl.proxies, err = parseProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseProxies([]string{"nope"}); err == nil {
+		t.Fatal("expected an invalid proxy to be refused")
+	}
+
+	for _, test := range []struct {
+		remote  string
+		forward []string
+		client  string
+	}{
+		{"192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"127.0.0.1:1234", nil, "127.0.0.1"},
+		{"127.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"127.0.0.1:1234", []string{"203.0.113.1, 198.51.100.1, 10.1.2.3"}, "198.51.100.1"},
+		{"127.0.0.1:1234", []string{"203.0.113.1", "198.51.100.1,10.1.2.3"}, "198.51.100.1"},
+		{"127.0.0.1:1234", []string{"10.1.2.3"}, "10.1.2.3"},
+		{"127.0.0.1:1234", []string{"nope, 10.1.2.3"}, "10.1.2.3"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remote
+		for _, h := range test.forward {
+			r.Header.Add("X-Forwarded-For", h)
+		}
+		if client := rl.client(r); client != test.client {
+			t.Errorf("%s %v: got %s, expected %s", test.remote, test.forward, client, test.client)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreunix"
 	"github.com/ipfs/go-ipfs/gc"
 	"github.com/ipfs/go-ipfs/repo"
 
@@ -83,8 +84,32 @@ func BestEffortRoots(filesRoot *mfs.Root) ([]cid.Cid, error) {
 	return []cid.Cid{rootDag.Cid()}, nil
 }
 
-func GarbageCollect(n *core.IpfsNode, ctx context.Context) error {
+// gcRoots returns the roots of the DAGs to keep on a best effort basis: the
+// files root, the imports in progress, the MFS snapshots and transactions.
+func gcRoots(ctx context.Context, n *core.IpfsNode) ([]cid.Cid, error) {
 	roots, err := BestEffortRoots(n.FilesRoot)
+	if err != nil {
+		return nil, err
+	}
+	checkpointed, err := coreunix.CheckpointedCids(ctx, n.Repo.Datastore())
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := coreunix.SnapshotCids(ctx, n.Repo.Datastore())
+	if err != nil {
+		return nil, err
+	}
+	txs, err := coreunix.TxCids(ctx, n.Repo.Datastore())
+	if err != nil {
+		return nil, err
+	}
+	roots = append(roots, checkpointed...)
+	roots = append(roots, snapshots...)
+	return append(roots, txs...), nil
+}
+
+func GarbageCollect(n *core.IpfsNode, ctx context.Context) error {
+	roots, err := gcRoots(ctx, n)
 	if err != nil {
 		return err
 	}
@@ -148,9 +173,9 @@ func (e *MultiError) Error() string {
 }
 
 func GarbageCollectAsync(n *core.IpfsNode, ctx context.Context) <-chan gc.Result {
-	roots, err := BestEffortRoots(n.FilesRoot)
+	roots, err := gcRoots(ctx, n)
 	if err != nil {
-		out := make(chan gc.Result)
+		out := make(chan gc.Result, 1)
 		out <- gc.Result{Error: err}
 		close(out)
 		return out
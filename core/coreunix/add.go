@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	gopath "path"
 	"strconv"
 
@@ -24,6 +25,8 @@ import (
 	"github.com/ipfs/go-unixfs/importer/trickle"
 	coreiface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/path"
+
+	"github.com/ipfs/go-ipfs/core/node"
 )
 
 var log = logging.Logger("coreunix")
@@ -46,17 +49,20 @@ type syncer interface {
 func NewAdder(ctx context.Context, p pin.Pinner, bs bstore.GCLocker, ds ipld.DAGService) (*Adder, error) {
 	bufferedDS := ipld.NewBufferedDAG(ctx, ds)
 
-	return &Adder{
-		ctx:        ctx,
-		pinning:    p,
-		gcLocker:   bs,
-		dagService: ds,
-		bufferedDS: bufferedDS,
-		Progress:   false,
-		Pin:        true,
-		Trickle:    false,
-		Chunker:    "",
-	}, nil
+	adder := &Adder{
+		ctx:               ctx,
+		pinning:           p,
+		gcLocker:          bs,
+		dagService:        ds,
+		bufferedDS:        bufferedDS,
+		Progress:          false,
+		Pin:               true,
+		Trickle:           false,
+		Chunker:           "",
+		ShardingThreshold: node.DefaultShardingThreshold,
+	}
+	adder.staging = &stagedDAG{DAGService: ds, adder: adder}
+	return adder, nil
 }
 
 // Adder holds the switches passed to the `add` command.
@@ -65,6 +71,7 @@ type Adder struct {
 	pinning    pin.Pinner
 	gcLocker   bstore.GCLocker
 	dagService ipld.DAGService
+	staging    *stagedDAG
 	bufferedDS *ipld.BufferedDAG
 	Out        chan<- interface{}
 	Progress   bool
@@ -79,6 +86,55 @@ type Adder struct {
 	tempRoot   cid.Cid
 	CidBuilder cid.Builder
 	liveNodes  uint64
+
+	// PreserveMode and PreserveMtime store the mode and modification time
+	// of the added files and directories, see UnixFSMetadata. They are
+	// taken from Metadata if set, from the file information the added
+	// nodes come with otherwise, as those read from the local filesystem.
+	PreserveMode  bool
+	PreserveMtime bool
+	// Metadata is the metadata of the added files and directories by path
+	// relative to the added node, "" being the node itself. The daemon
+	// can't look up the files of its clients, which send it instead.
+	Metadata map[string]UnixFSMetadata
+
+	// metadata of the directories, set once they are complete
+	dirMetadata map[string]UnixFSMetadata
+	// estimated sizes of the directories, and those past ShardingThreshold
+	dirSizes    map[string]int
+	dirsToShard map[string]bool
+	// dirs holding the directories of dirMetadata and dirsToShard
+	dirsToPatch map[string]bool
+	dirCidLen   int
+
+	// Checkpoints, when set, makes the import resumable, see Checkpoints.
+	Checkpoints *Checkpoints
+
+	// Workers is the number of files chunked and hashed in parallel, they
+	// are imported one after the other when below 2.
+	Workers  int
+	pipeline *addPipeline
+
+	// ShardingThreshold is the estimated size past which directories are
+	// sharded, see node.ShardingThreshold. Zero disables it.
+	ShardingThreshold int
+
+	checkpointID       string
+	subtrees           map[string]subtree
+	pendingCheckpoints []pendingCheckpoint
+	// absolute paths of the imported files and directories
+	checkpointRoots map[string]bool
+}
+
+// AdderOptions are Adder settings the CoreAPI add options don't cover.
+type AdderOptions struct {
+	PreserveMode  bool
+	PreserveMtime bool
+	Metadata      map[string]UnixFSMetadata
+	// Resume makes the import resumable, see Checkpoints.
+	Resume bool
+	// Workers is the number of files imported in parallel.
+	Workers int
 }
 
 func (adder *Adder) mfsRoot() (*mfs.Root, error) {
@@ -87,7 +143,7 @@ func (adder *Adder) mfsRoot() (*mfs.Root, error) {
 	}
 	rnode := unixfs.EmptyDirNode()
 	rnode.SetCidBuilder(adder.CidBuilder)
-	mr, err := mfs.NewRoot(adder.ctx, adder.dagService, rnode, nil)
+	mr, err := mfs.NewRoot(adder.ctx, adder.staging, rnode, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -100,15 +156,15 @@ func (adder *Adder) SetMfsRoot(r *mfs.Root) {
 	adder.mroot = r
 }
 
-// Constructs a node from reader's data, and adds it. Doesn't pin.
-func (adder *Adder) add(reader io.Reader) (ipld.Node, error) {
+// Constructs a node from reader's data, and adds it to ds. Doesn't pin.
+func (adder *Adder) add(ds *ipld.BufferedDAG, reader io.Reader) (ipld.Node, error) {
 	chnk, err := chunker.FromString(reader, adder.Chunker)
 	if err != nil {
 		return nil, err
 	}
 
 	params := ihelper.DagBuilderParams{
-		Dagserv:    adder.bufferedDS,
+		Dagserv:    ds,
 		RawLeaves:  adder.RawLeaves,
 		Maxlinks:   ihelper.DefaultLinksPerBlock,
 		NoCopy:     adder.NoCopy,
@@ -129,7 +185,7 @@ func (adder *Adder) add(reader io.Reader) (ipld.Node, error) {
 		return nil, err
 	}
 
-	return nd, adder.bufferedDS.Commit()
+	return nd, ds.Commit()
 }
 
 // RootNode returns the mfs root node
@@ -145,7 +201,7 @@ func (adder *Adder) curRootNode() (ipld.Node, error) {
 
 	// if one root file, use that hash as root.
 	if len(root.Links()) == 1 {
-		nd, err := root.Links()[0].GetNode(adder.ctx, adder.dagService)
+		nd, err := root.Links()[0].GetNode(adder.ctx, adder.staging)
 		if err != nil {
 			return nil, err
 		}
@@ -246,6 +302,7 @@ func (adder *Adder) addNode(node ipld.Node, path string) error {
 	if err := mfs.PutNode(mr, path, node); err != nil {
 		return err
 	}
+	adder.addDirSize(dir, gopath.Base(path), node.Cid().ByteLen())
 
 	if !adder.Silent {
 		return outputDagnode(adder.Out, path, node)
@@ -264,7 +321,21 @@ func (adder *Adder) AddAllAndPin(file files.Node) (ipld.Node, error) {
 		}
 	}()
 
-	if err := adder.addFileNode("", file, true); err != nil {
+	adder.startPipeline()
+	defer adder.stopPipeline()
+
+	err := adder.addFileNode("", file, true)
+	if err == nil && adder.pipeline != nil {
+		err = adder.pipeline.finish(true)
+	}
+	adder.stopPipeline()
+	if adder.Checkpoints != nil {
+		// keep what was done for the next try
+		if ferr := adder.flushCheckpoints(); err == nil {
+			err = ferr
+		}
+	}
+	if err != nil {
 		return nil, err
 	}
 
@@ -282,6 +353,35 @@ func (adder *Adder) AddAllAndPin(file files.Node) (ipld.Node, error) {
 		return nil, err
 	}
 
+	if len(adder.dirsToPatch) > 0 {
+		// directory nodes are rebuilt by mfs as children are added, set
+		// their metadata and shard them now that the tree is complete
+		nd, err := rootdir.GetNode()
+		if err != nil {
+			return nil, err
+		}
+		patched, _, err := adder.patchDirs(nd, "")
+		if err != nil {
+			return nil, err
+		}
+		adder.staging.drop(nd.Cid())
+		nd = patched
+		pn, ok := nd.(*dag.ProtoNode)
+		if !ok {
+			return nil, dag.ErrNotProtobuf
+		}
+		if err := mr.Close(); err != nil {
+			return nil, err
+		}
+		mr, err = mfs.NewRoot(adder.ctx, adder.staging, pn, nil)
+		if err != nil {
+			return nil, err
+		}
+		adder.mroot = mr
+		rootdir = mr.GetDirectory()
+		root = rootdir
+	}
+
 	// if adding a file without wrapping, swap the root to it (when adding a
 	// directory, mfs root is the directory)
 	_, dir := file.(files.Directory)
@@ -327,14 +427,28 @@ func (adder *Adder) AddAllAndPin(file files.Node) (ipld.Node, error) {
 		}
 	}
 
-	if !adder.Pin {
-		return nd, nil
+	if adder.Pin {
+		if err := adder.PinRoot(nd); err != nil {
+			return nil, err
+		}
+	}
+	if adder.Checkpoints != nil {
+		// the import is complete, its checkpoints don't need to keep its
+		// blocks around anymore
+		if err := adder.clearCheckpoints(); err != nil {
+			return nil, err
+		}
 	}
-	return nd, adder.PinRoot(nd)
+	return nd, nil
 }
 
 func (adder *Adder) addFileNode(path string, file files.Node, toplevel bool) error {
-	defer file.Close()
+	closeFile := true
+	defer func() {
+		if closeFile {
+			file.Close()
+		}
+	}()
 
 	err := adder.maybePauseForGC()
 	if err != nil {
@@ -361,6 +475,8 @@ func (adder *Adder) addFileNode(path string, file files.Node, toplevel bool) err
 	case *files.Symlink:
 		return adder.addSymlink(path, f)
 	case files.File:
+		// closed once imported, which the pipeline may do later
+		closeFile = false
 		return adder.addFile(path, f)
 	default:
 		return errors.New("unknown file type")
@@ -380,34 +496,117 @@ func (adder *Adder) addSymlink(path string, l *files.Symlink) error {
 		return err
 	}
 
-	return adder.addNode(dagnode, path)
+	return adder.inOrder(func() error {
+		return adder.addNode(dagnode, path)
+	})
 }
 
+// addFile imports a file and closes it.
 func (adder *Adder) addFile(path string, file files.File) error {
+	stat, abspath := adder.stat(file)
+	_, sent := file.(SentFile)
+	resumable := adder.Checkpoints != nil && stat != nil && stat.Mode().IsRegular() && abspath != ""
+
+	if resumable {
+		c, ok, err := adder.checkpointed(abspath, stat, sent)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if ok {
+			file.Close()
+			return adder.addCheckpointed(path, abspath, fileCheckpoint(c, stat, sent))
+		}
+	}
+
+	finish := func(dagnode ipld.Node, n int64) error {
+		dagnode, err := adder.withMetadata(dagnode, adder.metadata(path, stat))
+		if err != nil {
+			return err
+		}
+		// a file changed while being read may not be the one added
+		if resumable && stat.Size() == n {
+			if err := adder.checkpoint(path, abspath, fileCheckpoint(dagnode.Cid(), stat, sent)); err != nil {
+				return err
+			}
+		}
+
+		// patch it into the root
+		return adder.addNode(dagnode, path)
+	}
+
+	if adder.pipeline != nil {
+		return adder.pipeline.add(path, file, finish)
+	}
+
+	defer file.Close()
+	dagnode, n, err := adder.importFile(adder.bufferedDS, path, file)
+	if err != nil {
+		return err
+	}
+	return finish(dagnode, n)
+}
+
+// importFile chunks the content of a file into a DAG written to ds, returning
+// its root and the size of the content.
+func (adder *Adder) importFile(ds *ipld.BufferedDAG, path string, file io.Reader) (ipld.Node, int64, error) {
+	counter := &countingReader{r: file}
+	var reader io.Reader = counter
 	// if the progress flag was specified, wrap the file so that we can send
 	// progress updates to the client (over the output channel)
-	var reader io.Reader = file
 	if adder.Progress {
-		rdr := &progressReader{file: reader, path: path, out: adder.Out}
-		if fi, ok := file.(files.FileInfo); ok {
-			reader = &progressReader2{rdr, fi}
-		} else {
-			reader = rdr
-		}
+		reader = &progressReader{file: reader, path: path, out: adder.Out}
 	}
+	// the importer needs the path of files added with nocopy
+	if fi, ok := file.(files.FileInfo); ok {
+		reader = &fileInfoReader{reader, fi}
+	}
+
+	dagnode, err := adder.add(ds, reader)
+	return dagnode, counter.n, err
+}
 
-	dagnode, err := adder.add(reader)
+// addCheckpointed adds a file found added by a previous run of the import,
+// as cp, without reading it.
+func (adder *Adder) addCheckpointed(path, abspath string, cp checkpoint) error {
+	log.Debugf("%s was added as %s by a previous run", path, cp.Cid)
+	dagnode, err := adder.dagService.Get(adder.ctx, cp.Cid)
 	if err != nil {
 		return err
 	}
-
-	// patch it into the root
-	return adder.addNode(dagnode, path)
+	return adder.inOrder(func() error {
+		if adder.Progress {
+			adder.Out <- &coreiface.AddEvent{
+				Name:  path,
+				Bytes: cp.Size,
+			}
+		}
+		// still needed if the import is interrupted again
+		if err := adder.checkpoint(path, abspath, cp); err != nil {
+			return err
+		}
+		return adder.addNode(dagnode, path)
+	})
 }
 
 func (adder *Adder) addDir(path string, dir files.Directory, toplevel bool) error {
 	log.Infof("adding directory: %s", path)
 
+	stat, _ := adder.stat(dir)
+	sub, err := adder.subtree(path, dir, stat)
+	if err != nil {
+		return err
+	}
+	if sub.checkpointed(path) {
+		c, ok, err := adder.checkpointedDir(sub)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return adder.addCheckpointedDir(path, sub, c)
+		}
+	}
+
 	if !(toplevel && path == "") {
 		mr, err := adder.mfsRoot()
 		if err != nil {
@@ -431,16 +630,292 @@ func (adder *Adder) addDir(path string, dir files.Directory, toplevel bool) erro
 			return err
 		}
 	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if path == "" {
+		if sub.abspath != "" {
+			// the paths in the import are relative to it
+			adder.addCheckpointRoot(sub.abspath)
+		}
+		// patched once the import completes
+		adder.setDirMetadata(path, adder.metadata(path, stat))
+		return nil
+	}
+	adder.addDirSize(gopath.Dir(path), gopath.Base(path), adder.directoryCidLen())
+	adder.setDirMetadata(path, adder.metadata(path, stat))
+	return adder.inOrder(func() error {
+		return adder.completeDir(path, sub)
+	})
+}
+
+// completeDir patches the directory at path once its entries are added, so
+// that its final CID is known, and checkpoints it.
+func (adder *Adder) completeDir(path string, sub subtree) error {
+	if !adder.dirsToPatch[path] && !sub.checkpointed(path) {
+		return nil
+	}
+	mr, err := adder.mfsRoot()
+	if err != nil {
+		return err
+	}
+	parent := mr.GetDirectory()
+	if dir := gopath.Dir(path); dir != "." {
+		fsn, err := mfs.Lookup(mr, dir)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if parent, ok = fsn.(*mfs.Directory); !ok {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	name := gopath.Base(path)
+	fsn, err := parent.Child(name)
+	if err != nil {
+		return err
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return err
+	}
+
+	if adder.dirsToPatch[path] {
+		patched, changed, err := adder.patchDirs(nd, path)
+		if err != nil {
+			return err
+		}
+		if changed {
+			if err := parent.Unlink(name); err != nil {
+				return err
+			}
+			if err := parent.AddChild(name, patched); err != nil {
+				return err
+			}
+			adder.staging.drop(nd.Cid())
+			nd = patched
+		}
+	}
+	if sub.checkpointed(path) {
+		return adder.checkpoint(path, sub.abspath, checkpoint{Cid: nd.Cid(), Fingerprint: sub.fingerprint, Sent: sub.sent})
+	}
+	return nil
+}
+
+// stat returns the file information an added node comes with, and its
+// absolute path if known, as those read from the local filesystem do.
+// Those sent by the clients of the daemon come without, unless SentFile.
+func (adder *Adder) stat(f files.Node) (os.FileInfo, string) {
+	switch f := f.(type) {
+	case SentFile:
+		return f.Stat(), f.SentPath()
+	case files.FileInfo:
+		return f.Stat(), f.AbsPath()
+	case interface{ Stat() os.FileInfo }:
+		// directories only have their file information
+		return f.Stat(), ""
+	}
+	return nil, ""
+}
+
+// metadata returns the metadata to preserve of the added node at path,
+// from Metadata if set, or from stat.
+func (adder *Adder) metadata(path string, stat os.FileInfo) UnixFSMetadata {
+	var from UnixFSMetadata
+	if adder.Metadata != nil {
+		from = adder.Metadata[path]
+	} else if stat != nil {
+		from = UnixFSMetadata{Mode: stat.Mode() & unixModeBits, Mtime: stat.ModTime()}
+	}
+
+	var md UnixFSMetadata
+	if adder.PreserveMode {
+		md.Mode = from.Mode & unixModeBits
+	}
+	if adder.PreserveMtime {
+		md.Mtime = from.Mtime
+	}
+	return md
+}
+
+// withMetadata returns the root of an added file with the given metadata.
+// Raw nodes can't hold any, they get a parent file node.
+func (adder *Adder) withMetadata(nd ipld.Node, md UnixFSMetadata) (ipld.Node, error) {
+	if md.IsZero() {
+		return nd, nil
+	}
+	if pi, ok := nd.(*posinfo.FilestoreNode); ok {
+		nd = pi.Node
+	}
+
+	var pn *dag.ProtoNode
+	switch nd := nd.(type) {
+	case *dag.ProtoNode:
+		pn = nd.Copy().(*dag.ProtoNode)
+	case *dag.RawNode:
+		fsn := unixfs.NewFSNode(unixfs.TFile)
+		fsn.AddBlockSize(uint64(len(nd.RawData())))
+		data, err := fsn.GetBytes()
+		if err != nil {
+			return nil, err
+		}
+		pn = dag.NodeWithData(data)
+		pn.SetCidBuilder(adder.CidBuilder)
+		if err := pn.AddNodeLink("", nd); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unexpected node type %T", nd)
+	}
+
+	if err := SetUnixFSMetadata(pn, md); err != nil {
+		return nil, err
+	}
+	return pn, adder.dagService.Add(adder.ctx, pn)
+}
 
-	return it.Err()
+func (adder *Adder) setDirMetadata(path string, md UnixFSMetadata) {
+	if md.IsZero() {
+		return
+	}
+	if adder.dirMetadata == nil {
+		adder.dirMetadata = make(map[string]UnixFSMetadata)
+	}
+	adder.dirMetadata[path] = md
+	adder.markDirToPatch(path)
+}
+
+// addDirSize accounts for the entry name, with a CID of cidLen bytes, in
+// the estimated size of the directory at path, to shard it if it gets past
+// ShardingThreshold.
+func (adder *Adder) addDirSize(path, name string, cidLen int) {
+	if !autoSharding(adder.ShardingThreshold) {
+		return
+	}
+	if path == "." {
+		path = ""
+	}
+	if adder.dirSizes == nil {
+		adder.dirSizes = make(map[string]int)
+		adder.dirsToShard = make(map[string]bool)
+	}
+	adder.dirSizes[path] += len(name) + cidLen
+	if adder.dirSizes[path] > adder.ShardingThreshold && !adder.dirsToShard[path] {
+		adder.dirsToShard[path] = true
+		adder.markDirToPatch(path)
+	}
+}
+
+// directoryCidLen returns the length of the CIDs of the added directories.
+func (adder *Adder) directoryCidLen() int {
+	if adder.dirCidLen == 0 {
+		nd := unixfs.EmptyDirNode()
+		nd.SetCidBuilder(adder.CidBuilder)
+		adder.dirCidLen = nd.Cid().ByteLen()
+	}
+	return adder.dirCidLen
+}
+
+// markDirToPatch marks the directory at path and its parents for patchDirs.
+func (adder *Adder) markDirToPatch(path string) {
+	if adder.dirsToPatch == nil {
+		adder.dirsToPatch = make(map[string]bool)
+	}
+	for p := path; !adder.dirsToPatch[p]; p = gopath.Dir(p) {
+		adder.dirsToPatch[p] = true
+		if p == "" || p == "." || p == "/" {
+			break
+		}
+	}
+	// paths are relative, gopath.Dir of a top level entry is "."
+	adder.dirsToPatch[""] = true
+}
+
+// patchDirs sets the metadata of the directories at and below path and
+// shards those that got too large, and returns the new node if it changed.
+func (adder *Adder) patchDirs(nd ipld.Node, path string) (ipld.Node, bool, error) {
+	delete(adder.dirsToPatch, path)
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nd, false, nil
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return nil, false, err
+	}
+	if fsn.Type() != unixfs.TDirectory && fsn.Type() != unixfs.THAMTShard {
+		return nd, false, nil
+	}
+
+	out := pn.Copy().(*dag.ProtoNode)
+	changed := false
+	// links of sharded directories aren't named after their entries, the
+	// directories below them were patched as they completed, see
+	// completeDir
+	if fsn.Type() == unixfs.TDirectory {
+		for _, l := range pn.Links() {
+			childPath := gopath.Join(path, l.Name)
+			if !adder.dirsToPatch[childPath] {
+				continue
+			}
+			child, err := l.GetNode(adder.ctx, adder.staging)
+			if err != nil {
+				return nil, false, err
+			}
+			child, childChanged, err := adder.patchDirs(child, childPath)
+			if err != nil {
+				return nil, false, err
+			}
+			if !childChanged {
+				continue
+			}
+			if err := out.RemoveNodeLink(l.Name); err != nil {
+				return nil, false, err
+			}
+			if err := out.AddNodeLink(l.Name, child); err != nil {
+				return nil, false, err
+			}
+			changed = true
+		}
+	}
+	if md, ok := adder.dirMetadata[path]; ok {
+		if err := SetUnixFSMetadata(out, md); err != nil {
+			return nil, false, err
+		}
+		changed = true
+	}
+	if adder.dirsToShard[path] {
+		sharded, err := ReshardDirectory(adder.ctx, adder.dagService, out, adder.ShardingThreshold)
+		if err != nil {
+			return nil, false, err
+		}
+		if sharded != ipld.Node(out) {
+			return sharded, true, nil
+		}
+	}
+	if !changed {
+		return nd, false, nil
+	}
+	return out, true, adder.dagService.Add(adder.ctx, out)
 }
 
 func (adder *Adder) maybePauseForGC() error {
 	if adder.unlocker != nil && adder.gcLocker.GCRequested() {
+		// blocks of files not in the root yet would be collected
+		if adder.pipeline != nil {
+			if err := adder.pipeline.finish(true); err != nil {
+				return err
+			}
+		}
+
 		rn, err := adder.curRootNode()
 		if err != nil {
 			return err
 		}
+		// the pinned root holds the directories not resharded yet
+		if err := adder.staging.flush(adder.ctx); err != nil {
+			return err
+		}
 
 		err = adder.PinRoot(rn)
 		if err != nil {
@@ -489,6 +964,17 @@ func getOutput(dagnode ipld.Node) (*coreiface.AddEvent, error) {
 	return output, nil
 }
 
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
 type progressReader struct {
 	file         io.Reader
 	path         string
@@ -512,11 +998,8 @@ func (i *progressReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
-type progressReader2 struct {
-	*progressReader
+// fileInfoReader reads a file through another reader.
+type fileInfoReader struct {
+	io.Reader
 	files.FileInfo
 }
-
-func (i *progressReader2) Read(p []byte) (int, error) {
-	return i.progressReader.Read(p)
-}
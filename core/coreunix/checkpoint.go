@@ -0,0 +1,427 @@
+package coreunix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-mfs"
+)
+
+// CheckpointPrefix is the datastore namespace of the checkpoints of
+// resumable imports.
+var CheckpointPrefix = datastore.NewKey("/local/addcheckpoints")
+
+// how many files are added between writes of their checkpoints
+const checkpointBatchSize = 64
+
+// CheckpointExpiry is how long the checkpoints of an interrupted import are
+// kept, the garbage collector collects their blocks afterwards.
+var CheckpointExpiry = 7 * 24 * time.Hour
+
+// Checkpoints records the files and directories added by resumable imports,
+// so that an interrupted import run again with the same options only adds
+// those that weren't done or changed since.
+//
+// They are keyed by the absolute path of the sources, and checked against
+// their file information, so only the files read from the local filesystem
+// or sent along with theirs, see SentFile, are checkpointed. The clients of
+// the daemon can't be trusted with those of the local files: what they send
+// is only checked against what was sent by a previous run.
+type Checkpoints struct {
+	ds datastore.Batching
+	bs bstore.Blockstore
+}
+
+// NewCheckpoints returns the Checkpoints stored in ds, of the DAGs stored
+// in bs.
+func NewCheckpoints(ds datastore.Batching, bs bstore.Blockstore) *Checkpoints {
+	return &Checkpoints{ds: ds, bs: bs}
+}
+
+// SentFile is an added node sent by a client of the daemon along with its
+// file information and absolute path on the client, which make its import
+// resumable.
+type SentFile interface {
+	files.Node
+	Stat() os.FileInfo
+	SentPath() string
+}
+
+// checkpoint is the record of an added file or directory.
+type checkpoint struct {
+	Cid     cid.Cid
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	// Fingerprint is the one of the subtree of a directory.
+	Fingerprint string `json:",omitempty"`
+	// Sent is set when the file information was sent by a client.
+	Sent bool `json:",omitempty"`
+	// Time is when it was last written, see CheckpointExpiry.
+	Time time.Time
+}
+
+// fileCheckpoint returns the checkpoint of a file added as c, whose file
+// information was sent by a client if sent.
+func fileCheckpoint(c cid.Cid, stat os.FileInfo, sent bool) checkpoint {
+	return checkpoint{Cid: c, Size: stat.Size(), ModTime: stat.ModTime(), Mode: stat.Mode(), Sent: sent}
+}
+
+func (cp checkpoint) expired() bool {
+	return time.Since(cp.Time) > CheckpointExpiry
+}
+
+// subtree is a directory of a resumable import, checkpointed as a whole.
+type subtree struct {
+	abspath string
+	// fingerprint identifies the file information of the directory and of
+	// everything below it, empty if some isn't known
+	fingerprint string
+	// sent is set when the file information was sent by a client
+	sent bool
+}
+
+// checkpointed returns whether the directory at path is checkpointed.
+func (s subtree) checkpointed(path string) bool {
+	// the root of the import can't be replaced
+	return path != "" && s.abspath != "" && s.fingerprint != ""
+}
+
+// pendingCheckpoint is a checkpoint waiting for its blocks to be synced.
+type pendingCheckpoint struct {
+	key datastore.Key
+	checkpoint
+}
+
+// checkpointKey returns the key of the checkpoint of the file at abspath,
+// added with the given settings.
+func checkpointKey(settings, abspath string) datastore.Key {
+	return CheckpointPrefix.ChildString(settings).Child(datastore.NewKey(filepath.ToSlash(abspath)))
+}
+
+// checkpointSettings identifies the adder settings changing the CIDs, so that
+// the checkpoints of an import with others are never used.
+func (adder *Adder) checkpointSettings() string {
+	if adder.checkpointID == "" {
+		s := fmt.Sprintf("%s|%t|%t|%t|%t|%t|%d|%#v", adder.Chunker, adder.RawLeaves, adder.Trickle,
+			adder.NoCopy, adder.PreserveMode, adder.PreserveMtime, adder.ShardingThreshold, adder.CidBuilder)
+		sum := sha256.Sum256([]byte(s))
+		adder.checkpointID = hex.EncodeToString(sum[:8])
+	}
+	return adder.checkpointID
+}
+
+// loadCheckpoint returns the checkpoint of abspath, if there is one whose
+// DAG is complete.
+func (adder *Adder) loadCheckpoint(abspath string) (checkpoint, bool, error) {
+	data, err := adder.Checkpoints.ds.Get(checkpointKey(adder.checkpointSettings(), abspath))
+	if err == datastore.ErrNotFound {
+		return checkpoint{}, false, nil
+	}
+	if err != nil {
+		return checkpoint{}, false, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		log.Warnf("ignoring malformed checkpoint of %s: %s", abspath, err)
+		return checkpoint{}, false, nil
+	}
+	if cp.expired() {
+		return checkpoint{}, false, nil
+	}
+	// the blocks are synced before their checkpoint is written, the DAG is
+	// complete if its root is there
+	has, err := adder.Checkpoints.bs.Has(cp.Cid)
+	if err != nil || !has {
+		return checkpoint{}, false, err
+	}
+	return cp, true, nil
+}
+
+// checkpointed returns the CID the file at abspath was added as, if it
+// was checkpointed and didn't change since.
+func (adder *Adder) checkpointed(abspath string, stat os.FileInfo, sent bool) (cid.Cid, bool, error) {
+	cp, ok, err := adder.loadCheckpoint(abspath)
+	if err != nil || !ok {
+		return cid.Undef, false, err
+	}
+	if cp.Sent != sent || cp.Fingerprint != "" || cp.Size != stat.Size() || !cp.ModTime.Equal(stat.ModTime()) || cp.Mode != stat.Mode() {
+		return cid.Undef, false, nil
+	}
+	return cp.Cid, true, nil
+}
+
+// checkpointedDir returns the CID the directory of sub was added as, if it
+// was checkpointed and nothing changed below it since.
+func (adder *Adder) checkpointedDir(sub subtree) (cid.Cid, bool, error) {
+	cp, ok, err := adder.loadCheckpoint(sub.abspath)
+	if err != nil || !ok {
+		return cid.Undef, false, err
+	}
+	if cp.Sent != sub.sent || cp.Fingerprint != sub.fingerprint {
+		return cid.Undef, false, nil
+	}
+	return cp.Cid, true, nil
+}
+
+// subtree returns the subtree of the directory dir at path, walking it along
+// with the directories below it the first time one of them is added.
+func (adder *Adder) subtree(path string, dir files.Directory, stat os.FileInfo) (subtree, error) {
+	if adder.Checkpoints == nil || stat == nil {
+		return subtree{}, nil
+	}
+	if sub, ok := adder.subtrees[path]; ok {
+		return sub, nil
+	}
+	if adder.subtrees == nil {
+		adder.subtrees = make(map[string]subtree)
+	}
+	return adder.fingerprint(path, dir, stat)
+}
+
+// fingerprint walks the directory dir at path, and records the subtrees of
+// it and of the directories below it. Only the file information of the
+// entries is read.
+func (adder *Adder) fingerprint(path string, dir files.Directory, stat os.FileInfo) (subtree, error) {
+	var sub subtree
+	complete := stat != nil
+	h := sha256.New()
+	if complete {
+		fmt.Fprintf(h, "%o %d\n", stat.Mode(), stat.ModTime().UnixNano())
+	}
+
+	it := dir.Entries()
+	for it.Next() {
+		var entry string
+		switch nd := it.Node().(type) {
+		case files.Directory:
+			st, _ := adder.stat(nd)
+			child, err := adder.fingerprint(gopath.Join(path, it.Name()), nd, st)
+			if err != nil {
+				nd.Close()
+				return subtree{}, err
+			}
+			entry = "d " + child.fingerprint
+			complete = complete && child.fingerprint != ""
+			if sub.abspath == "" && child.abspath != "" {
+				sub.abspath = filepath.Dir(child.abspath)
+			}
+			sub.sent = sub.sent || child.sent
+		case *files.Symlink:
+			entry = "l " + nd.Target
+		default:
+			st, abspath := adder.stat(nd)
+			if st == nil {
+				complete = false
+				break
+			}
+			entry = fmt.Sprintf("f %o %d %d", st.Mode(), st.Size(), st.ModTime().UnixNano())
+			if sub.abspath == "" && abspath != "" {
+				sub.abspath = filepath.Dir(abspath)
+			}
+			if _, ok := nd.(SentFile); ok {
+				sub.sent = true
+			}
+		}
+		// the entries are opened again when added
+		it.Node().Close()
+		fmt.Fprintf(h, "%q %s\n", it.Name(), entry)
+	}
+	if err := it.Err(); err != nil {
+		return subtree{}, err
+	}
+	if complete {
+		sub.fingerprint = hex.EncodeToString(h.Sum(nil))
+	}
+	adder.subtrees[path] = sub
+	return sub, nil
+}
+
+// addCheckpointedDir adds a directory found added by a previous run of the
+// import, without walking it again.
+func (adder *Adder) addCheckpointedDir(path string, sub subtree, c cid.Cid) error {
+	log.Debugf("%s was added as %s by a previous run", path, c)
+	nd, err := adder.dagService.Get(adder.ctx, c)
+	if err != nil {
+		return err
+	}
+	mr, err := adder.mfsRoot()
+	if err != nil {
+		return err
+	}
+	adder.addDirSize(gopath.Dir(path), gopath.Base(path), adder.directoryCidLen())
+	return adder.inOrder(func() error {
+		// still needed if the import is interrupted again
+		if err := adder.checkpoint(path, sub.abspath, checkpoint{Cid: c, Fingerprint: sub.fingerprint, Sent: sub.sent}); err != nil {
+			return err
+		}
+		return mfs.PutNode(mr, path, nd)
+	})
+}
+
+// checkpoint records that the file or directory at path in the import, from
+// abspath, was added as cp.Cid.
+func (adder *Adder) checkpoint(path, abspath string, cp checkpoint) error {
+	root := abspath
+	for i := strings.Count(path, "/"); i > 0; i-- {
+		root = filepath.Dir(root)
+	}
+	adder.addCheckpointRoot(root)
+
+	cp.Time = time.Now()
+	adder.pendingCheckpoints = append(adder.pendingCheckpoints, pendingCheckpoint{
+		key:        checkpointKey(adder.checkpointSettings(), abspath),
+		checkpoint: cp,
+	})
+	if len(adder.pendingCheckpoints) < checkpointBatchSize {
+		return nil
+	}
+	return adder.flushCheckpoints()
+}
+
+// addCheckpointRoot records that the checkpoints at and below the absolute
+// path root are those of the import, cleared once it completes.
+func (adder *Adder) addCheckpointRoot(root string) {
+	if adder.checkpointRoots == nil {
+		adder.checkpointRoots = make(map[string]bool)
+	}
+	adder.checkpointRoots[root] = true
+}
+
+// flushCheckpoints writes the pending checkpoints, once their blocks are on
+// disk.
+func (adder *Adder) flushCheckpoints() error {
+	if len(adder.pendingCheckpoints) == 0 {
+		return nil
+	}
+	if s, ok := adder.dagService.(syncer); ok {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+
+	b, err := adder.Checkpoints.ds.Batch()
+	if err != nil {
+		return err
+	}
+	for _, p := range adder.pendingCheckpoints {
+		data, err := json.Marshal(p.checkpoint)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(p.key, data); err != nil {
+			return err
+		}
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+	adder.pendingCheckpoints = adder.pendingCheckpoints[:0]
+	return adder.Checkpoints.ds.Sync(CheckpointPrefix)
+}
+
+// clearCheckpoints removes the checkpoints of a completed import.
+func (adder *Adder) clearCheckpoints() error {
+	adder.pendingCheckpoints = nil
+	if len(adder.checkpointRoots) == 0 {
+		return nil
+	}
+
+	b, err := adder.Checkpoints.ds.Batch()
+	if err != nil {
+		return err
+	}
+	for root := range adder.checkpointRoots {
+		rootKey := checkpointKey(adder.checkpointSettings(), root)
+		// a file, or a directory
+		if err := b.Delete(rootKey); err != nil {
+			return err
+		}
+		res, err := adder.Checkpoints.ds.Query(query.Query{Prefix: rootKey.String(), KeysOnly: true})
+		if err != nil {
+			return err
+		}
+		for r := range res.Next() {
+			if r.Error != nil {
+				res.Close()
+				return r.Error
+			}
+			k := datastore.RawKey(r.Key)
+			// some datastores match siblings sharing the beginning of
+			// the name
+			if !k.IsDescendantOf(rootKey) {
+				continue
+			}
+			if err := b.Delete(k); err != nil {
+				res.Close()
+				return err
+			}
+		}
+		res.Close()
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+	adder.checkpointRoots = nil
+	return adder.Checkpoints.ds.Sync(CheckpointPrefix)
+}
+
+// CheckpointedCids returns the CIDs of the checkpoints of interrupted
+// imports, which the garbage collector should keep. The expired ones are
+// removed.
+func CheckpointedCids(ctx context.Context, ds datastore.Datastore) ([]cid.Cid, error) {
+	res, err := ds.Query(query.Query{Prefix: CheckpointPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var cids []cid.Cid
+	var expired []datastore.Key
+loop:
+	for {
+		var r query.Result
+		var ok bool
+		select {
+		case r, ok = <-res.Next():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !ok {
+			break loop
+		}
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var cp checkpoint
+		if err := json.Unmarshal(r.Value, &cp); err != nil {
+			log.Warnf("ignoring malformed checkpoint %s: %s", r.Key, err)
+			continue
+		}
+		if cp.expired() {
+			expired = append(expired, datastore.RawKey(r.Key))
+			continue
+		}
+		cids = append(cids, cp.Cid)
+	}
+
+	for _, k := range expired {
+		if err := ds.Delete(k); err != nil {
+			return nil, err
+		}
+	}
+	return cids, nil
+}
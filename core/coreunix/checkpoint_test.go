@@ -0,0 +1,230 @@
+package coreunix
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("interrupted")
+}
+
+func TestResumeImport(t *testing.T) {
+	node := newTestNode(t)
+	ctx := context.Background()
+
+	dir := filepath.Join(t.TempDir(), "dir")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1500000000, 0)
+	for name, data := range map[string]string{"a": "first file", "b": "second file", "sub/c": "third file"} {
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := ioutil.WriteFile(fpath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fpath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serialDir := func() files.Node {
+		st, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sf, err := files.NewSerialFile(dir, false, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sf
+	}
+	// add returns the root and the names of the files added
+	add := func(f files.Node) (ipld.Node, []string, error) {
+		adder, err := NewAdder(ctx, node.Pinning, node.Blockstore, node.DAG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adder.Checkpoints = NewCheckpoints(node.Repo.Datastore(), node.Blockstore)
+		out := make(chan interface{}, 64)
+		adder.Out = out
+		nd, err := adder.AddAllAndPin(f)
+		close(out)
+		var added []string
+		for o := range out {
+			if ev := o.(*coreiface.AddEvent); ev.Path != nil {
+				added = append(added, ev.Name)
+			}
+		}
+		return nd, added, err
+	}
+	interrupted := func() {
+		_, _, err := add(files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("dir", serialDir()),
+			files.FileEntry("zzz", files.NewReaderFile(failingReader{})),
+		}))
+		if err == nil {
+			t.Fatal("expected the import to fail")
+		}
+	}
+
+	interrupted()
+	checkpointed, err := CheckpointedCids(ctx, node.Repo.Datastore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpointed) != 5 {
+		t.Fatalf("expected 3 checkpointed files and 2 directories, got %d", len(checkpointed))
+	}
+
+	// same size and mtime, only files that changed are added again, and
+	// the directories with nothing changed below them aren't walked
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("FIRST FILE"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "a"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	resumed, added, err := add(serialDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range added {
+		if name == "sub/c" {
+			t.Error("expected the checkpointed directory not to be walked")
+		}
+	}
+
+	// without checkpoints, for comparison
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("first file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	adder, err := NewAdder(ctx, node.Pinning, node.Blockstore, node.DAG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := adder.AddAllAndPin(serialDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed.Cid().Equals(original.Cid()) {
+		t.Errorf("resumed import gave %s, expected %s", resumed.Cid(), original.Cid())
+	}
+
+	checkpointed, err = CheckpointedCids(ctx, node.Repo.Datastore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpointed) != 0 {
+		t.Errorf("expected the checkpoints to be cleared, got %d", len(checkpointed))
+	}
+
+	// the checkpoints of imports never resumed expire
+	interrupted()
+	defer func(expiry time.Duration) {
+		CheckpointExpiry = expiry
+	}(CheckpointExpiry)
+	CheckpointExpiry = 0
+	for i := 0; i < 2; i++ {
+		checkpointed, err = CheckpointedCids(ctx, node.Repo.Datastore())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(checkpointed) != 0 {
+			t.Errorf("expected the checkpoints to expire, got %d", len(checkpointed))
+		}
+	}
+}
+
+// sentFile is a file sent by a client of the daemon, with its file
+// information.
+type sentFile struct {
+	files.File
+	stat os.FileInfo
+	path string
+}
+
+func (f *sentFile) Stat() os.FileInfo { return f.stat }
+func (f *sentFile) SentPath() string  { return f.path }
+
+func TestResumeSentImport(t *testing.T) {
+	node := newTestNode(t)
+	ctx := context.Background()
+
+	fpath := filepath.Join(t.TempDir(), "a")
+	if err := ioutil.WriteFile(fpath, []byte("local file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	add := func(f files.Node) (ipld.Node, error) {
+		adder, err := NewAdder(ctx, node.Pinning, node.Blockstore, node.DAG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adder.Checkpoints = NewCheckpoints(node.Repo.Datastore(), node.Blockstore)
+		return adder.AddAllAndPin(f)
+	}
+	sent := func(data string) files.Node {
+		return &sentFile{File: files.NewBytesFile([]byte(data)), stat: st, path: filepath.ToSlash(fpath)}
+	}
+	interrupted := func(f files.Node) {
+		_, err := add(files.NewSliceDirectory([]files.DirEntry{
+			files.FileEntry("a", f),
+			files.FileEntry("zzz", files.NewReaderFile(failingReader{})),
+		}))
+		if err == nil {
+			t.Fatal("expected the import to fail")
+		}
+	}
+	fileCid := func(data string) string {
+		adder, err := NewAdder(ctx, node.Pinning, node.Blockstore, node.DAG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd, err := adder.AddAllAndPin(files.NewBytesFile([]byte(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd.Cid().String()
+	}
+
+	// the file information sent doesn't match the checkpoints of the
+	// local files
+	sf, err := files.NewSerialFile(fpath, false, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted(sf)
+	nd, err := add(sent("sent file!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd.Cid().String() != fileCid("sent file!") {
+		t.Fatal("expected the sent file to be added, not the checkpointed local one")
+	}
+
+	// but those sent by a previous run
+	interrupted(sent("sent file!"))
+	nd, err = add(sent("SENT FILE!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd.Cid().String() != fileCid("sent file!") {
+		t.Fatal("expected the checkpointed sent file to be skipped")
+	}
+}
@@ -0,0 +1,320 @@
+package coreunix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gopath "path"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+// DiffType is the kind of change a DiffEntry describes.
+type DiffType string
+
+const (
+	DiffAdded    DiffType = "added"
+	DiffRemoved  DiffType = "removed"
+	DiffModified DiffType = "modified"
+	DiffMoved    DiffType = "moved"
+)
+
+// DiffEntry is a change between two UnixFS trees. Directories only present
+// in one of them are single entries, their contents aren't listed.
+type DiffEntry struct {
+	Type DiffType
+	// Path is relative to the roots, in the new tree except for removed
+	// entries.
+	Path string
+	// From is the path of moved entries in the old tree.
+	From string
+
+	// Before and After are the CIDs in the old and new tree, undefined on
+	// the side the entry isn't in.
+	Before, After cid.Cid
+	// BeforeSize and AfterSize are the cumulative sizes of the DAGs of the
+	// entry, as recorded in the links to them.
+	BeforeSize, AfterSize uint64
+}
+
+// diffLink is an entry of a compared directory.
+type diffLink struct {
+	path string
+	cid  cid.Cid
+	size uint64
+}
+
+// Diff compares the UnixFS trees a and b, descending only into the
+// directories, and the shards of sharded directories, which differ, and
+// passes the changes to out as they are found. Entries removed from one
+// place and added to another with the same CID are reported as moved: the
+// added and removed entries are held back until the trees are walked, to be
+// paired, and passed last ordered by path.
+func Diff(ctx context.Context, ds ipld.DAGService, a, b ipld.Node, out func(DiffEntry) error) error {
+	if a.Cid().Equals(b.Cid()) {
+		return nil
+	}
+
+	var added, removed []diffLink
+	err := diffNodes(ctx, ds, "", a, b, func(e DiffEntry) error {
+		switch e.Type {
+		case DiffAdded:
+			added = append(added, diffLink{e.Path, e.After, e.AfterSize})
+		case DiffRemoved:
+			removed = append(removed, diffLink{e.Path, e.Before, e.BeforeSize})
+		default:
+			return out(e)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// pair additions with removals of the same CID, in path order
+	removedByCid := make(map[cid.Cid][]diffLink)
+	for _, r := range removed {
+		removedByCid[r.cid] = append(removedByCid[r.cid], r)
+	}
+	var changes []DiffEntry
+	moved := make(map[string]bool)
+	for _, l := range added {
+		if rs := removedByCid[l.cid]; len(rs) > 0 {
+			changes = append(changes, DiffEntry{
+				Type: DiffMoved, Path: l.path, From: rs[0].path,
+				Before: l.cid, After: l.cid, BeforeSize: rs[0].size, AfterSize: l.size,
+			})
+			moved[rs[0].path] = true
+			removedByCid[l.cid] = rs[1:]
+			continue
+		}
+		changes = append(changes, DiffEntry{Type: DiffAdded, Path: l.path, After: l.cid, AfterSize: l.size})
+	}
+	for _, r := range removed {
+		if !moved[r.path] {
+			changes = append(changes, DiffEntry{Type: DiffRemoved, Path: r.path, Before: r.cid, BeforeSize: r.size})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	for _, c := range changes {
+		if err := out(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffNodes compares the nodes a and b at path, which differ.
+func diffNodes(ctx context.Context, ds ipld.DAGService, path string, a, b ipld.Node, out func(DiffEntry) error) error {
+	fsA, err := directoryData(a)
+	if err != nil {
+		return err
+	}
+	fsB, err := directoryData(b)
+	if err != nil {
+		return err
+	}
+	if fsA == nil || fsB == nil {
+		sizeA, _ := a.Size()
+		sizeB, _ := b.Size()
+		return out(DiffEntry{
+			Type: DiffModified, Path: path,
+			Before: a.Cid(), After: b.Cid(), BeforeSize: sizeA, AfterSize: sizeB,
+		})
+	}
+
+	linksA := make(map[string]*ipld.Link)
+	linksB := make(map[string]*ipld.Link)
+	if fsA.Type() == unixfs.THAMTShard && fsB.Type() == unixfs.THAMTShard && fsA.Fanout() == fsB.Fanout() {
+		// the same entries are in the same shards, those left identical
+		// aren't listed
+		padLen := len(fmt.Sprintf("%X", fsA.Fanout()-1))
+		err = diffShards(ctx, ds, a.(*dag.ProtoNode), b.(*dag.ProtoNode), padLen, linksA, linksB)
+	} else {
+		err = directoryLinks(ctx, ds, a, linksA)
+		if err == nil {
+			err = directoryLinks(ctx, ds, b, linksB)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(linksA)+len(linksB))
+	for name := range linksA {
+		names = append(names, name)
+	}
+	for name := range linksB {
+		if _, ok := linksA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		childPath := gopath.Join(path, name)
+		la, inA := linksA[name]
+		lb, inB := linksB[name]
+		switch {
+		case !inA:
+			err = out(DiffEntry{Type: DiffAdded, Path: childPath, After: lb.Cid, AfterSize: lb.Size})
+		case !inB:
+			err = out(DiffEntry{Type: DiffRemoved, Path: childPath, Before: la.Cid, BeforeSize: la.Size})
+		case la.Cid.Equals(lb.Cid):
+			// identical subtrees
+		case la.Cid.Type() == cid.Raw || lb.Cid.Type() == cid.Raw:
+			err = out(DiffEntry{
+				Type: DiffModified, Path: childPath,
+				Before: la.Cid, After: lb.Cid, BeforeSize: la.Size, AfterSize: lb.Size,
+			})
+		default:
+			var childA, childB ipld.Node
+			if childA, err = la.GetNode(ctx, ds); err != nil {
+				return err
+			}
+			if childB, err = lb.GetNode(ctx, ds); err != nil {
+				return err
+			}
+			err = diffNodes(ctx, ds, childPath, childA, childB, out)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errInvalidShardLink = errors.New("invalid HAMT shard link name")
+
+// diffShards adds the entries of the HAMT shards a and b to linksA and
+// linksB, except those below the links they have in common, which are
+// identical. The links of shards are named after the index of the bucket
+// they're in, padded to padLen, followed by the name of the entry for
+// values, the entries of a bucket being in the same one in both shards.
+func diffShards(ctx context.Context, ds ipld.DAGService, a, b *dag.ProtoNode, padLen int, linksA, linksB map[string]*ipld.Link) error {
+	bucketsB := make(map[string]*ipld.Link)
+	for _, l := range b.Links() {
+		if len(l.Name) < padLen {
+			return errInvalidShardLink
+		}
+		bucketsB[l.Name[:padLen]] = l
+	}
+	for _, la := range a.Links() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(la.Name) < padLen {
+			return errInvalidShardLink
+		}
+		bucket := la.Name[:padLen]
+		lb, ok := bucketsB[bucket]
+		delete(bucketsB, bucket)
+		switch {
+		case !ok:
+			if err := shardEntries(ctx, ds, la, padLen, linksA); err != nil {
+				return err
+			}
+			continue
+		case la.Name == lb.Name && la.Cid.Equals(lb.Cid):
+			// identical buckets
+			continue
+		case len(la.Name) == padLen && len(lb.Name) == padLen:
+			childA, err := la.GetNode(ctx, ds)
+			if err != nil {
+				return err
+			}
+			childB, err := lb.GetNode(ctx, ds)
+			if err != nil {
+				return err
+			}
+			pnA, okA := childA.(*dag.ProtoNode)
+			pnB, okB := childB.(*dag.ProtoNode)
+			if !okA || !okB {
+				return dag.ErrNotProtobuf
+			}
+			if err := diffShards(ctx, ds, pnA, pnB, padLen, linksA, linksB); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := shardEntries(ctx, ds, la, padLen, linksA); err != nil {
+			return err
+		}
+		if err := shardEntries(ctx, ds, lb, padLen, linksB); err != nil {
+			return err
+		}
+	}
+	for _, lb := range bucketsB {
+		if err := shardEntries(ctx, ds, lb, padLen, linksB); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardEntries adds the entries of the HAMT link l, a value or a child
+// shard, to links.
+func shardEntries(ctx context.Context, ds ipld.DAGService, l *ipld.Link, padLen int, links map[string]*ipld.Link) error {
+	if len(l.Name) > padLen {
+		lcopy := *l
+		lcopy.Name = l.Name[padLen:]
+		links[lcopy.Name] = &lcopy
+		return nil
+	}
+	child, err := l.GetNode(ctx, ds)
+	if err != nil {
+		return err
+	}
+	return directoryLinks(ctx, ds, child, links)
+}
+
+// asDirectory returns the UnixFS directory nd is, or nil if it isn't one.
+func asDirectory(ds ipld.DAGService, nd ipld.Node) (uio.Directory, error) {
+	fsn, err := directoryData(nd)
+	if err != nil || fsn == nil {
+		return nil, err
+	}
+	return uio.NewDirectoryFromNode(ds, nd)
+}
+
+// directoryData returns the UnixFS data of nd if it's a directory, nil
+// otherwise.
+func directoryData(nd ipld.Node) (*unixfs.FSNode, error) {
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil, nil
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return nil, err
+	}
+	if fsn.Type() != unixfs.TDirectory && fsn.Type() != unixfs.THAMTShard {
+		return nil, nil
+	}
+	return fsn, nil
+}
+
+// directoryLinks adds the entries of the directory nd to links by name,
+// whatever its layout.
+func directoryLinks(ctx context.Context, ds ipld.DAGService, nd ipld.Node, links map[string]*ipld.Link) error {
+	dir, err := uio.NewDirectoryFromNode(ds, nd)
+	if err != nil {
+		return err
+	}
+	return dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		lcopy := *l
+		links[l.Name] = &lcopy
+		return nil
+	})
+}
@@ -0,0 +1,151 @@
+package coreunix
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+func TestDiff(t *testing.T) {
+	node := newTestNode(t)
+	ctx := context.Background()
+
+	add := func(tree map[string]files.Node, threshold int) ipld.Node {
+		adder, err := NewAdder(ctx, node.Pinning, node.Blockstore, node.DAG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adder.ShardingThreshold = threshold
+		nd, err := adder.AddAllAndPin(files.NewMapDirectory(tree))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd
+	}
+	file := func(s string) files.Node {
+		return files.NewBytesFile([]byte(s))
+	}
+	diff := func(ds ipld.DAGService, a, b ipld.Node) []DiffEntry {
+		var changes []DiffEntry
+		err := Diff(ctx, ds, a, b, func(c DiffEntry) error {
+			changes = append(changes, c)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changes
+	}
+
+	old := add(map[string]files.Node{
+		"same":   file("unchanged"),
+		"edited": file("before"),
+		"gone":   file("removed"),
+		"old":    file("moved around"),
+		"dir": files.NewMapDirectory(map[string]files.Node{
+			"a": file("a"),
+			"b": file("b"),
+		}),
+		"olddir": files.NewMapDirectory(map[string]files.Node{
+			"c": file("c"),
+		}),
+	}, 0)
+	large := func() map[string]files.Node {
+		entries := make(map[string]files.Node)
+		for i := 0; i < 50; i++ {
+			entries[fmt.Sprintf("file%02d", i)] = file(fmt.Sprint(i))
+		}
+		return entries
+	}
+	newer := add(map[string]files.Node{
+		"same":   file("unchanged"),
+		"edited": file("after"),
+		"new":    file("added"),
+		"dir": files.NewMapDirectory(map[string]files.Node{
+			"a":     file("a"),
+			"b":     file("b changed"),
+			"moved": file("moved around"),
+		}),
+		"large": files.NewMapDirectory(large()),
+	}, 500)
+
+	changes := diff(node.DAG, old, newer)
+	var got []string
+	for _, c := range changes {
+		s := string(c.Type) + " " + c.Path
+		if c.From != "" {
+			s += " from " + c.From
+		}
+		got = append(got, s)
+	}
+	// the modified entries come as found, the others once paired
+	expected := []string{
+		"modified dir/b",
+		"modified edited",
+		"moved dir/moved from old",
+		"removed gone",
+		"added large",
+		"added new",
+		"removed olddir",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("got changes:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+
+	for _, c := range changes {
+		if c.Type == DiffModified && (c.BeforeSize == 0 || c.AfterSize == 0) {
+			t.Errorf("missing sizes of %s", c.Path)
+		}
+	}
+
+	// the same entries in another layout
+	basic := add(large(), 0)
+	sharded, err := ReshardDirectory(ctx, node.DAG, basic, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sharded.Cid().Equals(basic.Cid()) {
+		t.Fatal("expected the directory to be sharded")
+	}
+	for _, pair := range [][2]ipld.Node{{old, old}, {basic, sharded}} {
+		changes = diff(node.DAG, pair[0], pair[1])
+		if len(changes) != 0 {
+			t.Errorf("expected no changes between %s and %s, got %d", pair[0].Cid(), pair[1].Cid(), len(changes))
+		}
+	}
+
+	// only the shards holding the changed entry are fetched
+	many := func(changed string) ipld.Node {
+		entries := make(map[string]files.Node)
+		for i := 0; i < 1000; i++ {
+			entries[fmt.Sprintf("file%03d", i)] = file(fmt.Sprint(i))
+		}
+		entries["file500"] = file(changed)
+		return add(entries, 500)
+	}
+	before, after := many("before"), many("after")
+	counting := &countingDAG{DAGService: node.DAG}
+	changes = diff(counting, before, after)
+	if len(changes) != 1 || changes[0].Type != DiffModified || changes[0].Path != "file500" {
+		t.Fatalf("expected file500 to be modified, got %+v", changes)
+	}
+	if counting.gets > 10 {
+		t.Errorf("expected the identical shards to be skipped, fetched %d nodes", counting.gets)
+	}
+}
+
+// countingDAG counts the nodes fetched from it.
+type countingDAG struct {
+	ipld.DAGService
+	gets int
+}
+
+func (ds *countingDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	ds.gets++
+	return ds.DAGService.Get(ctx, c)
+}
@@ -0,0 +1,180 @@
+package coreunix
+
+import (
+	"context"
+	"fmt"
+	gopath "path"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+)
+
+// DiskUsage is the size of a directory of a UnixFS tree.
+type DiskUsage struct {
+	Path string
+	// Size is the cumulative size of the DAG of the directory.
+	Size uint64
+	// LocalSize is the size of the blocks of the DAG present locally.
+	LocalSize uint64
+}
+
+type duWalker struct {
+	ctx      context.Context
+	dserv    ipld.DAGService
+	local    ipld.DAGService
+	maxDepth int
+	out      func(DiskUsage) error
+}
+
+// DiskUsageTree walks the directory nd at path, fetching its subdirectories
+// from dserv, and calls out with the disk usage of each directory, at most
+// maxDepth levels below path if not negative, the subdirectories before
+// their parent. The contents of files are not fetched, and the directories
+// dserv doesn't have, with an offline DAG service, aren't walked.
+func DiskUsageTree(ctx context.Context, dserv ipld.DAGService, bs blockstore.Blockstore, path string, nd ipld.Node, maxDepth int, out func(DiskUsage) error) error {
+	w := &duWalker{
+		ctx:      ctx,
+		dserv:    dserv,
+		local:    dag.NewDAGService(blockservice.New(bs, offline.Exchange(bs))),
+		maxDepth: maxDepth,
+		out:      out,
+	}
+	isLocal, err := bs.Has(nd.Cid())
+	if err != nil {
+		return err
+	}
+	_, err = w.walkNode(path, nd, isLocal, 0)
+	return err
+}
+
+// walkCid walks the entry c at path and returns its local size.
+func (w *duWalker) walkCid(path string, c cid.Cid, depth int) (uint64, error) {
+	nd, err := w.local.Get(w.ctx, c)
+	if err == nil {
+		return w.walkNode(path, nd, true, depth)
+	}
+	if err != ipld.ErrNotFound {
+		return 0, err
+	}
+
+	nd, err = w.dserv.Get(w.ctx, c)
+	if err == ipld.ErrNotFound {
+		// not available offline
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if dir, err := asDirectory(w.dserv, nd); err != nil || dir == nil {
+		// only the missing directories are fetched
+		return 0, err
+	}
+	return w.walkNode(path, nd, false, depth)
+}
+
+// walkNode walks the entry nd at path, which is present locally if isLocal,
+// and returns its local size.
+func (w *duWalker) walkNode(path string, nd ipld.Node, isLocal bool, depth int) (uint64, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	dir, err := asDirectory(w.dserv, nd)
+	if err != nil {
+		return 0, err
+	}
+	if dir == nil {
+		return localSize(w.ctx, w.local, nd)
+	}
+
+	var local uint64
+	if isLocal {
+		local, err = shardsLocalSize(w.ctx, w.local, nd)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = dir.ForEachLink(w.ctx, func(l *ipld.Link) error {
+		childLocal, err := w.walkCid(gopath.Join(path, l.Name), l.Cid, depth+1)
+		local += childLocal
+		return err
+	})
+	if err != nil && err != ipld.ErrNotFound {
+		return 0, err
+	}
+
+	if w.maxDepth < 0 || depth <= w.maxDepth {
+		size, err := nd.Size()
+		if err != nil {
+			return 0, err
+		}
+		if err := w.out(DiskUsage{Path: path, Size: size, LocalSize: local}); err != nil {
+			return 0, err
+		}
+	}
+	return local, nil
+}
+
+// localSize returns the size of the blocks of the DAG of nd in the offline
+// DAG service local.
+func localSize(ctx context.Context, local ipld.DAGService, nd ipld.Node) (uint64, error) {
+	size := uint64(len(nd.RawData()))
+	for _, l := range nd.Links() {
+		child, err := local.Get(ctx, l.Cid)
+		if err == ipld.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		childSize, err := localSize(ctx, local, child)
+		if err != nil {
+			return 0, err
+		}
+		size += childSize
+	}
+	return size, nil
+}
+
+// shardsLocalSize returns the size of the blocks of the directory nd itself,
+// its HAMT shards if sharded, in the offline DAG service local.
+func shardsLocalSize(ctx context.Context, local ipld.DAGService, nd ipld.Node) (uint64, error) {
+	size := uint64(len(nd.RawData()))
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return size, nil
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return 0, err
+	}
+	if fsn.Type() != unixfs.THAMTShard {
+		return size, nil
+	}
+
+	// the links to the shards are named after their index only, the ones
+	// to the entries after their index and name
+	padLen := len(fmt.Sprintf("%X", fsn.Fanout()-1))
+	for _, l := range pn.Links() {
+		if len(l.Name) != padLen {
+			continue
+		}
+		child, err := local.Get(ctx, l.Cid)
+		if err == ipld.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		childSize, err := shardsLocalSize(ctx, local, child)
+		if err != nil {
+			return 0, err
+		}
+		size += childSize
+	}
+	return size, nil
+}
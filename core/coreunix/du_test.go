@@ -0,0 +1,112 @@
+package coreunix
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+func TestDiskUsageTree(t *testing.T) {
+	node := newTestNode(t)
+	ctx := context.Background()
+
+	file := func(s string) files.Node {
+		return files.NewBytesFile([]byte(s))
+	}
+	large := make(map[string]files.Node)
+	for i := 0; i < 50; i++ {
+		large[fmt.Sprintf("file%02d", i)] = file(fmt.Sprint(i))
+	}
+	adder, err := NewAdder(ctx, node.Pinning, node.Blockstore, node.DAG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adder.ShardingThreshold = 500
+	root, err := adder.AddAllAndPin(files.NewMapDirectory(map[string]files.Node{
+		"a": file("a"),
+		"dir": files.NewMapDirectory(map[string]files.Node{
+			"b":    file("bb"),
+			"sub":  files.NewMapDirectory(map[string]files.Node{"c": file("ccc")}),
+			"gone": files.NewMapDirectory(map[string]files.Node{"d": file("dddd")}),
+		}),
+		"large": files.NewMapDirectory(large),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	du := func(depth int) map[string]DiskUsage {
+		usage := make(map[string]DiskUsage)
+		var order []string
+		err := DiskUsageTree(ctx, node.DAG, node.Blockstore, "/", root, depth, func(du DiskUsage) error {
+			usage[du.Path] = du
+			order = append(order, du.Path)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order[len(order)-1] != "/" {
+			t.Fatalf("expected the root last, got %v", order)
+		}
+		return usage
+	}
+	size := func(nd ipld.Node) uint64 {
+		s, err := nd.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	usage := du(-1)
+	if len(usage) != 5 {
+		t.Fatalf("expected 5 directories, got %v", usage)
+	}
+	for path, u := range usage {
+		if u.LocalSize != u.Size {
+			t.Errorf("%s: expected all of the %d bytes to be local, got %d", path, u.Size, u.LocalSize)
+		}
+	}
+	if usage["/"].Size != size(root) {
+		t.Errorf("expected the size of the root to be %d, got %d", size(root), usage["/"].Size)
+	}
+
+	usage = du(1)
+	if len(usage) != 3 {
+		t.Fatalf("expected the directories down to depth 1, got %v", usage)
+	}
+
+	// remove a directory and a file block, not available offline
+	dir, err := root.(*dag.ProtoNode).GetLinkedProtoNode(ctx, node.DAG, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, err := dir.GetNodeLink("gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := root.(*dag.ProtoNode).GetNodeLink("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []ipld.Link{*gone, *a} {
+		if err := node.Blockstore.DeleteBlock(c.Cid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usage = du(-1)
+	if _, ok := usage["/dir/gone"]; ok {
+		t.Error("expected the missing directory not to be listed")
+	}
+	if u := usage["/dir"]; u.Size-u.LocalSize != gone.Size {
+		t.Errorf("expected %d bytes of /dir to be missing, got %d", gone.Size, u.Size-u.LocalSize)
+	}
+	if u := usage["/"]; u.Size-u.LocalSize != gone.Size+a.Size {
+		t.Errorf("expected %d bytes of / to be missing, got %d", gone.Size+a.Size, u.Size-u.LocalSize)
+	}
+}
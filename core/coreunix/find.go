@@ -0,0 +1,134 @@
+package coreunix
+
+import (
+	"context"
+	gopath "path"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+)
+
+// FindType restricts the entries found by Find to a type.
+type FindType string
+
+const (
+	FindAny         FindType = ""
+	FindFiles       FindType = "f"
+	FindDirectories FindType = "d"
+)
+
+// FindOptions are the criteria of the entries found by Find.
+type FindOptions struct {
+	// Name is a pattern the names must match, see path.Match.
+	Name string
+	Type FindType
+	// MinSize is the minimum size of the files, the cumulative size of the
+	// DAG of the directories.
+	MinSize uint64
+}
+
+// FindResult is an entry found by Find.
+type FindResult struct {
+	Path string
+	Cid  cid.Cid
+	Dir  bool
+	Size uint64
+}
+
+// Find walks the UnixFS tree nd at path, fetching its entries from dserv,
+// and calls out with each entry, nd included, matching opts, parents before
+// their entries. The directories dserv doesn't have, with an offline DAG
+// service, are skipped.
+func Find(ctx context.Context, dserv ipld.DAGService, path string, nd ipld.Node, opts FindOptions, out func(FindResult) error) error {
+	if opts.Name != "" {
+		// report malformed patterns before walking
+		if _, err := gopath.Match(opts.Name, ""); err != nil {
+			return err
+		}
+	}
+	return find(ctx, dserv, path, nd, opts, out)
+}
+
+func find(ctx context.Context, dserv ipld.DAGService, path string, nd ipld.Node, opts FindOptions, out func(FindResult) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dir, err := asDirectory(dserv, nd)
+	if err != nil {
+		return err
+	}
+
+	res := FindResult{Path: path, Cid: nd.Cid(), Dir: dir != nil}
+	if res.Dir {
+		res.Size, err = nd.Size()
+	} else {
+		res.Size, err = fileSize(nd)
+	}
+	if err != nil {
+		return err
+	}
+	if findMatch(res, opts) {
+		if err := out(res); err != nil {
+			return err
+		}
+	}
+	if dir == nil {
+		return nil
+	}
+
+	err = dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		child, err := l.GetNode(ctx, dserv)
+		if err == ipld.ErrNotFound {
+			// not available offline
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return find(ctx, dserv, gopath.Join(path, l.Name), child, opts, out)
+	})
+	if err == ipld.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func findMatch(res FindResult, opts FindOptions) bool {
+	switch opts.Type {
+	case FindFiles:
+		if res.Dir {
+			return false
+		}
+	case FindDirectories:
+		if !res.Dir {
+			return false
+		}
+	}
+	if res.Size < opts.MinSize {
+		return false
+	}
+	if opts.Name != "" {
+		// checked by Find
+		match, _ := gopath.Match(opts.Name, gopath.Base(res.Path))
+		return match
+	}
+	return true
+}
+
+// fileSize returns the size of the contents of the UnixFS file nd.
+func fileSize(nd ipld.Node) (uint64, error) {
+	switch nd := nd.(type) {
+	case *dag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return 0, err
+		}
+		return fsn.FileSize(), nil
+	case *dag.RawNode:
+		return uint64(len(nd.RawData())), nil
+	default:
+		return nd.Size()
+	}
+}
@@ -0,0 +1,88 @@
+package coreunix
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	files "github.com/ipfs/go-ipfs-files"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+func TestFind(t *testing.T) {
+	node := newTestNode(t)
+	ctx := context.Background()
+
+	file := func(size int) files.Node {
+		return files.NewBytesFile([]byte(strings.Repeat("x", size)))
+	}
+	large := make(map[string]files.Node)
+	for i := 0; i < 50; i++ {
+		large[fmt.Sprintf("file%02d.txt", i)] = file(i)
+	}
+	adder, err := NewAdder(ctx, node.Pinning, node.Blockstore, node.DAG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adder.ShardingThreshold = 500
+	root, err := adder.AddAllAndPin(files.NewMapDirectory(map[string]files.Node{
+		"a.csv": file(10),
+		"b.txt": file(1000),
+		"dir": files.NewMapDirectory(map[string]files.Node{
+			"c.csv": file(2000),
+			"gone":  files.NewMapDirectory(map[string]files.Node{"d.csv": file(3000)}),
+		}),
+		"large": files.NewMapDirectory(large),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	find := func(opts FindOptions) string {
+		t.Helper()
+		var found []string
+		err := Find(ctx, node.DAG, "/", root, opts, func(r FindResult) error {
+			found = append(found, r.Path)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(found)
+		return strings.Join(found, " ")
+	}
+	expect := func(opts FindOptions, expected string) {
+		t.Helper()
+		if got := find(opts); got != expected {
+			t.Errorf("%+v: found %q, expected %q", opts, got, expected)
+		}
+	}
+
+	expect(FindOptions{Name: "*.csv"}, "/a.csv /dir/c.csv /dir/gone/d.csv")
+	expect(FindOptions{Name: "file4?.txt", MinSize: 48}, "/large/file48.txt /large/file49.txt")
+	expect(FindOptions{Type: FindDirectories}, "/ /dir /dir/gone /large")
+	expect(FindOptions{Type: FindFiles, MinSize: 1000}, "/b.txt /dir/c.csv /dir/gone/d.csv")
+	if got := len(strings.Fields(find(FindOptions{}))); got != 58 {
+		t.Errorf("expected 58 entries, found %d", got)
+	}
+
+	// not available offline
+	dir, err := root.(*dag.ProtoNode).GetLinkedProtoNode(ctx, node.DAG, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, err := dir.GetNodeLink("gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Blockstore.DeleteBlock(gone.Cid); err != nil {
+		t.Fatal(err)
+	}
+	expect(FindOptions{Name: "*.csv"}, "/a.csv /dir/c.csv")
+
+	if err := Find(ctx, node.DAG, "/", root, FindOptions{Name: "["}, func(FindResult) error { return nil }); err == nil {
+		t.Error("expected a malformed pattern to fail")
+	}
+}
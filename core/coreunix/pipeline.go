@@ -0,0 +1,194 @@
+package coreunix
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Files streamed to the adder, as opposed to opened from the local
+// filesystem, have to be read before the next one is. Those up to this size
+// are buffered for the workers, larger ones imported as they come.
+const pipelineBufferSize = 1 << 20
+
+// addPipeline imports files on several workers. The imported files are
+// added to the root in the order they were given, so that the output events
+// and the resulting DAGs are the same as when importing them sequentially.
+type addPipeline struct {
+	adder  *Adder
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	jobs chan *addJob
+	wg   sync.WaitGroup
+
+	// files imported or being imported, in order, only accessed by the
+	// goroutine of the adder
+	pending []*addJob
+}
+
+type addJob struct {
+	path   string
+	reader io.Reader
+	closer io.Closer
+
+	// set by the worker before closing done
+	done chan struct{}
+	nd   ipld.Node
+	n    int64
+	err  error
+
+	// finish adds the imported node, from the goroutine of the adder
+	finish func(nd ipld.Node, n int64) error
+}
+
+// startPipeline starts the workers, if there should be more than one.
+func (adder *Adder) startPipeline() {
+	if adder.Workers < 2 || adder.pipeline != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(adder.ctx)
+	p := &addPipeline{
+		adder:  adder,
+		ctx:    ctx,
+		cancel: cancel,
+		jobs:   make(chan *addJob),
+	}
+	for i := 0; i < adder.Workers; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	adder.pipeline = p
+}
+
+// stopPipeline stops the workers, dropping the files not added yet.
+func (adder *Adder) stopPipeline() {
+	p := adder.pipeline
+	if p == nil {
+		return
+	}
+	p.cancel()
+	close(p.jobs)
+	p.wg.Wait()
+	adder.pipeline = nil
+}
+
+// inOrder calls f once the files given before are added.
+func (adder *Adder) inOrder(f func() error) error {
+	if adder.pipeline == nil {
+		return f()
+	}
+	job := &addJob{
+		done: make(chan struct{}),
+		finish: func(ipld.Node, int64) error {
+			return f()
+		},
+	}
+	close(job.done)
+	return adder.pipeline.enqueue(job, false)
+}
+
+func (p *addPipeline) worker() {
+	defer p.wg.Done()
+	// the buffered DAG of the adder isn't safe for concurrent use
+	ds := ipld.NewBufferedDAG(p.ctx, p.adder.dagService)
+	for job := range p.jobs {
+		if err := p.ctx.Err(); err != nil {
+			job.err = err
+		} else {
+			job.nd, job.n, job.err = p.adder.importFile(ds, job.path, job.reader)
+		}
+		if job.closer != nil {
+			job.closer.Close()
+		}
+		close(job.done)
+	}
+}
+
+// add imports file, and calls finish with the result once the files given
+// before are added.
+func (p *addPipeline) add(path string, file files.File, finish func(ipld.Node, int64) error) error {
+	job := &addJob{
+		path:   path,
+		done:   make(chan struct{}),
+		finish: finish,
+	}
+
+	if fi, ok := file.(files.FileInfo); ok && fi.Stat() != nil {
+		// files opened locally can be read in any order
+		job.reader = file
+		job.closer = file
+		return p.enqueue(job, true)
+	}
+
+	defer file.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(file, pipelineBufferSize+1))
+	if err != nil {
+		return err
+	}
+	var reader io.Reader = bytes.NewReader(buf)
+	if len(buf) > pipelineBufferSize {
+		reader = io.MultiReader(reader, file)
+	}
+	if fi, ok := file.(files.FileInfo); ok {
+		reader = &fileInfoReader{reader, fi}
+	}
+
+	if len(buf) <= pipelineBufferSize {
+		job.reader = reader
+		return p.enqueue(job, true)
+	}
+	// too large to keep around, import it now
+	job.nd, job.n, job.err = p.adder.importFile(p.adder.bufferedDS, path, reader)
+	close(job.done)
+	return p.enqueue(job, false)
+}
+
+// enqueue queues a job, sending it to the workers if work is set, and adds
+// the files done importing.
+func (p *addPipeline) enqueue(job *addJob, work bool) error {
+	if work {
+		select {
+		case p.jobs <- job:
+		case <-p.ctx.Done():
+			if job.closer != nil {
+				job.closer.Close()
+			}
+			return p.ctx.Err()
+		}
+	}
+	p.pending = append(p.pending, job)
+	return p.finish(false)
+}
+
+// finish adds the files done importing, in order. It waits for all of them
+// when all is set, or for those over the limit of pending files.
+func (p *addPipeline) finish(all bool) error {
+	for len(p.pending) > 0 {
+		job := p.pending[0]
+		if !all && len(p.pending) <= 4*p.adder.Workers {
+			select {
+			case <-job.done:
+			default:
+				return nil
+			}
+		} else {
+			<-job.done
+		}
+
+		p.pending[0] = nil
+		p.pending = p.pending[1:]
+		if job.err != nil {
+			return job.err
+		}
+		if err := job.finish(job.nd, job.n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package coreunix
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	files "github.com/ipfs/go-ipfs-files"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+)
+
+func TestAddParallel(t *testing.T) {
+	node := newTestNode(t)
+
+	rnd := rand.New(rand.NewSource(1))
+	randomData := func(n int) []byte {
+		data := make([]byte, n)
+		rnd.Read(data)
+		return data
+	}
+
+	dir := t.TempDir()
+	for i := 0; i < 40; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%d", i%4))
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(sub, fmt.Sprintf("f%d", i)), randomData(rnd.Intn(600000)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("d0/f0", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	// streamed files, including one too large to be buffered
+	streamed := []struct {
+		name string
+		data []byte
+	}{
+		{"small", randomData(1000)},
+		{"large", randomData(pipelineBufferSize + 300000)},
+	}
+
+	add := func(workers int) (string, []string) {
+		st, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sf, err := files.NewSerialFile(dir, false, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := []files.DirEntry{files.FileEntry("dir", sf)}
+		for _, f := range streamed {
+			entries = append(entries, files.FileEntry(f.name, files.NewReaderFile(ioutil.NopCloser(newSlowReader(f.data)))))
+		}
+
+		adder, err := NewAdder(context.Background(), node.Pinning, node.Blockstore, node.DAG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adder.Workers = workers
+		adder.RawLeaves = true
+		out := make(chan interface{})
+		adder.Out = out
+
+		var events []string
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for e := range out {
+				events = append(events, e.(*coreiface.AddEvent).Name)
+			}
+		}()
+		nd, err := adder.AddAllAndPin(files.NewSliceDirectory(entries))
+		close(out)
+		<-done
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd.Cid().String(), events
+	}
+
+	sequential, seqEvents := add(1)
+	parallel, parEvents := add(8)
+	if sequential != parallel {
+		t.Fatalf("parallel import gave %s, expected %s", parallel, sequential)
+	}
+	if fmt.Sprint(seqEvents) != fmt.Sprint(parEvents) {
+		t.Errorf("events differ:\n%v\n%v", seqEvents, parEvents)
+	}
+}
+
+// slowReader returns little data at a time, like a network stream.
+type slowReader struct {
+	data []byte
+}
+
+func newSlowReader(data []byte) *slowReader {
+	return &slowReader{data}
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > 4096 {
+		p = p[:4096]
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
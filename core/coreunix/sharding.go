@@ -0,0 +1,272 @@
+package coreunix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gopath "path"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-mfs"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+var errPastThreshold = errors.New("past the sharding threshold")
+
+// autoSharding returns whether directories should be resharded by size,
+// which Experimental.ShardingEnabled overrides by sharding all of them.
+func autoSharding(threshold int) bool {
+	return threshold > 0 && !uio.UseHAMTSharding
+}
+
+// linkSize is what a directory entry adds to the estimated size of the
+// directory, the length of its name and of its CID, which leaves out the
+// protobuf framing and the sizes.
+func linkSize(l *ipld.Link) int {
+	return len(l.Name) + l.Cid.ByteLen()
+}
+
+// pastThreshold returns whether nd is a basic directory whose estimated size
+// is past threshold.
+func pastThreshold(nd ipld.Node, threshold int) bool {
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok || !autoSharding(threshold) {
+		return false
+	}
+	size := 0
+	for _, l := range pn.Links() {
+		size += linkSize(l)
+	}
+	if size <= threshold {
+		return false
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	return err == nil && fsn.Type() == unixfs.TDirectory
+}
+
+// stagedDAG is the DAG service of the MFS root of the adder. It keeps the
+// basic directories past the sharding threshold in memory instead of
+// writing them, as mfs syncs them before the adder reshards them once
+// complete, see Adder.patchDirs.
+type stagedDAG struct {
+	ipld.DAGService
+	adder *Adder
+
+	lk     sync.Mutex
+	staged map[cid.Cid]ipld.Node
+}
+
+func (s *stagedDAG) Add(ctx context.Context, nd ipld.Node) error {
+	if !pastThreshold(nd, s.adder.ShardingThreshold) {
+		return s.DAGService.Add(ctx, nd)
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.staged == nil {
+		s.staged = make(map[cid.Cid]ipld.Node)
+	}
+	s.staged[nd.Cid()] = nd
+	return nil
+}
+
+func (s *stagedDAG) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		if err := s.Add(ctx, nd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *stagedDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	s.lk.Lock()
+	nd, ok := s.staged[c]
+	s.lk.Unlock()
+	if ok {
+		return nd, nil
+	}
+	return s.DAGService.Get(ctx, c)
+}
+
+func (s *stagedDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	var rest []cid.Cid
+	s.lk.Lock()
+	for _, c := range cids {
+		if nd, ok := s.staged[c]; ok {
+			out <- &ipld.NodeOption{Node: nd}
+		} else {
+			rest = append(rest, c)
+		}
+	}
+	s.lk.Unlock()
+	go func() {
+		defer close(out)
+		if len(rest) == 0 {
+			return
+		}
+		for opt := range s.DAGService.GetMany(ctx, rest) {
+			out <- opt
+		}
+	}()
+	return out
+}
+
+// drop forgets the staged node c, replaced by its resharded version.
+func (s *stagedDAG) drop(c cid.Cid) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	delete(s.staged, c)
+}
+
+// flush writes the staged nodes, for the incomplete directories to be
+// pinned.
+func (s *stagedDAG) flush(ctx context.Context) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for c, nd := range s.staged {
+		if err := s.DAGService.Add(ctx, nd); err != nil {
+			return err
+		}
+		delete(s.staged, c)
+	}
+	return nil
+}
+
+// ReshardDirectory turns the directory nd into a HAMT if its estimated size
+// is past threshold, or a sharded one back into a basic directory if
+// below, keeping its metadata. It returns nd if the layout doesn't change,
+// and the new node, added to dserv, otherwise.
+func ReshardDirectory(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, threshold int) (ipld.Node, error) {
+	if !autoSharding(threshold) {
+		return nd, nil
+	}
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nd, nil
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return nil, err
+	}
+	if fsn.Type() != unixfs.TDirectory && fsn.Type() != unixfs.THAMTShard {
+		return nd, nil
+	}
+	dir, err := uio.NewDirectoryFromNode(dserv, pn)
+	if err != nil {
+		return nil, err
+	}
+
+	// stop counting as soon as the threshold is passed
+	size := 0
+	err = dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		size += linkSize(l)
+		if size > threshold {
+			return errPastThreshold
+		}
+		return nil
+	})
+	if err != nil && err != errPastThreshold {
+		return nil, err
+	}
+	shard := size > threshold
+
+	var out ipld.Node
+	switch d := dir.(type) {
+	case *uio.BasicDirectory:
+		if !shard {
+			return nd, nil
+		}
+		hamtDir, err := d.SwitchToSharding(ctx)
+		if err != nil {
+			return nil, err
+		}
+		out, err = hamtDir.GetNode()
+		if err != nil {
+			return nil, err
+		}
+	case *uio.HAMTDirectory:
+		if shard {
+			return nd, nil
+		}
+		basic := unixfs.EmptyDirNode()
+		basic.SetCidBuilder(pn.CidBuilder())
+		err := d.ForEachLink(ctx, func(l *ipld.Link) error {
+			return basic.AddRawLink(l.Name, l)
+		})
+		if err != nil {
+			return nil, err
+		}
+		out = basic
+	default:
+		return nd, nil
+	}
+
+	// the switch drops the metadata of the directory
+	md, err := ReadUnixFSMetadata(pn)
+	if err != nil {
+		return nil, err
+	}
+	if outpn, ok := out.(*dag.ProtoNode); ok && !md.IsZero() {
+		outpn = outpn.Copy().(*dag.ProtoNode)
+		if err := SetUnixFSMetadata(outpn, md); err != nil {
+			return nil, err
+		}
+		out = outpn
+	}
+	return out, dserv.Add(ctx, out)
+}
+
+// ReshardMfsDirectory reshards the MFS directory at path, see
+// ReshardDirectory, replacing it in its parent. The root directory can't be
+// replaced, it keeps its layout.
+func ReshardMfsDirectory(ctx context.Context, r *mfs.Root, dserv ipld.DAGService, path string, threshold int) error {
+	path = gopath.Clean(path)
+	if path == "/" || path == "." {
+		return nil
+	}
+	dir, err := mfsDirectory(r, path)
+	if err != nil {
+		return err
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		return err
+	}
+	resharded, err := ReshardDirectory(ctx, dserv, nd, threshold)
+	if err != nil || resharded == nd {
+		return err
+	}
+
+	// replaced in its parent, the entries below it are looked up again from
+	// the new node
+	parent, err := mfsDirectory(r, gopath.Dir(path))
+	if err != nil {
+		return err
+	}
+	name := gopath.Base(path)
+	if err := parent.Unlink(name); err != nil {
+		return err
+	}
+	if err := parent.AddChild(name, resharded); err != nil {
+		return err
+	}
+	return parent.Flush()
+}
+
+// mfsDirectory returns the MFS directory at path.
+func mfsDirectory(r *mfs.Root, path string) (*mfs.Directory, error) {
+	fsn, err := mfs.Lookup(r, path)
+	if err != nil {
+		return nil, err
+	}
+	dir, ok := fsn.(*mfs.Directory)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a directory", path)
+	}
+	return dir, nil
+}
@@ -0,0 +1,109 @@
+package coreunix
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+	pb "github.com/ipfs/go-unixfs/pb"
+)
+
+func TestAddAutoSharding(t *testing.T) {
+	node := newTestNode(t)
+	ctx := context.Background()
+
+	add := func(threshold int) ipld.Node {
+		large := make(map[string]files.Node)
+		for i := 0; i < 100; i++ {
+			large[fmt.Sprintf("file%03d", i)] = files.NewBytesFile([]byte(fmt.Sprint(i)))
+		}
+		large["small"] = files.NewMapDirectory(map[string]files.Node{
+			"a": files.NewBytesFile([]byte("a")),
+			"b": files.NewBytesFile([]byte("b")),
+		})
+
+		adder, err := NewAdder(ctx, node.Pinning, node.Blockstore, node.DAG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adder.ShardingThreshold = threshold
+		nd, err := adder.AddAllAndPin(files.NewMapDirectory(large))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd
+	}
+	dirType := func(nd ipld.Node) pb.Data_DataType {
+		fsn, err := unixfs.FSNodeFromBytes(nd.(*dag.ProtoNode).Data())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fsn.Type()
+	}
+
+	// 100 entries of 7 bytes names and 34 bytes CIDs
+	sharded := add(1000)
+	if dirType(sharded) != unixfs.THAMTShard {
+		t.Fatalf("expected the large directory to be sharded, got %s", dirType(sharded))
+	}
+	// the basic directory it was, past the threshold, isn't written
+	dir, err := uio.NewDirectoryFromNode(node.DAG, sharded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wasBasic := unixfs.EmptyDirNode()
+	err = dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		return wasBasic.AddRawLink(l.Name, l)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has, err := node.Blockstore.Has(wasBasic.Cid()); err != nil || has {
+		t.Errorf("expected the unsharded directory not to be written, got %v, %v", has, err)
+	}
+	small := findChild(ctx, t, node.DAG, sharded, "small")
+	if dirType(small) != unixfs.TDirectory {
+		t.Fatalf("expected the small directory not to be sharded, got %s", dirType(small))
+	}
+
+	basic := add(0)
+	if dirType(basic) != unixfs.TDirectory {
+		t.Fatalf("expected no sharding with a zero threshold, got %s", dirType(basic))
+	}
+
+	// back below the threshold, the same as never sharded
+	unsharded, err := ReshardDirectory(ctx, node.DAG, sharded, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wasBasic.Cid().Equals(basic.Cid()) {
+		t.Errorf("unsharded directory is %s, expected %s", wasBasic.Cid(), basic.Cid())
+	}
+	if !unsharded.Cid().Equals(basic.Cid()) {
+		t.Errorf("unsharded directory is %s, expected %s", unsharded.Cid(), basic.Cid())
+	}
+	resharded, err := ReshardDirectory(ctx, node.DAG, basic, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resharded.Cid().Equals(sharded.Cid()) {
+		t.Errorf("resharded directory is %s, expected %s", resharded.Cid(), sharded.Cid())
+	}
+}
+
+func findChild(ctx context.Context, t *testing.T, ds ipld.DAGService, nd ipld.Node, name string) ipld.Node {
+	dir, err := uio.NewDirectoryFromNode(ds, nd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := dir.Find(ctx, name)
+	if err != nil {
+		t.Fatalf("finding %s: %s", name, err)
+	}
+	return child
+}
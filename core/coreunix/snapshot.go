@@ -0,0 +1,280 @@
+package coreunix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	gopath "path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-mfs"
+)
+
+// SnapshotPrefix is the datastore namespace of the MFS snapshots.
+var SnapshotPrefix = datastore.NewKey("/local/filessnapshots")
+
+// snapshotTimeFormat names the snapshots not given a name.
+const snapshotTimeFormat = "20060102-150405.000"
+
+// snapshotName matches the valid snapshot names, which are datastore key
+// components.
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+var (
+	ErrSnapshotExists   = errors.New("snapshot already exists")
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
+
+// Snapshot is a recorded state of an MFS file or directory, kept by the
+// garbage collector until removed.
+type Snapshot struct {
+	Name string
+	// Path is the MFS path the snapshot was taken of.
+	Path string
+	Cid  cid.Cid
+	Time time.Time
+}
+
+func snapshotKey(name string) datastore.Key {
+	return SnapshotPrefix.ChildString(name)
+}
+
+// SnapshotMfs records the state of the MFS file or directory at path as the
+// snapshot name, named after the current time if empty. Names are made of
+// letters, digits, dots, dashes and underscores, and start with a letter or
+// a digit.
+func SnapshotMfs(ctx context.Context, r *mfs.Root, ds datastore.Datastore, path, name string) (Snapshot, error) {
+	now := time.Now()
+	if name == "" {
+		var err error
+		name, err = unusedSnapshotName(ds, now)
+		if err != nil {
+			return Snapshot{}, err
+		}
+	}
+	if !snapshotName.MatchString(name) {
+		return Snapshot{}, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	key := snapshotKey(name)
+	if has, err := ds.Has(key); err != nil || has {
+		if err == nil {
+			err = ErrSnapshotExists
+		}
+		return Snapshot{}, err
+	}
+
+	path = gopath.Clean(path)
+	nd, err := mfs.FlushPath(ctx, r, path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	s := Snapshot{Name: name, Path: path, Cid: nd.Cid(), Time: now}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err := ds.Put(key, data); err != nil {
+		return Snapshot{}, err
+	}
+	return s, ds.Sync(key)
+}
+
+// unusedSnapshotName names a snapshot taken at t after it, with a counter
+// appended if others were taken in the same millisecond.
+func unusedSnapshotName(ds datastore.Datastore, t time.Time) (string, error) {
+	base := t.UTC().Format(snapshotTimeFormat)
+	name := base
+	for i := 1; ; i++ {
+		has, err := ds.Has(snapshotKey(name))
+		if err != nil {
+			return "", err
+		}
+		if !has {
+			return name, nil
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// GetSnapshot returns the snapshot name.
+func GetSnapshot(ds datastore.Datastore, name string) (Snapshot, error) {
+	if !snapshotName.MatchString(name) {
+		return Snapshot{}, ErrSnapshotNotFound
+	}
+	data, err := ds.Get(snapshotKey(name))
+	if err == datastore.ErrNotFound {
+		return Snapshot{}, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return Snapshot{}, fmt.Errorf("malformed snapshot %s: %s", name, err)
+	}
+	return s, nil
+}
+
+// RemoveSnapshot removes the snapshot name, letting the garbage collector
+// remove the data only it holds.
+func RemoveSnapshot(ds datastore.Datastore, name string) error {
+	if !snapshotName.MatchString(name) {
+		return ErrSnapshotNotFound
+	}
+	key := snapshotKey(name)
+	has, err := ds.Has(key)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return ErrSnapshotNotFound
+	}
+	return ds.Delete(key)
+}
+
+// Snapshots returns the snapshots, the latest first.
+func Snapshots(ctx context.Context, ds datastore.Datastore) ([]Snapshot, error) {
+	res, err := ds.Query(query.Query{Prefix: SnapshotPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var snapshots []Snapshot
+loop:
+	for {
+		var r query.Result
+		var ok bool
+		select {
+		case r, ok = <-res.Next():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !ok {
+			break loop
+		}
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var s Snapshot
+		if err := json.Unmarshal(r.Value, &s); err != nil {
+			log.Warnf("ignoring malformed snapshot %s: %s", r.Key, err)
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+// SnapshotCids returns the CIDs of the snapshots, which the garbage
+// collector should keep.
+func SnapshotCids(ctx context.Context, ds datastore.Datastore) ([]cid.Cid, error) {
+	snapshots, err := Snapshots(ctx, ds)
+	if err != nil {
+		return nil, err
+	}
+	cids := make([]cid.Cid, len(snapshots))
+	for i, s := range snapshots {
+		cids[i] = s.Cid
+	}
+	return cids, nil
+}
+
+// RollbackMfs restores the MFS file or directory the snapshot s was taken of.
+func RollbackMfs(ctx context.Context, r *mfs.Root, dserv ipld.DAGService, s Snapshot) error {
+	nd, err := dserv.Get(ctx, s.Cid)
+	if err != nil {
+		return err
+	}
+	return replaceMfs(ctx, r, dserv, s.Path, nd)
+}
+
+// replaceMfs puts nd at path in MFS, in place of the entry there if any.
+// Whatever may fail, like fetching the entries of a new root, is done before
+// MFS is changed. MFS having no way to replace an entry, the old one is then
+// unlinked and the new one added; callers keep the other changes to MFS out
+// meanwhile.
+//
+// The MFS root directory can't be replaced: replacing it replaces the
+// entries that differ, it keeps its own CID version and layout.
+func replaceMfs(ctx context.Context, r *mfs.Root, dserv ipld.DAGService, path string, nd ipld.Node) error {
+	if path != "/" {
+		dir := gopath.Dir(path)
+		if err := mfs.Mkdir(r, dir, mfs.MkdirOpts{Mkparents: true}); err != nil {
+			return err
+		}
+		parent, err := mfsDirectory(r, dir)
+		if err != nil {
+			return err
+		}
+		name := gopath.Base(path)
+		if err := parent.Unlink(name); err != nil && err != os.ErrNotExist {
+			return err
+		}
+		if err := parent.AddChild(name, nd); err != nil {
+			return err
+		}
+		_, err = mfs.FlushPath(ctx, r, path)
+		return err
+	}
+
+	newRoot, err := asDirectory(dserv, nd)
+	if err != nil {
+		return err
+	}
+	if newRoot == nil {
+		return fmt.Errorf("%s is not a directory", nd.Cid())
+	}
+	root := r.GetDirectory()
+	entries, err := root.List(ctx)
+	if err != nil {
+		return err
+	}
+	old := make(map[string]string, len(entries))
+	for _, e := range entries {
+		old[e.Name] = e.Hash
+	}
+	// staged, the entries that differ are all fetched before MFS is changed
+	children := make(map[string]ipld.Node)
+	err = newRoot.ForEachLink(ctx, func(l *ipld.Link) error {
+		if h, ok := old[l.Name]; ok && h == l.Cid.String() {
+			delete(old, l.Name)
+			return nil
+		}
+		child, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return err
+		}
+		children[l.Name] = child
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// left are the entries removed or changed
+	for name := range old {
+		if err := root.Unlink(name); err != nil {
+			return err
+		}
+	}
+	for name, child := range children {
+		if err := root.AddChild(name, child); err != nil {
+			return err
+		}
+	}
+	_, err = mfs.FlushPath(ctx, r, "/")
+	return err
+}
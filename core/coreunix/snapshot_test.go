@@ -0,0 +1,129 @@
+package coreunix
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-mfs"
+	ft "github.com/ipfs/go-unixfs"
+)
+
+func TestSnapshots(t *testing.T) {
+	node := newTestNode(t)
+	ctx := context.Background()
+	ds := node.Repo.Datastore()
+
+	put := func(path string, data string) {
+		nd := dag.NodeWithData(ft.FilePBData([]byte(data), uint64(len(data))))
+		if err := mfs.PutNode(node.FilesRoot, path, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := func(path string) cid.Cid {
+		nd, err := mfs.FlushPath(ctx, node.FilesRoot, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd.Cid()
+	}
+
+	if err := mfs.Mkdir(node.FilesRoot, "/dir/sub", mfs.MkdirOpts{Mkparents: true}); err != nil {
+		t.Fatal(err)
+	}
+	put("/top", "top")
+	put("/dir/a", "a")
+	put("/dir/sub/b", "b")
+
+	root, err := SnapshotMfs(ctx, node.FilesRoot, ds, "/", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := SnapshotMfs(ctx, node.FilesRoot, ds, "/dir/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Cid.Equals(current("/")) || !dir.Cid.Equals(current("/dir")) {
+		t.Fatal("snapshots don't match the MFS state")
+	}
+	if _, err := SnapshotMfs(ctx, node.FilesRoot, ds, "/", "root"); err != ErrSnapshotExists {
+		t.Fatalf("expected %q, got %v", ErrSnapshotExists, err)
+	}
+	for _, name := range []string{".", "..", "a/b", "-a", ".a"} {
+		if _, err := SnapshotMfs(ctx, node.FilesRoot, ds, "/", name); err == nil {
+			t.Errorf("expected the name %q to be refused", name)
+		}
+	}
+	// taken in the same millisecond
+	if name, err := unusedSnapshotName(ds, dir.Time); err != nil || name != dir.Name+"-1" {
+		t.Errorf("expected a name unused, got %q, %v", name, err)
+	}
+
+	snapshots, err := Snapshots(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Name != dir.Name || snapshots[1].Name != "root" {
+		t.Fatalf("unexpected snapshots %v", snapshots)
+	}
+	if snapshots[0].Path != "/dir" {
+		t.Errorf("expected the path to be cleaned, got %s", snapshots[0].Path)
+	}
+
+	// a subpath
+	put("/dir/c", "new")
+	if err := node.FilesRoot.GetDirectory().Unlink("top"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfs.Mv(node.FilesRoot, "/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RollbackMfs(ctx, node.FilesRoot, node.DAG, dir); err != nil {
+		t.Fatal(err)
+	}
+	if !current("/dir").Equals(dir.Cid) {
+		t.Fatal("expected /dir to be rolled back")
+	}
+	if _, err := mfs.Lookup(node.FilesRoot, "/top"); err == nil {
+		t.Fatal("expected the rest of MFS to be left alone")
+	}
+
+	// the root
+	if err := RollbackMfs(ctx, node.FilesRoot, node.DAG, root); err != nil {
+		t.Fatal(err)
+	}
+	if !current("/").Equals(root.Cid) {
+		t.Fatal("expected the root to be rolled back")
+	}
+
+	// failing, MFS is left alone
+	missing := dag.NodeWithData(ft.FilePBData([]byte("missing"), 7))
+	broken := ft.EmptyDirNode()
+	if err := broken.AddNodeLink("missing", missing); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.DAG.Add(ctx, broken); err != nil {
+		t.Fatal(err)
+	}
+	if err := RollbackMfs(ctx, node.FilesRoot, node.DAG, Snapshot{Path: "/", Cid: broken.Cid()}); err == nil {
+		t.Fatal("expected the rollback to fail")
+	}
+	if !current("/").Equals(root.Cid) {
+		t.Fatal("expected MFS to be left alone")
+	}
+
+	if err := RemoveSnapshot(ds, "root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveSnapshot(ds, "root"); err != ErrSnapshotNotFound {
+		t.Fatalf("expected %q, got %v", ErrSnapshotNotFound, err)
+	}
+	cids, err := SnapshotCids(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cids) != 1 || !cids[0].Equals(dir.Cid) {
+		t.Fatalf("unexpected snapshot cids %v", cids)
+	}
+}
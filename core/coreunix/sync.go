@@ -0,0 +1,464 @@
+package coreunix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	gopath "path"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	files "github.com/ipfs/go-ipfs-files"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-mfs"
+	"github.com/ipfs/go-unixfs"
+
+	"github.com/ipfs/go-ipfs/core/node"
+)
+
+// SyncCachePrefix is the datastore namespace of the state caches of MFS
+// syncs.
+var SyncCachePrefix = datastore.NewKey("/local/filessync")
+
+// SyncEvent is a change made to MFS by a Syncer, DiffAdded, DiffModified or
+// DiffRemoved.
+type SyncEvent struct {
+	Type DiffType
+	// Path is relative to the synced directory.
+	Path string
+}
+
+// SyncStat is the file information of a synced file.
+type SyncStat struct {
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// Syncer brings an MFS directory in line with a local directory, like rsync:
+// only the files which changed are imported, and the entries missing
+// locally are removed.
+//
+// Files are known to be unchanged when their size and mtime are those of the
+// MFS file, as stored with PreserveMtime, or as recorded in the state cache.
+// Other files of the same size are imported again, and only replaced in MFS
+// if their CID changed.
+type Syncer struct {
+	ctx        context.Context
+	pinning    pin.Pinner
+	gcLocker   bstore.GCLocker
+	dagService ipld.DAGService
+	root       *mfs.Root
+
+	Chunker   string
+	RawLeaves bool
+	// CidBuilder, when set, is used for the added files and directories
+	// instead of that of their parent.
+	CidBuilder    cid.Builder
+	PreserveMode  bool
+	PreserveMtime bool
+
+	// ShardingThreshold is the estimated size past which the directories
+	// are sharded, see node.ShardingThreshold. Zero disables it.
+	ShardingThreshold int
+
+	// Cache, when set, holds the state cache, recording the size, mtime
+	// and CID of the synced files.
+	Cache datastore.Batching
+
+	// Stats, when set, holds the file information of the synced files by
+	// path relative to the synced directory, which API clients send along
+	// with them. Otherwise it's taken from the files, as those read from the
+	// filesystem.
+	Stats map[string]SyncStat
+
+	// Out, when set, is called with every change made.
+	Out func(SyncEvent) error
+
+	cacheID    string
+	cacheBatch datastore.Batch
+	cacheOps   int
+}
+
+// NewSyncer returns a Syncer of directories of the MFS root r.
+func NewSyncer(ctx context.Context, p pin.Pinner, bs bstore.GCLocker, ds ipld.DAGService, r *mfs.Root) *Syncer {
+	return &Syncer{
+		ctx:               ctx,
+		pinning:           p,
+		gcLocker:          bs,
+		dagService:        ds,
+		root:              r,
+		ShardingThreshold: node.DefaultShardingThreshold,
+	}
+}
+
+// Sync brings the MFS directory at mfsPath, created if needed, in line with
+// the directory dir. source names where dir was read from, as its local
+// path, and keeps the state caches of different sources apart.
+func (s *Syncer) Sync(source string, dir files.Directory, mfsPath string) (err error) {
+	mfsPath = gopath.Clean(mfsPath)
+	err = mfs.Mkdir(s.root, mfsPath, mfs.MkdirOpts{
+		Mkparents:  true,
+		CidBuilder: s.CidBuilder,
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.Cache != nil {
+		sum := sha256.Sum256([]byte(source + "\x00" + mfsPath))
+		s.cacheID = hex.EncodeToString(sum[:8])
+		defer func() {
+			// what was synced stays valid when interrupted
+			if cerr := s.commitCache(); err == nil {
+				err = cerr
+			}
+		}()
+	}
+
+	if err := s.syncDir(dir, mfsPath, ""); err != nil {
+		return err
+	}
+	_, err = mfs.FlushPath(s.ctx, s.root, mfsPath)
+	return err
+}
+
+// syncDir syncs the MFS directory at mfsPath with the local directory
+// local, at rel in the synced tree.
+func (s *Syncer) syncDir(local files.Directory, mfsPath, rel string) error {
+	dir, err := mfsDirectory(s.root, mfsPath)
+	if err != nil {
+		return err
+	}
+
+	// the entries are streamed, those missing are only known at the end
+	seen := make(map[string]bool)
+	it := local.Entries()
+	for it.Next() {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+		name := it.Name()
+		seen[name] = true
+		childRel := gopath.Join(rel, name)
+
+		existing, err := dir.Child(name)
+		if err == os.ErrNotExist {
+			existing = nil
+		} else if err != nil {
+			return err
+		}
+
+		switch nd := it.Node().(type) {
+		case files.Directory:
+			if existing != nil && existing.Type() != mfs.TDir {
+				if err := s.remove(dir, name, childRel); err != nil {
+					return err
+				}
+				existing = nil
+			}
+			if existing == nil {
+				sub, err := dir.Mkdir(name)
+				if err != nil {
+					return err
+				}
+				if s.CidBuilder != nil {
+					sub.SetCidBuilder(s.CidBuilder)
+				}
+				if err := s.emit(DiffAdded, childRel); err != nil {
+					return err
+				}
+			}
+			if err := s.syncDir(nd, gopath.Join(mfsPath, name), childRel); err != nil {
+				return err
+			}
+		case *files.Symlink:
+			data, err := unixfs.SymlinkData(nd.Target)
+			if err != nil {
+				return err
+			}
+			pn := dag.NodeWithData(data)
+			pn.SetCidBuilder(dir.GetCidBuilder())
+			if err := s.put(dir, name, childRel, existing, pn); err != nil {
+				return err
+			}
+		case files.File:
+			if err := s.syncFile(dir, nd, name, childRel, existing); err != nil {
+				return err
+			}
+		default:
+			log.Infof("sync: skipping %s, neither a file, a directory nor a symlink", childRel)
+		}
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+
+	names, err := dir.ListNames(s.ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		if err := s.remove(dir, name, gopath.Join(rel, name)); err != nil {
+			return err
+		}
+	}
+
+	return ReshardMfsDirectory(s.ctx, s.root, s.dagService, mfsPath, s.ShardingThreshold)
+}
+
+// syncFile syncs the local file f into dir, unless it didn't change since
+// the last sync.
+func (s *Syncer) syncFile(dir *mfs.Directory, f files.File, name, rel string, existing mfs.FSNode) error {
+	defer f.Close()
+	st, err := s.stat(rel, f)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Type() == mfs.TFile {
+		old, err := existing.GetNode()
+		if err != nil {
+			return err
+		}
+		unchanged, cached, err := s.unchanged(rel, st, old)
+		if err != nil || cached {
+			return err
+		}
+		if unchanged {
+			return s.record(rel, st, old.Cid())
+		}
+	}
+
+	nd, err := s.importFile(f, st, dir.GetCidBuilder())
+	if err != nil {
+		return err
+	}
+	if err := s.put(dir, name, rel, existing, nd); err != nil {
+		return err
+	}
+	return s.record(rel, st, nd.Cid())
+}
+
+// stat returns the file information of the file f at rel, from Stats if
+// set.
+func (s *Syncer) stat(rel string, f files.File) (SyncStat, error) {
+	if s.Stats != nil {
+		st, ok := s.Stats[rel]
+		if !ok {
+			return SyncStat{}, fmt.Errorf("no file information sent for %s", rel)
+		}
+		return st, nil
+	}
+	fi, ok := f.(files.FileInfo)
+	if !ok || fi.Stat() == nil {
+		return SyncStat{}, fmt.Errorf("no file information for %s", rel)
+	}
+	st := fi.Stat()
+	return SyncStat{Size: st.Size(), Mode: st.Mode(), ModTime: st.ModTime()}, nil
+}
+
+// unchanged returns whether the local file st is the same as nd, added by
+// a previous sync, and whether the state cache knows it already.
+func (s *Syncer) unchanged(rel string, st SyncStat, nd ipld.Node) (unchanged bool, cached bool, err error) {
+	if s.Cache != nil {
+		data, err := s.Cache.Get(s.cacheKey(rel))
+		switch err {
+		case nil:
+			var rec checkpoint
+			if err := json.Unmarshal(data, &rec); err != nil {
+				log.Warnf("ignoring malformed sync state of %s: %s", rel, err)
+				break
+			}
+			if rec.Size == st.Size && rec.ModTime.Equal(st.ModTime) && rec.Cid.Equals(nd.Cid()) {
+				return true, true, nil
+			}
+		case datastore.ErrNotFound:
+		default:
+			return false, false, err
+		}
+	}
+
+	if !s.PreserveMtime {
+		return false, false, nil
+	}
+	var size int64
+	switch nd := nd.(type) {
+	case *dag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return false, false, err
+		}
+		size = int64(fsn.FileSize())
+	case *dag.RawNode:
+		size = int64(len(nd.RawData()))
+	default:
+		return false, false, nil
+	}
+	md, err := ReadUnixFSMetadata(nd)
+	if err != nil {
+		return false, false, err
+	}
+	unchanged = size == st.Size && md.Mtime.Equal(st.ModTime) &&
+		(!s.PreserveMode || md.Mode == st.Mode&unixModeBits)
+	return unchanged, false, nil
+}
+
+// importFile adds the local file f, of file information st, with the
+// CidBuilder of the Syncer or else the given one.
+func (s *Syncer) importFile(f files.File, st SyncStat, builder cid.Builder) (ipld.Node, error) {
+	adder, err := NewAdder(s.ctx, s.pinning, s.gcLocker, s.dagService)
+	if err != nil {
+		return nil, err
+	}
+	adder.Pin = false
+	adder.Silent = true
+	adder.Chunker = s.Chunker
+	adder.RawLeaves = s.RawLeaves
+	adder.CidBuilder = builder
+	if s.CidBuilder != nil {
+		adder.CidBuilder = s.CidBuilder
+	}
+	adder.PreserveMode = s.PreserveMode
+	adder.PreserveMtime = s.PreserveMtime
+	adder.Metadata = map[string]UnixFSMetadata{
+		"": {Mode: st.Mode & unixModeBits, Mtime: st.ModTime},
+	}
+	return adder.AddAllAndPin(f)
+}
+
+// put sets the entry name of dir to nd, replacing existing if it differs.
+func (s *Syncer) put(dir *mfs.Directory, name, rel string, existing mfs.FSNode, nd ipld.Node) error {
+	change := DiffAdded
+	if existing != nil {
+		old, err := existing.GetNode()
+		if err != nil {
+			return err
+		}
+		if old.Cid().Equals(nd.Cid()) {
+			return nil
+		}
+		if err := dir.Unlink(name); err != nil {
+			return err
+		}
+		if existing.Type() == mfs.TDir {
+			// replaced by a file
+			if err := s.forget(rel); err != nil {
+				return err
+			}
+		}
+		change = DiffModified
+	}
+	if err := dir.AddChild(name, nd); err != nil {
+		return err
+	}
+	return s.emit(change, rel)
+}
+
+// remove removes the entry name of dir, missing locally.
+func (s *Syncer) remove(dir *mfs.Directory, name, rel string) error {
+	if err := dir.Unlink(name); err != nil {
+		return err
+	}
+	if err := s.forget(rel); err != nil {
+		return err
+	}
+	return s.emit(DiffRemoved, rel)
+}
+
+func (s *Syncer) emit(t DiffType, rel string) error {
+	if s.Out == nil {
+		return nil
+	}
+	return s.Out(SyncEvent{Type: t, Path: rel})
+}
+
+func (s *Syncer) cacheKey(rel string) datastore.Key {
+	return SyncCachePrefix.ChildString(s.cacheID).Child(datastore.NewKey(rel))
+}
+
+// record writes the state of a synced file to the cache.
+func (s *Syncer) record(rel string, st SyncStat, c cid.Cid) error {
+	if s.Cache == nil {
+		return nil
+	}
+	data, err := json.Marshal(checkpoint{Cid: c, Size: st.Size, ModTime: st.ModTime})
+	if err != nil {
+		return err
+	}
+	return s.cacheOp(func(b datastore.Batch) error {
+		return b.Put(s.cacheKey(rel), data)
+	})
+}
+
+// forget removes the state of the removed file or directory at rel from the
+// cache.
+func (s *Syncer) forget(rel string) error {
+	if s.Cache == nil {
+		return nil
+	}
+	key := s.cacheKey(rel)
+	if err := s.cacheOp(func(b datastore.Batch) error { return b.Delete(key) }); err != nil {
+		return err
+	}
+	res, err := s.Cache.Query(query.Query{Prefix: key.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		k := datastore.RawKey(r.Key)
+		// some datastores match siblings sharing the beginning of the name
+		if !k.IsDescendantOf(key) {
+			continue
+		}
+		if err := s.cacheOp(func(b datastore.Batch) error { return b.Delete(k) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheOp applies op to the cache in batches.
+func (s *Syncer) cacheOp(op func(datastore.Batch) error) error {
+	if s.cacheBatch == nil {
+		b, err := s.Cache.Batch()
+		if err != nil {
+			return err
+		}
+		s.cacheBatch = b
+	}
+	if err := op(s.cacheBatch); err != nil {
+		return err
+	}
+	s.cacheOps++
+	if s.cacheOps < checkpointBatchSize {
+		return nil
+	}
+	return s.commitCache()
+}
+
+func (s *Syncer) commitCache() error {
+	if s.cacheBatch == nil {
+		return nil
+	}
+	if err := s.cacheBatch.Commit(); err != nil {
+		return err
+	}
+	s.cacheBatch = nil
+	s.cacheOps = 0
+	return s.Cache.Sync(SyncCachePrefix)
+}
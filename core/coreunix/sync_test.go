@@ -0,0 +1,202 @@
+package coreunix
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-mfs"
+)
+
+func TestSync(t *testing.T) {
+	node := newTestNode(t)
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	mtime := time.Unix(1500000000, 0)
+	write := func(name, data string) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a", "first")
+	write("sub/b", "second")
+	write("sub/deep/c", "third")
+	if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	sync := func(cache, mtime bool) []string {
+		syncer := NewSyncer(ctx, node.Pinning, node.Blockstore, node.DAG, node.FilesRoot)
+		if cache {
+			syncer.Cache = node.Repo.Datastore()
+		}
+		syncer.PreserveMtime = mtime
+		var events []string
+		syncer.Out = func(e SyncEvent) error {
+			events = append(events, fmt.Sprintf("%s %s", e.Type, e.Path))
+			return nil
+		}
+		st, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sf, err := files.NewSerialFile(dir, true, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := syncer.Sync(dir, sf.(files.Directory), "/dst"); err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+	// the same as adding the directory
+	checkSame := func() {
+		st, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sf, err := files.NewSerialFile(dir, false, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adder, err := NewAdder(ctx, node.Pinning, node.Blockstore, node.DAG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adder.Pin = false
+		added, err := adder.AddAllAndPin(sf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsn, err := mfs.Lookup(node.FilesRoot, "/dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		synced, err := fsn.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !synced.Cid().Equals(added.Cid()) {
+			t.Fatalf("synced %s, expected %s", synced.Cid(), added.Cid())
+		}
+	}
+	expectEvents := func(got []string, expected ...string) {
+		t.Helper()
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("got events %v, expected %v", got, expected)
+		}
+	}
+
+	expectEvents(sync(true, false),
+		"added a", "added link", "added sub", "added sub/b", "added sub/deep", "added sub/deep/c")
+	checkSame()
+	expectEvents(sync(true, false))
+
+	// same size and mtime, only noticed without the state cache
+	write("a", "FIRST")
+	write("sub/b", "second, longer")
+	if err := os.RemoveAll(filepath.Join(dir, "sub/deep")); err != nil {
+		t.Fatal(err)
+	}
+	write("new", "fourth")
+	expectEvents(sync(true, false), "added new", "modified sub/b", "removed sub/deep")
+	expectEvents(sync(false, false), "modified a")
+	checkSame()
+
+	// the same with the stored mtimes
+	write("a", "first")
+	expectEvents(sync(false, true), "modified a", "modified new", "modified sub/b")
+	write("a", "FIRST")
+	expectEvents(sync(false, true))
+
+	fsn, err := mfs.Lookup(node.FilesRoot, "/dst/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := ReadUnixFSMetadata(nd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !md.Mtime.Equal(mtime) {
+		t.Errorf("expected the mtime to be stored, got %s", md.Mtime)
+	}
+}
+
+func TestSyncStats(t *testing.T) {
+	node := newTestNode(t)
+	ctx := context.Background()
+
+	mtime := time.Unix(1500000000, 0)
+	sync := func(stats map[string]SyncStat, data string) ([]string, error) {
+		// as sent by a client, without file information
+		dir := files.NewMapDirectory(map[string]files.Node{
+			"sub": files.NewMapDirectory(map[string]files.Node{
+				"f": files.NewBytesFile([]byte(data)),
+			}),
+		})
+		syncer := NewSyncer(ctx, node.Pinning, node.Blockstore, node.DAG, node.FilesRoot)
+		syncer.PreserveMtime = true
+		syncer.Stats = stats
+		var events []string
+		syncer.Out = func(e SyncEvent) error {
+			events = append(events, fmt.Sprintf("%s %s", e.Type, e.Path))
+			return nil
+		}
+		err := syncer.Sync("client", dir, "/dst")
+		return events, err
+	}
+
+	stats := map[string]SyncStat{"sub/f": {Size: 4, Mode: 0644, ModTime: mtime}}
+	events, err := sync(stats, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(events) != "[added sub added sub/f]" {
+		t.Fatalf("unexpected events %v", events)
+	}
+	// the same size and mtime, not read again
+	events, err = sync(stats, "DATA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	fsn, err := mfs.Lookup(node.FilesRoot, "/dst/sub/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := ReadUnixFSMetadata(nd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !md.Mtime.Equal(mtime) {
+		t.Errorf("expected the sent mtime to be stored, got %s", md.Mtime)
+	}
+
+	if _, err := sync(map[string]SyncStat{}, "data"); err == nil {
+		t.Fatal("expected the file information to be required")
+	}
+}
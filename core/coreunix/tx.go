@@ -0,0 +1,293 @@
+package coreunix
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	gopath "path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-mfs"
+)
+
+// TxPrefix is the datastore namespace of the MFS transactions in progress.
+var TxPrefix = datastore.NewKey("/local/filestx")
+
+var (
+	ErrTxNotFound = errors.New("transaction not found")
+	ErrTxConflict = errors.New("transaction conflict: the path changed since the transaction began")
+)
+
+// Tx is an MFS transaction: changes to a private copy of MFS, applied to
+// the path of the transaction at once on commit.
+type Tx struct {
+	ID string
+	// Path is the MFS path the transaction may change.
+	Path string
+	// Base is the CID of Path when the transaction began.
+	Base cid.Cid
+	// BaseRoot is the CID of the MFS root when the transaction began.
+	BaseRoot cid.Cid
+	// Root is the CID of the private copy of the MFS root.
+	Root cid.Cid
+	Time time.Time
+}
+
+// txID matches the IDs BeginTx generates, which are datastore key
+// components.
+var txID = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// txKey returns the key of the transaction id, or ErrTxNotFound if id isn't
+// a valid ID.
+func txKey(id string) (datastore.Key, error) {
+	if !txID.MatchString(id) {
+		return datastore.Key{}, ErrTxNotFound
+	}
+	return TxPrefix.ChildString(id), nil
+}
+
+func putTx(ds datastore.Datastore, tx Tx) error {
+	data, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	key, err := txKey(tx.ID)
+	if err != nil {
+		return err
+	}
+	if err := ds.Put(key, data); err != nil {
+		return err
+	}
+	return ds.Sync(key)
+}
+
+// BeginTx starts a transaction changing the MFS directory at path.
+func BeginTx(ctx context.Context, r *mfs.Root, ds datastore.Datastore, path string) (Tx, error) {
+	path = gopath.Clean(path)
+	fsn, err := mfs.Lookup(r, path)
+	if err != nil {
+		return Tx{}, err
+	}
+	if fsn.Type() != mfs.TDir {
+		return Tx{}, fmt.Errorf("%s is not a directory", path)
+	}
+	base, err := mfs.FlushPath(ctx, r, path)
+	if err != nil {
+		return Tx{}, err
+	}
+	root, err := mfs.FlushPath(ctx, r, "/")
+	if err != nil {
+		return Tx{}, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Tx{}, err
+	}
+	tx := Tx{
+		ID:       hex.EncodeToString(id),
+		Path:     path,
+		Base:     base.Cid(),
+		BaseRoot: root.Cid(),
+		Root:     root.Cid(),
+		Time:     time.Now(),
+	}
+	return tx, putTx(ds, tx)
+}
+
+// GetTx returns the transaction id.
+func GetTx(ds datastore.Datastore, id string) (Tx, error) {
+	key, err := txKey(id)
+	if err != nil {
+		return Tx{}, err
+	}
+	data, err := ds.Get(key)
+	if err == datastore.ErrNotFound {
+		return Tx{}, ErrTxNotFound
+	}
+	if err != nil {
+		return Tx{}, err
+	}
+	var tx Tx
+	if err := json.Unmarshal(data, &tx); err != nil {
+		return Tx{}, fmt.Errorf("malformed transaction %s: %s", id, err)
+	}
+	return tx, nil
+}
+
+// TxRoot returns the private MFS root of the transaction tx, to close once
+// done. Changes made to it are kept once saved with SaveTx.
+func TxRoot(ctx context.Context, dserv ipld.DAGService, tx Tx) (*mfs.Root, error) {
+	nd, err := dserv.Get(ctx, tx.Root)
+	if err != nil {
+		return nil, err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil, dag.ErrNotProtobuf
+	}
+	// published by SaveTx, flushing MFS paths needs a publisher though
+	return mfs.NewRoot(ctx, dserv, pbnd, func(context.Context, cid.Cid) error {
+		return nil
+	})
+}
+
+// SaveTx records the changes made to the root of the transaction tx.
+func SaveTx(ctx context.Context, ds datastore.Datastore, tx *Tx, root *mfs.Root) error {
+	dir := root.GetDirectory()
+	if err := dir.Flush(); err != nil {
+		return err
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		return err
+	}
+	if nd.Cid().Equals(tx.Root) {
+		return nil
+	}
+	tx.Root = nd.Cid()
+	return putTx(ds, *tx)
+}
+
+// AbortTx drops the transaction id and its changes.
+func AbortTx(ds datastore.Datastore, id string) error {
+	key, err := txKey(id)
+	if err != nil {
+		return err
+	}
+	has, err := ds.Has(key)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return ErrTxNotFound
+	}
+	return ds.Delete(key)
+}
+
+// CommitTx applies the changes of the transaction id to MFS, replacing its
+// path with the one of the private root, and ends it. It fails with
+// ErrTxConflict, keeping the transaction, if the path changed in MFS since
+// the transaction began.
+//
+// The caller must keep MFS from changing until CommitTx returns, so that it
+// still is as checked once the path is replaced.
+func CommitTx(ctx context.Context, r *mfs.Root, dserv ipld.DAGService, ds datastore.Datastore, id string) (Tx, error) {
+	tx, err := GetTx(ds, id)
+	if err != nil {
+		return Tx{}, err
+	}
+
+	current, err := mfs.FlushPath(ctx, r, tx.Path)
+	if err == os.ErrNotExist {
+		return Tx{}, ErrTxConflict
+	}
+	if err != nil {
+		return Tx{}, err
+	}
+	if !current.Cid().Equals(tx.Base) {
+		return Tx{}, ErrTxConflict
+	}
+
+	baseRoot, err := dserv.Get(ctx, tx.BaseRoot)
+	if err != nil {
+		return Tx{}, err
+	}
+	txRoot, err := TxRoot(ctx, dserv, tx)
+	if err != nil {
+		return Tx{}, err
+	}
+	defer txRoot.Close()
+	changed, err := txRoot.GetDirectory().GetNode()
+	if err != nil {
+		return Tx{}, err
+	}
+	err = Diff(ctx, dserv, baseRoot, changed, func(c DiffEntry) error {
+		for _, p := range []string{c.Path, c.From} {
+			if p != "" && !inTxPath(tx, "/"+p) {
+				return fmt.Errorf("transaction changed /%s, outside of %s", p, tx.Path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Tx{}, err
+	}
+
+	nd, err := mfs.FlushPath(ctx, txRoot, tx.Path)
+	if err != nil {
+		return Tx{}, err
+	}
+	if err := replaceMfs(ctx, r, dserv, tx.Path, nd); err != nil {
+		return Tx{}, err
+	}
+	return tx, AbortTx(ds, id)
+}
+
+// inTxPath returns whether path is within the path of the transaction tx.
+func inTxPath(tx Tx, path string) bool {
+	return tx.Path == "/" || path == tx.Path || strings.HasPrefix(path, tx.Path+"/")
+}
+
+// Txs returns the transactions in progress, the oldest first.
+func Txs(ctx context.Context, ds datastore.Datastore) ([]Tx, error) {
+	res, err := ds.Query(query.Query{Prefix: TxPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var txs []Tx
+loop:
+	for {
+		var r query.Result
+		var ok bool
+		select {
+		case r, ok = <-res.Next():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !ok {
+			break loop
+		}
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var tx Tx
+		if err := json.Unmarshal(r.Value, &tx); err != nil {
+			log.Warnf("ignoring malformed transaction %s: %s", r.Key, err)
+			continue
+		}
+		txs = append(txs, tx)
+	}
+	sort.SliceStable(txs, func(i, j int) bool {
+		return txs[i].Time.Before(txs[j].Time)
+	})
+	return txs, nil
+}
+
+// TxCids returns the CIDs of the roots of the transactions in progress,
+// which the garbage collector should keep.
+func TxCids(ctx context.Context, ds datastore.Datastore) ([]cid.Cid, error) {
+	txs, err := Txs(ctx, ds)
+	if err != nil {
+		return nil, err
+	}
+	var cids []cid.Cid
+	for _, tx := range txs {
+		cids = append(cids, tx.Root, tx.BaseRoot)
+	}
+	return cids, nil
+}
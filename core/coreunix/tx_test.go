@@ -0,0 +1,154 @@
+package coreunix
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-mfs"
+	ft "github.com/ipfs/go-unixfs"
+)
+
+func TestTx(t *testing.T) {
+	node := newTestNode(t)
+	ctx := context.Background()
+	ds := node.Repo.Datastore()
+
+	put := func(root *mfs.Root, path string, data string) {
+		nd := dag.NodeWithData(ft.FilePBData([]byte(data), uint64(len(data))))
+		if err := mfs.PutNode(root, path, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := func(root *mfs.Root, path string) cid.Cid {
+		nd, err := mfs.FlushPath(ctx, root, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd.Cid()
+	}
+	// change runs f on the root of the transaction id and saves it
+	change := func(id string, f func(root *mfs.Root)) {
+		tx, err := GetTx(ds, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := TxRoot(ctx, node.DAG, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer root.Close()
+		f(root)
+		if err := SaveTx(ctx, ds, &tx, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := mfs.Mkdir(node.FilesRoot, "/dir", mfs.MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	put(node.FilesRoot, "/dir/a", "a")
+	put(node.FilesRoot, "/other", "other")
+
+	tx, err := BeginTx(ctx, node.FilesRoot, ds, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := current(node.FilesRoot, "/")
+	var expected cid.Cid
+	change(tx.ID, func(root *mfs.Root) {
+		put(root, "/dir/b", "b")
+		if err := mfs.Mkdir(root, "/dir/sub", mfs.MkdirOpts{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	change(tx.ID, func(root *mfs.Root) {
+		put(root, "/dir/sub/c", "c")
+		expected = current(root, "/dir")
+	})
+	if !current(node.FilesRoot, "/").Equals(before) {
+		t.Fatal("expected MFS to be left alone until the commit")
+	}
+
+	// changes elsewhere don't conflict
+	put(node.FilesRoot, "/new", "new")
+	if _, err := CommitTx(ctx, node.FilesRoot, node.DAG, ds, tx.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !current(node.FilesRoot, "/dir").Equals(expected) {
+		t.Fatal("expected the changes of the transaction to be applied")
+	}
+	if _, err := mfs.Lookup(node.FilesRoot, "/new"); err != nil {
+		t.Fatal("expected the changes made meanwhile to be kept")
+	}
+	if _, err := GetTx(ds, tx.ID); err != ErrTxNotFound {
+		t.Fatalf("expected the transaction to end, got %v", err)
+	}
+
+	// changes to the path conflict
+	tx, err = BeginTx(ctx, node.FilesRoot, ds, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(tx.ID, func(root *mfs.Root) {
+		put(root, "/dir/d", "d")
+	})
+	put(node.FilesRoot, "/dir/e", "e")
+	if _, err := CommitTx(ctx, node.FilesRoot, node.DAG, ds, tx.ID); err != ErrTxConflict {
+		t.Fatalf("expected %q, got %v", ErrTxConflict, err)
+	}
+	if _, err := mfs.Lookup(node.FilesRoot, "/dir/d"); err == nil {
+		t.Fatal("expected a conflicting transaction not to be applied")
+	}
+	cids, err := TxCids(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cids) != 2 {
+		t.Fatalf("expected the transaction to be kept, got %v", cids)
+	}
+	if err := AbortTx(ds, tx.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// changes outside of the path are refused
+	tx, err = BeginTx(ctx, node.FilesRoot, ds, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(tx.ID, func(root *mfs.Root) {
+		put(root, "/outside", "outside")
+	})
+	if _, err := CommitTx(ctx, node.FilesRoot, node.DAG, ds, tx.ID); err == nil {
+		t.Fatal("expected changes outside of the transaction path to fail the commit")
+	}
+	if err := AbortTx(ds, tx.ID); err != nil {
+		t.Fatal(err)
+	}
+	txs, err := Txs(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 0 {
+		t.Fatalf("expected no transactions left, got %d", len(txs))
+	}
+
+	// IDs can't reach the keys outside of the transactions
+	other := datastore.NewKey("/local/other")
+	if err := ds.Put(other, []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"../other", "../../local/other", "", tx.ID + "/x"} {
+		if _, err := GetTx(ds, id); err != ErrTxNotFound {
+			t.Errorf("expected %q not to be found, got %v", id, err)
+		}
+		if err := AbortTx(ds, id); err != ErrTxNotFound {
+			t.Errorf("expected %q not to be found, got %v", id, err)
+		}
+	}
+	if has, err := ds.Has(other); err != nil || !has {
+		t.Fatalf("expected the other key to be kept, got %v, %v", has, err)
+	}
+}
@@ -0,0 +1,223 @@
+package coreunix
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"time"
+
+	proto "github.com/gogo/protobuf/proto"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	pb "github.com/ipfs/go-unixfs/pb"
+)
+
+// Fields of the UnixFS 1.5 additions to the Data message. The generated
+// code of go-unixfs doesn't know them yet, but keeps them around as
+// unrecognized fields, which is where they are read from and written to.
+const (
+	pbModeField  = 7 // uint32
+	pbMtimeField = 8 // UnixTime
+
+	pbUnixTimeSecondsField = 1 // int64
+	pbUnixTimeNanosField   = 2 // fixed32
+
+	pbWireVarint  = 0
+	pbWireFixed64 = 1
+	pbWireBytes   = 2
+	pbWireFixed32 = 5
+)
+
+var errBadUnixFSMetadata = errors.New("malformed unixfs metadata")
+
+// unixModeBits are the mode bits UnixFS stores.
+const unixModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// UnixFSMetadata is the optional mode and modification time of a UnixFS
+// file or directory.
+type UnixFSMetadata struct {
+	// Mode holds the permission bits, os.ModeSetuid, os.ModeSetgid and
+	// os.ModeSticky. Zero when not set.
+	Mode os.FileMode
+	// Mtime is the zero time when not set.
+	Mtime time.Time
+}
+
+// IsZero returns whether neither the mode nor the mtime are set.
+func (md UnixFSMetadata) IsZero() bool {
+	return md.Mode == 0 && md.Mtime.IsZero()
+}
+
+// ReadUnixFSMetadata returns the metadata of a UnixFS node. Nodes without
+// any, like raw leaves, have a zero UnixFSMetadata.
+func ReadUnixFSMetadata(nd ipld.Node) (UnixFSMetadata, error) {
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return UnixFSMetadata{}, nil
+	}
+	var data pb.Data
+	if err := proto.Unmarshal(pn.Data(), &data); err != nil {
+		return UnixFSMetadata{}, err
+	}
+
+	var md UnixFSMetadata
+	err := forEachPBField(data.XXX_unrecognized, func(field, wire int, v uint64, b []byte) error {
+		switch {
+		case field == pbModeField && wire == pbWireVarint:
+			md.Mode = unixToFileMode(uint32(v))
+		case field == pbMtimeField && wire == pbWireBytes:
+			var secs int64
+			var nanos uint32
+			err := forEachPBField(b, func(field, wire int, v uint64, _ []byte) error {
+				switch {
+				case field == pbUnixTimeSecondsField && wire == pbWireVarint:
+					secs = int64(v)
+				case field == pbUnixTimeNanosField && wire == pbWireFixed32:
+					nanos = uint32(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			md.Mtime = time.Unix(secs, int64(nanos))
+		}
+		return nil
+	})
+	return md, err
+}
+
+// SetUnixFSMetadata replaces the metadata of a UnixFS node.
+func SetUnixFSMetadata(nd *dag.ProtoNode, md UnixFSMetadata) error {
+	var data pb.Data
+	if err := proto.Unmarshal(nd.Data(), &data); err != nil {
+		return err
+	}
+
+	// keep the unrecognized fields we don't own
+	var rest []byte
+	err := forEachPBField(data.XXX_unrecognized, func(field, wire int, v uint64, b []byte) error {
+		if field == pbModeField || field == pbMtimeField {
+			return nil
+		}
+		rest = appendPBField(rest, field, wire, v, b)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if md.Mode != 0 {
+		rest = appendPBField(rest, pbModeField, pbWireVarint, uint64(fileModeToUnix(md.Mode)), nil)
+	}
+	if !md.Mtime.IsZero() {
+		ut := appendPBField(nil, pbUnixTimeSecondsField, pbWireVarint, uint64(md.Mtime.Unix()), nil)
+		if nanos := md.Mtime.Nanosecond(); nanos != 0 {
+			ut = appendPBField(ut, pbUnixTimeNanosField, pbWireFixed32, uint64(nanos), nil)
+		}
+		rest = appendPBField(rest, pbMtimeField, pbWireBytes, 0, ut)
+	}
+	data.XXX_unrecognized = rest
+
+	out, err := proto.Marshal(&data)
+	if err != nil {
+		return err
+	}
+	nd.SetData(out)
+	return nil
+}
+
+func fileModeToUnix(m os.FileMode) uint32 {
+	mode := uint32(m & os.ModePerm)
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+func unixToFileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode) & os.ModePerm
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// forEachPBField calls f with every field of a protobuf message: the varint
+// or fixed size value as v, the content of length delimited fields as b.
+func forEachPBField(msg []byte, f func(field, wire int, v uint64, b []byte) error) error {
+	for len(msg) > 0 {
+		key, n := proto.DecodeVarint(msg)
+		if n == 0 {
+			return errBadUnixFSMetadata
+		}
+		msg = msg[n:]
+		field, wire := int(key>>3), int(key&7)
+
+		var v uint64
+		var b []byte
+		switch wire {
+		case pbWireVarint:
+			v, n = proto.DecodeVarint(msg)
+			if n == 0 {
+				return errBadUnixFSMetadata
+			}
+		case pbWireFixed64:
+			if len(msg) < 8 {
+				return errBadUnixFSMetadata
+			}
+			v, n = binary.LittleEndian.Uint64(msg), 8
+		case pbWireFixed32:
+			if len(msg) < 4 {
+				return errBadUnixFSMetadata
+			}
+			v, n = uint64(binary.LittleEndian.Uint32(msg)), 4
+		case pbWireBytes:
+			l, ln := proto.DecodeVarint(msg)
+			if ln == 0 || uint64(len(msg)-ln) < l {
+				return errBadUnixFSMetadata
+			}
+			b, n = msg[ln:ln+int(l)], ln+int(l)
+		default:
+			return errBadUnixFSMetadata
+		}
+		msg = msg[n:]
+
+		if err := f(field, wire, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendPBField(buf []byte, field, wire int, v uint64, b []byte) []byte {
+	buf = append(buf, proto.EncodeVarint(uint64(field<<3|wire))...)
+	switch wire {
+	case pbWireVarint:
+		buf = append(buf, proto.EncodeVarint(v)...)
+	case pbWireFixed64:
+		var tmp [8]byte
+		binary.LittleEndian.PutUint64(tmp[:], v)
+		buf = append(buf, tmp[:]...)
+	case pbWireFixed32:
+		var tmp [4]byte
+		binary.LittleEndian.PutUint32(tmp[:], uint32(v))
+		buf = append(buf, tmp[:]...)
+	case pbWireBytes:
+		buf = append(buf, proto.EncodeVarint(uint64(len(b)))...)
+		buf = append(buf, b...)
+	}
+	return buf
+}
@@ -0,0 +1,290 @@
+package coreunix
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+)
+
+func TestUnixFSMetadataRoundTrip(t *testing.T) {
+	nd := dag.NodeWithData(ft.FilePBData([]byte("hello"), 5))
+	md, err := ReadUnixFSMetadata(nd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !md.IsZero() {
+		t.Fatalf("expected no metadata, got %+v", md)
+	}
+
+	want := UnixFSMetadata{
+		Mode:  0750 | os.ModeSetgid,
+		Mtime: time.Unix(1600000000, 42),
+	}
+	if err := SetUnixFSMetadata(nd, want); err != nil {
+		t.Fatal(err)
+	}
+	md, err = ReadUnixFSMetadata(nd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Mode != want.Mode || !md.Mtime.Equal(want.Mtime) {
+		t.Fatalf("got %+v, expected %+v", md, want)
+	}
+
+	// the rest of the node is untouched
+	fsn, err := ft.FSNodeFromBytes(nd.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsn.Type() != ft.TFile || string(fsn.Data()) != "hello" || fsn.FileSize() != 5 {
+		t.Fatal("unixfs data was altered")
+	}
+
+	// and the metadata can be cleared again
+	if err := SetUnixFSMetadata(nd, UnixFSMetadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(nd.Data(), ft.FilePBData([]byte("hello"), 5)) {
+		t.Fatal("clearing the metadata should restore the original node")
+	}
+}
+
+func TestAddPreserveMetadata(t *testing.T) {
+	node := newTestNode(t)
+
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "dir")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fpath := filepath.Join(dir, "sub", "file")
+	if err := ioutil.WriteFile(fpath, []byte("some data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "sub"), 0710); err != nil {
+		t.Fatal(err)
+	}
+	fileMtime := time.Unix(1500000000, 0)
+	dirMtime := time.Unix(1400000000, 0)
+	if err := os.Chtimes(fpath, fileMtime, fileMtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "sub"), dirMtime, dirMtime); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, err := files.NewSerialFile(dir, false, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adder, err := NewAdder(context.Background(), node.Pinning, node.Blockstore, node.DAG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adder.PreserveMode = true
+	adder.PreserveMtime = true
+	out := make(chan interface{}, 16)
+	adder.Out = out
+
+	root, err := adder.AddAllAndPin(files.NewSliceDirectory([]files.DirEntry{files.FileEntry("dir", sf)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	resolve := func(names ...string) ipld.Node {
+		nd := root
+		for _, name := range names {
+			l, _, err := nd.ResolveLink([]string{name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nd, err = l.GetNode(ctx, node.DAG); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nd
+	}
+
+	for _, test := range []struct {
+		path  []string
+		mode  os.FileMode
+		mtime time.Time
+	}{
+		{[]string{"dir", "sub", "file"}, 0600, fileMtime},
+		{[]string{"dir", "sub"}, 0710, dirMtime},
+		{[]string{"dir"}, 0755, time.Time{}},
+	} {
+		md, err := ReadUnixFSMetadata(resolve(test.path...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.Mode != test.mode {
+			t.Errorf("%v: got mode %v, expected %v", test.path, md.Mode, test.mode)
+		}
+		if !test.mtime.IsZero() && !md.Mtime.Equal(test.mtime) {
+			t.Errorf("%v: got mtime %v, expected %v", test.path, md.Mtime, test.mtime)
+		}
+	}
+
+	// and they make it into tar archives
+	var buf bytes.Buffer
+	tw := NewTarWriter(ctx, node.DAG, &buf)
+	if err := tw.WriteNode(resolve("dir"), "dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Name != "dir/sub/file" {
+			continue
+		}
+		md := TarHeaderMetadata(h)
+		if md.Mode != 0600 || !md.Mtime.Equal(fileMtime) {
+			t.Errorf("unexpected tar metadata %+v", md)
+		}
+		return
+	}
+	t.Error("file missing from the archive")
+}
+
+func TestTarWriterModeBits(t *testing.T) {
+	node := newTestNode(t)
+	ctx := context.Background()
+
+	nd := dag.NodeWithData(ft.FilePBData([]byte("hello"), 5))
+	if err := SetUnixFSMetadata(nd, UnixFSMetadata{Mode: 0755 | os.ModeSetuid | os.ModeSticky}); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.DAG.Add(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := NewTarWriter(ctx, node.DAG, &buf)
+	if err := tw.WriteNode(nd, "file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h, err := tar.NewReader(&buf).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Mode != 0755 || h.PAXRecords[TarModeRecord] != "755" {
+		t.Errorf("expected the permission bits only, got %o and %q", h.Mode, h.PAXRecords[TarModeRecord])
+	}
+}
+
+func TestTarWriterLinkNames(t *testing.T) {
+	node := newTestNode(t)
+	ctx := context.Background()
+
+	child := dag.NodeWithData(ft.FilePBData([]byte("outside"), 7))
+	if err := node.DAG.Add(ctx, child); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../x", "sub/../../x", `..\x`, ".."} {
+		dir := ft.EmptyDirNode()
+		if err := dir.AddNodeLink(name, child); err != nil {
+			t.Fatal(err)
+		}
+		if err := node.DAG.Add(ctx, dir); err != nil {
+			t.Fatal(err)
+		}
+		tw := NewTarWriter(ctx, node.DAG, ioutil.Discard)
+		if err := tw.WriteNode(dir, "site"); err == nil {
+			t.Errorf("expected the link name %q to be rejected", name)
+		}
+	}
+}
+
+func TestAddSentMetadata(t *testing.T) {
+	node := newTestNode(t)
+
+	// as sent to the daemon, without any file information
+	dir := files.NewMapDirectory(map[string]files.Node{
+		"sub": files.NewMapDirectory(map[string]files.Node{
+			"file": files.NewBytesFile([]byte("some data")),
+		}),
+		"other": files.NewBytesFile([]byte("other data")),
+	})
+	mtime := time.Unix(1500000000, 0)
+
+	adder, err := NewAdder(context.Background(), node.Pinning, node.Blockstore, node.DAG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adder.PreserveMode = true
+	adder.Metadata = map[string]UnixFSMetadata{
+		"":         {Mode: 0755, Mtime: mtime},
+		"sub":      {Mode: 0710},
+		"sub/file": {Mode: 0600 | os.ModeDir, Mtime: mtime},
+	}
+	root, err := adder.AddAllAndPin(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, test := range []struct {
+		path string
+		mode os.FileMode
+	}{
+		{"", 0755},
+		{"sub", 0710},
+		{"sub/file", 0600},
+		{"other", 0},
+	} {
+		nd := root
+		for _, name := range strings.Split(test.path, "/") {
+			if name == "" {
+				continue
+			}
+			l, _, err := nd.ResolveLink([]string{name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nd, err = l.GetNode(ctx, node.DAG); err != nil {
+				t.Fatal(err)
+			}
+		}
+		md, err := ReadUnixFSMetadata(nd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.Mode != test.mode {
+			t.Errorf("%q: got mode %v, expected %v", test.path, md.Mode, test.mode)
+		}
+		if !md.Mtime.IsZero() {
+			t.Errorf("%q: expected no mtime without PreserveMtime, got %v", test.path, md.Mtime)
+		}
+	}
+}
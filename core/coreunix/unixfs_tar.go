@@ -0,0 +1,152 @@
+package coreunix
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	gopath "path"
+	"strconv"
+	"strings"
+	"time"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	unixfile "github.com/ipfs/go-unixfs/file"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+// PAX records telling which header fields come from the UnixFS metadata, as
+// opposed to defaults.
+const (
+	TarModeRecord  = "IPFS.mode"
+	TarMtimeRecord = "IPFS.mtime"
+)
+
+// TarWriter writes UnixFS DAGs as tar archives, like files.TarWriter, with
+// the mode and modification time of their metadata where present.
+type TarWriter struct {
+	ctx  context.Context
+	dag  ipld.DAGService
+	tarW *tar.Writer
+}
+
+// NewTarWriter returns a TarWriter writing to w.
+func NewTarWriter(ctx context.Context, dag ipld.DAGService, w io.Writer) *TarWriter {
+	return &TarWriter{ctx: ctx, dag: dag, tarW: tar.NewWriter(w)}
+}
+
+// WriteNode adds the UnixFS DAG under nd to the archive at fpath.
+func (w *TarWriter) WriteNode(nd ipld.Node, fpath string) error {
+	f, err := unixfile.NewUnixfsFile(w.ctx, w.dag, nd)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	md, err := ReadUnixFSMetadata(nd)
+	if err != nil {
+		return err
+	}
+
+	switch f := f.(type) {
+	case *files.Symlink:
+		return w.tarW.WriteHeader(&tar.Header{
+			Name:     fpath,
+			Linkname: f.Target,
+			Mode:     0777,
+			Typeflag: tar.TypeSymlink,
+		})
+	case files.File:
+		size, err := f.Size()
+		if err != nil {
+			return err
+		}
+		h := &tar.Header{
+			Name:     fpath,
+			Size:     size,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+		}
+		setTarMetadata(h, md)
+		if err := w.tarW.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w.tarW, f); err != nil {
+			return err
+		}
+		return w.tarW.Flush()
+	case files.Directory:
+		h := &tar.Header{
+			Name:     fpath,
+			Typeflag: tar.TypeDir,
+			Mode:     0777,
+		}
+		setTarMetadata(h, md)
+		if err := w.tarW.WriteHeader(h); err != nil {
+			return err
+		}
+
+		dir, err := uio.NewDirectoryFromNode(w.dag, nd)
+		if err != nil {
+			return err
+		}
+		return dir.ForEachLink(w.ctx, func(l *ipld.Link) error {
+			if err := CheckLinkName(l.Name); err != nil {
+				return fmt.Errorf("%s in %q", err, fpath)
+			}
+			child, err := l.GetNode(w.ctx, w.dag)
+			if err != nil {
+				return err
+			}
+			return w.WriteNode(child, gopath.Join(fpath, l.Name))
+		})
+	default:
+		return fmt.Errorf("file type %T at %q is not supported", f, fpath)
+	}
+}
+
+// CheckLinkName returns an error if the link name isn't a single path
+// element, as "../x", which would be extracted outside of its directory.
+func CheckLinkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid link name %q", name)
+	}
+	return nil
+}
+
+// Close closes the tar writer.
+func (w *TarWriter) Close() error {
+	return w.tarW.Close()
+}
+
+func setTarMetadata(h *tar.Header, md UnixFSMetadata) {
+	h.ModTime = time.Now()
+	if md.Mode != 0 {
+		// no setuid, setgid or sticky bits from the content of archives
+		mode := fileModeToUnix(md.Mode & os.ModePerm)
+		h.Mode = int64(mode)
+		h.PAXRecords = map[string]string{TarModeRecord: strconv.FormatUint(uint64(mode), 8)}
+	}
+	if !md.Mtime.IsZero() {
+		h.ModTime = md.Mtime
+		if h.PAXRecords == nil {
+			h.PAXRecords = map[string]string{}
+		}
+		h.PAXRecords[TarMtimeRecord] = strconv.FormatInt(md.Mtime.Unix(), 10)
+	}
+}
+
+// TarHeaderMetadata returns the UnixFS metadata of an entry written by
+// TarWriter.
+func TarHeaderMetadata(h *tar.Header) UnixFSMetadata {
+	var md UnixFSMetadata
+	if _, ok := h.PAXRecords[TarModeRecord]; ok {
+		md.Mode = unixToFileMode(uint32(h.Mode))
+	}
+	if _, ok := h.PAXRecords[TarMtimeRecord]; ok {
+		md.Mtime = h.ModTime
+	}
+	return md
+}
@@ -0,0 +1,318 @@
+// Package denylist implements a list of content that must not be served,
+// read from a file that is reloaded whenever it changes.
+//
+// The file has one entry per line. Empty lines and lines starting with '#'
+// are ignored. An entry is one of:
+//
+//	<cid>                   the CID (in any version or codec)
+//	/ipfs/<cid>             same as above
+//	/ipfs/<cid>/sub/path    the given path under the CID, and everything below
+//	/ipns/<name>            an IPNS key or DNSLink name, and everything below
+//	/ipns/<name>/sub/path   the given path under the name, and everything below
+package denylist
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+	cid "github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log"
+	ipfspath "github.com/ipfs/go-path"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+var log = logging.Logger("denylist")
+
+// ErrBlocked is returned when refusing to serve content on the denylist.
+var ErrBlocked = errors.New("content is blocked by the denylist")
+
+// reloadDelay debounces bursts of file system events, editors tend to
+// write a file in several steps.
+const reloadDelay = 100 * time.Millisecond
+
+// Denylist is a hot-reloaded list of blocked content. It is safe for
+// concurrent use.
+type Denylist struct {
+	path string
+
+	mu sync.RWMutex
+	// entries maps a namespace root (/ipfs/<multihash> or /ipns/<name>) to
+	// the blocked subpaths under it. An empty subpath blocks the whole root.
+	entries map[string][]string
+
+	watcher *fsnotify.Watcher
+	closed  chan struct{}
+	done    chan struct{}
+}
+
+// Open loads the denylist at path and starts watching the file for changes.
+func Open(path string) (*Denylist, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Denylist{
+		path:   path,
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+
+	// watch the directory, files replaced by a rename would drop the watch
+	// on the file itself
+	d.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.watcher.Add(filepath.Dir(path)); err != nil {
+		d.watcher.Close()
+		return nil, err
+	}
+	go d.watch()
+
+	return d, nil
+}
+
+// Reload re-reads the file. On error, the current entries stay in place.
+func (d *Denylist) Reload() error {
+	f, err := os.Open(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := parse(f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", d.path, err)
+	}
+
+	d.mu.Lock()
+	d.entries = entries
+	d.mu.Unlock()
+	log.Infof("loaded %d denylist entries from %s", len(entries), d.path)
+	return nil
+}
+
+func (d *Denylist) watch() {
+	defer close(d.done)
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-d.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(ev.Name) != d.path {
+				continue
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				reload = time.After(reloadDelay)
+			}
+		case err, ok := <-d.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("error watching %s: %s", d.path, err)
+		case <-reload:
+			reload = nil
+			if err := d.Reload(); err != nil {
+				log.Errorf("failed to reload denylist: %s", err)
+			}
+		case <-d.closed:
+			return
+		}
+	}
+}
+
+// Close stops watching the file.
+func (d *Denylist) Close() error {
+	close(d.closed)
+	err := d.watcher.Close()
+	<-d.done
+	return err
+}
+
+// IsPathBlocked returns true if the /ipfs/ or /ipns/ path is blocked, either
+// because its root or because a path leading to it is on the list.
+func (d *Denylist) IsPathBlocked(p string) bool {
+	segments := strings.Split(strings.Trim(gopath.Clean(p), "/"), "/")
+	if len(segments) < 2 {
+		return false
+	}
+	var root string
+	switch segments[0] {
+	case "ipfs":
+		c, err := cid.Decode(segments[1])
+		if err != nil {
+			return false
+		}
+		root = cidKey(c)
+	case "ipns":
+		root = nameKey(segments[1])
+	default:
+		return false
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, blocked := range d.entries[root] {
+		if blocked == "" {
+			return true
+		}
+		sub := strings.Join(segments[2:], "/")
+		if sub == blocked || strings.HasPrefix(sub, blocked+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns ErrBlocked if the path is blocked, or else the path to serve
+// in its place, resolved, so that the content served is the one checked.
+// Besides the path itself, it checks the /ipfs/ path an /ipns/ path points to
+// and, resolving it one segment at a time, the path below every CID met on
+// the way. Resolution errors are left to the caller to report, p is returned
+// as is.
+func (d *Denylist) Check(ctx context.Context, api coreiface.CoreAPI, p ipath.Path) (ipath.Path, error) {
+	if d.IsPathBlocked(p.String()) {
+		return nil, ErrBlocked
+	}
+
+	target := p
+	if p.Namespace() == "ipns" {
+		segments := strings.SplitN(strings.Trim(p.String(), "/"), "/", 3)
+		if len(segments) < 2 {
+			return p, nil
+		}
+		resolved, err := api.Name().Resolve(ctx, segments[1])
+		if err != nil {
+			return p, nil
+		}
+		target = resolved
+		if len(segments) == 3 {
+			target = ipath.Join(target, segments[2])
+		}
+		if d.IsPathBlocked(target.String()) {
+			return nil, ErrBlocked
+		}
+	}
+
+	ns := target.Namespace()
+	if ns != "ipfs" && ns != "ipld" {
+		return p, nil
+	}
+	clean := gopath.Clean(target.String())
+	segments := strings.Split(strings.Trim(clean, "/"), "/")
+	if len(segments) < 2 {
+		return p, nil
+	}
+	root, err := cid.Decode(segments[1])
+	if err != nil {
+		return p, nil
+	}
+
+	c := root
+	var remainder string
+	for i := 2; ; i++ {
+		if d.IsPathBlocked(ipath.Join(ipath.IpfsPath(c), segments[i:]...).String()) {
+			return nil, ErrBlocked
+		}
+		if i == len(segments) {
+			break
+		}
+		next, err := api.ResolvePath(ctx, ipath.Join(ipath.New("/"+ns+"/"+c.String()), segments[i]))
+		if err != nil {
+			return p, nil
+		}
+		if next.Remainder() != "" {
+			// the rest of the path is within the node, no CID below
+			next, err = api.ResolvePath(ctx, ipath.Join(ipath.New("/"+ns+"/"+c.String()), segments[i:]...))
+			if err != nil {
+				return p, nil
+			}
+			if d.IsCidBlocked(next.Cid()) {
+				return nil, ErrBlocked
+			}
+			c, remainder = next.Cid(), next.Remainder()
+			break
+		}
+		c = next.Cid()
+	}
+	return ipath.NewResolvedPath(ipfspath.Path(clean), c, root, remainder), nil
+}
+
+// IsCidBlocked returns true if the CID itself is blocked. CIDs are compared
+// by multihash, so all versions and codecs of a blocked CID match.
+func (d *Denylist) IsCidBlocked(c cid.Cid) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, blocked := range d.entries[cidKey(c)] {
+		if blocked == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func parse(r io.Reader) (map[string][]string, error) {
+	entries := make(map[string][]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if !strings.HasPrefix(entry, "/") {
+			entry = "/ipfs/" + entry
+		}
+
+		segments := strings.Split(strings.Trim(gopath.Clean(entry), "/"), "/")
+		if len(segments) < 2 {
+			return nil, fmt.Errorf("line %d: invalid entry %q", line, entry)
+		}
+		var root string
+		switch segments[0] {
+		case "ipfs":
+			c, err := cid.Decode(segments[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid CID %q: %s", line, segments[1], err)
+			}
+			root = cidKey(c)
+		case "ipns":
+			root = nameKey(segments[1])
+		default:
+			return nil, fmt.Errorf("line %d: unknown namespace %q", line, segments[0])
+		}
+		entries[root] = append(entries[root], strings.Join(segments[2:], "/"))
+	}
+	return entries, scanner.Err()
+}
+
+func cidKey(c cid.Cid) string {
+	return "/ipfs/" + c.Hash().B58String()
+}
+
+// nameKey normalizes IPNS names: keys may be written as a base58 peer ID or
+// as a CIDv1, and DNS names are case insensitive.
+func nameKey(name string) string {
+	if pid, err := peer.Decode(name); err == nil {
+		return "/ipns/" + pid.Pretty()
+	}
+	return "/ipns/" + strings.ToLower(name)
+}
@@ -0,0 +1,146 @@
+package denylist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	mbase "github.com/multiformats/go-multibase"
+)
+
+const (
+	blockedCid = "QmbWqxBEKC3P8tqsKc98xmWNzrzDtRLMiMPL8wBuTGsMnR"
+	partialCid = "QmXoypizjW3WknFiJnKLwHCnL72vedxjQkDDP1mXWo6uco"
+	peerID     = "12D3KooWD3eckifWpRn9wQpMG9R9hX3sD158z7EqHWmweQAJU5SA"
+)
+
+func mustDecode(t *testing.T, s string) cid.Cid {
+	t.Helper()
+	c, err := cid.Decode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func writeList(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openList(t *testing.T, content string) (*Denylist, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "denylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "denylist")
+	writeList(t, path, content)
+	d, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, path
+}
+
+func TestMatching(t *testing.T) {
+	// the same content as blockedCid, as a raw CIDv1
+	blockedCidV1 := cid.NewCidV1(cid.Raw, mustDecode(t, blockedCid).Hash()).String()
+	// peerID as a libp2p-key CID
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerCid, err := peer.ToCid(pid).StringOfBase(mbase.Base36)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, _ := openList(t, `
+# comment
+`+blockedCid+`
+/ipfs/`+partialCid+`/wiki/Secret
+/ipns/Example.com
+/ipns/`+peerID+`/private
+`)
+
+	for _, test := range []struct {
+		path    string
+		blocked bool
+	}{
+		{"/ipfs/" + blockedCid, true},
+		{"/ipfs/" + blockedCid + "/any/thing", true},
+		{"/ipfs/" + blockedCidV1, true},
+		{"/ipfs/" + partialCid, false},
+		{"/ipfs/" + partialCid + "/wiki", false},
+		{"/ipfs/" + partialCid + "/wiki/Secret", true},
+		{"/ipfs/" + partialCid + "/wiki/Secret/", true},
+		{"/ipfs/" + partialCid + "/wiki/Secret/page.html", true},
+		{"/ipfs/" + partialCid + "/wiki/SecretNot", false},
+		{"/ipns/example.com", true},
+		{"/ipns/example.com/index.html", true},
+		{"/ipns/example.net", false},
+		{"/ipns/" + peerID, false},
+		{"/ipns/" + peerID + "/private/key", true},
+		{"/ipns/" + peerCid + "/private", true},
+		{"/ipfs/not-a-cid", false},
+		{"/", false},
+	} {
+		if blocked := d.IsPathBlocked(test.path); blocked != test.blocked {
+			t.Errorf("%s: got blocked=%t, expected %t", test.path, blocked, test.blocked)
+		}
+	}
+
+	if !d.IsCidBlocked(mustDecode(t, blockedCidV1)) {
+		t.Error("expected CIDv1 to be blocked")
+	}
+	if d.IsCidBlocked(mustDecode(t, partialCid)) {
+		t.Error("expected CID with only a blocked subpath not to be blocked")
+	}
+}
+
+func TestInvalidEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "denylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "denylist")
+	writeList(t, path, "/ipfs/not-a-cid\n")
+	if _, err := Open(path); err == nil {
+		t.Fatal("expected an error for an invalid CID")
+	}
+}
+
+func TestReload(t *testing.T) {
+	d, path := openList(t, blockedCid+"\n")
+
+	writeList(t, path, partialCid+"\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for d.IsPathBlocked("/ipfs/" + blockedCid) {
+		if time.Now().After(deadline) {
+			t.Fatal("denylist was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !d.IsPathBlocked("/ipfs/" + partialCid) {
+		t.Fatal("expected the new entry to be blocked")
+	}
+
+	// a broken file keeps the previous entries
+	writeList(t, path, "garbage entry\n")
+	time.Sleep(3 * reloadDelay)
+	if !d.IsPathBlocked("/ipfs/" + partialCid) {
+		t.Fatal("expected the previous entries to be kept")
+	}
+}
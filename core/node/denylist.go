@@ -0,0 +1,34 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/ipfs/go-ipfs/core/denylist"
+	"github.com/ipfs/go-ipfs/repo"
+	"go.uber.org/fx"
+)
+
+// DenylistConfigKey is the config key holding the path of the content
+// denylist. Relative paths are relative to the repo root.
+const DenylistConfigKey = "Gateway.Denylist"
+
+// Denylist loads the content denylist and hooks the watcher reloading it
+// into fx's lifetime management system.
+func Denylist(path string) func(lc fx.Lifecycle, r repo.Repo) (*denylist.Denylist, error) {
+	return func(lc fx.Lifecycle, r repo.Repo) (*denylist.Denylist, error) {
+		if pr, ok := r.(interface{ Path() string }); ok && !filepath.IsAbs(path) {
+			path = filepath.Join(pr.Path(), path)
+		}
+		dl, err := denylist.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		lc.Append(fx.Hook{
+			OnStop: func(context.Context) error {
+				return dl.Close()
+			},
+		})
+		return dl, nil
+	}
+}
@@ -15,6 +15,7 @@ import (
 
 	"github.com/ipfs/go-ipfs/core/node/libp2p"
 	"github.com/ipfs/go-ipfs/p2p"
+	"github.com/ipfs/go-ipfs/repo"
 
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	offroute "github.com/ipfs/go-ipfs-routing/offline"
@@ -123,6 +124,11 @@ func LibP2P(bcfg *BuildCfg, cfg *config.Config) fx.Option {
 		}
 	}
 
+	var ipnsGateways []string
+	if _, err := repo.DecodeConfigKey(bcfg.Repo, libp2p.IpnsGatewaysConfigKey, &ipnsGateways); err != nil {
+		return fx.Error(err)
+	}
+
 	// Gather all the options
 	opts := fx.Options(
 		BaseLibP2P,
@@ -140,6 +146,7 @@ func LibP2P(bcfg *BuildCfg, cfg *config.Config) fx.Option {
 		fx.Provide(libp2p.Routing),
 		fx.Provide(libp2p.BaseRouting),
 		maybeProvide(libp2p.PubsubRouter, bcfg.getOpt("ipnsps")),
+		maybeProvide(libp2p.GatewayIpnsRouter(ipnsGateways), len(ipnsGateways) > 0),
 
 		maybeProvide(libp2p.BandwidthCounter, !cfg.Swarm.DisableBandwidthMetrics),
 		maybeProvide(libp2p.NatPortMap, !cfg.Swarm.DisableNatPortMap),
@@ -317,6 +324,15 @@ func IPFS(ctx context.Context, bcfg *BuildCfg) fx.Option {
 	// TEMP: setting global sharding switch here
 	uio.UseHAMTSharding = cfg.Experimental.ShardingEnabled
 
+	var denylistPath string
+	if _, err := repo.DecodeConfigKey(bcfg.Repo, DenylistConfigKey, &denylistPath); err != nil {
+		return fx.Error(err)
+	}
+	threshold, err := LoadShardingThreshold(bcfg.Repo)
+	if err != nil {
+		return fx.Error(err)
+	}
+
 	return fx.Options(
 		bcfgOpts,
 
@@ -326,6 +342,9 @@ func IPFS(ctx context.Context, bcfg *BuildCfg) fx.Option {
 		Identity(cfg),
 		IPNS,
 		Networked(bcfg, cfg),
+		// only the daemon serves the gateway the denylist applies to
+		maybeProvide(Denylist(denylistPath), denylistPath != "" && bcfg.Permanent),
+		fx.Provide(func() ShardingThreshold { return threshold }),
 
 		Core,
 	)
@@ -0,0 +1,136 @@
+package libp2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	routing "github.com/libp2p/go-libp2p-core/routing"
+	record "github.com/libp2p/go-libp2p-record"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+)
+
+// IpnsGatewaysConfigKey is the config key holding the HTTP gateways IPNS
+// records are fetched from, in addition to the other routers.
+const IpnsGatewaysConfigKey = "Ipns.ResolveGateways"
+
+// maxIpnsRecordSize is the size limit records are held to by the DHT too.
+const maxIpnsRecordSize = 10 << 10
+
+// GatewayValueStore fetches IPNS records from HTTP gateways, with
+// /ipns/<key>?format=ipns-record requests. Gateways aren't trusted: records
+// are only returned after passing the validator.
+type GatewayValueStore struct {
+	Gateways  []string
+	Validator record.Validator
+	Client    *http.Client
+}
+
+var _ routing.ValueStore = (*GatewayValueStore)(nil)
+
+// PutValue is not supported, gateways are read-only.
+func (s *GatewayValueStore) PutValue(context.Context, string, []byte, ...routing.Option) error {
+	return routing.ErrNotSupported
+}
+
+// GetValue returns the best valid record of all gateways.
+func (s *GatewayValueStore) GetValue(ctx context.Context, key string, opts ...routing.Option) ([]byte, error) {
+	ns, rest, err := record.SplitKey(key)
+	if err != nil || ns != "ipns" {
+		return nil, routing.ErrNotSupported
+	}
+	pid, err := peer.IDFromBytes([]byte(rest))
+	if err != nil {
+		return nil, err
+	}
+
+	var records [][]byte
+	for _, gw := range s.Gateways {
+		rec, err := s.fetch(ctx, gw, pid)
+		if err != nil {
+			log.Debugf("failed to fetch the IPNS record of %s from %s: %s", pid, gw, err)
+			continue
+		}
+		if err := s.Validator.Validate(key, rec); err != nil {
+			log.Warnf("invalid IPNS record for %s from %s: %s", pid, gw, err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	if len(records) == 0 {
+		return nil, routing.ErrNotFound
+	}
+
+	best, err := s.Validator.Select(key, records)
+	if err != nil {
+		return nil, err
+	}
+	return records[best], nil
+}
+
+// SearchValue returns the result of GetValue, gateways are only asked once.
+func (s *GatewayValueStore) SearchValue(ctx context.Context, key string, opts ...routing.Option) (<-chan []byte, error) {
+	rec, err := s.GetValue(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan []byte, 1)
+	out <- rec
+	close(out)
+	return out, nil
+}
+
+func (s *GatewayValueStore) fetch(ctx context.Context, gw string, pid peer.ID) ([]byte, error) {
+	u := strings.TrimSuffix(gw, "/") + "/ipns/" + peer.ToCid(pid).String() + "?format=ipns-record"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipfs.ipns-record")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	rec, err := ioutil.ReadAll(io.LimitReader(res.Body, maxIpnsRecordSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(rec) > maxIpnsRecordSize {
+		return nil, fmt.Errorf("record larger than %d bytes", maxIpnsRecordSize)
+	}
+	return rec, nil
+}
+
+// GatewayIpnsRouter adds the gateways as a source of IPNS records.
+func GatewayIpnsRouter(gateways []string) func(validator record.Validator) p2pRouterOut {
+	return func(validator record.Validator) p2pRouterOut {
+		return p2pRouterOut{
+			Router: Router{
+				Routing: &routinghelpers.Compose{
+					ValueStore: &routinghelpers.LimitedValueStore{
+						ValueStore: &GatewayValueStore{
+							Gateways:  gateways,
+							Validator: validator,
+						},
+						Namespaces: []string{"ipns"},
+					},
+				},
+				Priority: 200,
+			},
+		}
+	}
+}
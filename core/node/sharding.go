@@ -0,0 +1,35 @@
+package node
+
+import (
+	"fmt"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/ipfs/go-ipfs/repo"
+)
+
+// ShardingThresholdConfigKey is the config key holding the estimated size
+// past which directories are sharded, as a humanized size like "256KiB".
+const ShardingThresholdConfigKey = "Internal.UnixFSShardingSizeThreshold"
+
+// DefaultShardingThreshold keeps directory blocks well below the block size
+// bitswap transfers.
+const DefaultShardingThreshold = 256 << 10
+
+// ShardingThreshold is the estimated size past which the directories built
+// by the adder and modified through MFS are sharded, and below which sharded
+// ones are turned back into basic directories. Zero disables it.
+type ShardingThreshold int
+
+// LoadShardingThreshold reads the ShardingThreshold configured in r, once
+// when the node is built.
+func LoadShardingThreshold(r repo.Repo) (ShardingThreshold, error) {
+	var s string
+	if ok, err := repo.DecodeConfigKey(r, ShardingThresholdConfigKey, &s); err != nil || !ok {
+		return DefaultShardingThreshold, err
+	}
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", ShardingThresholdConfigKey, err)
+	}
+	return ShardingThreshold(n), nil
+}
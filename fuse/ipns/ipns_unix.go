@@ -12,6 +12,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/ipfs/go-ipfs/core/coreunix"
 	dag "github.com/ipfs/go-merkledag"
 	ft "github.com/ipfs/go-unixfs"
 	path "github.com/ipfs/interface-go-ipfs-core/path"
@@ -250,7 +251,7 @@ func (d *Directory) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Mode = os.ModeDir | 0555
 	a.Uid = uint32(os.Getuid())
 	a.Gid = uint32(os.Getgid())
-	return nil
+	return setMetadataAttr(d.dir, a)
 }
 
 // Attr returns the attributes of a given node.
@@ -265,6 +266,25 @@ func (fi *FileNode) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Size = uint64(size)
 	a.Uid = uint32(os.Getuid())
 	a.Gid = uint32(os.Getgid())
+	return setMetadataAttr(fi.fi, a)
+}
+
+// setMetadataAttr applies the mode and mtime stored in the UnixFS node, if
+// any, to the attributes.
+func setMetadataAttr(n mfs.FSNode, a *fuse.Attr) error {
+	nd, err := n.GetNode()
+	if err != nil {
+		return err
+	}
+	md, err := coreunix.ReadUnixFSMetadata(nd)
+	if err != nil {
+		return fmt.Errorf("fuse/ipns: invalid metadata: %s", err)
+	}
+	if md.Mode != 0 {
+		// without setuid, setgid or sticky bits, from any content
+		a.Mode = a.Mode&os.ModeType | md.Mode&os.ModePerm
+	}
+	a.Mtime = md.Mtime
 	return nil
 }
 
@@ -11,6 +11,7 @@ import (
 	"syscall"
 
 	core "github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreunix"
 	mdag "github.com/ipfs/go-merkledag"
 	path "github.com/ipfs/go-path"
 	ft "github.com/ipfs/go-unixfs"
@@ -135,9 +136,21 @@ func (s *Node) Attr(ctx context.Context, a *fuse.Attr) error {
 	case ft.TSymlink:
 		a.Mode = 0777 | os.ModeSymlink
 		a.Size = uint64(len(s.cached.Data()))
+		return nil
 	default:
 		return fmt.Errorf("invalid data type - %s", s.cached.Type())
 	}
+
+	md, err := coreunix.ReadUnixFSMetadata(s.Nd)
+	if err != nil {
+		return fmt.Errorf("readonly: invalid metadata: %s", err)
+	}
+	if md.Mode != 0 {
+		// keep the type, without setuid, setgid or sticky bits nor write
+		// permissions, this is a read-only filesystem
+		a.Mode = a.Mode&os.ModeType | md.Mode&os.ModePerm&^0222
+	}
+	a.Mtime = md.Mtime
 	return nil
 }
 
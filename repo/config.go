@@ -0,0 +1,34 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// DecodeConfigKey decodes the value of the given config key into out. It is
+// meant for settings config.Config has no field for, which are only reachable
+// through GetConfigKey. It returns false if the key is not set.
+//
+// These settings are read from the config file on each call, and only
+// checked when read, unlike those of config.Config: a malformed one is only
+// reported by the feature reading it. Setting them with 'ipfs config' works
+// as for the others, and SetConfig keeps them. They belong in
+// go-ipfs-config, where they would be typed, once it gets fields for them.
+func DecodeConfigKey(r Repo, key string, out interface{}) (bool, error) {
+	v, err := r.GetConfigKey(key)
+	if err != nil || v == nil {
+		// GetConfigKey doesn't distinguish missing keys from other
+		// failures, and the latter would have surfaced when loading the
+		// config already.
+		return false, nil
+	}
+
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(buf, out); err != nil {
+		return false, fmt.Errorf("failure to decode config setting %s: %s", key, err)
+	}
+	return true, nil
+}
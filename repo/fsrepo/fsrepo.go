@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 
@@ -558,6 +559,9 @@ func (r *FSRepo) setConfigUnsynced(updated *config.Config) error {
 	if err != nil {
 		return err
 	}
+	// keys the config struct knows nothing about would be lost when
+	// replacing whole sections, carry them over
+	keepUnknownKeys(m, mapconf, reflect.TypeOf(config.Config{}))
 	for k, v := range m {
 		mapconf[k] = v
 	}
@@ -570,6 +574,49 @@ func (r *FSRepo) setConfigUnsynced(updated *config.Config) error {
 	return nil
 }
 
+// keepUnknownKeys copies into updated the keys of old the struct type t has no
+// field for, recursing into nested sections. These are settings read with
+// GetConfigKey that only survive if written back verbatim.
+func keepUnknownKeys(updated, old map[string]interface{}, t reflect.Type) {
+	for k, ov := range old {
+		field, known := configField(t, k)
+		if !known {
+			if _, ok := updated[k]; !ok {
+				updated[k] = ov
+			}
+			continue
+		}
+
+		ft := field.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		um, uok := updated[k].(map[string]interface{})
+		om, ook := ov.(map[string]interface{})
+		if uok && ook && ft.Kind() == reflect.Struct {
+			keepUnknownKeys(um, om, ft)
+		}
+	}
+}
+
+// configField finds the field of the struct type t that the JSON key decodes
+// into, following the case-insensitive matching of encoding/json.
+func configField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
 // SetConfig updates the FSRepo's config. The user must not modify the config
 // object after calling this method.
 func (r *FSRepo) SetConfig(updated *config.Config) error {
@@ -581,6 +628,33 @@ func (r *FSRepo) SetConfig(updated *config.Config) error {
 	return r.setConfigUnsynced(updated)
 }
 
+// ReplaceConfig replaces the FSRepo's config with updated, and the settings
+// it has no field for with those of file. The user must not modify the config
+// object after calling this method.
+func (r *FSRepo) ReplaceConfig(updated *config.Config, file map[string]interface{}) error {
+	packageLock.Lock()
+	defer packageLock.Unlock()
+
+	if r.closed {
+		return errors.New("repo is closed")
+	}
+
+	configFilename, err := config.Filename(r.path)
+	if err != nil {
+		return err
+	}
+	m, err := config.ToMap(updated)
+	if err != nil {
+		return err
+	}
+	keepUnknownKeys(m, file, reflect.TypeOf(config.Config{}))
+	if err := serialize.WriteConfigFile(configFilename, m); err != nil {
+		return err
+	}
+	r.config = updated
+	return nil
+}
+
 // GetConfigKey retrieves only the value of a particular key.
 func (r *FSRepo) GetConfigKey(key string) (interface{}, error) {
 	packageLock.Lock()
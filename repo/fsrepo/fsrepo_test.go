@@ -116,3 +116,72 @@ func TestOpenMoreThanOnceInSameProcess(t *testing.T) {
 	assert.Nil(r1.Close(), t)
 	assert.Nil(r2.Close(), t)
 }
+
+func TestSetConfigKeepsUnknownKeys(t *testing.T) {
+	t.Parallel()
+	path := testRepoPath("unknownkeys", t)
+	assert.Nil(Init(path, &config.Config{
+		Datastore: config.DefaultDatastoreConfig(),
+		Identity:  config.Identity{PrivKey: "fake"},
+	}), t)
+
+	r, err := Open(path)
+	assert.Nil(err, t)
+	defer r.Close()
+
+	assert.Nil(r.SetConfigKey("Gateway.SomethingNew", "value"), t)
+	assert.Nil(r.SetConfigKey("SomethingElse", "value"), t)
+
+	// a struct based update must not clobber keys the struct doesn't know
+	cfg, err := r.Config()
+	assert.Nil(err, t)
+	cfg.Gateway.Writable = true
+	assert.Nil(r.SetConfig(cfg), t)
+
+	for _, key := range []string{"Gateway.SomethingNew", "SomethingElse"} {
+		v, err := r.GetConfigKey(key)
+		assert.Nil(err, t, key)
+		if v != "value" {
+			t.Fatalf("%s: got %v, expected value", key, v)
+		}
+	}
+	v, err := r.GetConfigKey("Gateway.Writable")
+	assert.Nil(err, t)
+	if v != true {
+		t.Fatalf("Gateway.Writable: got %v, expected true", v)
+	}
+}
+
+func TestReplaceConfigReplacesUnknownKeys(t *testing.T) {
+	t.Parallel()
+	path := testRepoPath("replaceunknownkeys", t)
+	assert.Nil(Init(path, &config.Config{
+		Datastore: config.DefaultDatastoreConfig(),
+		Identity:  config.Identity{PrivKey: "fake"},
+	}), t)
+
+	r, err := Open(path)
+	assert.Nil(err, t)
+	defer r.Close()
+
+	assert.Nil(r.SetConfigKey("Gateway.SomethingNew", "value"), t)
+	assert.Nil(r.SetConfigKey("SomethingElse", "value"), t)
+
+	cfg, err := r.Config()
+	assert.Nil(err, t)
+	file := map[string]interface{}{
+		"Gateway": map[string]interface{}{"SomethingOther": "other"},
+	}
+	assert.Nil(r.ReplaceConfig(cfg, file), t)
+
+	for _, key := range []string{"Gateway.SomethingNew", "SomethingElse"} {
+		if v, err := r.GetConfigKey(key); err == nil {
+			t.Fatalf("%s: expected to be removed, got %v", key, v)
+		}
+	}
+	v, err := r.GetConfigKey("Gateway.SomethingOther")
+	assert.Nil(err, t)
+	if v != "other" {
+		t.Fatalf("Gateway.SomethingOther: got %v, expected other", v)
+	}
+}
@@ -29,6 +29,10 @@ func (m *Mock) SetConfig(updated *config.Config) error {
 	return nil
 }
 
+func (m *Mock) ReplaceConfig(updated *config.Config, file map[string]interface{}) error {
+	return m.SetConfig(updated)
+}
+
 func (m *Mock) BackupConfig(prefix string) (string, error) {
 	return "", errTODO
 }
@@ -29,6 +29,11 @@ type Repo interface {
 	// SetConfig persists the given configuration struct to storage.
 	SetConfig(*config.Config) error
 
+	// ReplaceConfig persists the given configuration struct to storage, with
+	// the settings it has no field for taken from file, the config file it
+	// was decoded from, instead of kept from storage.
+	ReplaceConfig(updated *config.Config, file map[string]interface{}) error
+
 	// SetConfigKey sets the given key-value pair within the config and persists it to storage.
 	SetConfigKey(key string, value interface{}) error
 
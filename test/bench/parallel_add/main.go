@@ -0,0 +1,128 @@
+// parallel_add compares the throughput of adding many files with a
+// growing number of adder workers, checking that the CIDs don't change.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreunix"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/thirdparty/unit"
+
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	config "github.com/ipfs/go-ipfs-config"
+	files "github.com/ipfs/go-ipfs-files"
+	random "github.com/jbenet/go-random"
+)
+
+var (
+	numFiles   = flag.Int("files", 256, "number of files to add")
+	fileSize   = flag.Int64("size", int64(4*unit.MB), "size of the files, in bytes")
+	maxWorkers = flag.Int("workers", runtime.NumCPU(), "largest number of workers to benchmark")
+)
+
+func main() {
+	flag.Parse()
+	if err := compareResults(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func compareResults() error {
+	dir, err := ioutil.TempDir("", "parallel_add")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < *numFiles; i++ {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("file%d", i)))
+		if err != nil {
+			return err
+		}
+		err = random.WritePseudoRandomBytes(*fileSize, f, int64(i))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var expected string
+	for workers := 1; workers <= *maxWorkers; workers *= 2 {
+		results, root, err := benchmarkAdd(dir, workers)
+		if err != nil {
+			return err
+		}
+		if expected == "" {
+			expected = root
+		} else if root != expected {
+			return fmt.Errorf("%d workers added %s, expected %s", workers, root, expected)
+		}
+		log.Println(workers, "workers\t", results)
+	}
+	return nil
+}
+
+func benchmarkAdd(dir string, workers int) (*testing.BenchmarkResult, string, error) {
+	var root string
+	var err error
+	results := testing.Benchmark(func(b *testing.B) {
+		b.SetBytes(*fileSize * int64(*numFiles))
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			// a fresh repo each time, not to only find the blocks there
+			r := &repo.Mock{
+				C: config.Config{
+					Identity: config.Identity{
+						PeerID: "QmTFauExutTsy4XP6JbMFcw2Wa9645HJt2bTqL6qYDCKfe", // required by offline node
+					},
+				},
+				D: syncds.MutexWrap(datastore.NewMapDatastore()),
+			}
+			var node *core.IpfsNode
+			node, err = core.NewNode(context.Background(), &core.BuildCfg{Repo: r})
+			if err != nil {
+				b.Fatal(err)
+			}
+			var st os.FileInfo
+			st, err = os.Stat(dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var f files.Node
+			f, err = files.NewSerialFile(dir, false, st)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var adder *coreunix.Adder
+			adder, err = coreunix.NewAdder(context.Background(), node.Pinning, node.Blockstore, node.DAG)
+			if err != nil {
+				b.Fatal(err)
+			}
+			adder.Workers = workers
+
+			b.StartTimer()
+			nd, aerr := adder.AddAllAndPin(f)
+			b.StopTimer()
+			if aerr != nil {
+				err = aerr
+				b.Fatal(err)
+			}
+			root = nd.Cid().String()
+			node.Close()
+		}
+	})
+	return &results, root, err
+}